@@ -22,6 +22,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/cubefs/cubefs-csi/pkg/cubefs"
 	"github.com/golang/glog"
@@ -53,7 +54,6 @@ func main() {
 		Use:   "cfs-csi-driver --endpoint=<endpoint> --nodeid=<nodeid> --drivername=<drivername> --version=<version>",
 		Short: "CSI based CFS driver",
 		Run: func(cmd *cobra.Command, args []string) {
-			registerInterceptedSignal()
 			handle()
 		},
 	}
@@ -67,6 +67,226 @@ func main() {
 	cmd.PersistentFlags().BoolVar(&conf.RemountDamaged, "remountdamaged", false,
 		"Try to remount all the volumes damaged during csi-node restart or upgrade, set mountPropagation of pod to HostToContainer to use this feature")
 	cmd.PersistentFlags().StringVar(&conf.KubeletRootDir, "kubeletrootdir", "/var/lib/kubelet", "The path of your kubelet root dir, set it if you customized it")
+	cmd.PersistentFlags().IntVar(&conf.MasterRetryCount, "master-retry-count", 3,
+		"How many times a master request failing with a transient error (network error or http 5xx) is retried")
+	cmd.PersistentFlags().DurationVar(&conf.MasterRetryInterval, "master-retry-interval", time.Second,
+		"Base interval between master request retries, doubled with jitter on every retry")
+	cmd.PersistentFlags().DurationVar(&conf.MasterRetryMaxInterval, "master-retry-max-interval", 30*time.Second,
+		"Cap of the interval between master request retries, 0 means uncapped")
+	cmd.PersistentFlags().DurationVar(&conf.MasterRetryDeadline, "master-retry-deadline", 0,
+		"How long the retries of a master request may take in total, after which the last error is returned, 0 means unbounded")
+	cmd.PersistentFlags().IntSliceVar(&conf.MasterRetryableCodes, "master-retryable-codes", []int{cubefs.ErrCodePersistenceByRaft},
+		"Codes of the master responses which are retried as transient, e.g. the raft failures while the masters elect a leader")
+	cmd.PersistentFlags().IntVar(&conf.MasterMaxIdleConns, "master-max-idle-conns", 100,
+		"Maximum number of idle connections kept to all the masters, 0 means unlimited")
+	cmd.PersistentFlags().IntVar(&conf.MasterMaxIdleConnsPerHost, "master-max-idle-conns-per-host", 10,
+		"Maximum number of idle connections kept to every master")
+	cmd.PersistentFlags().DurationVar(&conf.MasterIdleConnTimeout, "master-idle-conn-timeout", 90*time.Second,
+		"How long an idle connection to a master is kept, 0 means forever")
+	cmd.PersistentFlags().BoolVar(&conf.MasterTLS, "master-tls", false, "Talk to the masters over https")
+	cmd.PersistentFlags().StringVar(&conf.MasterTLSCAFile, "master-tls-ca-file", "",
+		"PEM file of the CA certificates verifying the masters, the system roots are used if empty")
+	cmd.PersistentFlags().StringSliceVar(&conf.MasterTLSIdentities, "master-tls-identities", nil,
+		"Names (SAN or CN) one of which the master certificates must carry, rejecting other certificates even if they are trusted by the CA")
+	cmd.PersistentFlags().StringVar(&conf.MasterPathPrefix, "master-path-prefix", "",
+		"Path prefix (e.g. /cubefs/master) of a gateway fronting the masters, prepended to the master api paths")
+	cmd.PersistentFlags().IntVar(&conf.MasterQuorum, "master-quorum", 0,
+		"Minimum number of reachable masters required to create, delete or expand a volume, 0 disables the check")
+	cmd.PersistentFlags().StringVar(&conf.MasterAddrFile, "master-addr-file", "",
+		"File containing the master addr list (host:port separated by comma or newline) used when a volume does not set masterAddr")
+	cmd.PersistentFlags().DurationVar(&conf.MasterAddrReloadInterval, "master-addr-reload-interval", 30*time.Second,
+		"How often the master addr file is re-read")
+	cmd.PersistentFlags().IntVar(&conf.MaxNameLength, "max-name-length", 256,
+		"Maximum length of the volume name or ID in controller requests, 0 means unlimited")
+	cmd.PersistentFlags().IntVar(&conf.MaxParameters, "max-parameters", 64,
+		"Maximum number of parameters of a CreateVolume request, 0 means unlimited")
+	cmd.PersistentFlags().IntVar(&conf.MaxParametersSize, "max-parameters-size", 16*1024,
+		"Maximum total size in bytes of the parameter keys and values of a CreateVolume request, 0 means unlimited")
+	cmd.PersistentFlags().StringToStringVar(&conf.MasterHeaders, "master-headers", nil,
+		"Static http headers attached to every master request, e.g. X-Route=csi,X-Env=prod. "+
+			"Sensitive headers should be passed by the \"masterHeader.<name>\" keys of the CSI secrets instead")
+	cmd.PersistentFlags().StringVar(&conf.NodePools, "node-pools", "",
+		"Node pools selectable by the nodeSelector parameter, in the form of <zone>:<label key>=<label value>, separated by comma. "+
+			"Volumes selecting a pool are created in its zone and only accessible from the nodes with the label")
+	cmd.PersistentFlags().BoolVar(&conf.MasterListPagination, "master-list-pagination", false,
+		"Pass the ListVolumes pagination to the master as offset and limit, instead of paging through the whole volume list")
+	cmd.PersistentFlags().Float64Var(&conf.InodeAbnormalRatio, "inode-abnormal-ratio", 0.9,
+		"Volumes whose inode usage reaches this ratio of their inode limit are listed with an abnormal condition")
+	cmd.PersistentFlags().Float64Var(&conf.InodeHeadroomRatio, "inode-headroom-ratio", 0,
+		"Reject CreateVolume with RESOURCE_EXHAUSTED once the meta nodes, which hold the inodes, are used up to this ratio, 0 disables the check")
+	cmd.PersistentFlags().BoolVar(&conf.ExpandCapacityCheck, "expand-capacity-check", false,
+		"Reject expanding a volume with RESOURCE_EXHAUSTED when the growth exceeds the free data capacity of its zones or the cluster")
+	cmd.PersistentFlags().DurationVar(&conf.CapacityReconcileInterval, "capacity-reconcile-interval", 0,
+		"How often the controller compares the capacity of the volumes with the master and reports drifts, 0 disables it")
+	cmd.PersistentFlags().BoolVar(&conf.CapacityReconcileExpand, "capacity-reconcile-expand", false,
+		"Expand the volumes shrunk on the master back to the capacity of their PersistentVolume during capacity reconciliation")
+	cmd.PersistentFlags().StringVar(&conf.ParameterPolicyFile, "parameter-policy-file", "",
+		"JSON file mapping a PVC namespace (or * for the others) to the values each StorageClass parameter may take")
+	cmd.PersistentFlags().DurationVar(&conf.PortReservationTTL, "port-reservation-ttl", time.Minute,
+		"How long a port handed to a client is kept from being handed out again, so that concurrent mounts do not get the same port")
+	cmd.PersistentFlags().StringVar(&conf.ExporterPortRange, "exporter-port-range", "",
+		"Range (e.g. 9500-9600) the exporter ports of the clients are allocated in, any free port if empty")
+	cmd.PersistentFlags().StringVar(&conf.ProfPortRange, "prof-port-range", "",
+		"Range (e.g. 10000-10100) the prof ports of the clients are allocated in, any free port if empty")
+	cmd.PersistentFlags().BoolVar(&conf.EnableAttach, "enable-attach", false,
+		"Advertise and serve ControllerPublishVolume/ControllerUnpublishVolume, for the CSIDriver with attachRequired")
+	cmd.PersistentFlags().StringVar(&conf.MetricsAddress, "metrics-address", "",
+		"Address (e.g. :9180) serving the prometheus metrics at /metrics, empty disables it")
+	cmd.PersistentFlags().DurationVar(&conf.ClientStatsInterval, "client-stats-interval", 0,
+		"How often the node plugin samples the memory and CPU of the fuse clients into the metrics, 0 disables it")
+	cmd.PersistentFlags().StringVar(&conf.CapacityMasterAddr, "capacity-master-addr", "",
+		"Masters whose total and per-zone capacity is served as JSON at /capacity of the metrics address, "+
+			"the masters of --master-addr-file if empty")
+	cmd.PersistentFlags().DurationVar(&conf.CapacityCacheTTL, "capacity-cache-ttl", time.Minute,
+		"How long the capacity served at /capacity is cached before querying the master again")
+	cmd.PersistentFlags().StringVar(&conf.VolumeStatsTotal, "volume-stats-total", "auto",
+		"What the total capacity of the volume stats reflects: provisioned is the capacity of the volume, cluster the used "+
+			"bytes plus the free capacity of the cluster, auto the latter for the volumes created with unlimited=true only")
+	cmd.PersistentFlags().DurationVar(&conf.ClientSuperviseInterval, "client-supervise-interval", 0,
+		"How often the node plugin checks the fuse clients, restarting the ones which died (e.g. OOM killed) with the persisted "+
+			"config, and backing off from this interval. 0 disables it")
+	cmd.PersistentFlags().IntVar(&conf.ClientRestartLimit, "client-restart-limit", 5,
+		"Consecutive restarts of a fuse client before giving up and reporting the volume abnormal in NodeGetVolumeStats")
+	cmd.PersistentFlags().IntVar(&conf.MaxVolumesPerNode, "max-volumes-per-node", 0,
+		"Volumes a node mounts at most, reported to the scheduler and enforced when staging, 0 means unlimited")
+	cmd.PersistentFlags().StringVar(&conf.ShutdownFlushPath, "shutdown-flush-path", "",
+		"Path of the prof port of the fuse clients the node plugin requests to flush their caches when it is terminated, "+
+			"empty disables the flush")
+	cmd.PersistentFlags().DurationVar(&conf.ShutdownFlushTimeout, "shutdown-flush-timeout", 10*time.Second,
+		"How long the node plugin waits for the fuse clients to flush when it is terminated")
+	cmd.PersistentFlags().Int64Var(&conf.UnlimitedCapacityGB, "unlimited-capacity-gb", 0,
+		"Capacity in GB of the volumes created with the unlimited=true parameter, which bypass the requested capacity, "+
+			"e.g. a value beyond the cluster capacity. 0 disallows unlimited volumes")
+	cmd.PersistentFlags().BoolVar(&conf.NoRoundUp, "no-round-up", false,
+		"Reject the requested capacities which are not a whole GiB instead of rounding them, so that volumes get the exact capacity")
+	cmd.PersistentFlags().StringVar(&conf.MountDirMode, "mount-dir-mode", "0750",
+		"Octal permission of the target and staging directories created by the node plugin, regardless of its umask")
+	cmd.PersistentFlags().StringVar(&conf.MinVolumeSizeMode, "min-volume-size-mode", "round-up",
+		"How the requests below the minimum volume size of 1GiB are handled: round-up creates a 1GiB volume, "+
+			"strict rejects them with OUT_OF_RANGE to catch unit mistakes")
+	cmd.PersistentFlags().StringVar(&conf.NoCapacityMode, "no-capacity-mode", "default",
+		"How the requests without a capacity are handled: default creates a volume of --default-capacity-gb, "+
+			"reject rejects them with INVALID_ARGUMENT so that volumes are never created with a size nobody asked for")
+	cmd.PersistentFlags().Int64Var(&conf.DefaultCapacityGB, "default-capacity-gb", 1,
+		"Capacity in GB of the volumes created without a capacity with --no-capacity-mode=default")
+	cmd.PersistentFlags().BoolVar(&conf.VolumeNameFromPVC, "volume-name-from-pvc", false,
+		"Name the volumes <namespace>-<pvc name>-<hash> instead of pvc-<uuid>, so that they are identifiable in the master, "+
+			"needs the csi-provisioner started with --extra-create-metadata")
+	cmd.PersistentFlags().BoolVar(&conf.AsyncDelete, "async-delete", false,
+		"Wait for the master to remove a deleted volume until the request deadline, failing with DEADLINE_EXCEEDED so that the deletion is retried")
+	cmd.PersistentFlags().DurationVar(&conf.AsyncDeletePollInterval, "async-delete-poll-interval", 5*time.Second,
+		"How often the master is polled for the removal of a deleted volume")
+	cmd.PersistentFlags().StringVar(&conf.ClusterID, "cluster-id", "",
+		"ID of the kubernetes cluster stamped onto the created volumes, ListVolumes then only lists the volumes of this cluster, "+
+			"needs --volume-store-dir")
+	cmd.PersistentFlags().BoolVar(&conf.BlockDeleteInUse, "block-delete-in-use", false,
+		"Refuse to delete a volume still mounted by clients, as reported by the master, with FAILED_PRECONDITION")
+	cmd.PersistentFlags().DurationVar(&conf.DeleteNotFoundGrace, "delete-not-found-grace", 0,
+		"How long after its creation a volume the master reports missing is deleted again instead of taken as deleted, "+
+			"for masters lagging behind the creation, 0 disables it")
+	cmd.PersistentFlags().BoolVar(&conf.LoadFuseModule, "load-fuse-module", false,
+		"Try to load the fuse kernel module when /dev/fuse is missing, the node plugin must be privileged")
+	cmd.PersistentFlags().IntVar(&conf.MountRetryCount, "mount-retry-count", 0,
+		"How many times a failed client mount is retried, independent of --master-retry-count")
+	cmd.PersistentFlags().DurationVar(&conf.MountRetryInterval, "mount-retry-interval", time.Second,
+		"Interval between client mount retries")
+	cmd.PersistentFlags().DurationVar(&conf.MountTimeout, "mount-timeout", 0,
+		"How long a client mount attempt may take before it is killed and its mount point lazily unmounted, 0 means no timeout")
+	cmd.PersistentFlags().StringSliceVar(&conf.DisabledFeatures, "disable-features", nil,
+		"Controller features not to advertise, e.g. when the master does not support them: expand, list")
+	cmd.PersistentFlags().BoolVar(&conf.ReadOnlyController, "read-only-controller", false,
+		"Neither advertise nor serve creating, deleting and expanding volumes, for a controller serving the read RPCs only "+
+			"while the volumes are provisioned externally")
+	cmd.PersistentFlags().StringSliceVar(&conf.FsTypes, "fs-types", []string{"cubefs", "chubaofs"},
+		"Fstypes accepted in the volume capabilities, the first one is the primary which an empty fstype stands for")
+	cmd.PersistentFlags().StringVar(&conf.DefaultCrossZone, "default-cross-zone", "",
+		"crossZone (true or false) of the volumes whose StorageClass does not set it, empty leaves it to the master default")
+	cmd.PersistentFlags().StringVar(&conf.DefaultZone, "default-zone", "",
+		"zoneName of the volumes whose StorageClass does not set it, empty leaves it to the master default")
+	cmd.PersistentFlags().StringVar(&conf.DefaultConsulAddr, "default-consul-addr", cubefs.DefaultConsulAddr,
+		"consulAddr the clients register with when the StorageClass does not set it, empty omits it for the deployments without consul")
+	cmd.PersistentFlags().StringVar(&conf.ClientConfDelivery, "client-conf-delivery", "file",
+		"How the client configuration is handed to the client: file writes a per-volume config file, "+
+			"stdin pipes it to the client without touching the node filesystem")
+	cmd.PersistentFlags().StringVar(&conf.VolumeStoreDir, "volume-store-dir", "",
+		"Directory (usually a persistent or shared volume) recording the metadata of the created volumes, such as the generated owner")
+	cmd.PersistentFlags().BoolVar(&conf.EmitEvents, "emit-events", false,
+		"Record Kubernetes events with the master error on the PVC or the PersistentVolume when creating, deleting or expanding a volume fails")
+	cmd.PersistentFlags().StringVar(&conf.AuditLogFile, "audit-log-file", "",
+		"File appending a json line for every volume create, delete and expand, with the capacities, owner and result")
+	cmd.PersistentFlags().StringVar(&conf.WebhookURL, "webhook-url", "",
+		"URL every volume create, delete and expand is POSTed to as json, like the lines of the audit log, in the background")
+	cmd.PersistentFlags().IntVar(&conf.WebhookRetries, "webhook-retries", 3,
+		"How many times a failed POST to the webhook is retried before the event is dropped")
+	cmd.PersistentFlags().DurationVar(&conf.WebhookRetryInterval, "webhook-retry-interval", time.Second,
+		"Initial interval between the retries of a failed POST to the webhook, doubled on every retry")
+	cmd.PersistentFlags().StringVar(&conf.PolicyWebhookURL, "policy-webhook-url", "",
+		"URL every volume is POSTed to as json, with its name, capacity and parameters, before it is created, "+
+			"e.g. an OPA server. The volume is only created if it responds {\"allowed\": true}")
+	cmd.PersistentFlags().DurationVar(&conf.PolicyWebhookTimeout, "policy-webhook-timeout", 10*time.Second,
+		"Timeout of the requests to the policy webhook")
+	cmd.PersistentFlags().BoolVar(&conf.PolicyWebhookFailOpen, "policy-webhook-fail-open", false,
+		"Create the volumes when the policy webhook fails, instead of refusing them with UNAVAILABLE")
+	cmd.PersistentFlags().StringVar(&conf.TracingEndpoint, "tracing-endpoint", "",
+		"OTLP/HTTP traces URL of an OpenTelemetry collector, e.g. http://collector:4318/v1/traces, the spans of "+
+			"the volume create, delete, expand and of their master requests are exported to, empty disables tracing")
+
+	var diagnoseOpts cubefs.DiagnoseOptions
+	diagnoseCmd := &cobra.Command{
+		Use:   "diagnose --master-addr=<masterAddr>",
+		Short: "Check the master connectivity and the client binary, then create, mount and delete a throwaway volume",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := cubefs.Diagnose(conf, diagnoseOpts, os.Stdout); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+	}
+	diagnoseCmd.Flags().StringVar(&diagnoseOpts.MasterAddr, "master-addr", "", "Master addr list to diagnose, separated by comma")
+	diagnoseCmd.Flags().StringVar(&diagnoseOpts.ClientBin, "client-bin", cubefs.CfsClientBin, "Path of the CubeFS client binary")
+	diagnoseCmd.Flags().BoolVar(&diagnoseOpts.SkipMount, "skip-mount", false, "Do not mount the throwaway volume")
+	_ = diagnoseCmd.MarkFlagRequired("master-addr")
+	cmd.AddCommand(diagnoseCmd)
+
+	var qosOpts cubefs.QosOptions
+	qosCmd := &cobra.Command{
+		Use:   "set-qos --master-addr=<masterAddr> --volume=<volume> --owner=<owner>",
+		Short: "Adjust the IOPS and bandwidth limits of an existing volume",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := cubefs.UpdateVolumeQos(conf, qosOpts); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+	}
+	qosCmd.Flags().StringVar(&qosOpts.MasterAddr, "master-addr", "", "Master addr list of the volume, separated by comma")
+	qosCmd.Flags().StringVar(&qosOpts.VolumeName, "volume", "", "Name of the volume on the master")
+	qosCmd.Flags().StringVar(&qosOpts.Owner, "owner", "", "Owner of the volume, whose md5 is the authKey")
+	qosCmd.Flags().StringVar(&qosOpts.AuthKey, "auth-key", "", "AuthKey of the volume, if it is not the md5 of the owner")
+	qosCmd.Flags().StringVar(&qosOpts.MaxIOPS, "max-iops", "", "IOPS limit of reads and writes each")
+	qosCmd.Flags().StringVar(&qosOpts.MaxBandwidth, "max-bandwidth", "", "Bandwidth limit of reads and writes each, in MB/s")
+	_ = qosCmd.MarkFlagRequired("master-addr")
+	_ = qosCmd.MarkFlagRequired("volume")
+	cmd.AddCommand(qosCmd)
+
+	var clientsOpts cubefs.VolumeClientsOptions
+	clientsCmd := &cobra.Command{
+		Use:   "list-clients --master-addr=<masterAddr> --volume=<volume> --owner=<owner>",
+		Short: "List the nodes mounting a volume with their client versions",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := cubefs.ListVolumeClients(conf, clientsOpts, os.Stdout); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+	}
+	clientsCmd.Flags().StringVar(&clientsOpts.MasterAddr, "master-addr", "", "Master addr list of the volume, separated by comma")
+	clientsCmd.Flags().StringVar(&clientsOpts.VolumeName, "volume", "", "Name of the volume on the master")
+	clientsCmd.Flags().StringVar(&clientsOpts.Owner, "owner", "", "Owner of the volume, whose md5 is the authKey")
+	clientsCmd.Flags().StringVar(&clientsOpts.AuthKey, "auth-key", "", "AuthKey of the volume, if it is not the md5 of the owner")
+	_ = clientsCmd.MarkFlagRequired("master-addr")
+	_ = clientsCmd.MarkFlagRequired("volume")
+	cmd.AddCommand(clientsCmd)
 
 	if err := cmd.Execute(); err != nil {
 		glog.Errorf("cmd.Execute error:%v\n", err)
@@ -83,15 +303,18 @@ func handle() {
 		os.Exit(1)
 	}
 
+	registerInterceptedSignal(d.Shutdown)
 	d.Run(endpoint)
 }
 
-func registerInterceptedSignal() {
+func registerInterceptedSignal(shutdown func()) {
 	sigC := make(chan os.Signal, 1)
 	signal.Notify(sigC, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		sig := <-sigC
 		glog.Errorf("Killed due to a received signal (%v)\n", sig)
+		shutdown()
+		glog.Flush()
 		os.Exit(1)
 	}()
 }
@@ -19,6 +19,7 @@ package csicommon
 import (
 	"fmt"
 	"path"
+	"runtime/debug"
 	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -26,6 +27,8 @@ import (
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func ParseEndpoint(ep string) (string, string, error) {
@@ -106,6 +109,38 @@ func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, h
 	return resp, err
 }
 
+// recoverGRPC keeps a panicking handler from bringing the whole driver down by
+// converting the panic into a codes.Internal error. Errors which are not gRPC
+// statuses are normalized as well, instead of reaching the CO as codes.Unknown.
+func recoverGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			glog.Errorf("GRPC panic: %s body: %s panic: %v\n%s",
+				info.FullMethod, protosanitizer.StripSecrets(req), r, debug.Stack())
+			resp, err = nil, status.Errorf(codes.Internal, "%s panicked: %v", path.Base(info.FullMethod), r)
+		}
+	}()
+
+	resp, err = handler(ctx, req)
+	return resp, normalizeError(err)
+}
+
+func normalizeError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	if s := status.FromContextError(err); s.Code() != codes.Unknown {
+		return s.Err()
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
+
 // ShortenString returns the first N slice of a string.
 func ShortenString(str string, n int) string {
 	if len(str) <= n {
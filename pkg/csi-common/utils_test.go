@@ -17,9 +17,14 @@ limitations under the License.
 package csicommon
 
 import (
+	"context"
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestParseEndpoint(t *testing.T) {
@@ -74,3 +79,39 @@ func TestParseEndpoint(t *testing.T) {
 	_, _, err = ParseEndpoint("")
 	assert.NotNil(t, err)
 }
+
+func TestRecoverGRPC(t *testing.T) {
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+
+	// panic is converted into codes.Internal
+	resp, err := recoverGRPC(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		var param map[string]string
+		param["volName"] = "pvc-panic"
+		return "unreachable", nil
+	})
+	assert.Nil(t, resp)
+	assert.Equal(t, codes.Internal, status.Code(err))
+
+	// plain errors are normalized
+	_, err = recoverGRPC(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, errors.New("plain error")
+	})
+	assert.Equal(t, codes.Internal, status.Code(err))
+
+	_, err = recoverGRPC(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, context.DeadlineExceeded
+	})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	// status errors and successful responses are passed through
+	_, err = recoverGRPC(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "not found")
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	resp, err = recoverGRPC(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "ok", nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", resp)
+}
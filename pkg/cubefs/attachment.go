@@ -0,0 +1,112 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// attachmentTracker records the nodes every volume is published to. CubeFS
+// volumes are mounted over the network, so publishing is bookkeeping only.
+// The records are lost when the controller restarts or fails over to another
+// replica, see attachedNodes for the attachments which outlive them.
+type attachmentTracker struct {
+	mutex sync.Mutex
+	nodes map[string]map[string]bool // volume id -> node ids
+}
+
+func newAttachmentTracker() *attachmentTracker {
+	return &attachmentTracker{nodes: make(map[string]map[string]bool)}
+}
+
+func (a *attachmentTracker) attach(volumeID, nodeID string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.nodes[volumeID] == nil {
+		a.nodes[volumeID] = make(map[string]bool)
+	}
+	a.nodes[volumeID][nodeID] = true
+}
+
+func (a *attachmentTracker) detach(volumeID, nodeID string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	delete(a.nodes[volumeID], nodeID)
+	if len(a.nodes[volumeID]) == 0 {
+		delete(a.nodes, volumeID)
+	}
+}
+
+// nodesOf returns the sorted ids of the nodes the volume is published to.
+func (a *attachmentTracker) nodesOf(volumeID string) []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var nodes []string
+	for node := range a.nodes[volumeID] {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// attachedNodes returns the sorted ids of the nodes the volume is attached to
+// according to the VolumeAttachment objects of the driver, which outlive the
+// controller, unlike attachmentTracker.
+func attachedNodes(ctx context.Context, clientSet *kubernetes.Clientset, driverName, volumeID string) ([]string, error) {
+	vaList, err := clientSet.StorageV1().VolumeAttachments().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	pvList, err := clientSet.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return attachedNodesOf(vaList.Items, pvList.Items, driverName, volumeID), nil
+}
+
+// attachedNodesOf returns the sorted nodes of the attached vas of driverName
+// whose PersistentVolume of pvs has the handle volumeID.
+func attachedNodesOf(vas []storagev1.VolumeAttachment, pvs []v1.PersistentVolume, driverName, volumeID string) []string {
+	pvNames := make(map[string]bool)
+	for i := range pvs {
+		if source := pvs[i].Spec.CSI; source != nil && source.Driver == driverName && source.VolumeHandle == volumeID {
+			pvNames[pvs[i].Name] = true
+		}
+	}
+
+	var nodes []string
+	for _, va := range vas {
+		if va.Spec.Attacher == driverName && va.Status.Attached &&
+			va.Spec.Source.PersistentVolumeName != nil && pvNames[*va.Spec.Source.PersistentVolumeName] {
+			nodes = append(nodes, va.Spec.NodeName)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
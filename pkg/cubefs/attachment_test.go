@@ -0,0 +1,55 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+)
+
+func newTestAttachment(driverName, pvName, nodeName string, attached bool) storagev1.VolumeAttachment {
+	va := storagev1.VolumeAttachment{}
+	va.Spec.Attacher = driverName
+	va.Spec.Source.PersistentVolumeName = &pvName
+	va.Spec.NodeName = nodeName
+	va.Status.Attached = attached
+	return va
+}
+
+func TestAttachedNodesOf(t *testing.T) {
+	pvs := make([]v1.PersistentVolume, 2)
+	pvs[0].Name = "pv-a"
+	pvs[0].Spec.CSI = &v1.CSIPersistentVolumeSource{Driver: DriverName, VolumeHandle: "vol-a"}
+	pvs[1].Name = "pv-b"
+	pvs[1].Spec.CSI = &v1.CSIPersistentVolumeSource{Driver: DriverName, VolumeHandle: "vol-b"}
+
+	vas := []storagev1.VolumeAttachment{
+		newTestAttachment(DriverName, "pv-a", "node-2", true),
+		newTestAttachment(DriverName, "pv-a", "node-1", true),
+		// not attached yet
+		newTestAttachment(DriverName, "pv-a", "node-3", false),
+		newTestAttachment(DriverName, "pv-b", "node-4", true),
+		newTestAttachment("other.csi.driver", "pv-a", "node-5", true),
+	}
+
+	assert.Equal(t, []string{"node-1", "node-2"}, attachedNodesOf(vas, pvs, DriverName, "vol-a"))
+	assert.Equal(t, []string{"node-4"}, attachedNodesOf(vas, pvs, DriverName, "vol-b"))
+	assert.Nil(t, attachedNodesOf(vas, pvs, DriverName, "vol-c"))
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// operations recorded in the audit log
+const (
+	auditCreate = "create"
+	auditDelete = "delete"
+	auditExpand = "expand"
+)
+
+// auditEntry is a line of the audit log. The capacities are in bytes, and 0
+// when they are unknown.
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Volume    string    `json:"volume"`
+	Owner     string    `json:"owner,omitempty"`
+	// capacity before the operation, and the one requested and taking effect
+	PreviousBytes  int64  `json:"previousBytes,omitempty"`
+	RequestedBytes int64  `json:"requestedBytes,omitempty"`
+	CapacityBytes  int64  `json:"capacityBytes,omitempty"`
+	Result         string `json:"result"`
+	Error          string `json:"error,omitempty"`
+}
+
+// auditLog appends the volume lifecycle operations to a file as json lines.
+// It is separate from the glog output, which may be rotated, sampled or
+// dropped, and every entry is synced to disk before the operation returns.
+type auditLog struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func newAuditLog(path string) (*auditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditLog{file: file}, nil
+}
+
+// withResult returns the entry with the result of err, the time is set if
+// missing.
+func (entry auditEntry) withResult(err error) auditEntry {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now().UTC()
+	}
+	entry.Result = "success"
+	if err != nil {
+		entry.Result, entry.Error = "failure", err.Error()
+	}
+	return entry
+}
+
+// record writes the entry with the result of err, the time is set if missing.
+func (l *auditLog) record(entry auditEntry, err error) error {
+	line, err := json.Marshal(entry.withResult(err))
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	return l.file.Sync()
+}
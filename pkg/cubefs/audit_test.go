@@ -0,0 +1,79 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readAuditLog returns the entries of the audit log at path.
+func readAuditLog(t *testing.T, path string) []auditEntry {
+	content, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+
+	var entries []auditEntry
+	for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry auditEntry
+		assert.NoError(t, json.Unmarshal([]byte(line), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditLogRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := newAuditLog(path)
+	assert.NoError(t, err)
+
+	assert.NoError(t, log.record(auditEntry{Operation: auditCreate, Volume: "pvc-1", Owner: "csiuser",
+		RequestedBytes: 10 << 30, CapacityBytes: 10 << 30}, nil))
+	assert.NoError(t, log.record(auditEntry{Operation: auditExpand, Volume: "pvc-1", Owner: "csiuser",
+		PreviousBytes: 10 << 30, RequestedBytes: 15<<30 + 1, CapacityBytes: 16 << 30}, nil))
+	assert.NoError(t, log.record(auditEntry{Operation: auditDelete, Volume: "pvc-1", Owner: "csiuser",
+		PreviousBytes: 16 << 30}, errors.New("master unreachable")))
+
+	// reopening appends to the existing entries
+	log, err = newAuditLog(path)
+	assert.NoError(t, err)
+	assert.NoError(t, log.record(auditEntry{Operation: auditDelete, Volume: "pvc-1", Owner: "csiuser"}, nil))
+
+	entries := readAuditLog(t, path)
+	assert.Len(t, entries, 4)
+	for _, entry := range entries {
+		assert.False(t, entry.Time.IsZero())
+		assert.Equal(t, "pvc-1", entry.Volume)
+		assert.Equal(t, "csiuser", entry.Owner)
+	}
+	assert.Equal(t, []string{auditCreate, auditExpand, auditDelete, auditDelete},
+		[]string{entries[0].Operation, entries[1].Operation, entries[2].Operation, entries[3].Operation})
+	assert.Equal(t, int64(10<<30), entries[1].PreviousBytes)
+	assert.Equal(t, int64(16<<30), entries[1].CapacityBytes)
+	assert.Equal(t, "failure", entries[2].Result)
+	assert.Equal(t, "master unreachable", entries[2].Error)
+	assert.Equal(t, "success", entries[3].Result)
+	assert.Empty(t, entries[3].Error)
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// capacityDrift is a volume whose capacity recorded by its PersistentVolume
+// differs from the capacity reported by the master, e.g. after the volume was
+// expanded or shrunk on the master directly.
+type capacityDrift struct {
+	pvCapacityGB     int64
+	masterCapacityGB int64
+}
+
+func (d *capacityDrift) String() string {
+	return fmt.Sprintf("PersistentVolume capacity %vGB, master capacity %vGB", d.pvCapacityGB, d.masterCapacityGB)
+}
+
+// detectCapacityDrift compares the capacity of pv with the capacity of the
+// volume reported by the master, returning nil if they match. The capacities
+// are compared in GB, as the volumes are created with the capacity in GB.
+// Unlimited volumes never drift, their capacity on the master is made up.
+func detectCapacityDrift(pv *v1.PersistentVolume, cs *cfsServer) (*capacityDrift, error) {
+	quantity, ok := pv.Spec.Capacity[v1.ResourceStorage]
+	if !ok {
+		return nil, nil
+	}
+
+	if pv.Spec.CSI != nil && pv.Spec.CSI.VolumeAttributes[KUnlimited] == "true" {
+		return nil, nil
+	}
+
+	view, err := cs.getVolume()
+	if err != nil {
+		return nil, err
+	}
+
+	pvCapacityGB := quantity.Value() >> 30
+	if pvCapacityGB == view.Capacity {
+		return nil, nil
+	}
+
+	return &capacityDrift{pvCapacityGB: pvCapacityGB, masterCapacityGB: view.Capacity}, nil
+}
+
+// runCapacityReconciler reconciles the capacity of the volumes every interval,
+// jittered so that the controller replicas do not hit the master together.
+func (d *driver) runCapacityReconciler(interval time.Duration) {
+	for {
+		time.Sleep(interval + time.Duration(rand.Int63n(int64(interval)/10+1)))
+		d.reconcileCapacity(context.Background())
+	}
+}
+
+// reconcileCapacity reports the volumes of the driver whose capacity drifted,
+// and expands the volumes shrunk on the master back to the capacity of their
+// PersistentVolume if CapacityReconcileExpand is set.
+func (d *driver) reconcileCapacity(ctx context.Context) {
+	pvs, err := d.ClientSet.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("capacity reconcile: list PersistentVolumes fail. err:%v", err)
+		return
+	}
+
+	for i := range pvs.Items {
+		pv := &pvs.Items[i]
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != d.DriverName {
+			continue
+		}
+
+		// newCfsServer fills the defaults into the parameters, keep the PersistentVolume intact
+		param := make(map[string]string, len(pv.Spec.CSI.VolumeAttributes))
+		for k, v := range pv.Spec.CSI.VolumeAttributes {
+			param[k] = v
+		}
+
+		// the volume is named after its handle unless the volume context names it
+		cs, err := newCfsServer(pv.Spec.CSI.VolumeHandle, param, &d.Config)
+		if err != nil {
+			glog.Warningf("capacity reconcile: volume[%v] skipped, err:%v", pv.Spec.CSI.VolumeHandle, err)
+			continue
+		}
+
+		volName := cs.clientConf[KVolumeName]
+		drift, err := detectCapacityDrift(pv, cs)
+		if err != nil {
+			glog.Warningf("capacity reconcile: query volume[%v] fail. err:%v", volName, err)
+			continue
+		}
+
+		if drift == nil {
+			continue
+		}
+
+		glog.Warningf("capacity reconcile: volume[%v] capacity drifted, %v", volName, drift)
+		d.recordCapacityDriftEvent(ctx, pv, drift)
+		if d.CapacityReconcileExpand && drift.masterCapacityGB < drift.pvCapacityGB {
+			if err := cs.expandVolume(drift.pvCapacityGB); err != nil {
+				glog.Errorf("capacity reconcile: expand volume[%v] to %vGB fail. err:%v", volName, drift.pvCapacityGB, err)
+			} else {
+				glog.Infof("capacity reconcile: volume[%v] expanded to %vGB", volName, drift.pvCapacityGB)
+			}
+		}
+	}
+}
+
+func (d *driver) recordCapacityDriftEvent(ctx context.Context, pv *v1.PersistentVolume, drift *capacityDrift) {
+	event := newEvent(pvReference(pv), "", v1.EventTypeWarning, "CapacityDrift", drift.String(), d.DriverName)
+	if _, err := d.ClientSet.CoreV1().Events(event.Namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		glog.Warningf("capacity reconcile: record event of volume[%v] fail. err:%v", pv.Name, err)
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func newCapacityTestPV(capacity string) *v1.PersistentVolume {
+	pv := &v1.PersistentVolume{}
+	pv.Name = "pvc-fake"
+	if capacity != "" {
+		pv.Spec.Capacity = v1.ResourceList{v1.ResourceStorage: resource.MustParse(capacity)}
+	}
+	return pv
+}
+
+func TestDetectCapacityDrift(t *testing.T) {
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/admin/getVol", r.URL.Path)
+		fmt.Fprint(w, `{"code":0,"msg":"success","data":{"Name":"pvc-fake","Capacity":20}}`)
+	})
+
+	drift, err := detectCapacityDrift(newCapacityTestPV("10Gi"), cs)
+	assert.NoError(t, err)
+	assert.Equal(t, &capacityDrift{pvCapacityGB: 10, masterCapacityGB: 20}, drift)
+
+	drift, err = detectCapacityDrift(newCapacityTestPV("30Gi"), cs)
+	assert.NoError(t, err)
+	assert.Equal(t, &capacityDrift{pvCapacityGB: 30, masterCapacityGB: 20}, drift)
+
+	for _, capacity := range []string{"20Gi", "21474836481", ""} {
+		drift, err = detectCapacityDrift(newCapacityTestPV(capacity), cs)
+		assert.NoError(t, err)
+		assert.Nil(t, drift, "capacity %q", capacity)
+	}
+}
+
+func TestDetectCapacityDriftUnlimited(t *testing.T) {
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected master request %v", r.URL)
+	})
+
+	pv := newCapacityTestPV("0")
+	pv.Spec.CSI = &v1.CSIPersistentVolumeSource{VolumeAttributes: map[string]string{KUnlimited: "true"}}
+	drift, err := detectCapacityDrift(pv, cs)
+	assert.NoError(t, err)
+	assert.Nil(t, drift)
+}
+
+func TestDetectCapacityDriftVolumeNotExists(t *testing.T) {
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		writeMasterResponse(w, ErrCodeVolNotExists, "vol not exists")
+	})
+
+	_, err := detectCapacityDrift(newCapacityTestPV("10Gi"), cs)
+	assert.Error(t, err)
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// cfsZoneNodesStat is the usage of the data or meta nodes of a zone, in GB.
+type cfsZoneNodesStat struct {
+	TotalGB float64 `json:"TotalGB"`
+	UsedGB  float64 `json:"UsedGB"`
+	AvailGB float64 `json:"AvailGB"`
+}
+
+// cfsClusterStat is the subset of the cluster stat returned by the master.
+type cfsClusterStat struct {
+	DataNodeStatInfo *cfsNodeStatInfo `json:"DataNodeStatInfo"`
+	ZoneStatInfo     map[string]*struct {
+		DataNodeStat *cfsZoneNodesStat `json:"dataNodeStat"`
+	} `json:"ZoneStatInfo"`
+}
+
+// clusterStat queries the master for the usage of the cluster and its zones.
+func (cs *cfsServer) clusterStat() (stat *cfsClusterStat, err error) {
+	err = cs.retryOnTransient("GetClusterStat", func() error {
+		return cs.forEachReadMasterAddr("GetClusterStat", func(addr string) error {
+			resp, err := cs.executeRequest(cs.masterURL(addr, "/cluster/stat"))
+			if err != nil {
+				return err
+			}
+
+			if resp.Code != 0 {
+				return status.Errorf(codes.Internal, "get cluster stat failed, code:%v, msg:%v", resp.Code, resp.Msg)
+			}
+
+			stat = &cfsClusterStat{}
+			if err := json.Unmarshal(resp.Data, stat); err != nil {
+				return status.Errorf(codes.Internal, "unmarshal cluster stat failed: %v", err)
+			}
+
+			return nil
+		})
+	})
+
+	return stat, err
+}
+
+// checkExpandCapacity fails with ResourceExhausted if the free data capacity
+// cannot hold the growth of the volume to capacityGB. The free capacity is the
+// one of the zones of the volume if the master reports them, of the cluster
+// otherwise, and does not account for the replicas of the data.
+func (cs *cfsServer) checkExpandCapacity(view *cfsVolumeView, capacityGB int64) error {
+	stat, err := cs.clusterStat()
+	if err != nil {
+		return err
+	}
+
+	report := newCapacityReport(stat, time.Now())
+	if report.Total == 0 {
+		glog.Warningf("no data node usage reported by the master, skip the expand capacity check")
+		return nil
+	}
+
+	free, scope := report.freeIn(view.ZoneName)
+	if growth := uint64(capacityGB-view.Capacity) << 30; growth > free {
+		return status.Errorf(codes.ResourceExhausted, "expanding volume[%v] from %vGB to %vGB exceeds the %vGB free in %s",
+			cs.clientConf[KVolumeName], view.Capacity, capacityGB, free>>30, scope)
+	}
+
+	return nil
+}
+
+// capacityUsage is the data capacity of the cluster or a zone, in bytes.
+type capacityUsage struct {
+	Total uint64 `json:"total"`
+	Used  uint64 `json:"used"`
+	Free  uint64 `json:"free"`
+}
+
+// capacityReport breaks the data capacity of the cluster down by zone.
+type capacityReport struct {
+	capacityUsage
+	Zones      map[string]capacityUsage `json:"zones"`
+	UpdateTime time.Time                `json:"updateTime"`
+}
+
+// freeIn returns the free capacity of the comma separated zones reported by
+// the master, or of the cluster if none is, along with the scope it is of.
+func (r *capacityReport) freeIn(zoneNames string) (uint64, string) {
+	var zones []string
+	var free uint64
+	for _, zone := range strings.Split(zoneNames, ",") {
+		if usage, ok := r.Zones[strings.TrimSpace(zone)]; ok {
+			zones = append(zones, strings.TrimSpace(zone))
+			free += usage.Free
+		}
+	}
+	if len(zones) == 0 {
+		return r.Free, "the cluster"
+	}
+
+	return free, fmt.Sprintf("zones %s", strings.Join(zones, ","))
+}
+
+func gbToBytes(gb float64) uint64 {
+	if gb <= 0 {
+		return 0
+	}
+	return uint64(gb * (1 << 30))
+}
+
+// newCapacityReport maps the cluster stat of the master into the report. The
+// total of a master not reporting it is summed up from the zones.
+func newCapacityReport(stat *cfsClusterStat, now time.Time) *capacityReport {
+	report := &capacityReport{Zones: make(map[string]capacityUsage), UpdateTime: now}
+
+	names := make([]string, 0, len(stat.ZoneStatInfo))
+	for name := range stat.ZoneStatInfo {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sum capacityUsage
+	for _, name := range names {
+		zone := stat.ZoneStatInfo[name]
+		if zone == nil || zone.DataNodeStat == nil {
+			continue
+		}
+
+		usage := capacityUsage{
+			Total: gbToBytes(zone.DataNodeStat.TotalGB),
+			Used:  gbToBytes(zone.DataNodeStat.UsedGB),
+			Free:  gbToBytes(zone.DataNodeStat.AvailGB),
+		}
+		report.Zones[name] = usage
+		sum.Total += usage.Total
+		sum.Used += usage.Used
+		sum.Free += usage.Free
+	}
+
+	report.capacityUsage = sum
+	if total := stat.DataNodeStatInfo; total != nil && total.TotalGB != 0 {
+		report.Total = total.TotalGB << 30
+		report.Used = total.UsedGB << 30
+		report.Free = 0
+		if total.TotalGB > total.UsedGB {
+			report.Free = (total.TotalGB - total.UsedGB) << 30
+		}
+	}
+
+	return report
+}
+
+// capacityCache serves the capacity report, querying the master at most once
+// per ttl, so that dashboards polling it do not load the master.
+type capacityCache struct {
+	mutex  sync.Mutex
+	ttl    time.Duration
+	fetch  func() (*cfsClusterStat, error)
+	report *capacityReport
+	now    func() time.Time
+}
+
+func newCapacityCache(ttl time.Duration, fetch func() (*cfsClusterStat, error)) *capacityCache {
+	return &capacityCache{ttl: ttl, fetch: fetch, now: time.Now}
+}
+
+func (c *capacityCache) get() (*capacityReport, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := c.now()
+	if c.report != nil && now.Sub(c.report.UpdateTime) < c.ttl {
+		return c.report, nil
+	}
+
+	stat, err := c.fetch()
+	if err != nil {
+		return nil, err
+	}
+
+	c.report = newCapacityReport(stat, now)
+	return c.report, nil
+}
+
+// ServeHTTP serves the capacity report as JSON.
+func (c *capacityCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report, err := c.get()
+	if err != nil {
+		glog.Errorf("get capacity report fail. err:%v", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		glog.Warningf("write capacity report fail. err:%v", err)
+	}
+}
+
+// newDriverCapacityCache returns the cache of the capacity of the cluster at
+// CapacityMasterAddr, or at the default masters if not set.
+func newDriverCapacityCache(conf *Config) *capacityCache {
+	return newCapacityCache(conf.CapacityCacheTTL, func() (*cfsClusterStat, error) {
+		param := map[string]string{KMasterAddr: conf.CapacityMasterAddr}
+		cs, err := newCfsServer("capacity", param, conf)
+		if err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "no master to report the capacity of: %v", err)
+		}
+
+		return cs.clusterStat()
+	})
+}
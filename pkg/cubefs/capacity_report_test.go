@@ -0,0 +1,147 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// a cluster stat of a master with two zones, one without data nodes
+const multiZoneClusterStat = `{
+	"DataNodeStatInfo": {"TotalGB": 300, "UsedGB": 120, "IncreasedGB": 1, "UsedRatio": "0.4"},
+	"MetaNodeStatInfo": {"TotalGB": 30, "UsedGB": 3},
+	"ZoneStatInfo": {
+		"zone-b": {"dataNodeStat": {"TotalGB": 100, "UsedGB": 80, "AvailGB": 20, "UsedRatio": 0.8, "TotalNodes": 2}},
+		"zone-a": {"dataNodeStat": {"TotalGB": 200, "UsedGB": 40, "AvailGB": 160, "UsedRatio": 0.2, "TotalNodes": 4}},
+		"zone-meta": {"metaNodeStat": {"TotalGB": 30, "UsedGB": 3, "AvailGB": 27}}
+	}
+}`
+
+func TestNewCapacityReport(t *testing.T) {
+	stat := &cfsClusterStat{}
+	assert.NoError(t, json.Unmarshal([]byte(multiZoneClusterStat), stat))
+
+	now := time.Unix(1700000000, 0)
+	report := newCapacityReport(stat, now)
+	assert.Equal(t, capacityUsage{Total: 300 << 30, Used: 120 << 30, Free: 180 << 30}, report.capacityUsage)
+	assert.Equal(t, map[string]capacityUsage{
+		"zone-a": {Total: 200 << 30, Used: 40 << 30, Free: 160 << 30},
+		"zone-b": {Total: 100 << 30, Used: 80 << 30, Free: 20 << 30},
+	}, report.Zones)
+	assert.Equal(t, now, report.UpdateTime)
+
+	// the total is summed up from the zones if the master does not report it
+	stat.DataNodeStatInfo = nil
+	report = newCapacityReport(stat, now)
+	assert.Equal(t, capacityUsage{Total: 300 << 30, Used: 120 << 30, Free: 180 << 30}, report.capacityUsage)
+}
+
+func TestCapacityCache(t *testing.T) {
+	fetches := 0
+	var fetchErr error
+	cache := newCapacityCache(time.Minute, func() (*cfsClusterStat, error) {
+		fetches++
+		stat := &cfsClusterStat{}
+		assert.NoError(t, json.Unmarshal([]byte(multiZoneClusterStat), stat))
+		return stat, fetchErr
+	})
+	now := time.Unix(1700000000, 0)
+	cache.now = func() time.Time { return now }
+
+	_, err := cache.get()
+	assert.NoError(t, err)
+	now = now.Add(30 * time.Second)
+	_, err = cache.get()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fetches)
+
+	now = now.Add(time.Minute)
+	fetchErr = errors.New("master down")
+	_, err = cache.get()
+	assert.Error(t, err)
+	assert.Equal(t, 2, fetches)
+
+	w := httptest.NewRecorder()
+	cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/capacity", nil))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+
+	fetchErr = nil
+	w = httptest.NewRecorder()
+	cache.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/capacity", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var report struct {
+		Total uint64                   `json:"total"`
+		Zones map[string]capacityUsage `json:"zones"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, uint64(300<<30), report.Total)
+	assert.Equal(t, uint64(20<<30), report.Zones["zone-b"].Free)
+}
+
+func TestExpandVolumeCapacityCheck(t *testing.T) {
+	zone, expanded := "", 0
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/admin/getVol":
+			fmt.Fprintf(w, `{"code":0,"msg":"success","data":{"Name":"pvc-fake","Capacity":10,"ZoneName":%q}}`, zone)
+		case "/cluster/stat":
+			fmt.Fprintf(w, `{"code":0,"msg":"success","data":%s}`, multiZoneClusterStat)
+		case "/vol/expand":
+			expanded++
+			writeMasterResponse(w, 0, "success")
+		}
+	})
+	cs.conf.ExpandCapacityCheck = true
+
+	// the cluster has 180GB free
+	assert.NoError(t, cs.expandVolume(190))
+	err := cs.expandVolume(200)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Contains(t, err.Error(), "from 10GB to 200GB exceeds the 180GB free in the cluster")
+	assert.Equal(t, 1, expanded)
+
+	// zone-b of the volume has 20GB free
+	zone = "zone-b"
+	assert.NoError(t, cs.expandVolume(30))
+	err = cs.expandVolume(40)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Contains(t, err.Error(), "20GB free in zones zone-b")
+	assert.Equal(t, 2, expanded)
+
+	// as do the zones of a cross zone volume together
+	zone = "zone-a,zone-b,zone-unknown"
+	assert.NoError(t, cs.expandVolume(190))
+	err = cs.expandVolume(200)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Contains(t, err.Error(), "180GB free in zones zone-a,zone-b")
+
+	// the check is optional
+	cs.conf.ExpandCapacityCheck = false
+	assert.NoError(t, cs.expandVolume(200))
+	assert.Equal(t, 4, expanded)
+}
@@ -17,37 +17,73 @@ limitations under the License.
 package cubefs
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
-	csicommon "github.com/cubefs/cubefs-csi/pkg/csi-common"
 	"github.com/golang/glog"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
 const (
-	KVolumeName   = "volName"
-	KMasterAddr   = "masterAddr"
-	KLogLevel     = "logLevel"
-	KLogDir       = "logDir"
-	KOwner        = "owner"
-	KMountPoint   = "mountPoint"
-	KExporterPort = "exporterPort"
-	KProfPort     = "profPort"
-	KCrossZone    = "crossZone"
-	KEnableToken  = "enableToken"
-	KZoneName     = "zoneName"
-	KConsulAddr   = "consulAddr"
-	KVolType      = "volType"
+	KVolumeName         = "volName"
+	KMasterAddr         = "masterAddr"
+	KLogLevel           = "logLevel"
+	KLogDir             = "logDir"
+	KOwner              = "owner"
+	KMountPoint         = "mountPoint"
+	KExporterPort       = "exporterPort"
+	KProfPort           = "profPort"
+	KCrossZone          = "crossZone"
+	KEnableToken        = "enableToken"
+	KZoneName           = "zoneName"
+	KConsulAddr         = "consulAddr"
+	KVolType            = "volType"
+	KInitDirs           = "initDirs"
+	KInitDirsMode       = "initDirsMode"
+	KNodeSelector       = "nodeSelector"
+	KMaxIOPS            = "maxIOPS"
+	KMaxBandwidth       = "maxBandwidth"
+	KClientUID          = "clientUID"
+	KClientGID          = "clientGID"
+	KUnlimited          = "unlimited"
+	KDescription        = "description"
+	KDataPartitionCount = "dataPartitionCount"
+	KReplicaNum         = "replicaNum"
+	// subdirectory the master scopes the volume to
+	KRootPath = "rootPath"
+	// snapshot group to restore from, which the master does not support yet
+	KSnapshotGroup = "snapshotGroup"
+	// capacities recorded in the volume context at creation: the one of the
+	// PVC, and the one the master was asked for
+	KRequestedBytes   = "requestedBytes"
+	KProvisionedBytes = "provisionedBytes"
+	// master addr lists for the read and the write requests, default to masterAddr
+	KReadMasterAddr  = "readMasterAddr"
+	KWriteMasterAddr = "writeMasterAddr"
 )
 
 const (
@@ -57,50 +93,195 @@ const (
 	defaultProfPort       int = 10094
 	defaultLogLevel           = "info"
 	jsonFileSuffix            = ".json"
-	defaultConsulAddr         = "http://consul-service.cubefs.svc.cluster.local:8500"
 	defaultVolType            = "0"
+	defaultInitDirsMode       = "0755"
+	maxDescriptionLength      = 256
+	maxDataPartitionCount     = 1000
+	maxReplicaNum             = 3
+	maxRootPathLength         = 1024
+)
+
+// DefaultConsulAddr is the consulAddr of the clients by default.
+const DefaultConsulAddr = "http://consul-service.cubefs.svc.cluster.local:8500"
+
+const (
+	// secrets with this key prefix are forwarded to the master as http headers
+	secretMasterHeaderPrefix = "masterHeader."
+	// the secret key of the authKey used instead of the md5 of the owner
+	secretAuthKey = "authKey"
 )
 
 const (
-	ErrCodeVolNotExists = 7
+	// volume status reported by the master
+	volStatusMarkDelete = 1
+)
+
+const (
+	// the master failed to commit the request through raft, e.g. while
+	// electing a leader
+	ErrCodePersistenceByRaft = 4
+	ErrCodeVolNotExists      = 7
+	// the authKey of the request does not match the owner of the volume,
+	// ErrCodeVolAuthKeyNotMatch of the master
+	ErrCodeAuthKeyMismatch = 33
 
 	ErrDuplicateVolMsg = "duplicate vol"
 )
 
+const (
+	// cap the exponent of the retry backoff so that the shift can never overflow
+	maxBackoffExponent = 16
+	// redirects followed from a follower master to the leader
+	maxMasterRedirects = 10
+	// bytes of an unexpected response body put in errors
+	maxBodySnippetLength = 256
+)
+
+const (
+	// the header carrying the idempotency key of a create or delete request,
+	// and the one the master answers with "true" to a replayed request
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+)
+
 type cfsServer struct {
 	clientConfFile string
-	masterAddrs    []string
-	clientConf     map[string]string
+	// the masters of the client, and of the read and write requests if they differ
+	readAddrs  []string
+	writeAddrs []string
+	// how the client is run to read its configuration, see clientConfDelivery
+	clientArgs  []string
+	clientStdin []byte
+	masterAddrs []string
+	clientConf  map[string]string
+	conf        *Config
+	// headers and authKey from the CSI secrets, must never be logged
+	secretHeaders map[string]string
+	secretAuthKey string
+	// whether createVolume created the volume, rather than finding it existing
+	created bool
+	// the client config persisted by persistClientConf, see ensureClientConf
+	clientConfBytes []byte
+	// the context of the CSI request, whose deadline bounds the master
+	// requests, and of the running attempt of retryOnTransient
+	ctx        context.Context
+	attemptCtx context.Context
+	// idempotency key of the mutating request being sent, see executeIdempotentRequest
+	idempotencyKey string
 }
 
 // Create and Delete Volume Response
 type cfsServerResponse struct {
-	Code int    `json:"code"`
-	Msg  string `json:"msg"`
-	Data string `json:"data,omitempty"`
+	Code int             `json:"code"`
+	Msg  string          `json:"msg"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// the volume information listed by the master, the inode fields are only
+// reported by the masters supporting them
+type cfsVolumeInfo struct {
+	Name       string `json:"Name"`
+	Owner      string `json:"Owner"`
+	Status     uint8  `json:"Status"`
+	TotalSize  int64  `json:"TotalSize"`
+	UsedSize   int64  `json:"UsedSize"`
+	InodeCount uint64 `json:"InodeCount"`
+	InodeLimit uint64 `json:"InodeLimit"`
+}
+
+// the subset of the volume view returned by the master
+type cfsVolumeView struct {
+	Name     string `json:"Name"`
+	Owner    string `json:"Owner"`
+	ZoneName string `json:"ZoneName"`
+	Status   int    `json:"Status"`
+	Capacity int64  `json:"Capacity"` // GB
+	RootPath string `json:"RootPath"`
 }
 
-func newCfsServer(volName string, param map[string]string) (cs *cfsServer, err error) {
+func newCfsServer(volName string, param map[string]string, conf *Config) (cs *cfsServer, err error) {
 	masterAddr := param[KMasterAddr]
+	if len(masterAddr) == 0 && conf.masterAddrSource != nil {
+		// keep the default out of param, so that the volume context does not pin it
+		masterAddr = conf.masterAddrSource.get()
+	}
+
 	if len(volName) == 0 || len(masterAddr) == 0 {
 		return nil, fmt.Errorf("invalid argument for initializing cfsServer")
 	}
 
+	if err := restoreVolumeMetadata(conf.volumeStore, volName, param); err != nil {
+		glog.Warningf("restore metadata of volume[%v] failed, err: %v", volName, err)
+	}
+
 	newVolName := getValueWithDefault(param, KVolumeName, volName)
 	clientConfFile := defaultClientConfPath + newVolName + jsonFileSuffix
-	newOwner := csicommon.ShortenString(fmt.Sprintf("csi_%d", time.Now().UnixNano()), 20)
-	param[KMasterAddr] = masterAddr
 	param[KVolumeName] = newVolName
-	param[KOwner] = getValueWithDefault(param, KOwner, newOwner)
+	if len(param[KOwner]) == 0 {
+		param[KOwner] = generateOwner(param, time.Now())
+	}
 	param[KLogLevel] = getValueWithDefault(param, KLogLevel, defaultLogLevel)
 	param[KLogDir] = defaultLogDir + newVolName
-	param[KConsulAddr] = getValueWithDefault(param, KConsulAddr, defaultConsulAddr)
+	if consulAddr := conf.DefaultConsulAddr; len(consulAddr) != 0 {
+		param[KConsulAddr] = getValueWithDefault(param, KConsulAddr, consulAddr)
+	} else if param[KConsulAddr] == DefaultConsulAddr || len(param[KConsulAddr]) == 0 {
+		// without consul the key is omitted, including the default recorded
+		// in the volume context of the volumes created before
+		delete(param, KConsulAddr)
+	}
 	param[KVolType] = getValueWithDefault(param, KVolType, defaultVolType)
-	return &cfsServer{
+	if len(conf.DefaultCrossZone) != 0 {
+		param[KCrossZone] = getValueWithDefault(param, KCrossZone, conf.DefaultCrossZone)
+	}
+	// the zone of a node pool or the zoneList win over the default
+	if len(conf.DefaultZone) != 0 && len(param[KNodeSelector]) == 0 && len(param[KZoneList]) == 0 {
+		param[KZoneName] = getValueWithDefault(param, KZoneName, conf.DefaultZone)
+	}
+	cs = &cfsServer{
 		clientConfFile: clientConfFile,
 		masterAddrs:    strings.Split(masterAddr, ","),
 		clientConf:     param,
-	}, err
+		conf:           conf,
+	}
+	if addrs := param[KReadMasterAddr]; len(addrs) != 0 {
+		cs.readAddrs = strings.Split(addrs, ",")
+	}
+	if addrs := param[KWriteMasterAddr]; len(addrs) != 0 {
+		cs.writeAddrs = strings.Split(addrs, ",")
+	}
+
+	return cs, err
+}
+
+// applySecrets takes the settings carried by the CSI secrets of the request.
+func (cs *cfsServer) applySecrets(secrets map[string]string) {
+	for k, v := range secrets {
+		if k == secretAuthKey {
+			cs.secretAuthKey = v
+			continue
+		}
+
+		if strings.HasPrefix(k, secretMasterHeaderPrefix) {
+			if cs.secretHeaders == nil {
+				cs.secretHeaders = make(map[string]string)
+			}
+			cs.secretHeaders[strings.TrimPrefix(k, secretMasterHeaderPrefix)] = v
+		}
+	}
+}
+
+// newClusterCfsServer returns a cfsServer for the cluster level requests which
+// are not bound to a volume, talking to the default masters.
+func newClusterCfsServer(conf *Config) (*cfsServer, error) {
+	if conf.masterAddrSource == nil {
+		return nil, fmt.Errorf("no default master addr, the driver must be started with --master-addr-file")
+	}
+
+	return &cfsServer{
+		masterAddrs: strings.Split(conf.masterAddrSource.get(), ","),
+		clientConf:  make(map[string]string),
+		conf:        conf,
+	}, nil
 }
 
 func getValueWithDefault(param map[string]string, key string, defaultValue string) string {
@@ -112,23 +293,136 @@ func getValueWithDefault(param map[string]string, key string, defaultValue strin
 	return value
 }
 
+// initDirs returns the directories to be created inside a freshly mounted
+// volume, relative to the volume root, and the permission to create them with.
+func (cs *cfsServer) initDirs() ([]string, os.FileMode, error) {
+	value := cs.clientConf[KInitDirs]
+	if len(value) == 0 {
+		return nil, 0, nil
+	}
+
+	modeStr := getValueWithDefault(cs.clientConf, KInitDirsMode, defaultInitDirsMode)
+	mode, err := parseDirMode(modeStr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid %s %q, must be an octal permission like 0755", KInitDirsMode, modeStr)
+	}
+
+	var dirs []string
+	for _, dir := range strings.Split(value, ",") {
+		dir = strings.TrimSpace(dir)
+		if len(dir) == 0 {
+			continue
+		}
+
+		if err := validateRelativePath(dir); err != nil {
+			return nil, 0, fmt.Errorf("invalid %s: %v", KInitDirs, err)
+		}
+		dirs = append(dirs, dir)
+	}
+
+	return dirs, mode, nil
+}
+
 func (cs *cfsServer) persistClientConf(mountPoint string) error {
-	exporterPort, _ := getFreePort(defaultExporterPort)
-	profPort, _ := getFreePort(defaultProfPort)
+	if _, err := cs.validateParameters(); err != nil {
+		return err
+	}
+
+	if err := applyClientProfile(cs.clientConf); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := applyClientBufferSizes(cs.clientConf); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := applyClientConcurrency(cs.clientConf); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := prepareClientCache(cs.clientConf); err != nil {
+		return err
+	}
+
+	if probe := cs.conf.clientVersionProbe; probe != nil {
+		if version, err := probe.get(); err != nil {
+			glog.Warningf("query the client version failed, skip checking the client options. err: %v", err)
+		} else if err := checkClientOptions(cs.clientConf, version); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	exporterPort, err := cs.allocatePort(defaultExporterPort, cs.conf.exporterPortRange)
+	if err != nil {
+		return status.Errorf(codes.ResourceExhausted, "allocate exporter port fail: %v", err)
+	}
+
+	profPort, err := cs.allocatePort(defaultProfPort, cs.conf.profPortRange)
+	if err != nil {
+		return status.Errorf(codes.ResourceExhausted, "allocate prof port fail: %v", err)
+	}
+
+	cs.clientConf[KMasterAddr] = strings.Join(cs.masterAddrs, ",")
 	cs.clientConf[KMountPoint] = mountPoint
 	cs.clientConf[KExporterPort] = strconv.Itoa(exporterPort)
 	cs.clientConf[KProfPort] = strconv.Itoa(profPort)
 	_ = os.Mkdir(cs.clientConf[KLogDir], 0777)
-	clientConfBytes, _ := json.Marshal(cs.clientConf)
-	err := ioutil.WriteFile(cs.clientConfFile, clientConfBytes, 0444)
+	clientConfBytes, err := marshalClientConf(cs.clientConf)
+	if err != nil {
+		return status.Errorf(codes.Internal, "marshal client config fail. err: %v", err)
+	}
+	delivery := cs.clientConfDelivery()
+
+	cs.clientArgs, cs.clientStdin, err = delivery.prepare(cs.clientConfFile, clientConfBytes)
+	if errors.Is(err, syscall.ENOSPC) {
+		// the config and the logs of the clients usually share the disk
+		logRoot := filepath.Dir(cs.clientConf[KLogDir])
+		freed, gcErr := gcClientLogs(logRoot, clientLogGCAge)
+		glog.Warningf("no space left for the client config file %v, removed %d bytes of old client logs in %v. err: %v",
+			cs.clientConfFile, freed, logRoot, gcErr)
+		cs.clientArgs, cs.clientStdin, err = delivery.prepare(cs.clientConfFile, clientConfBytes)
+	}
+
+	if errors.Is(err, syscall.ENOSPC) {
+		return status.Errorf(codes.ResourceExhausted, "no space left on the device of the client config directory %v, "+
+			"free disk space on the node. err: %v", filepath.Dir(cs.clientConfFile), err)
+	}
+
 	if err != nil {
 		return status.Errorf(codes.Internal, "create client config file fail. err: %v", err.Error())
 	}
 
+	cs.clientConfBytes = clientConfBytes
 	glog.V(0).Infof("create client config file success, volumeId:%v", cs.clientConf[KVolumeName])
 	return nil
 }
 
+func (cs *cfsServer) clientConfDelivery() clientConfDelivery {
+	if cs.conf.clientConfDelivery == nil {
+		return fileClientConfDelivery{}
+	}
+	return cs.conf.clientConfDelivery
+}
+
+// allocatePort returns a port of r for the client if r is set, or a free port
+// otherwise, which falls back to defaultPort if none is found.
+func (cs *cfsServer) allocatePort(defaultPort int, r *portRange) (int, error) {
+	allocator := cs.conf.portAllocator
+	if r != nil {
+		if allocator == nil {
+			allocator = newPortAllocator(0)
+		}
+		return allocator.allocateInRange(*r)
+	}
+
+	allocate := getFreePort
+	if allocator != nil {
+		allocate = allocator.allocate
+	}
+	port, _ := allocate(defaultPort)
+	return port, nil
+}
+
 func (cs *cfsServer) createVolume(capacityGB int64) (err error) {
 	valName := cs.clientConf[KVolumeName]
 	owner := cs.clientConf[KOwner]
@@ -137,30 +431,235 @@ func (cs *cfsServer) createVolume(capacityGB int64) (err error) {
 	zone := cs.clientConf[KZoneName]
 	volType := cs.clientConf[KVolType]
 
-	return cs.forEachMasterAddr("CreateVolume", func(addr string) error {
-		url := fmt.Sprintf("http://%s/admin/createVol?name=%s&capacity=%v&owner=%v&crossZone=%v&enableToken=%v&zoneName=%v&volType=%v",
-			addr, valName, capacityGB, owner, crossZone, token, zone, volType)
-		glog.Infof("createVol url: %v", url)
-		resp, err := cs.executeRequest(url)
+	if err := cs.checkMasterQuorum("CreateVolume"); err != nil {
+		return err
+	}
+
+	query, err := cs.validateParameters()
+	if err != nil {
+		return err
+	}
+
+	return cs.retryOnTransient("CreateVolume", func() error {
+		return cs.forEachMasterAddr("CreateVolume", func(addr string) error {
+			url := cs.masterURL(addr, fmt.Sprintf("/admin/createVol?name=%s&capacity=%v&owner=%v&crossZone=%v&enableToken=%v&zoneName=%v&volType=%v%s",
+				valName, capacityGB, owner, crossZone, token, zone, volType, query))
+			glog.Infof("createVol url: %v", redactAuthKey(url))
+			resp, err := cs.executeIdempotentRequest(url, "CreateVolume")
+			if err != nil {
+				return err
+			}
+
+			if resp.Code != 0 {
+				if strings.Contains(resp.Msg, ErrDuplicateVolMsg) {
+					glog.Warningf("duplicate to create volume. url(%v) msg: %v", redactAuthKey(url), resp.Msg)
+					idempotencyShortcuts.inc("CreateVolume")
+					return nil
+				}
+
+				return fmt.Errorf("create volume failed: url(%v) code=(%v), msg: %v", redactAuthKey(url), resp.Code, resp.Msg)
+			}
+
+			cs.created = true
+			return nil
+		})
+	})
+}
+
+// validateParameters checks the parameters of the volume, and returns the
+// query string passing the optional ones to the master when creating it. The
+// controller and the node both check the volumes with it, so that they never
+// disagree on the valid parameters.
+func (cs *cfsServer) validateParameters() (string, error) {
+	var query string
+	for _, createQuery := range []func() (string, error){
+		cs.qosQuery, cs.descriptionQuery, cs.dataPartitionQuery, cs.replicaQuery, cs.rootPathQuery,
+	} {
+		q, err := createQuery()
 		if err != nil {
-			return err
+			return "", status.Error(codes.InvalidArgument, err.Error())
 		}
+		query += q
+	}
 
-		if resp.Code != 0 {
-			if strings.Contains(resp.Msg, ErrDuplicateVolMsg) {
-				glog.Warningf("duplicate to create volume. url(%v) msg: %v", url, resp.Msg)
-				return nil
-			}
+	for _, check := range []func() error{
+		cs.checkEnableToken,
+		func() error { _, _, err := cs.initDirs(); return err },
+		func() error { _, err := parseDeleteGuard(cs.clientConf); return err },
+		func() error { _, err := clientBufferSizes(cs.clientConf); return err },
+		func() error { _, err := clientConcurrency(cs.clientConf); return err },
+		func() error { _, err := clientCacheOptions(cs.clientConf); return err },
+		// check the profile only, it is expanded by the node, so that changing
+		// a profile applies to the existing volumes at their next mount
+		func() error { return applyClientProfile(map[string]string{KProfile: cs.clientConf[KProfile]}) },
+		func() error { _, err := cs.clientCredential(); return err },
+	} {
+		if err := check(); err != nil {
+			return "", status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
 
-			return fmt.Errorf("create volume failed: url(%v) code=(%v), msg: %v", url, resp.Code, resp.Msg)
+	return query, nil
+}
+
+// descriptionQuery sanitizes the description parameter in place, dropping the
+// control characters, and returns the query string passing it to the master,
+// which is empty if there is no description.
+func (cs *cfsServer) descriptionQuery() (string, error) {
+	description := strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
 		}
+		return r
+	}, cs.clientConf[KDescription]))
+	if len(description) == 0 {
+		delete(cs.clientConf, KDescription)
+		return "", nil
+	}
+
+	if length := utf8.RuneCountInString(description); length > maxDescriptionLength {
+		return "", fmt.Errorf("%s of %d characters exceeds the limit %d", KDescription, length, maxDescriptionLength)
+	}
+
+	cs.clientConf[KDescription] = description
+	return "&description=" + url.QueryEscape(description), nil
+}
+
+// dataPartitionQuery validates the dataPartitionCount parameter, and returns
+// the query string making the master create the volume with that many data
+// partitions, which is empty if the master default is used.
+func (cs *cfsServer) dataPartitionQuery() (string, error) {
+	value := cs.clientConf[KDataPartitionCount]
+	if len(value) == 0 {
+		return "", nil
+	}
+
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 1 || count > maxDataPartitionCount {
+		return "", fmt.Errorf("invalid %s %q, must be an integer in [1, %d]", KDataPartitionCount, value, maxDataPartitionCount)
+	}
+
+	return fmt.Sprintf("&dpCount=%d", count), nil
+}
+
+// replicaQuery validates the replicaNum parameter, and returns the query
+// string setting the replicas of the data partitions, which is empty if the
+// master default is used. Only replica volumes have replicas.
+func (cs *cfsServer) replicaQuery() (string, error) {
+	value := cs.clientConf[KReplicaNum]
+	if len(value) == 0 {
+		return "", nil
+	}
+
+	if volType := cs.clientConf[KVolType]; volType != defaultVolType {
+		return "", fmt.Errorf("%s is not supported by %s %s, only by the replica volumes of %s %s",
+			KReplicaNum, KVolType, volType, KVolType, defaultVolType)
+	}
+
+	replicas, err := strconv.Atoi(value)
+	if err != nil || replicas < 1 || replicas > maxReplicaNum {
+		return "", fmt.Errorf("invalid %s %q, must be an integer in [1, %d]", KReplicaNum, value, maxReplicaNum)
+	}
+
+	return fmt.Sprintf("&replicaNum=%d", replicas), nil
+}
 
+// checkEnableToken validates the enableToken parameter. The tokens only
+// control the access to replica volumes, the token of a cold volume would
+// never be usable.
+func (cs *cfsServer) checkEnableToken() error {
+	value := cs.clientConf[KEnableToken]
+	if len(value) == 0 {
 		return nil
-	})
+	}
+
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q, must be true or false", KEnableToken, value)
+	}
+
+	if volType := cs.clientConf[KVolType]; enabled && volType == volTypeCold {
+		return fmt.Errorf("%s is not supported by %s %s, only by the replica volumes of %s %s",
+			KEnableToken, KVolType, volType, KVolType, defaultVolType)
+	}
+
+	return nil
+}
+
+// rootPathQuery validates the rootPath parameter, and returns the query string
+// making the master root the volume at that subdirectory, which is empty if
+// the volume is rooted at its top.
+func (cs *cfsServer) rootPathQuery() (string, error) {
+	value := cs.clientConf[KRootPath]
+	if len(value) == 0 {
+		return "", nil
+	}
+
+	if len(value) > maxRootPathLength || !path.IsAbs(value) || path.Clean(value) != value || value == "/" ||
+		strings.IndexFunc(value, unicode.IsControl) >= 0 {
+		return "", fmt.Errorf("invalid %s %q, must be a clean absolute path below / of at most %d bytes",
+			KRootPath, value, maxRootPathLength)
+	}
+
+	return "&rootPath=" + url.QueryEscape(value), nil
+}
+
+// checkRootPath verifies that the master rooted the volume at the rootPath
+// parameter. Masters without directory-scoped volumes ignore the parameter,
+// and would otherwise hand out the whole volume.
+func (cs *cfsServer) checkRootPath() error {
+	rootPath := cs.clientConf[KRootPath]
+	if len(rootPath) == 0 {
+		return nil
+	}
+
+	view, err := cs.getVolume()
+	if err != nil {
+		return err
+	}
+
+	volName := cs.clientConf[KVolumeName]
+	if len(view.RootPath) == 0 {
+		return status.Errorf(codes.FailedPrecondition, "the master does not support %s, volume[%v] is not rooted at %q",
+			KRootPath, volName, rootPath)
+	}
+
+	if view.RootPath != rootPath {
+		return status.Errorf(codes.FailedPrecondition, "volume[%v] is rooted at %q rather than %q",
+			volName, view.RootPath, rootPath)
+	}
+
+	return nil
+}
+
+// readMasterAddrs returns the masters serving the read requests.
+func (cs *cfsServer) readMasterAddrs() []string {
+	if len(cs.readAddrs) != 0 {
+		return cs.readAddrs
+	}
+	return cs.masterAddrs
+}
+
+// writeMasterAddrs returns the masters serving the requests mutating volumes.
+func (cs *cfsServer) writeMasterAddrs() []string {
+	if len(cs.writeAddrs) != 0 {
+		return cs.writeAddrs
+	}
+	return cs.masterAddrs
+}
+
+// forEachMasterAddr tries f with the write masters in turn until it succeeds.
+func (cs *cfsServer) forEachMasterAddr(stage string, f func(addr string) error) error {
+	return forEachAddr(stage, cs.writeMasterAddrs(), f)
+}
+
+// forEachReadMasterAddr tries f with the read masters in turn until it succeeds.
+func (cs *cfsServer) forEachReadMasterAddr(stage string, f func(addr string) error) error {
+	return forEachAddr(stage, cs.readMasterAddrs(), f)
 }
 
-func (cs *cfsServer) forEachMasterAddr(stage string, f func(addr string) error) (err error) {
-	for _, addr := range cs.masterAddrs {
+func forEachAddr(stage string, addrs []string, f func(addr string) error) (err error) {
+	for _, addr := range addrs {
 		if err = f(addr); err == nil {
 			break
 		}
@@ -176,81 +675,964 @@ func (cs *cfsServer) forEachMasterAddr(stage string, f func(addr string) error)
 	return nil
 }
 
-func (cs *cfsServer) deleteVolume() (err error) {
-	ownerMd5, err := cs.getOwnerMd5()
-	if err != nil {
-		return err
+// retryOnTransient calls f until it succeeds, fails with a non-transient error,
+// or the retry count configured for the driver is used up. The delay between
+// two attempts grows exponentially with random jitter, so that a master outage
+// does not turn into a synchronized retry storm, up to the cap of the driver.
+// The attempts share the time left until the deadline of the bound context,
+// see runAttempt, and the retries stop with the last error once the retry
+// deadline of the driver would pass. An attempt still running at the retry
+// deadline is interrupted.
+func (cs *cfsServer) retryOnTransient(stage string, f func() error) (err error) {
+	client := cs.masterClient()
+	start := time.Now()
+	var retryDeadline time.Time
+	if client.retryDeadline > 0 {
+		retryDeadline = start.Add(client.retryDeadline)
 	}
 
-	valName := cs.clientConf[KVolumeName]
-	return cs.forEachMasterAddr("DeleteVolume", func(addr string) error {
-		url := fmt.Sprintf("http://%s/vol/delete?name=%s&authKey=%v", addr, valName, ownerMd5)
-		glog.Infof("deleteVol url: %v", url)
-		resp, err := cs.executeRequest(url)
-		if err != nil {
+	for attempt := 0; ; attempt++ {
+		last := err
+		err = cs.runAttempt(attempt, retryDeadline, f)
+		if err != nil && last != nil && !retryDeadline.IsZero() && !time.Now().Before(retryDeadline) {
+			// interrupted by the retry deadline, the previous attempt tells
+			// why the master failed
+			glog.Errorf("%s interrupted by the retry deadline %v: %v", stage, client.retryDeadline, err)
+			return last
+		}
+		if err == nil || !isTransientError(err) || attempt >= client.retryCount {
 			return err
 		}
 
-		if resp.Code != 0 {
-			if resp.Code == ErrCodeVolNotExists {
-				glog.Warningf("volume[%s] not exists, assuming the volume has already been deleted. code:%v, msg:%v",
-					valName, resp.Code, resp.Msg)
-				return nil
-			}
-			return fmt.Errorf("delete volume[%s] is failed. code:%v, msg:%v", valName, resp.Code, resp.Msg)
+		delay := client.backoff(attempt)
+		if client.retryDeadline > 0 && time.Since(start)+delay >= client.retryDeadline {
+			glog.Errorf("%s failed with transient error, give up retry %d/%d past the retry deadline %v: %v",
+				stage, attempt+1, client.retryCount, client.retryDeadline, err)
+			return err
+		}
+		if deadline, ok := cs.requestContext().Deadline(); ok && time.Until(deadline) <= delay {
+			return status.Errorf(codes.DeadlineExceeded, "%s: no time left for retry %d/%d: %v",
+				stage, attempt+1, client.retryCount, err)
 		}
 
-		return nil
-	})
+		glog.Warningf("%s failed with transient error, retry %d/%d after %v: %v",
+			stage, attempt+1, client.retryCount, delay, err)
+		time.Sleep(delay)
+	}
 }
 
-func (cs *cfsServer) executeRequest(url string) (*cfsServerResponse, error) {
-	httpResp, err := http.Get(url)
-	if err != nil {
-		return nil, status.Errorf(codes.Unavailable, "request url failed, url(%v) err(%v)", url, err)
+// bindContext bounds the master requests by ctx, usually the context of the
+// CSI request, so that they do not overrun the deadline of the CO.
+func (cs *cfsServer) bindContext(ctx context.Context) {
+	cs.ctx = ctx
+}
+
+// requestContext returns the context of the master requests.
+func (cs *cfsServer) requestContext() context.Context {
+	if cs.attemptCtx != nil {
+		return cs.attemptCtx
 	}
 
-	defer httpResp.Body.Close()
-	body, err := ioutil.ReadAll(httpResp.Body)
-	if err != nil {
-		return nil, status.Errorf(codes.Unavailable, "read http response body, url(%v) bodyLen(%v) err(%v)", url, len(body), err)
+	if cs.ctx != nil {
+		return cs.ctx
 	}
 
-	resp := &cfsServerResponse{}
-	if err := json.Unmarshal(body, resp); err != nil {
-		return nil, status.Errorf(codes.Unavailable, "unmarshal http response body, url(%v) msg(%v) err(%v)", url, resp.Msg, err)
+	return context.Background()
+}
+
+// runAttempt calls f as the attempt of retryOnTransient, which is given its
+// share of the time left until the deadline: a hanging master then fails the
+// attempt early enough for the remaining attempts to be made. The attempt is
+// also bound by retryDeadline unless zero. Once the bound context is done, f
+// is not called anymore, and a failure of f is returned as DeadlineExceeded,
+// or Canceled.
+func (cs *cfsServer) runAttempt(attempt int, retryDeadline time.Time, f func() error) error {
+	if err := cs.contextError(nil); err != nil {
+		return err
 	}
-	return resp, nil
+
+	parent := cs.requestContext()
+	deadline, ok := parent.Deadline()
+	if ok {
+		attempts := cs.masterClient().retryCount - attempt + 1
+		if attempts < 1 {
+			attempts = 1
+		}
+		deadline = time.Now().Add(time.Until(deadline) / time.Duration(attempts))
+	}
+	if !retryDeadline.IsZero() && (!ok || retryDeadline.Before(deadline)) {
+		deadline, ok = retryDeadline, true
+	}
+	if !ok {
+		return f()
+	}
+
+	ctx, cancel := context.WithDeadline(parent, deadline)
+	defer cancel()
+
+	prev := cs.attemptCtx
+	cs.attemptCtx = ctx
+	defer func() { cs.attemptCtx = prev }()
+
+	if err := f(); err != nil {
+		if ctxErr := cs.contextError(err); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+
+	return nil
 }
 
-func (cs *cfsServer) runClient() error {
-	return mountVolume(cs.clientConfFile)
+// contextError returns the error of a request interrupted by the bound
+// context, wrapping cause if set, or nil if the context is not done.
+func (cs *cfsServer) contextError(cause error) error {
+	if cs.ctx == nil || cs.ctx.Err() == nil {
+		return nil
+	}
+
+	code := codes.DeadlineExceeded
+	if cs.ctx.Err() == context.Canceled {
+		code = codes.Canceled
+	}
+
+	if cause != nil {
+		return status.Errorf(code, "%v: %v", cs.ctx.Err(), cause)
+	}
+	return status.Error(code, cs.ctx.Err().Error())
 }
 
-func (cs *cfsServer) expandVolume(capacityGB int64) (err error) {
-	ownerMd5, err := cs.getOwnerMd5()
-	if err != nil {
-		return err
+// isTransientError reports whether err is worth retrying, i.e. the master could
+// not be reached or answered with a server side error.
+func isTransientError(err error) bool {
+	return status.Code(err) == codes.Unavailable
+}
+
+// backoffWithJitter returns a random delay in [d/2, d], where d is base*2^attempt.
+func backoffWithJitter(base time.Duration, attempt int) time.Duration {
+	if attempt > maxBackoffExponent {
+		attempt = maxBackoffExponent
 	}
 
-	volName := cs.clientConf[KVolumeName]
+	d := base << uint(attempt)
+	if d <= 0 {
+		return 0
+	}
 
-	return cs.forEachMasterAddr("ExpandVolume", func(addr string) error {
-		url := fmt.Sprintf("http://%s/vol/expand?name=%s&authKey=%v&capacity=%v", addr, volName, ownerMd5, capacityGB)
-		glog.Infof("expandVolume url: %v", url)
-		resp, err := cs.executeRequest(url)
-		if err != nil {
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// deleteVolume deletes the volume, which succeeds if it does not exist. A
+// volume the controller created within DeleteNotFoundGrace is deleted again
+// until its grace period ends, as a lagging master may not list it yet.
+func (cs *cfsServer) deleteVolume() error {
+	valName := cs.clientConf[KVolumeName]
+	for {
+		err := cs.deleteVolumeOnce()
+		if err != errNotFoundInGrace {
 			return err
 		}
 
-		if resp.Code != 0 {
-			return fmt.Errorf("expand volume[%v] failed, code:%v, msg:%v", volName, resp.Code, resp.Msg)
+		remaining := cs.conf.recentCreates.remaining(valName)
+		if remaining <= 0 {
+			glog.Warningf("volume[%s] still not exists after its grace period, assuming the volume has already been deleted", valName)
+			idempotencyShortcuts.inc("DeleteVolume")
+			return nil
+		}
+		if remaining > deleteGracePollInterval {
+			remaining = deleteGracePollInterval
 		}
 
-		return nil
+		select {
+		case <-cs.requestContext().Done():
+			return status.Errorf(codes.DeadlineExceeded, "volume[%v] created moments ago not exists yet, retry the deletion later", valName)
+		case <-time.After(remaining):
+		}
+	}
+}
+
+func (cs *cfsServer) deleteVolumeOnce() (err error) {
+	authKey, err := cs.getAuthKey()
+	if err != nil {
+		return err
+	}
+
+	if err := cs.checkMasterQuorum("DeleteVolume"); err != nil {
+		return err
+	}
+
+	valName := cs.clientConf[KVolumeName]
+	return cs.retryOnTransient("DeleteVolume", func() error {
+		return cs.forEachMasterAddr("DeleteVolume", func(addr string) error {
+			url := cs.masterURL(addr, fmt.Sprintf("/vol/delete?name=%s&authKey=%v", valName, authKey))
+			glog.Infof("deleteVol url: %v", redactAuthKey(url))
+			resp, err := cs.executeIdempotentRequest(url, "DeleteVolume")
+			if err != nil {
+				return err
+			}
+
+			if resp.Code != 0 {
+				if resp.Code == ErrCodeVolNotExists {
+					if cs.conf.recentCreates.remaining(valName) > 0 {
+						glog.Warningf("volume[%s] created moments ago not exists yet, delete it again. code:%v, msg:%v",
+							valName, resp.Code, resp.Msg)
+						return errNotFoundInGrace
+					}
+					glog.Warningf("volume[%s] not exists, assuming the volume has already been deleted. code:%v, msg:%v",
+						valName, resp.Code, resp.Msg)
+					idempotencyShortcuts.inc("DeleteVolume")
+					return nil
+				}
+				return fmt.Errorf("delete volume[%s] is failed. code:%v, msg:%v", valName, resp.Code, resp.Msg)
+			}
+
+			return nil
+		})
 	})
 }
 
+// deleteVolumeAsync deletes the volume and waits until the master has removed
+// it, which may take long for large volumes. A volume already being deleted
+// is waited for without deleting it again, so that retries are idempotent.
+func (cs *cfsServer) deleteVolumeAsync(ctx context.Context, pollInterval time.Duration) error {
+	view, err := cs.getVolume()
+	if status.Code(err) == codes.NotFound && cs.conf.recentCreates.remaining(cs.clientConf[KVolumeName]) > 0 {
+		// the volume may not be listed yet, see deleteVolume
+		if err := cs.deleteVolume(); err != nil {
+			return err
+		}
+		return cs.waitVolumeDeleted(ctx, pollInterval)
+	} else if status.Code(err) == codes.NotFound {
+		glog.Warningf("volume[%s] not exists, assuming the volume has already been deleted", cs.clientConf[KVolumeName])
+		idempotencyShortcuts.inc("DeleteVolume")
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if view.Status == volStatusMarkDelete {
+		glog.Infof("volume[%s] is already being deleted, wait for it", cs.clientConf[KVolumeName])
+	} else if err := cs.deleteVolume(); err != nil {
+		return err
+	}
+
+	return cs.waitVolumeDeleted(ctx, pollInterval)
+}
+
+// waitVolumeDeleted polls the master every interval until the volume is gone.
+// It fails with DeadlineExceeded once ctx is done, so that the CO retries the
+// deletion later and finds it in progress or completed.
+func (cs *cfsServer) waitVolumeDeleted(ctx context.Context, interval time.Duration) error {
+	volName := cs.clientConf[KVolumeName]
+	for {
+		_, err := cs.getVolume()
+		if status.Code(err) == codes.NotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return status.Errorf(codes.DeadlineExceeded, "deletion of volume[%v] is still in progress", volName)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// idempotencyKey derives the idempotency key of operation on the volume from
+// the request uri, i.e. the path and the parameters of the request, the same
+// for every retry to any master so that the master can coalesce them, while
+// a request with other parameters, e.g. another capacity, is not coalesced.
+func idempotencyKey(operation, volName, requestURI string) string {
+	sum := sha256.Sum256([]byte(operation + "/" + volName + "/" + requestURI))
+	return hex.EncodeToString(sum[:16])
+}
+
+// executeIdempotentRequest executes the request of operation carrying its
+// idempotency key. A response the master marks as the replay of an operation
+// which already succeeded is a success, whatever its body.
+func (cs *cfsServer) executeIdempotentRequest(rawURL, operation string) (*cfsServerResponse, error) {
+	requestURI := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		requestURI = u.RequestURI()
+	}
+	cs.idempotencyKey = idempotencyKey(operation, cs.clientConf[KVolumeName], requestURI)
+	defer func() { cs.idempotencyKey = "" }()
+	return cs.executeRequest(rawURL)
+}
+
+// executeRequest sends a master request, retargeting it to the leader named
+// by a follower master which rejects it as not the leader, e.g. while the
+// masters fail over. The hints are followed like the http redirects.
+func (cs *cfsServer) executeRequest(url string) (*cfsServerResponse, error) {
+	for redirects := 0; ; redirects++ {
+		resp, err := cs.executeMasterRequest(url)
+		if err != nil {
+			return nil, err
+		}
+
+		leader := leaderHint(resp)
+		if len(leader) == 0 {
+			if cs.masterClient().isRetryableCode(resp.Code) {
+				return nil, status.Errorf(codes.Unavailable, "master responded with the retryable code %v, url(%v) msg(%v)",
+					resp.Code, redactAuthKey(url), resp.Msg)
+			}
+			return resp, nil
+		}
+		if redirects >= maxMasterRedirects {
+			return nil, status.Errorf(codes.Unavailable, "stopped after %d leader hints, url(%v) msg(%v)",
+				maxMasterRedirects, redactAuthKey(url), resp.Msg)
+		}
+
+		next, ok := cs.retargetMasterURL(url, leader)
+		if !ok {
+			return nil, status.Errorf(codes.Unavailable, "master rejected the request as not the leader, naming %v "+
+				"which is not another configured master, url(%v) msg(%v)", leader, redactAuthKey(url), resp.Msg)
+		}
+		glog.Warningf("master rejected the request as not the leader, retarget it to the leader %v, url(%v) msg(%v)",
+			leader, redactAuthKey(url), resp.Msg)
+		url = next
+	}
+}
+
+// cfsLeaderHint is the data of a follower master rejecting a request as not
+// the leader, naming the current leader.
+type cfsLeaderHint struct {
+	LeaderAddr string `json:"LeaderAddr"`
+}
+
+// leaderHint returns the leader named by a master rejecting a request, empty
+// if the response is not such a rejection.
+func leaderHint(resp *cfsServerResponse) string {
+	if resp.Code == 0 || len(resp.Data) == 0 {
+		return ""
+	}
+
+	hint := &cfsLeaderHint{}
+	if err := json.Unmarshal(resp.Data, hint); err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(hint.LeaderAddr)
+}
+
+// retargetMasterURL returns rawURL sent to the leader instead, with the same
+// scheme, false if it is already sent there or cannot be retargeted. As the
+// request carries the authKey, it is only retargeted to the masters of cs.
+func (cs *cfsServer) retargetMasterURL(rawURL, leader string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == leader || !cs.isMasterAddr(leader) {
+		return "", false
+	}
+
+	u.Host = leader
+	return u.String(), true
+}
+
+func (cs *cfsServer) executeMasterRequest(url string) (*cfsServerResponse, error) {
+	httpResp, err := cs.sendRequest(url)
+	if err != nil {
+		return nil, err
+	}
+
+	defer httpResp.Body.Close()
+	url = redactAuthKey(url)
+	if len(cs.idempotencyKey) != 0 && httpResp.Header.Get(idempotentReplayedHeader) == "true" {
+		glog.Infof("master replayed the request with idempotency key %v, url(%v)", cs.idempotencyKey, url)
+		_, _ = io.Copy(ioutil.Discard, httpResp.Body)
+		return &cfsServerResponse{Code: 0, Msg: "replayed"}, nil
+	}
+	body, err := readResponseBody(httpResp)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "read http response body, url(%v) bodyLen(%v) err(%v)", url, len(body), err)
+	}
+
+	// the master answers every request with 200, anything else comes from a
+	// proxy or a wrong address, which retrying does not fix
+	if httpResp.StatusCode != http.StatusOK {
+		if isNonJSONResponse(httpResp, body) {
+			return nil, nonJSONResponseError(codes.Internal, httpResp, url, body)
+		}
+		return nil, status.Errorf(codes.Internal, "master responded with http status %v, url(%v) body(%v)",
+			httpResp.StatusCode, url, bodySnippet(body))
+	}
+
+	if isNonJSONResponse(httpResp, body) {
+		return nil, nonJSONResponseError(codes.Unavailable, httpResp, url, body)
+	}
+
+	resp := &cfsServerResponse{}
+	if err := json.Unmarshal(body, resp); err != nil {
+		return nil, status.Errorf(codes.Unavailable, "unmarshal http response body, url(%v) http status(%v) body(%v) err(%v)",
+			url, httpResp.StatusCode, bodySnippet(body), err)
+	}
+	return resp, nil
+}
+
+// sendRequest sends a master request, and returns its response unless the
+// master failed with a 5xx status. The caller must close the body.
+func (cs *cfsServer) sendRequest(url string) (httpResp *http.Response, err error) {
+	client := cs.masterClient()
+	httpReq, err := client.newRequest(cs.requestContext(), url)
+	// the url is only put in errors with the authKey redacted
+	url = redactAuthKey(url)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "build request failed, url(%v) err(%v)", url, err)
+	}
+	httpReq = httpReq.WithContext(context.WithValue(httpReq.Context(), isMasterAddrKey{}, cs.isMasterAddr))
+
+	_, span := cs.conf.tracer.start(httpReq.Context(), "master "+httpReq.URL.Path, spanKindClient)
+	if span != nil {
+		span.setAttribute("server.address", httpReq.URL.Host)
+		httpReq.Header.Set(traceparentHeader, span.traceparent())
+		defer func() { span.finish(err) }()
+	}
+
+	// ask for gzip explicitly, so that the decompression does not depend on the transport
+	httpReq.Header.Set("Accept-Encoding", "gzip")
+	if len(cs.idempotencyKey) != 0 {
+		httpReq.Header.Set(idempotencyKeyHeader, cs.idempotencyKey)
+	}
+	for k, v := range cs.secretHeaders {
+		httpReq.Header.Set(k, v)
+	}
+
+	httpResp, err = client.do(httpReq)
+	if err != nil {
+		// drop the unredacted url wrapped by the http client
+		if inner := errors.Unwrap(err); inner != nil {
+			err = inner
+		}
+		return nil, status.Errorf(codes.Unavailable, "request url failed, url(%v) err(%v)", url, err)
+	}
+	span.setAttribute("http.status_code", strconv.Itoa(httpResp.StatusCode))
+
+	if httpResp.StatusCode >= http.StatusInternalServerError {
+		defer httpResp.Body.Close()
+		body, _ := ioutil.ReadAll(io.LimitReader(httpResp.Body, maxBodySnippetLength))
+		// drain the body, so that the connection can be reused
+		_, _ = io.Copy(ioutil.Discard, httpResp.Body)
+		if isNonJSONResponse(httpResp, body) {
+			return nil, nonJSONResponseError(codes.Unavailable, httpResp, url, body)
+		}
+		return nil, status.Errorf(codes.Unavailable, "master responded with http status %v, url(%v) body(%v)",
+			httpResp.StatusCode, url, bodySnippet(body))
+	}
+
+	return httpResp, nil
+}
+
+// bodySnippet returns the beginning of a response body to be put in errors.
+func bodySnippet(body []byte) string {
+	if len(body) > maxBodySnippetLength {
+		return fmt.Sprintf("%q...", body[:maxBodySnippetLength])
+	}
+	return fmt.Sprintf("%q", body)
+}
+
+// isNonJSONResponse reports whether the response is not one of the master,
+// e.g. the html error page of a misconfigured proxy, which is told by its
+// content type or its leading '<'.
+func isNonJSONResponse(httpResp *http.Response, body []byte) bool {
+	if mediaType, _, err := mime.ParseMediaType(httpResp.Header.Get("Content-Type")); err == nil && mediaType == "text/html" {
+		return true
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(body), []byte("<"))
+}
+
+// nonJSONResponseError returns the error of a non-JSON response, which is not
+// unmarshalled, as the unmarshal error only obscures where it comes from.
+func nonJSONResponseError(code codes.Code, httpResp *http.Response, url string, body []byte) error {
+	return status.Errorf(code, "master returned a non-JSON response with http status %v and content type %q, "+
+		"check the proxies in front of the master, url(%v) body(%v)",
+		httpResp.StatusCode, httpResp.Header.Get("Content-Type"), url, bodySnippet(body))
+}
+
+// masterClient returns the master client shared by the driver, or one of the
+// config of cs if the driver did not set up one, e.g. in the CLI tools.
+func (cs *cfsServer) masterClient() *masterClient {
+	if cs.conf.masterClient != nil {
+		return cs.conf.masterClient
+	}
+	return newMasterClient(cs.conf, defaultMasterHTTPClient)
+}
+
+// masterURL returns the url of the master api path at addr.
+func (cs *cfsServer) masterURL(addr, path string) string {
+	return cs.masterClient().url(addr, path)
+}
+
+// isMasterAddr reports whether addr is one of the masters of cs.
+func (cs *cfsServer) isMasterAddr(addr string) bool {
+	for _, addrs := range [][]string{cs.masterAddrs, cs.readAddrs, cs.writeAddrs} {
+		for _, masterAddr := range addrs {
+			if masterAddr == addr {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// isMasterAddrKey is the context key of the isMasterAddr of the cfsServer
+// sending a master request, which keepHeadersOnRedirect checks.
+type isMasterAddrKey struct{}
+
+// keepHeadersOnRedirect follows the redirects of a follower master to the
+// leader with all the headers of the original request, including the auth
+// headers the http client drops when redirecting to another host. As the
+// http client keeps the other headers anyway, the redirects to anything but
+// a master of the request, or from https to http, are refused altogether.
+func keepHeadersOnRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxMasterRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxMasterRedirects)
+	}
+
+	isMasterAddr, _ := req.Context().Value(isMasterAddrKey{}).(func(string) bool)
+	if isMasterAddr == nil || !isMasterAddr(req.URL.Host) {
+		return fmt.Errorf("refused the redirect to %v, which is not a configured master", req.URL.Host)
+	}
+
+	if via[0].URL.Scheme == "https" && req.URL.Scheme != "https" {
+		return fmt.Errorf("refused the redirect from https to %v", req.URL.Scheme)
+	}
+
+	for k, v := range via[0].Header {
+		req.Header[k] = v
+	}
+	return nil
+}
+
+// readResponseBody reads the body of a master response, which is decompressed
+// if the master gzipped it.
+func readResponseBody(httpResp *http.Response) ([]byte, error) {
+	reader, err := responseBodyReader(httpResp)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadAll(reader)
+}
+
+// responseBodyReader returns a reader of the body of a master response, which
+// decompresses it if the master gzipped it.
+func responseBodyReader(httpResp *http.Response) (io.Reader, error) {
+	if !strings.EqualFold(httpResp.Header.Get("Content-Encoding"), "gzip") {
+		return httpResp.Body, nil
+	}
+
+	return gzip.NewReader(httpResp.Body)
+}
+
+func (cs *cfsServer) runClient() error {
+	cred, err := cs.clientCredential()
+	if err != nil {
+		return err
+	}
+
+	conf := cs.conf
+	return retryMount(conf.MountRetryCount, conf.MountRetryInterval, conf.MountTimeout, func(ctx context.Context) error {
+		return mountVolume(ctx, cs.clientArgs, cs.clientStdin, cred)
+	}, func() {
+		cleanupStuckMount(cs.clientConf[KMountPoint])
+	})
+}
+
+// clientCredential returns the credential to run the client with, which is
+// nil if the client runs as the driver. The gid defaults to the uid.
+func (cs *cfsServer) clientCredential() (*syscall.Credential, error) {
+	uidValue, gidValue := cs.clientConf[KClientUID], cs.clientConf[KClientGID]
+	if len(uidValue) == 0 && len(gidValue) == 0 {
+		return nil, nil
+	}
+
+	if len(uidValue) == 0 {
+		return nil, fmt.Errorf("%s is required with %s", KClientUID, KClientGID)
+	}
+
+	uid, err := strconv.ParseUint(uidValue, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q, must be a numeric uid", KClientUID, uidValue)
+	}
+
+	gid := uid
+	if len(gidValue) != 0 {
+		if gid, err = strconv.ParseUint(gidValue, 10, 32); err != nil {
+			return nil, fmt.Errorf("invalid %s %q, must be a numeric gid", KClientGID, gidValue)
+		}
+	}
+
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+// checkMaster checks whether the master at addr is reachable and answers requests.
+func (cs *cfsServer) checkMaster(addr string) error {
+	resp, err := cs.executeRequest(cs.masterURL(addr, "/admin/getIp"))
+	if err != nil {
+		return err
+	}
+
+	if resp.Code != 0 {
+		return fmt.Errorf("code:%v, msg:%v", resp.Code, resp.Msg)
+	}
+
+	return nil
+}
+
+// checkMasterQuorum refuses a mutating request unless at least MasterQuorum
+// masters are reachable, as a cluster with most masters gone may be split.
+func (cs *cfsServer) checkMasterQuorum(stage string) error {
+	quorum := cs.conf.MasterQuorum
+	if quorum <= 0 {
+		return nil
+	}
+
+	addrs := cs.writeMasterAddrs()
+	if len(addrs) < quorum {
+		return status.Errorf(codes.FailedPrecondition, "%s: only %d masters configured, less than the quorum %d",
+			stage, len(addrs), quorum)
+	}
+
+	reachable := 0
+	for i, addr := range addrs {
+		if err := cs.checkMaster(addr); err != nil {
+			glog.Warningf("%s: master %s is unreachable, err: %v", stage, addr, err)
+		} else {
+			reachable++
+		}
+
+		if reachable >= quorum {
+			return nil
+		}
+
+		// stop early once the quorum cannot be reached anymore
+		if reachable+len(addrs)-i-1 < quorum {
+			break
+		}
+	}
+
+	return status.Errorf(codes.FailedPrecondition, "%s: only %d of %d masters reachable, less than the quorum %d",
+		stage, reachable, len(addrs), quorum)
+}
+
+// getVolume queries the volume from the master. A codes.NotFound error is
+// returned if the volume does not exist.
+func (cs *cfsServer) getVolume() (view *cfsVolumeView, err error) {
+	authKey, err := cs.getAuthKey()
+	if err != nil {
+		return nil, err
+	}
+
+	volName := cs.clientConf[KVolumeName]
+	err = cs.retryOnTransient("GetVolume", func() error {
+		return cs.forEachReadMasterAddr("GetVolume", func(addr string) error {
+			url := cs.masterURL(addr, fmt.Sprintf("/admin/getVol?name=%s&authKey=%v", volName, authKey))
+			resp, err := cs.executeRequest(url)
+			if err != nil {
+				return err
+			}
+
+			if resp.Code == ErrCodeVolNotExists {
+				return status.Errorf(codes.NotFound, "volume[%v] not exists", volName)
+			}
+
+			if resp.Code == ErrCodeAuthKeyMismatch {
+				return cs.authKeyMismatchError(resp.Msg)
+			}
+
+			if resp.Code != 0 {
+				return status.Errorf(codes.Internal, "get volume[%v] failed, code:%v, msg:%v", volName, resp.Code, resp.Msg)
+			}
+
+			view = &cfsVolumeView{}
+			if err := json.Unmarshal(resp.Data, view); err != nil {
+				return status.Errorf(codes.Internal, "unmarshal volume[%v] view failed: %v", volName, err)
+			}
+
+			return nil
+		})
+	})
+
+	return view, err
+}
+
+// listVolumes lists all the volumes of the cluster.
+func (cs *cfsServer) listVolumes() (vols []*cfsVolumeInfo, err error) {
+	err = cs.streamVolumes("", func() func(vol *cfsVolumeInfo) {
+		vols = nil
+		return func(vol *cfsVolumeInfo) {
+			vols = append(vols, vol)
+		}
+	})
+
+	return vols, err
+}
+
+// streamVolumes lists all the volumes of the cluster without holding the list
+// in memory: the volumes are decoded one by one from the response, and passed
+// to the visitor returned by newVisitor. As a list may fail halfway, a new
+// visitor is requested for every attempt. The query is appended to the list
+// request, e.g. to paginate it on the master.
+func (cs *cfsServer) streamVolumes(query string, newVisitor func() func(vol *cfsVolumeInfo)) error {
+	return cs.retryOnTransient("ListVolumes", func() error {
+		return cs.forEachReadMasterAddr("ListVolumes", func(addr string) error {
+			url := cs.masterURL(addr, fmt.Sprintf("/admin/listVols?keywords=%s", query))
+			httpResp, err := cs.sendRequest(url)
+			if err != nil {
+				return err
+			}
+
+			defer httpResp.Body.Close()
+			if httpResp.StatusCode != http.StatusOK {
+				body, _ := ioutil.ReadAll(io.LimitReader(httpResp.Body, maxBodySnippetLength))
+				return status.Errorf(codes.Internal, "master responded with http status %v, url(%v) body(%v)",
+					httpResp.StatusCode, url, bodySnippet(body))
+			}
+
+			body, err := responseBodyReader(httpResp)
+			if err != nil {
+				return status.Errorf(codes.Unavailable, "read http response body, url(%v) err(%v)", url, err)
+			}
+
+			code, msg, err := decodeVolumeList(body, newVisitor())
+			if err != nil {
+				// a truncated response is retried, while a malformed one is not
+				var syntaxErr *json.SyntaxError
+				if errors.As(err, &syntaxErr) || errors.Is(err, io.ErrUnexpectedEOF) {
+					return status.Errorf(codes.Unavailable, "decode volume list failed, url(%v) err(%v)", url, err)
+				}
+				return status.Errorf(codes.Internal, "decode volume list failed, url(%v) err(%v)", url, err)
+			}
+
+			if code != 0 {
+				return status.Errorf(codes.Internal, "list volumes failed, code:%v, msg:%v", code, msg)
+			}
+
+			return nil
+		})
+	})
+}
+
+// pageQuery returns the query listing at most limit volumes from offset on
+// the masters paginating the list, no limit is set if it is not positive.
+func pageQuery(offset, limit int) string {
+	query := fmt.Sprintf("&offset=%d", offset)
+	if limit > 0 {
+		query += fmt.Sprintf("&limit=%d", limit)
+	}
+	return query
+}
+
+// decodeVolumeList decodes a master response listing volumes, passing every
+// volume of the data array to visit as soon as it is decoded.
+func decodeVolumeList(r io.Reader, visit func(vol *cfsVolumeInfo)) (code int, msg string, err error) {
+	dec := json.NewDecoder(r)
+	if err = expectDelim(dec, '{'); err != nil {
+		return
+	}
+
+	for dec.More() {
+		var key json.Token
+		if key, err = dec.Token(); err != nil {
+			return
+		}
+
+		switch key {
+		case "code":
+			err = dec.Decode(&code)
+		case "msg":
+			err = dec.Decode(&msg)
+		case "data":
+			err = decodeVolumeArray(dec, visit)
+		default:
+			var ignored json.RawMessage
+			err = dec.Decode(&ignored)
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	err = expectDelim(dec, '}')
+	return
+}
+
+// decodeVolumeArray decodes the data of a list response, which is not an
+// array if the list failed.
+func decodeVolumeArray(dec *json.Decoder, visit func(vol *cfsVolumeInfo)) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	if delim, ok := token.(json.Delim); !ok {
+		return nil
+	} else if delim != '[' {
+		return fmt.Errorf("unexpected %v in the volume list", delim)
+	}
+
+	for dec.More() {
+		vol := &cfsVolumeInfo{}
+		if err := dec.Decode(vol); err != nil {
+			return err
+		}
+		visit(vol)
+	}
+
+	return expectDelim(dec, ']')
+}
+
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	if delim, ok := token.(json.Delim); !ok || delim != want {
+		return fmt.Errorf("expected %v, got %v", want, token)
+	}
+
+	return nil
+}
+
+// cfsNodeStatInfo is the usage of the data or meta nodes of the cluster.
+type cfsNodeStatInfo struct {
+	TotalGB uint64 `json:"TotalGB"`
+	UsedGB  uint64 `json:"UsedGB"`
+}
+
+// metaNodeStat returns the usage of the meta nodes, which hold the inodes in
+// memory and thus bound the inodes the cluster can serve.
+func (cs *cfsServer) metaNodeStat() (stat *cfsNodeStatInfo, err error) {
+	err = cs.retryOnTransient("GetCluster", func() error {
+		return cs.forEachReadMasterAddr("GetCluster", func(addr string) error {
+			resp, err := cs.executeRequest(cs.masterURL(addr, "/admin/getCluster"))
+			if err != nil {
+				return err
+			}
+
+			if resp.Code != 0 {
+				return status.Errorf(codes.Internal, "get cluster failed, code:%v, msg:%v", resp.Code, resp.Msg)
+			}
+
+			view := struct {
+				MetaNodeStatInfo *cfsNodeStatInfo `json:"MetaNodeStatInfo"`
+			}{}
+			if err := json.Unmarshal(resp.Data, &view); err != nil {
+				return status.Errorf(codes.Internal, "unmarshal cluster view failed: %v", err)
+			}
+
+			stat = view.MetaNodeStatInfo
+			return nil
+		})
+	})
+
+	return stat, err
+}
+
+// checkInodeHeadroom fails with ResourceExhausted if the meta nodes of the
+// cluster are used up to maxRatio, as new volumes would run out of inodes.
+func (cs *cfsServer) checkInodeHeadroom(maxRatio float64) error {
+	stat, err := cs.metaNodeStat()
+	if err != nil {
+		return err
+	}
+
+	if stat == nil || stat.TotalGB == 0 {
+		glog.Warningf("no meta node usage reported by the master, skip the inode headroom check")
+		return nil
+	}
+
+	if ratio := float64(stat.UsedGB) / float64(stat.TotalGB); ratio >= maxRatio {
+		return status.Errorf(codes.ResourceExhausted, "meta nodes of the cluster are %.0f%% used (%v/%vGB), reaching the limit %.0f%%",
+			ratio*100, stat.UsedGB, stat.TotalGB, maxRatio*100)
+	}
+
+	return nil
+}
+
+func (cs *cfsServer) expandVolume(capacityGB int64) (err error) {
+	authKey, err := cs.getAuthKey()
+	if err != nil {
+		return err
+	}
+
+	if err := cs.checkMasterQuorum("ExpandVolume"); err != nil {
+		return err
+	}
+
+	// getVolume authenticates with the same authKey, so that a drifted owner
+	// fails here with a FailedPrecondition rather than as a failed expand
+	volName := cs.clientConf[KVolumeName]
+	view, err := cs.getVolume()
+	if err != nil {
+		return err
+	}
+
+	if view.Capacity >= capacityGB {
+		glog.Infof("volume[%v] capacity %vGB already satisfies %vGB, skip expanding", volName, view.Capacity, capacityGB)
+		return nil
+	}
+
+	if cs.conf.ExpandCapacityCheck {
+		if err := cs.checkExpandCapacity(view, capacityGB); err != nil {
+			return err
+		}
+	}
+
+	return cs.retryOnTransient("ExpandVolume", func() error {
+		return cs.forEachMasterAddr("ExpandVolume", func(addr string) error {
+			url := cs.masterURL(addr, fmt.Sprintf("/vol/expand?name=%s&authKey=%v&capacity=%v", volName, authKey, capacityGB))
+			glog.Infof("expandVolume url: %v", redactAuthKey(url))
+			resp, err := cs.executeRequest(url)
+			if err != nil {
+				return err
+			}
+
+			if resp.Code != 0 {
+				return status.Errorf(codes.Internal, "expand volume[%v] failed, code:%v, msg:%v", volName, resp.Code, resp.Msg)
+			}
+
+			return nil
+		})
+	})
+}
+
+// authKeyMismatchError explains the master rejecting the authKey, which is
+// usually derived from an owner differing from the one the volume was created
+// with, e.g. after the volume attributes lost it.
+func (cs *cfsServer) authKeyMismatchError(msg string) error {
+	volName := cs.clientConf[KVolumeName]
+	if len(cs.secretAuthKey) != 0 {
+		return status.Errorf(codes.FailedPrecondition, "the master rejected the authKey of volume[%v] from the secret: %v. "+
+			"put the authKey of the volume owner into the %s of the secret", volName, msg, secretAuthKey)
+	}
+
+	return status.Errorf(codes.FailedPrecondition, "the master rejected the authKey derived from the owner of volume[%v]: %v. "+
+		"set the %s volume attribute of the PersistentVolume to the owner the volume was created with, "+
+		"or put its authKey into the %s of the secret", volName, redactAuthKey(msg), KOwner, secretAuthKey)
+}
+
+// getAuthKey returns the authKey of the volume, which is taken from the CSI
+// secrets if provided, or derived from the owner otherwise.
+func (cs *cfsServer) getAuthKey() (string, error) {
+	if len(cs.secretAuthKey) != 0 {
+		return cs.secretAuthKey, nil
+	}
+
+	return cs.getOwnerMd5()
+}
+
+var authKeyPattern = regexp.MustCompile(`([?&])(authKey|owner)=[^&)\s]*`)
+
+// redactAuthKey hides the authKey in a master url to be logged or put in an
+// error, along with the owner, whose md5 is the authKey.
+func redactAuthKey(url string) string {
+	return authKeyPattern.ReplaceAllString(url, "${1}${2}=***")
+}
+
 func (cs *cfsServer) getOwnerMd5() (string, error) {
 	owner := cs.clientConf[KOwner]
 	key := md5.New()
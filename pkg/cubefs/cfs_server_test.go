@@ -0,0 +1,1249 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cubefs/cubefs-csi/pkg/mockmaster"
+	"github.com/golang/glog"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var fakeConfig = Config{
+	MasterRetryCount:    3,
+	MasterRetryInterval: time.Millisecond,
+}
+
+// newFakeCfsServer returns a cfsServer talking to a master served by handler.
+func newFakeCfsServer(t *testing.T, handler http.HandlerFunc) *cfsServer {
+	master := httptest.NewServer(handler)
+	t.Cleanup(master.Close)
+
+	conf := fakeConfig
+	cs, err := newCfsServer("pvc-fake", map[string]string{
+		KMasterAddr: master.Listener.Addr().String(),
+		KOwner:      "csiuser",
+	}, &conf)
+	assert.NoError(t, err)
+	return cs
+}
+
+func writeMasterResponse(w http.ResponseWriter, code int, msg string) {
+	fmt.Fprintf(w, `{"code":%d,"msg":%q,"data":""}`, code, msg)
+}
+
+func TestDeleteVolumeRetryTransient(t *testing.T) {
+	var calls int32
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writeMasterResponse(w, 0, "success")
+	})
+
+	assert.NoError(t, cs.deleteVolume())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestDeleteVolumeRetryExhausted(t *testing.T) {
+	var calls int32
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	assert.Error(t, cs.deleteVolume())
+	assert.Equal(t, int32(fakeConfig.MasterRetryCount+1), atomic.LoadInt32(&calls))
+}
+
+func TestDeleteVolumeRetryableCodes(t *testing.T) {
+	var calls int32
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			writeMasterResponse(w, ErrCodePersistenceByRaft, "raft persistence failed")
+			return
+		}
+		writeMasterResponse(w, 0, "success")
+	})
+
+	// the code is not retried unless configured
+	assert.Error(t, cs.deleteVolume())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	atomic.StoreInt32(&calls, 0)
+	cs.conf.MasterRetryableCodes = []int{ErrCodePersistenceByRaft, 12}
+	assert.NoError(t, cs.deleteVolume())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	assert.False(t, cs.masterClient().isRetryableCode(0))
+	assert.True(t, cs.masterClient().isRetryableCode(12))
+	assert.False(t, cs.masterClient().isRetryableCode(ErrCodeVolNotExists))
+}
+
+func TestExpandVolumeRetryableCodes(t *testing.T) {
+	var expands int32
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/admin/getVol" {
+			fmt.Fprint(w, `{"code":0,"msg":"success","data":{"Name":"pvc-fake","Capacity":5}}`)
+			return
+		}
+		if atomic.AddInt32(&expands, 1) < 3 {
+			writeMasterResponse(w, ErrCodePersistenceByRaft, "raft persistence failed")
+			return
+		}
+		writeMasterResponse(w, 0, "success")
+	})
+
+	cs.conf.MasterRetryableCodes = []int{ErrCodePersistenceByRaft}
+	assert.NoError(t, cs.expandVolume(10))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&expands))
+
+	// the other codes fail the expand at once
+	atomic.StoreInt32(&expands, 0)
+	cs.conf.MasterRetryableCodes = nil
+	err := cs.expandVolume(10)
+	assert.Equal(t, codes.Internal, status.Code(err))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&expands))
+}
+
+func TestDeleteVolumePermanentFailure(t *testing.T) {
+	var calls int32
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		writeMasterResponse(w, 2, "auth key not match")
+	})
+
+	assert.Error(t, cs.deleteVolume())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestDeleteVolumeNotExists(t *testing.T) {
+	var calls int32
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		writeMasterResponse(w, ErrCodeVolNotExists, "vol not exists")
+	})
+
+	assert.NoError(t, cs.deleteVolume())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestCreateVolumeRetryTransient(t *testing.T) {
+	var calls int32
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeMasterResponse(w, 1, ErrDuplicateVolMsg)
+	})
+
+	assert.NoError(t, cs.createVolume(1))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestBackoffWithJitter(t *testing.T) {
+	for attempt := 0; attempt < 5; attempt++ {
+		d := time.Second << uint(attempt)
+		delay := backoffWithJitter(time.Second, attempt)
+		assert.True(t, delay >= d/2 && delay <= d, "attempt %d delay %v", attempt, delay)
+	}
+
+	assert.Equal(t, time.Duration(0), backoffWithJitter(0, 3))
+	assert.True(t, backoffWithJitter(time.Second, 100) > 0)
+}
+
+func TestInitDirs(t *testing.T) {
+	cs := &cfsServer{clientConf: map[string]string{}}
+	dirs, _, err := cs.initDirs()
+	assert.NoError(t, err)
+	assert.Empty(t, dirs)
+
+	cs.clientConf[KInitDirs] = "data, logs/app,,"
+	dirs, mode, err := cs.initDirs()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"data", "logs/app"}, dirs)
+	assert.Equal(t, os.FileMode(0755), mode)
+
+	cs.clientConf[KInitDirsMode] = "0700"
+	_, mode, err = cs.initDirs()
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), mode)
+
+	for _, m := range []string{"rwx", "0999", "7777"} {
+		cs.clientConf[KInitDirsMode] = m
+		_, _, err = cs.initDirs()
+		assert.Error(t, err, "mode %q", m)
+	}
+
+	cs.clientConf[KInitDirsMode] = ""
+	for _, d := range []string{"data,../escape", "/etc", "data/../../escape"} {
+		cs.clientConf[KInitDirs] = d
+		_, _, err = cs.initDirs()
+		assert.Error(t, err, "dirs %q", d)
+	}
+}
+
+func TestMasterHeaders(t *testing.T) {
+	var header http.Header
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		writeMasterResponse(w, 0, "success")
+	})
+	cs.conf.MasterHeaders = map[string]string{"X-Route": "csi"}
+	cs.applySecrets(map[string]string{
+		secretMasterHeaderPrefix + "X-Api-Key": "secret-key",
+		"unrelated":                            "value",
+	})
+
+	assert.NoError(t, cs.deleteVolume())
+	assert.Equal(t, "csi", header.Get("X-Route"))
+	assert.Equal(t, "secret-key", header.Get("X-Api-Key"))
+	assert.Empty(t, header.Get("unrelated"))
+}
+
+func TestExpandVolumeNotExists(t *testing.T) {
+	var expanded int32
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/vol/expand" {
+			atomic.AddInt32(&expanded, 1)
+		}
+		writeMasterResponse(w, ErrCodeVolNotExists, "vol not exists")
+	})
+
+	err := cs.expandVolume(10)
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&expanded))
+}
+
+func TestExpandVolumeAlreadyExpanded(t *testing.T) {
+	var expanded int32
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/admin/getVol":
+			fmt.Fprint(w, `{"code":0,"msg":"success","data":{"Name":"pvc-fake","Capacity":10}}`)
+		case "/vol/expand":
+			atomic.AddInt32(&expanded, 1)
+			writeMasterResponse(w, 0, "success")
+		}
+	})
+
+	assert.NoError(t, cs.expandVolume(10))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&expanded))
+
+	assert.NoError(t, cs.expandVolume(20))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&expanded))
+}
+
+func TestExpandVolumeAuthKeyCheck(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+	master.PutVolume(mockmaster.Volume{Name: "pvc-drift", Owner: "csi_1700000000", CapacityGB: 10})
+
+	newServer := func(owner string) *cfsServer {
+		conf := fakeConfig
+		cs, err := newCfsServer("pvc-drift", map[string]string{KMasterAddr: master.Addr(), KOwner: owner}, &conf)
+		assert.NoError(t, err)
+		return cs
+	}
+
+	// the owner drifted, the expand is not attempted
+	err := newServer("csi_1700000001").expandVolume(20)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	// the owner is a secret of the volume, it is not put in the error
+	assert.NotContains(t, err.Error(), "csi_1700000001")
+	assert.Contains(t, err.Error(), "set the owner volume attribute")
+	vol, _ := master.Volume("pvc-drift")
+	assert.Equal(t, uint64(10), vol.CapacityGB)
+
+	cs := newServer("csi_1700000001")
+	cs.applySecrets(map[string]string{secretAuthKey: "wrong"})
+	err = cs.expandVolume(20)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "from the secret")
+
+	cs = newServer("csi_1700000001")
+	cs.applySecrets(map[string]string{secretAuthKey: mockmaster.AuthKey("csi_1700000000")})
+	assert.NoError(t, cs.expandVolume(20))
+
+	assert.NoError(t, newServer("csi_1700000000").expandVolume(30))
+	vol, _ = master.Volume("pvc-drift")
+	assert.Equal(t, uint64(30), vol.CapacityGB)
+}
+
+func TestMasterQuorum(t *testing.T) {
+	newMasters := func(up, down int) []string {
+		var addrs []string
+		for i := 0; i < up+down; i++ {
+			master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeMasterResponse(w, 0, "success")
+			}))
+			addrs = append(addrs, master.Listener.Addr().String())
+			if i < up {
+				t.Cleanup(master.Close)
+			} else {
+				master.Close()
+			}
+		}
+		return addrs
+	}
+
+	for _, tc := range []struct {
+		up, down, quorum int
+		ok               bool
+	}{
+		{up: 1, down: 2, quorum: 0, ok: true},
+		{up: 3, down: 0, quorum: 2, ok: true},
+		{up: 2, down: 1, quorum: 2, ok: true},
+		{up: 1, down: 2, quorum: 2, ok: false},
+		{up: 0, down: 3, quorum: 1, ok: false},
+		{up: 2, down: 0, quorum: 3, ok: false},
+	} {
+		conf := fakeConfig
+		conf.MasterQuorum = tc.quorum
+		cs := &cfsServer{masterAddrs: newMasters(tc.up, tc.down), conf: &conf}
+
+		err := cs.checkMasterQuorum("CreateVolume")
+		if tc.ok {
+			assert.NoError(t, err, "%+v", tc)
+		} else {
+			assert.Equal(t, codes.FailedPrecondition, status.Code(err), "%+v", tc)
+		}
+	}
+}
+
+func TestDeleteVolumeWithoutQuorum(t *testing.T) {
+	var deleted int32
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/vol/delete" {
+			atomic.AddInt32(&deleted, 1)
+		}
+		writeMasterResponse(w, 0, "success")
+	})
+	cs.conf.MasterQuorum = 2
+
+	assert.Equal(t, codes.FailedPrecondition, status.Code(cs.deleteVolume()))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&deleted))
+
+	cs.conf.MasterQuorum = 1
+	assert.NoError(t, cs.deleteVolume())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&deleted))
+}
+
+func TestSecretAuthKey(t *testing.T) {
+	var authKeys []string
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		authKeys = append(authKeys, r.URL.Query().Get("authKey"))
+		writeMasterResponse(w, 0, "success")
+	})
+
+	ownerMd5, err := cs.getOwnerMd5()
+	assert.NoError(t, err)
+	assert.NoError(t, cs.deleteVolume())
+
+	cs.applySecrets(map[string]string{secretAuthKey: "rotated-key"})
+	assert.NoError(t, cs.deleteVolume())
+	assert.Equal(t, []string{ownerMd5, "rotated-key"}, authKeys)
+}
+
+func TestRedactAuthKey(t *testing.T) {
+	assert.Equal(t, "http://m:17010/vol/expand?name=v&authKey=***&capacity=10",
+		redactAuthKey("http://m:17010/vol/expand?name=v&authKey=secret&capacity=10"))
+	assert.Equal(t, "http://m:17010/vol/delete?name=v&authKey=***",
+		redactAuthKey("http://m:17010/vol/delete?name=v&authKey=secret"))
+	assert.Equal(t, "create volume failed: url(http://m:17010/admin/createVol?name=v&owner=***&capacity=1) code=(1)",
+		redactAuthKey("create volume failed: url(http://m:17010/admin/createVol?name=v&owner=csiuser&capacity=1) code=(1)"))
+	assert.Equal(t, "url(http://m:17010/admin/createVol?name=v&owner=***) code=(1)",
+		redactAuthKey("url(http://m:17010/admin/createVol?name=v&owner=csiuser) code=(1)"))
+
+	cs := &cfsServer{conf: &fakeConfig}
+	_, err := cs.executeRequest("http://127.0.0.1:1/vol/delete?name=v&authKey=secret")
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), "secret")
+}
+
+// captureStderr returns what f logs, which is logged to stderr too meanwhile.
+// The file descriptor is redirected, as glog keeps the os.Stderr it started with.
+func captureStderr(t *testing.T, f func()) string {
+	assert.NoError(t, flag.Set("alsologtostderr", "true"))
+	defer func() { assert.NoError(t, flag.Set("alsologtostderr", "false")) }()
+
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	saved, err := unix.Dup(int(os.Stderr.Fd()))
+	assert.NoError(t, err)
+	assert.NoError(t, unix.Dup3(int(w.Fd()), int(os.Stderr.Fd()), 0))
+	defer func() {
+		assert.NoError(t, unix.Dup3(saved, int(os.Stderr.Fd()), 0))
+		unix.Close(saved)
+	}()
+
+	output := make(chan string)
+	go func() {
+		content, _ := ioutil.ReadAll(r)
+		output <- string(content)
+	}()
+
+	f()
+	glog.Flush()
+	assert.NoError(t, unix.Dup3(saved, int(os.Stderr.Fd()), 0))
+	assert.NoError(t, w.Close())
+	return <-output
+}
+
+func TestCreateVolumeRedactsOwner(t *testing.T) {
+	const owner = "owner-7f3a9c"
+	var msg string
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeMasterResponse(w, 1, msg)
+	}))
+	t.Cleanup(master.Close)
+
+	conf := fakeConfig
+	cs, err := newCfsServer("pvc-fake", map[string]string{KMasterAddr: master.Listener.Addr().String(), KOwner: owner}, &conf)
+	assert.NoError(t, err)
+
+	logged := captureStderr(t, func() {
+		msg = ErrDuplicateVolMsg
+		assert.NoError(t, cs.createVolume(1))
+
+		msg = "no space left"
+		err = cs.createVolume(1)
+	})
+	assert.Error(t, err)
+	assert.NotContains(t, err.Error(), owner)
+	assert.Contains(t, logged, "createVol url")
+	assert.Contains(t, logged, "duplicate to create volume")
+	assert.NotContains(t, logged, owner)
+}
+
+func TestGzipMasterResponse(t *testing.T) {
+	const body = `{"code":0,"msg":"success","data":{"Name":"pvc-fake","Owner":"csiuser","Capacity":10}}`
+	for _, compressed := range []bool{true, false} {
+		cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "gzip", r.Header.Get("Accept-Encoding"))
+			if !compressed {
+				fmt.Fprint(w, body)
+				return
+			}
+
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			fmt.Fprint(gz, body)
+			assert.NoError(t, gz.Close())
+		})
+
+		view, err := cs.getVolume()
+		assert.NoError(t, err, "compressed %v", compressed)
+		assert.Equal(t, &cfsVolumeView{Name: "pvc-fake", Owner: "csiuser", Capacity: 10}, view)
+	}
+}
+
+func TestCorruptGzipMasterResponse(t *testing.T) {
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		fmt.Fprint(w, `{"code":0}`)
+	})
+
+	_, err := cs.executeRequest("http://" + cs.masterAddrs[0] + "/admin/getIp")
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestUnexpectedMasterResponse(t *testing.T) {
+	htmlPage := "<html><head><title>404 Not Found</title></head><body>" + strings.Repeat("nginx ", 100) + "</body></html>"
+	for _, tc := range []struct {
+		name        string
+		status      int
+		contentType string
+		body        string
+		code        codes.Code
+		contains    []string
+	}{
+		{name: "html error page", status: http.StatusNotFound, body: htmlPage, code: codes.Internal,
+			contains: []string{"non-JSON response", "http status 404", "<title>404 Not Found</title>", "..."}},
+		{name: "html with 200", status: http.StatusOK, body: htmlPage, code: codes.Unavailable,
+			contains: []string{"non-JSON response", "http status 200", "<html>"}},
+		{name: "html gateway error", status: http.StatusBadGateway, contentType: "text/html; charset=utf-8",
+			body: "\n<html><body><h1>502 Bad Gateway</h1></body></html>", code: codes.Unavailable,
+			contains: []string{"non-JSON response", "http status 502", `content type "text/html; charset=utf-8"`, "502 Bad Gateway"}},
+		{name: "html content type", status: http.StatusBadGateway, contentType: "text/html", body: "bad gateway",
+			code: codes.Unavailable, contains: []string{"non-JSON response", "http status 502", "bad gateway"}},
+		{name: "truncated json", status: http.StatusOK, body: `{"code":0,"msg":"succ`, code: codes.Unavailable,
+			contains: []string{"http status(200)", `{\"code\":0,\"msg\":\"succ`, "unexpected end of JSON input"}},
+		{name: "gateway error", status: http.StatusBadGateway, body: "upstream unreachable", code: codes.Unavailable,
+			contains: []string{"http status 502", "upstream unreachable"}},
+	} {
+		cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+			if len(tc.contentType) != 0 {
+				w.Header().Set("Content-Type", tc.contentType)
+			}
+			w.WriteHeader(tc.status)
+			fmt.Fprint(w, tc.body)
+		})
+
+		_, err := cs.executeRequest("http://" + cs.masterAddrs[0] + "/admin/getIp")
+		assert.Equal(t, tc.code, status.Code(err), tc.name)
+		for _, s := range tc.contains {
+			assert.Contains(t, err.Error(), s, tc.name)
+		}
+		assert.Less(t, len(err.Error()), 2*maxBodySnippetLength, tc.name)
+	}
+}
+
+func TestMasterHTTPClientReusesConnections(t *testing.T) {
+	var conns int32
+	master := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeMasterResponse(w, 0, "success")
+	}))
+	master.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	master.Start()
+	t.Cleanup(master.Close)
+
+	conf := fakeConfig
+	conf.MasterMaxIdleConns = 10
+	conf.MasterMaxIdleConnsPerHost = 2
+	conf.MasterIdleConnTimeout = time.Minute
+	conf.masterClient = newMasterClient(&conf, newMasterHTTPClient(&conf))
+	for i := 0; i < 5; i++ {
+		cs, err := newCfsServer(fmt.Sprintf("pvc-%d", i), map[string]string{
+			KMasterAddr: master.Listener.Addr().String(),
+		}, &conf)
+		assert.NoError(t, err)
+		assert.NoError(t, cs.checkMaster(cs.masterAddrs[0]))
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns))
+}
+
+func BenchmarkMasterRequest(b *testing.B) {
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeMasterResponse(w, 0, "success")
+	}))
+	defer master.Close()
+
+	conf := fakeConfig
+	conf.MasterMaxIdleConnsPerHost = 2
+	conf.masterClient = newMasterClient(&conf, newMasterHTTPClient(&conf))
+	cs, err := newCfsServer("pvc-bench", map[string]string{KMasterAddr: master.Listener.Addr().String()}, &conf)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := cs.checkMaster(cs.masterAddrs[0]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestClientCredential(t *testing.T) {
+	cs := &cfsServer{clientConf: map[string]string{}}
+	cred, err := cs.clientCredential()
+	assert.NoError(t, err)
+	assert.Nil(t, cred)
+
+	cs.clientConf[KClientUID] = "1000"
+	cred, err = cs.clientCredential()
+	assert.NoError(t, err)
+	assert.Equal(t, &syscall.Credential{Uid: 1000, Gid: 1000}, cred)
+
+	cs.clientConf[KClientGID] = "2000"
+	cred, err = cs.clientCredential()
+	assert.NoError(t, err)
+	assert.Equal(t, &syscall.Credential{Uid: 1000, Gid: 2000}, cred)
+
+	for _, ids := range [][2]string{{"", "2000"}, {"nobody", ""}, {"-1", ""}, {"1000", "staff"}, {"4294967296", ""}} {
+		cs.clientConf[KClientUID], cs.clientConf[KClientGID] = ids[0], ids[1]
+		_, err = cs.clientCredential()
+		assert.Error(t, err, "ids %v", ids)
+	}
+}
+
+func TestMasterRedirectKeepsHeaders(t *testing.T) {
+	var leaderHeader http.Header
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leaderHeader = r.Header.Clone()
+		writeMasterResponse(w, 0, "success")
+	}))
+	t.Cleanup(leader.Close)
+
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		// the leader is addressed by another host, for which the http client drops the auth headers by default
+		location := strings.Replace(leader.URL, "127.0.0.1", "localhost", 1) + r.URL.RequestURI()
+		http.Redirect(w, r, location, http.StatusTemporaryRedirect)
+	})
+	cs.conf.MasterHeaders = map[string]string{"Authorization": "Bearer token"}
+	cs.applySecrets(map[string]string{secretMasterHeaderPrefix + "X-Api-Key": "secret-key"})
+	cs.masterAddrs = append(cs.masterAddrs, strings.Replace(leader.Listener.Addr().String(), "127.0.0.1", "localhost", 1))
+
+	for _, client := range []*masterClient{nil, newMasterClient(cs.conf, newMasterHTTPClient(cs.conf))} {
+		leaderHeader = nil
+		cs.conf.masterClient = client
+		assert.NoError(t, cs.deleteVolume())
+		assert.Equal(t, "Bearer token", leaderHeader.Get("Authorization"))
+		assert.Equal(t, "secret-key", leaderHeader.Get("X-Api-Key"))
+	}
+}
+
+func TestMasterRedirectToOtherHost(t *testing.T) {
+	var otherCalls int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&otherCalls, 1)
+		writeMasterResponse(w, 0, "success")
+	}))
+	t.Cleanup(other.Close)
+
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, other.URL+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	})
+	cs.conf.MasterRetryCount = 0
+	cs.applySecrets(map[string]string{secretMasterHeaderPrefix + "X-Api-Key": "secret-key"})
+
+	err := cs.deleteVolume()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not a configured master")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&otherCalls))
+}
+
+func TestMasterRedirectDowngrade(t *testing.T) {
+	isMasterAddr := func(addr string) bool { return addr == "master:17010" }
+	ctx := context.WithValue(context.Background(), isMasterAddrKey{}, isMasterAddr)
+	newRequest := func(rawURL string) *http.Request {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+		assert.NoError(t, err)
+		return req
+	}
+
+	via := []*http.Request{newRequest("https://master:17010/vol/delete")}
+	assert.NoError(t, keepHeadersOnRedirect(newRequest("https://master:17010/vol/delete"), via))
+	assert.Error(t, keepHeadersOnRedirect(newRequest("http://master:17010/vol/delete"), via))
+	assert.Error(t, keepHeadersOnRedirect(newRequest("https://attacker:17010/vol/delete"), via))
+}
+
+func TestMasterRedirectLoop(t *testing.T) {
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	})
+
+	assert.Error(t, cs.checkMaster(cs.masterAddrs[0]))
+}
+
+func TestMasterLeaderHint(t *testing.T) {
+	var leaderPaths []string
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		leaderPaths = append(leaderPaths, r.URL.Path+"?name="+r.URL.Query().Get("name"))
+		writeMasterResponse(w, 0, "success")
+	}))
+	t.Cleanup(leader.Close)
+
+	var followerCalls int32
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&followerCalls, 1)
+		fmt.Fprintf(w, `{"code":1,"msg":"not leader","data":{"LeaderAddr":%q}}`, leader.Listener.Addr().String())
+	})
+
+	// a leader which is not a master of the volume is not sent the request
+	err := cs.deleteVolume()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Empty(t, leaderPaths)
+
+	atomic.StoreInt32(&followerCalls, 0)
+	cs.masterAddrs = append(cs.masterAddrs, leader.Listener.Addr().String())
+	assert.NoError(t, cs.deleteVolume())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&followerCalls))
+	assert.Equal(t, []string{"/vol/delete?name=pvc-fake"}, leaderPaths)
+
+	// a master naming itself is retried as unavailable
+	var calls int32
+	var self string
+	cs = newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		fmt.Fprintf(w, `{"code":1,"msg":"not leader","data":{"LeaderAddr":%q}}`, self)
+	})
+	self = cs.masterAddrs[0]
+	err = cs.deleteVolume()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, int32(fakeConfig.MasterRetryCount+1), atomic.LoadInt32(&calls))
+
+	// failures without a leader hint are returned as is
+	assert.Equal(t, "", leaderHint(&cfsServerResponse{Code: 1, Data: []byte(`""`)}))
+	assert.Equal(t, "", leaderHint(&cfsServerResponse{Code: 0, Data: []byte(`{"LeaderAddr":"10.0.0.2:17010"}`)}))
+	assert.Equal(t, "10.0.0.2:17010", leaderHint(&cfsServerResponse{Code: 1, Data: []byte(`{"LeaderAddr":"10.0.0.2:17010"}`)}))
+}
+
+func TestReadWriteMasterAddrs(t *testing.T) {
+	newMaster := func(paths *[]string) string {
+		master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			*paths = append(*paths, r.URL.Path)
+			switch r.URL.Path {
+			case "/admin/getVol":
+				fmt.Fprint(w, `{"code":0,"msg":"success","data":{"Name":"pvc-rw","Capacity":10}}`)
+			case "/admin/listVols":
+				fmt.Fprint(w, `{"code":0,"msg":"success","data":[]}`)
+			default:
+				writeMasterResponse(w, 0, "success")
+			}
+		}))
+		t.Cleanup(master.Close)
+		return master.Listener.Addr().String()
+	}
+
+	var clientPaths, readPaths, writePaths []string
+	conf := fakeConfig
+	cs, err := newCfsServer("pvc-rw", map[string]string{
+		KMasterAddr:      newMaster(&clientPaths),
+		KReadMasterAddr:  newMaster(&readPaths),
+		KWriteMasterAddr: newMaster(&writePaths),
+		KOwner:           "csiuser",
+	}, &conf)
+	assert.NoError(t, err)
+
+	assert.NoError(t, cs.createVolume(10))
+	_, err = cs.getVolume()
+	assert.NoError(t, err)
+	_, err = cs.listVolumes()
+	assert.NoError(t, err)
+	assert.NoError(t, cs.expandVolume(20))
+	assert.NoError(t, cs.deleteVolume())
+
+	assert.Empty(t, clientPaths)
+	assert.Equal(t, []string{"/admin/getVol", "/admin/listVols", "/admin/getVol"}, readPaths)
+	assert.Equal(t, []string{"/admin/createVol", "/vol/expand", "/vol/delete"}, writePaths)
+
+	// both default to masterAddr
+	cs, err = newCfsServer("pvc-rw", map[string]string{KMasterAddr: "10.0.0.1:17010"}, &conf)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:17010"}, cs.readMasterAddrs())
+	assert.Equal(t, []string{"10.0.0.1:17010"}, cs.writeMasterAddrs())
+}
+
+func TestDeleteVolumeAsync(t *testing.T) {
+	var deletes, polls int32
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/vol/delete":
+			atomic.AddInt32(&deletes, 1)
+			writeMasterResponse(w, 0, "success")
+		case "/admin/getVol":
+			// the volume is marked deleted for a few polls before it is gone
+			switch n := atomic.AddInt32(&polls, 1); {
+			case n == 1 && atomic.LoadInt32(&deletes) == 0:
+				fmt.Fprint(w, `{"code":0,"msg":"success","data":{"Name":"pvc-fake","Status":0}}`)
+			case n < 4:
+				fmt.Fprintf(w, `{"code":0,"msg":"success","data":{"Name":"pvc-fake","Status":%d}}`, volStatusMarkDelete)
+			default:
+				writeMasterResponse(w, ErrCodeVolNotExists, "vol not exists")
+			}
+		}
+	})
+
+	assert.NoError(t, cs.deleteVolumeAsync(context.Background(), time.Millisecond))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&deletes))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&polls))
+
+	// completed deletions are detected without deleting again
+	assert.NoError(t, cs.deleteVolumeAsync(context.Background(), time.Millisecond))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&deletes))
+}
+
+func TestDeleteVolumeAsyncDeadline(t *testing.T) {
+	var deletes int32
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/vol/delete":
+			atomic.AddInt32(&deletes, 1)
+			writeMasterResponse(w, 0, "success")
+		case "/admin/getVol":
+			fmt.Fprintf(w, `{"code":0,"msg":"success","data":{"Name":"pvc-fake","Status":%d}}`, volStatusMarkDelete)
+		}
+	})
+
+	// the deletion in progress is waited for without deleting again
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := cs.deleteVolumeAsync(ctx, time.Millisecond)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&deletes))
+}
+
+func TestCreateVolumeDescription(t *testing.T) {
+	var descriptions []string
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if values := r.URL.Query()["description"]; len(values) != 0 {
+			descriptions = append(descriptions, values[0])
+		}
+		writeMasterResponse(w, 0, "success")
+	})
+
+	cs.clientConf[KDescription] = " logs of team\x00 a\r\n & b\x1b "
+	assert.NoError(t, cs.createVolume(10))
+	assert.Equal(t, []string{"logs of team a & b"}, descriptions)
+	assert.Equal(t, "logs of team a & b", cs.clientConf[KDescription])
+
+	// a description of control characters only is dropped
+	cs.clientConf[KDescription] = "\t\n"
+	assert.NoError(t, cs.createVolume(10))
+	assert.Len(t, descriptions, 1)
+	_, ok := cs.clientConf[KDescription]
+	assert.False(t, ok)
+
+	cs.clientConf[KDescription] = strings.Repeat("说", maxDescriptionLength)
+	_, err := cs.descriptionQuery()
+	assert.NoError(t, err)
+	cs.clientConf[KDescription] = strings.Repeat("x", maxDescriptionLength+1)
+	assert.Equal(t, codes.InvalidArgument, status.Code(cs.createVolume(10)))
+	assert.Len(t, descriptions, 1)
+}
+
+func TestCreateVolumeDataPartitionCount(t *testing.T) {
+	var counts []string
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		counts = append(counts, r.URL.Query().Get("dpCount"))
+		writeMasterResponse(w, 0, "success")
+	})
+
+	assert.NoError(t, cs.createVolume(10))
+	cs.clientConf[KDataPartitionCount] = "30"
+	assert.NoError(t, cs.createVolume(10))
+	assert.Equal(t, []string{"", "30"}, counts)
+
+	for _, value := range []string{"0", "-1", "1001", "ten"} {
+		cs.clientConf[KDataPartitionCount] = value
+		assert.Equal(t, codes.InvalidArgument, status.Code(cs.createVolume(10)), value)
+	}
+	assert.Len(t, counts, 2)
+}
+
+func TestVolumeLifecycleWithMockMaster(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+
+	conf := fakeConfig
+	cs, err := newCfsServer("pvc-mock", map[string]string{
+		KMasterAddr:         master.Addr(),
+		KOwner:              "csiuser",
+		KDataPartitionCount: "20",
+	}, &conf)
+	assert.NoError(t, err)
+
+	assert.NoError(t, cs.createVolume(10))
+	vol, ok := master.Volume("pvc-mock")
+	assert.True(t, ok)
+	assert.Equal(t, "csiuser", vol.Owner)
+	assert.Equal(t, uint64(10), vol.CapacityGB)
+	assert.Equal(t, "20", vol.CreateQuery["dpCount"])
+
+	// creating again is idempotent
+	assert.NoError(t, cs.createVolume(10))
+
+	assert.NoError(t, cs.expandVolume(20))
+	view, err := cs.getVolume()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(20), view.Capacity)
+
+	vols, err := cs.listVolumes()
+	assert.NoError(t, err)
+	assert.Len(t, vols, 1)
+	assert.Equal(t, int64(20<<30), vols[0].TotalSize)
+
+	assert.NoError(t, cs.deleteVolume())
+	_, ok = master.Volume("pvc-mock")
+	assert.False(t, ok)
+	_, err = cs.getVolume()
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// deleting again is idempotent
+	assert.NoError(t, cs.deleteVolume())
+	assert.NoError(t, cs.deleteVolumeAsync(context.Background(), time.Millisecond))
+}
+
+func TestDeleteVolumeAuthFailureWithMockMaster(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+	master.PutVolume(mockmaster.Volume{Name: "pvc-other", Owner: "someone", CapacityGB: 10})
+
+	conf := fakeConfig
+	cs, err := newCfsServer("pvc-other", map[string]string{KMasterAddr: master.Addr(), KOwner: "csiuser"}, &conf)
+	assert.NoError(t, err)
+	assert.Error(t, cs.deleteVolume())
+	_, ok := master.Volume("pvc-other")
+	assert.True(t, ok)
+}
+
+func TestIdempotencyKeyStableAcrossRetries(t *testing.T) {
+	var keys []string
+	var requestURI string
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(idempotencyKeyHeader))
+		requestURI = r.URL.RequestURI()
+		if len(keys) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writeMasterResponse(w, 0, "success")
+	})
+
+	assert.NoError(t, cs.deleteVolume())
+	assert.Len(t, keys, 3)
+	assert.Equal(t, keys[0], keys[1])
+	assert.Equal(t, keys[0], keys[2])
+	assert.Equal(t, idempotencyKey("DeleteVolume", "pvc-fake", requestURI), keys[0])
+	assert.NotEqual(t, idempotencyKey("CreateVolume", "pvc-fake", requestURI), keys[0])
+	assert.NotEqual(t, idempotencyKey("DeleteVolume", "pvc-other", requestURI), keys[0])
+	// a request with other parameters is not coalesced, e.g. recreating a volume with another capacity
+	assert.NotEqual(t, idempotencyKey("CreateVolume", "pvc-fake", "/admin/createVol?name=pvc-fake&capacity=1"),
+		idempotencyKey("CreateVolume", "pvc-fake", "/admin/createVol?name=pvc-fake&capacity=2"))
+
+	// the key is only sent with the mutating requests
+	assert.Empty(t, cs.idempotencyKey)
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/admin/createVol" || r.URL.Path == "/vol/delete" {
+			// the response of a replay carries no meaningful result
+			w.Header().Set(idempotentReplayedHeader, "true")
+			writeMasterResponse(w, 1, "operation in progress")
+			return
+		}
+		writeMasterResponse(w, 0, "success")
+	})
+
+	assert.NoError(t, cs.createVolume(10))
+	assert.True(t, cs.created)
+	assert.NoError(t, cs.deleteVolume())
+}
+
+func TestMasterPathPrefix(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+
+	// a gateway serving the master under a path prefix, rejecting the other paths
+	var paths []string
+	target, err := url.Parse("http://" + master.Addr())
+	assert.NoError(t, err)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		http.StripPrefix("/cubefs/master", proxy).ServeHTTP(w, r)
+	}))
+	t.Cleanup(gateway.Close)
+
+	conf := fakeConfig
+	conf.MasterPathPrefix = "/cubefs/master"
+	cs, err := newCfsServer("pvc-prefix", map[string]string{
+		KMasterAddr: gateway.Listener.Addr().String(),
+		KOwner:      "csiuser",
+	}, &conf)
+	assert.NoError(t, err)
+
+	assert.NoError(t, cs.createVolume(10))
+	assert.NoError(t, cs.expandVolume(20))
+	vol, ok := master.Volume("pvc-prefix")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(20), vol.CapacityGB)
+
+	assert.NoError(t, cs.deleteVolume())
+	_, ok = master.Volume("pvc-prefix")
+	assert.False(t, ok)
+
+	for _, path := range []string{"/admin/createVol", "/vol/expand", "/vol/delete"} {
+		assert.Contains(t, paths, "/cubefs/master"+path)
+	}
+	for _, path := range paths {
+		assert.True(t, strings.HasPrefix(path, "/cubefs/master/"), path)
+	}
+}
+
+func TestDefaultCrossZone(t *testing.T) {
+	conf := fakeConfig
+	cs, err := newCfsServer("pvc-zone", map[string]string{KMasterAddr: "10.0.0.1:17010"}, &conf)
+	assert.NoError(t, err)
+	assert.Empty(t, cs.clientConf[KCrossZone])
+
+	conf.DefaultCrossZone = "true"
+	cs, err = newCfsServer("pvc-zone", map[string]string{KMasterAddr: "10.0.0.1:17010"}, &conf)
+	assert.NoError(t, err)
+	assert.Equal(t, "true", cs.clientConf[KCrossZone])
+
+	// the parameter wins over the default
+	cs, err = newCfsServer("pvc-zone", map[string]string{KMasterAddr: "10.0.0.1:17010", KCrossZone: "false"}, &conf)
+	assert.NoError(t, err)
+	assert.Equal(t, "false", cs.clientConf[KCrossZone])
+}
+
+func TestDefaultZone(t *testing.T) {
+	conf := fakeConfig
+	conf.DefaultZone = "zone-a"
+	cs, err := newCfsServer("pvc-zone", map[string]string{KMasterAddr: "10.0.0.1:17010"}, &conf)
+	assert.NoError(t, err)
+	assert.Equal(t, "zone-a", cs.clientConf[KZoneName])
+
+	// the parameter wins over the default
+	cs, err = newCfsServer("pvc-zone", map[string]string{KMasterAddr: "10.0.0.1:17010", KZoneName: "zone-b"}, &conf)
+	assert.NoError(t, err)
+	assert.Equal(t, "zone-b", cs.clientConf[KZoneName])
+
+	// as does the zone of the node pool
+	cs, err = newCfsServer("pvc-zone", map[string]string{KMasterAddr: "10.0.0.1:17010", KNodeSelector: "disktype=ssd"}, &conf)
+	assert.NoError(t, err)
+	assert.Empty(t, cs.clientConf[KZoneName])
+}
+
+func TestCreateVolumeReplicaNum(t *testing.T) {
+	var replicas []string
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		replicas = append(replicas, r.URL.Query().Get("replicaNum"))
+		writeMasterResponse(w, 0, "success")
+	})
+
+	assert.NoError(t, cs.createVolume(10))
+	for _, value := range []string{"2", "3"} {
+		cs.clientConf[KReplicaNum] = value
+		assert.NoError(t, cs.createVolume(10))
+	}
+	assert.Equal(t, []string{"", "2", "3"}, replicas)
+
+	for _, value := range []string{"0", "4", "two"} {
+		cs.clientConf[KReplicaNum] = value
+		assert.Equal(t, codes.InvalidArgument, status.Code(cs.createVolume(10)), value)
+	}
+
+	// erasure coded volumes have no replicas
+	cs.clientConf[KReplicaNum] = "3"
+	cs.clientConf[KVolType] = volTypeCold
+	err := cs.createVolume(10)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Contains(t, err.Error(), "not supported by volType 1")
+	assert.Len(t, replicas, 3)
+}
+
+// volumeListReader generates the master response listing count volumes, as
+// the master would stream it.
+type volumeListReader struct {
+	count, next int
+	pending     string
+	read        int64
+}
+
+func (r *volumeListReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		switch {
+		case r.next > r.count:
+			return 0, io.EOF
+		case r.next == r.count:
+			r.pending = "]}"
+		case r.next == 0:
+			r.pending = `{"code":0,"msg":"success","data":[{"Name":"pvc-0","TotalSize":1073741824}`
+		default:
+			r.pending = fmt.Sprintf(`,{"Name":"pvc-%d","TotalSize":1073741824}`, r.next)
+		}
+		r.next++
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	r.read += int64(n)
+	return n, nil
+}
+
+func TestDecodeVolumeListIncrementally(t *testing.T) {
+	const count = 100000
+	reader := &volumeListReader{count: count}
+	var visited int
+	var readAtFirst int64
+	code, msg, err := decodeVolumeList(reader, func(vol *cfsVolumeInfo) {
+		if visited == 0 {
+			readAtFirst = reader.read
+		}
+		assert.Equal(t, fmt.Sprintf("pvc-%d", visited), vol.Name)
+		visited++
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, code)
+	assert.Equal(t, "success", msg)
+	assert.Equal(t, count, visited)
+
+	// the first volume is visited long before the multi-MB response is read
+	assert.Greater(t, reader.read, int64(count*30))
+	assert.Less(t, readAtFirst, int64(64<<10))
+}
+
+func TestDecodeVolumeListFailure(t *testing.T) {
+	code, msg, err := decodeVolumeList(strings.NewReader(`{"code":1,"msg":"internal error","data":null}`),
+		func(vol *cfsVolumeInfo) { t.Fatal("no volume expected") })
+	assert.NoError(t, err)
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "internal error", msg)
+
+	_, _, err = decodeVolumeList(strings.NewReader(`{"code":0,"msg":"success","data":[{"Name":"pvc-1"},`),
+		func(vol *cfsVolumeInfo) {})
+	assert.Error(t, err)
+}
+
+func TestRetryWithinContextDeadline(t *testing.T) {
+	var calls int32
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		// the first attempt hangs until it times out
+		if atomic.AddInt32(&calls, 1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		writeMasterResponse(w, 0, "success")
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 400*time.Millisecond)
+	defer cancel()
+	cs.bindContext(ctx)
+	start := time.Now()
+	assert.NoError(t, cs.deleteVolume())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	// the hanging attempt only got its share of the deadline
+	assert.Less(t, int64(time.Since(start)), int64(300*time.Millisecond))
+}
+
+func TestRetryExhaustsContextDeadline(t *testing.T) {
+	var calls int32
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	cs.bindContext(ctx)
+	start := time.Now()
+	err := cs.deleteVolume()
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+	assert.Greater(t, atomic.LoadInt32(&calls), int32(1))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	// a done context fails the request without calling the master
+	atomic.StoreInt32(&calls, 0)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(cs.deleteVolume()))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+}
+
+func TestCreateVolumeRootPathForwarded(t *testing.T) {
+	var rootPaths []string
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		rootPaths = append(rootPaths, r.URL.Query().Get("rootPath"))
+		writeMasterResponse(w, 0, "success")
+	})
+
+	assert.NoError(t, cs.createVolume(10))
+	cs.clientConf[KRootPath] = "/team a/data"
+	assert.NoError(t, cs.createVolume(10))
+	assert.Equal(t, []string{"", "/team a/data"}, rootPaths)
+
+	for _, value := range []string{"data", "/", "/data/", "/data/../etc", "/da\nta", "/" + strings.Repeat("a", maxRootPathLength)} {
+		cs.clientConf[KRootPath] = value
+		assert.Equal(t, codes.InvalidArgument, status.Code(cs.createVolume(10)), value)
+	}
+	assert.Len(t, rootPaths, 2)
+}
+
+func TestCreateVolumeEnableToken(t *testing.T) {
+	var tokens []string
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, r.URL.Query().Get("enableToken"))
+		writeMasterResponse(w, 0, "success")
+	})
+
+	for _, tc := range []struct{ volType, token string }{
+		{defaultVolType, ""},
+		{defaultVolType, "true"},
+		{defaultVolType, "false"},
+		{volTypeCold, "false"},
+	} {
+		cs.clientConf[KVolType], cs.clientConf[KEnableToken] = tc.volType, tc.token
+		assert.NoError(t, cs.createVolume(10), tc)
+	}
+	assert.Equal(t, []string{"", "true", "false", "false"}, tokens)
+
+	// the token of a cold volume would never be usable
+	cs.clientConf[KVolType], cs.clientConf[KEnableToken] = volTypeCold, "true"
+	err := cs.createVolume(10)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Contains(t, err.Error(), "enableToken is not supported by volType 1")
+
+	cs.clientConf[KVolType], cs.clientConf[KEnableToken] = defaultVolType, "yes"
+	assert.Equal(t, codes.InvalidArgument, status.Code(cs.createVolume(10)))
+	assert.Len(t, tokens, 4)
+}
+
+func TestDefaultConsulAddr(t *testing.T) {
+	conf := fakeConfig
+	conf.DefaultConsulAddr = DefaultConsulAddr
+	cs, err := newCfsServer("pvc-consul", map[string]string{KMasterAddr: "10.0.0.1:17010"}, &conf)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultConsulAddr, cs.clientConf[KConsulAddr])
+
+	// the StorageClass wins over the default
+	consul := map[string]string{KMasterAddr: "10.0.0.1:17010", KConsulAddr: "http://consul:8500"}
+	cs, err = newCfsServer("pvc-consul", consul, &conf)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://consul:8500", cs.clientConf[KConsulAddr])
+
+	// without consul the key is omitted, including the default recorded by
+	// the volumes created before
+	conf.DefaultConsulAddr = ""
+	for _, param := range []map[string]string{
+		{KMasterAddr: "10.0.0.1:17010"},
+		{KMasterAddr: "10.0.0.1:17010", KConsulAddr: DefaultConsulAddr},
+	} {
+		cs, err = newCfsServer("pvc-consul", param, &conf)
+		assert.NoError(t, err)
+		assert.NotContains(t, cs.clientConf, KConsulAddr)
+	}
+
+	// while the consul set by the StorageClass is kept
+	cs, err = newCfsServer("pvc-consul", consul, &conf)
+	assert.NoError(t, err)
+	assert.Equal(t, "http://consul:8500", cs.clientConf[KConsulAddr])
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// sizes of the buffers of the client, see clientBufferOptions
+	KBufferSize    = "bufferSize"
+	KReadAheadSize = "readAheadSize"
+)
+
+// clientBufferOption maps a buffer size parameter to the client option it
+// sets, bounded to the sizes the client runs sanely with.
+type clientBufferOption struct {
+	param  string
+	option string
+	min    int64
+	max    int64
+}
+
+var clientBufferOptions = []clientBufferOption{
+	// the memory shared by the read and write buffers of the open files
+	{param: KBufferSize, option: "buffersTotalLimit", min: 32 << 20, max: 64 << 30},
+	// the memory holding the blocks read ahead for sequential readers
+	{param: KReadAheadSize, option: "aheadReadTotalMem", min: 4 << 20, max: 16 << 30},
+}
+
+// parseByteSize parses a size in bytes, with an optional Ki, Mi or Gi suffix.
+func parseByteSize(value string) (int64, error) {
+	shift := uint(0)
+	for suffix, s := range map[string]uint{"Ki": 10, "Mi": 20, "Gi": 30} {
+		if strings.HasSuffix(value, suffix) {
+			value, shift = strings.TrimSuffix(value, suffix), s
+			break
+		}
+	}
+
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 || size > (1<<62)>>shift {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+
+	return size << shift, nil
+}
+
+// clientBufferSizes validates the buffer sizes set in param, and returns the
+// client options they set. Setting the read ahead size enables reading ahead.
+func clientBufferSizes(param map[string]string) (map[string]string, error) {
+	options := make(map[string]string)
+	for _, o := range clientBufferOptions {
+		value := param[o.param]
+		if len(value) == 0 {
+			continue
+		}
+
+		size, err := parseByteSize(value)
+		if err != nil || size < o.min || size > o.max {
+			return nil, fmt.Errorf("invalid %s %q, must be a size in bytes (or with a Ki, Mi or Gi suffix) in [%dMi, %dGi]",
+				o.param, value, o.min>>20, o.max>>30)
+		}
+		options[o.option] = strconv.FormatInt(size, 10)
+	}
+
+	if _, ok := options["aheadReadTotalMem"]; ok {
+		options["aheadReadEnable"] = "true"
+	}
+
+	return options, nil
+}
+
+// applyClientBufferSizes sets the client options of the buffer sizes in param.
+func applyClientBufferSizes(param map[string]string) error {
+	options, err := clientBufferSizes(param)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range options {
+		param[k] = v
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for value, want := range map[string]int64{
+		"0":       0,
+		"1048576": 1 << 20,
+		"512Ki":   512 << 10,
+		"256Mi":   256 << 20,
+		"2Gi":     2 << 30,
+	} {
+		size, err := parseByteSize(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, want, size, value)
+	}
+
+	for _, value := range []string{"", "-1", "1.5Gi", "1G", "Mi", "9999999999999Gi"} {
+		_, err := parseByteSize(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestClientBufferSizes(t *testing.T) {
+	options, err := clientBufferSizes(map[string]string{KBufferSize: "1Gi", KReadAheadSize: "268435456"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"buffersTotalLimit": "1073741824",
+		"aheadReadTotalMem": "268435456",
+		"aheadReadEnable":   "true",
+	}, options)
+
+	options, err = clientBufferSizes(map[string]string{KBufferSize: "32Mi"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"buffersTotalLimit": "33554432"}, options)
+
+	options, err = clientBufferSizes(map[string]string{})
+	assert.NoError(t, err)
+	assert.Empty(t, options)
+
+	for _, param := range []map[string]string{
+		{KBufferSize: "16Mi"},
+		{KBufferSize: "65Gi"},
+		{KBufferSize: "lots"},
+		{KReadAheadSize: "1Mi"},
+		{KReadAheadSize: "17Gi"},
+	} {
+		_, err := clientBufferSizes(param)
+		assert.Error(t, err, param)
+	}
+}
+
+func TestPersistClientConfBufferSizes(t *testing.T) {
+	cs, mountPoint := newClientConfTestServer(t, clientConfDeliveryFile)
+	cs.clientConf[KBufferSize] = "4Gi"
+	cs.clientConf[KReadAheadSize] = "512Mi"
+	assert.NoError(t, cs.persistClientConf(mountPoint))
+
+	content, err := ioutil.ReadFile(cs.clientConfFile)
+	assert.NoError(t, err)
+	written := map[string]string{}
+	assert.NoError(t, json.Unmarshal(content, &written))
+	assert.Equal(t, "4294967296", written["buffersTotalLimit"])
+	assert.Equal(t, "536870912", written["aheadReadTotalMem"])
+	assert.Equal(t, "true", written["aheadReadEnable"])
+
+	cs, mountPoint = newClientConfTestServer(t, clientConfDeliveryFile)
+	cs.clientConf[KBufferSize] = "1Ki"
+	assert.Equal(t, codes.InvalidArgument, status.Code(cs.persistClientConf(mountPoint)))
+}
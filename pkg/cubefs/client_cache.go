@@ -0,0 +1,94 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// the local block cache of the client, see clientCacheOptions
+	KLocalCacheDir  = "localCacheDir"
+	KLocalCacheSize = "localCacheSize"
+
+	// bounds of the local cache size
+	minLocalCacheSize = 1 << 30
+	maxLocalCacheSize = 16 << 40
+)
+
+// clientCacheOptions validates the local cache set in param, and returns the
+// client options enabling it. Setting no cache directory leaves the cache
+// disabled.
+func clientCacheOptions(param map[string]string) (map[string]string, error) {
+	dir, size := param[KLocalCacheDir], param[KLocalCacheSize]
+	if len(dir) == 0 {
+		if len(size) != 0 {
+			return nil, fmt.Errorf("%s is set without %s", KLocalCacheSize, KLocalCacheDir)
+		}
+		return map[string]string{}, nil
+	}
+
+	if !filepath.IsAbs(dir) || filepath.Clean(dir) != dir || dir == "/" {
+		return nil, fmt.Errorf("invalid %s %q, must be a clean absolute path other than /", KLocalCacheDir, dir)
+	}
+
+	options := map[string]string{"enableBcache": "true", "bcacheDir": dir}
+	if len(size) != 0 {
+		bytes, err := parseByteSize(size)
+		if err != nil || bytes < minLocalCacheSize || bytes > maxLocalCacheSize {
+			return nil, fmt.Errorf("invalid %s %q, must be a size in bytes (or with a Ki, Mi or Gi suffix) in [%dGi, %dGi]",
+				KLocalCacheSize, size, minLocalCacheSize>>30, maxLocalCacheSize>>30)
+		}
+		options["bcacheCapacity"] = strconv.FormatInt(bytes, 10)
+	}
+
+	return options, nil
+}
+
+// prepareClientCache sets the client options of the local cache in param, and
+// creates its directory on the node if missing.
+func prepareClientCache(param map[string]string) error {
+	options, err := clientCacheOptions(param)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	for k, v := range options {
+		param[k] = v
+	}
+
+	dir, ok := options["bcacheDir"]
+	if !ok {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return status.Errorf(codes.Internal, "create the local cache directory %s failed: %v", dir, err)
+	}
+
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return status.Errorf(codes.Internal, "the local cache directory %s is not a directory", dir)
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClientCacheOptions(t *testing.T) {
+	options, err := clientCacheOptions(map[string]string{KLocalCacheDir: "/var/cache/cfs", KLocalCacheSize: "100Gi"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"enableBcache":   "true",
+		"bcacheDir":      "/var/cache/cfs",
+		"bcacheCapacity": "107374182400",
+	}, options)
+
+	options, err = clientCacheOptions(map[string]string{KLocalCacheDir: "/var/cache/cfs"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"enableBcache": "true", "bcacheDir": "/var/cache/cfs"}, options)
+
+	options, err = clientCacheOptions(map[string]string{})
+	assert.NoError(t, err)
+	assert.Empty(t, options)
+
+	for _, param := range []map[string]string{
+		{KLocalCacheSize: "10Gi"},
+		{KLocalCacheDir: "cache"},
+		{KLocalCacheDir: "/"},
+		{KLocalCacheDir: "/var/cache/../cfs"},
+		{KLocalCacheDir: "/var/cache/cfs", KLocalCacheSize: "512Mi"},
+		{KLocalCacheDir: "/var/cache/cfs", KLocalCacheSize: "16385Gi"},
+		{KLocalCacheDir: "/var/cache/cfs", KLocalCacheSize: "lots"},
+	} {
+		_, err := clientCacheOptions(param)
+		assert.Error(t, err, param)
+	}
+}
+
+func TestPersistClientConfLocalCache(t *testing.T) {
+	cacheDir := filepath.Join(t.TempDir(), "bcache", "vol")
+	cs, mountPoint := newClientConfTestServer(t, clientConfDeliveryFile)
+	cs.clientConf[KLocalCacheDir] = cacheDir
+	cs.clientConf[KLocalCacheSize] = "20Gi"
+	assert.NoError(t, cs.persistClientConf(mountPoint))
+
+	info, err := os.Stat(cacheDir)
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	content, err := ioutil.ReadFile(cs.clientConfFile)
+	assert.NoError(t, err)
+	written := map[string]string{}
+	assert.NoError(t, json.Unmarshal(content, &written))
+	assert.Equal(t, "true", written["enableBcache"])
+	assert.Equal(t, cacheDir, written["bcacheDir"])
+	assert.Equal(t, "21474836480", written["bcacheCapacity"])
+
+	// a file in the way of the directory
+	blocked := filepath.Join(t.TempDir(), "file")
+	assert.NoError(t, ioutil.WriteFile(blocked, nil, 0644))
+	cs, mountPoint = newClientConfTestServer(t, clientConfDeliveryFile)
+	cs.clientConf[KLocalCacheDir] = blocked
+	assert.Equal(t, codes.Internal, status.Code(cs.persistClientConf(mountPoint)))
+
+	cs, mountPoint = newClientConfTestServer(t, clientConfDeliveryFile)
+	cs.clientConf[KLocalCacheDir] = cacheDir
+	cs.clientConf[KLocalCacheSize] = "1Mi"
+	assert.Equal(t, codes.InvalidArgument, status.Code(cs.persistClientConf(mountPoint)))
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"fmt"
+	"strconv"
+)
+
+const (
+	// the requests the client has in flight to the kernel at most
+	KMaxConcurrentRequests = "maxConcurrentRequests"
+
+	// bounds of the max concurrent requests, the kernel default is 12
+	minConcurrentRequests = 1
+	maxConcurrentRequests = 4096
+)
+
+// clientConcurrency validates the max concurrent requests set in param, and
+// returns the client options it sets, i.e. the max background requests of
+// the fuse connection.
+func clientConcurrency(param map[string]string) (map[string]string, error) {
+	value := param[KMaxConcurrentRequests]
+	if len(value) == 0 {
+		return map[string]string{}, nil
+	}
+
+	requests, err := strconv.Atoi(value)
+	if err != nil || requests < minConcurrentRequests || requests > maxConcurrentRequests {
+		return nil, fmt.Errorf("invalid %s %q, must be an integer in [%d, %d]",
+			KMaxConcurrentRequests, value, minConcurrentRequests, maxConcurrentRequests)
+	}
+
+	return map[string]string{"maxBackground": strconv.Itoa(requests)}, nil
+}
+
+// applyClientConcurrency sets the client options of the max concurrent
+// requests in param.
+func applyClientConcurrency(param map[string]string) error {
+	options, err := clientConcurrency(param)
+	if err != nil {
+		return err
+	}
+
+	for k, v := range options {
+		param[k] = v
+	}
+
+	return nil
+}
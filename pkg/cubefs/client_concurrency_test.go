@@ -0,0 +1,60 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClientConcurrency(t *testing.T) {
+	for value, want := range map[string]string{"1": "1", "256": "256", "4096": "4096"} {
+		options, err := clientConcurrency(map[string]string{KMaxConcurrentRequests: value})
+		assert.NoError(t, err, value)
+		assert.Equal(t, map[string]string{"maxBackground": want}, options)
+	}
+
+	options, err := clientConcurrency(map[string]string{})
+	assert.NoError(t, err)
+	assert.Empty(t, options)
+
+	for _, value := range []string{"0", "-1", "4097", "1.5", "many"} {
+		_, err := clientConcurrency(map[string]string{KMaxConcurrentRequests: value})
+		assert.Error(t, err, value)
+	}
+}
+
+func TestPersistClientConfConcurrency(t *testing.T) {
+	cs, mountPoint := newClientConfTestServer(t, clientConfDeliveryFile)
+	cs.clientConf[KMaxConcurrentRequests] = "128"
+	assert.NoError(t, cs.persistClientConf(mountPoint))
+
+	content, err := ioutil.ReadFile(cs.clientConfFile)
+	assert.NoError(t, err)
+	written := map[string]string{}
+	assert.NoError(t, json.Unmarshal(content, &written))
+	assert.Equal(t, "128", written["maxBackground"])
+
+	cs, mountPoint = newClientConfTestServer(t, clientConfDeliveryFile)
+	cs.clientConf[KMaxConcurrentRequests] = "100000"
+	assert.Equal(t, codes.InvalidArgument, status.Code(cs.persistClientConf(mountPoint)))
+}
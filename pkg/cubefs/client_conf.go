@@ -0,0 +1,215 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	clientConfDeliveryFile  = "file"
+	clientConfDeliveryStdin = "stdin"
+)
+
+// KClientConfFile is the config file of the client of a volume, reported along
+// with its log dir and ports to find them when debugging its mount.
+const KClientConfFile = "clientConfFile"
+
+// suffix of the file next to the config file recording the checksum of the
+// config intended by the driver
+const clientConfChecksumSuffix = ".sha256"
+
+// clientConfDelivery hands the client configuration over to the cfs-client.
+type clientConfDelivery interface {
+	// prepare makes conf available to the client, and returns the arguments
+	// and the stdin to run the client with.
+	prepare(confFile string, conf []byte) (args []string, stdin []byte, err error)
+	// drifted reports whether the config the client reads on a restart
+	// differs from conf, e.g. as the config file was edited.
+	drifted(confFile string, conf []byte) (bool, error)
+}
+
+func newClientConfDelivery(mode string) (clientConfDelivery, error) {
+	switch mode {
+	case "", clientConfDeliveryFile:
+		return fileClientConfDelivery{}, nil
+	case clientConfDeliveryStdin:
+		return stdinClientConfDelivery{}, nil
+	default:
+		return nil, fmt.Errorf("unknown client config delivery %q, must be %s or %s",
+			mode, clientConfDeliveryFile, clientConfDeliveryStdin)
+	}
+}
+
+// fileClientConfDelivery writes the configuration to the per-volume config file.
+type fileClientConfDelivery struct {
+	// replaceable in tests, ioutil.WriteFile if nil
+	writeFile func(name string, data []byte, perm os.FileMode) error
+}
+
+func (d fileClientConfDelivery) prepare(confFile string, conf []byte) ([]string, []byte, error) {
+	writeFile := d.writeFile
+	if writeFile == nil {
+		writeFile = ioutil.WriteFile
+	}
+
+	if err := writeFile(confFile, conf, 0444); err != nil {
+		return nil, nil, err
+	}
+
+	if err := writeFile(confFile+clientConfChecksumSuffix, []byte(clientConfChecksum(conf)), 0444); err != nil {
+		return nil, nil, err
+	}
+
+	return []string{"-c", confFile}, nil, nil
+}
+
+// drifted compares the config file and its recorded checksum with conf. A
+// missing file is drifted, as the client cannot be restarted without it.
+func (fileClientConfDelivery) drifted(confFile string, conf []byte) (bool, error) {
+	expected := clientConfChecksum(conf)
+	checksum, err := ioutil.ReadFile(confFile + clientConfChecksumSuffix)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if string(bytes.TrimSpace(checksum)) != expected {
+		return true, nil
+	}
+
+	content, err := ioutil.ReadFile(confFile)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return clientConfChecksum(content) != expected, nil
+}
+
+// clientLocations returns the config file, log dir and ports of the client of
+// the volume, those known: the ports are only allocated by the node, and no
+// config file is written with the stdin delivery.
+func (cs *cfsServer) clientLocations() map[string]string {
+	locations := map[string]string{KLogDir: cs.clientConf[KLogDir]}
+	if _, stdin := cs.clientConfDelivery().(stdinClientConfDelivery); !stdin {
+		locations[KClientConfFile] = cs.clientConfFile
+	}
+	for _, k := range []string{KExporterPort, KProfPort} {
+		if v := cs.clientConf[k]; len(v) != 0 {
+			locations[k] = v
+		}
+	}
+
+	return locations
+}
+
+// marshalClientConf encodes the client config with its keys sorted, as
+// encoding/json sorts the keys of maps, so that the same config always yields
+// the same bytes, and the same checksum.
+func marshalClientConf(conf map[string]string) ([]byte, error) {
+	return json.Marshal(conf)
+}
+
+func clientConfChecksum(conf []byte) string {
+	sum := sha256.Sum256(conf)
+	return hex.EncodeToString(sum[:])
+}
+
+// stdinClientConfDelivery pipes the configuration to the stdin of the client,
+// so that nothing is written to the node filesystem.
+type stdinClientConfDelivery struct{}
+
+func (stdinClientConfDelivery) prepare(confFile string, conf []byte) ([]string, []byte, error) {
+	return []string{"-c", "/dev/stdin"}, conf, nil
+}
+
+// drifted is always false, as the config is piped from memory.
+func (stdinClientConfDelivery) drifted(confFile string, conf []byte) (bool, error) {
+	return false, nil
+}
+
+// ensureClientConf regenerates the config the client is restarted with if it
+// drifted from the one persisted by persistClientConf.
+func (cs *cfsServer) ensureClientConf() error {
+	if cs.clientConfBytes == nil {
+		return nil
+	}
+
+	delivery := cs.clientConfDelivery()
+	drifted, err := delivery.drifted(cs.clientConfFile, cs.clientConfBytes)
+	if err != nil {
+		return fmt.Errorf("check client config file %v fail: %v", cs.clientConfFile, err)
+	}
+	if !drifted {
+		return nil
+	}
+
+	glog.Warningf("client config file %v of volume[%v] drifted from the intended config, regenerate it",
+		cs.clientConfFile, cs.clientConf[KVolumeName])
+	if _, _, err := delivery.prepare(cs.clientConfFile, cs.clientConfBytes); err != nil {
+		return fmt.Errorf("regenerate client config file %v fail: %v", cs.clientConfFile, err)
+	}
+	return nil
+}
+
+// client log files not written for this long are removed to free disk space
+const clientLogGCAge = 7 * 24 * time.Hour
+
+// gcClientLogs removes the files under the client log directory root which
+// were not modified for maxAge, i.e. the rotated logs of the clients, and
+// returns the bytes freed.
+func gcClientLogs(root string, maxAge time.Duration) (int64, error) {
+	var freed int64
+	deadline := time.Now().Add(-maxAge)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// the logs of a volume may be removed concurrently
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if !info.Mode().IsRegular() || info.ModTime().After(deadline) {
+			return nil
+		}
+
+		if err := os.Remove(path); err != nil {
+			glog.Warningf("remove client log %v fail. err:%v", path, err)
+			return nil
+		}
+		freed += info.Size()
+		return nil
+	})
+
+	return freed, err
+}
@@ -0,0 +1,261 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newClientConfTestServer(t *testing.T, mode string) (*cfsServer, string) {
+	delivery, err := newClientConfDelivery(mode)
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	conf := fakeConfig
+	conf.clientConfDelivery = delivery
+	cs, err := newCfsServer("pvc-conf", map[string]string{KMasterAddr: "10.0.0.1:17010"}, &conf)
+	assert.NoError(t, err)
+	cs.clientConfFile = filepath.Join(dir, "pvc-conf"+jsonFileSuffix)
+	cs.clientConf[KLogDir] = filepath.Join(dir, "logs")
+	return cs, filepath.Join(dir, "mnt")
+}
+
+func TestClientLocations(t *testing.T) {
+	cs, mountPoint := newClientConfTestServer(t, clientConfDeliveryFile)
+	assert.Equal(t, map[string]string{
+		KClientConfFile: cs.clientConfFile,
+		KLogDir:         cs.clientConf[KLogDir],
+	}, cs.clientLocations())
+
+	// the ports are known once allocated at staging
+	assert.NoError(t, cs.persistClientConf(mountPoint))
+	locations := cs.clientLocations()
+	assert.Equal(t, cs.clientConfFile, locations[KClientConfFile])
+	assert.Equal(t, cs.clientConf[KExporterPort], locations[KExporterPort])
+	assert.Equal(t, cs.clientConf[KProfPort], locations[KProfPort])
+	assert.NotEmpty(t, locations[KExporterPort])
+	assert.NotEmpty(t, locations[KProfPort])
+
+	// no config file is written with the stdin delivery
+	cs, _ = newClientConfTestServer(t, clientConfDeliveryStdin)
+	assert.NotContains(t, cs.clientLocations(), KClientConfFile)
+}
+
+func TestFileClientConfDelivery(t *testing.T) {
+	cs, mountPoint := newClientConfTestServer(t, clientConfDeliveryFile)
+	assert.NoError(t, cs.persistClientConf(mountPoint))
+	assert.Equal(t, []string{"-c", cs.clientConfFile}, cs.clientArgs)
+	assert.Nil(t, cs.clientStdin)
+
+	content, err := ioutil.ReadFile(cs.clientConfFile)
+	assert.NoError(t, err)
+	written := map[string]string{}
+	assert.NoError(t, json.Unmarshal(content, &written))
+	assert.Equal(t, mountPoint, written[KMountPoint])
+	assert.Equal(t, "10.0.0.1:17010", written[KMasterAddr])
+}
+
+func TestMarshalClientConfStable(t *testing.T) {
+	keys := []string{KVolumeName, KMasterAddr, KOwner, KLogDir, KLogLevel, KExporterPort, KProfPort, KMountPoint}
+	forward, backward := map[string]string{}, map[string]string{}
+	for i, k := range keys {
+		forward[k] = k + "-value"
+		backward[keys[len(keys)-1-i]] = keys[len(keys)-1-i] + "-value"
+	}
+
+	expected, err := marshalClientConf(forward)
+	assert.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		content, err := marshalClientConf(backward)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, content)
+	}
+	assert.True(t, strings.HasPrefix(string(expected), `{"exporterPort":"exporterPort-value","logDir":`), string(expected))
+
+	// the written config is the marshaled one, byte for byte
+	cs, mountPoint := newClientConfTestServer(t, clientConfDeliveryFile)
+	assert.NoError(t, cs.persistClientConf(mountPoint))
+	content, err := ioutil.ReadFile(cs.clientConfFile)
+	assert.NoError(t, err)
+	expected, err = marshalClientConf(cs.clientConf)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, content)
+}
+
+func TestClientConfDrift(t *testing.T) {
+	cs, mountPoint := newClientConfTestServer(t, clientConfDeliveryFile)
+	// nothing was persisted yet
+	assert.NoError(t, cs.ensureClientConf())
+
+	assert.NoError(t, cs.persistClientConf(mountPoint))
+	intended, err := ioutil.ReadFile(cs.clientConfFile)
+	assert.NoError(t, err)
+	delivery := fileClientConfDelivery{}
+	drifted, err := delivery.drifted(cs.clientConfFile, intended)
+	assert.NoError(t, err)
+	assert.False(t, drifted)
+
+	for name, corrupt := range map[string]func(){
+		"edited config": func() {
+			assert.NoError(t, os.Chmod(cs.clientConfFile, 0644))
+			assert.NoError(t, ioutil.WriteFile(cs.clientConfFile, []byte(`{"logLevel":"debug"}`), 0644))
+		},
+		"removed config":   func() { assert.NoError(t, os.Remove(cs.clientConfFile)) },
+		"removed checksum": func() { assert.NoError(t, os.Remove(cs.clientConfFile+clientConfChecksumSuffix)) },
+	} {
+		corrupt()
+		drifted, err = delivery.drifted(cs.clientConfFile, intended)
+		assert.NoError(t, err, name)
+		assert.True(t, drifted, name)
+
+		// the intended config is regenerated
+		assert.NoError(t, cs.ensureClientConf(), name)
+		content, err := ioutil.ReadFile(cs.clientConfFile)
+		assert.NoError(t, err, name)
+		assert.Equal(t, intended, content, name)
+		drifted, err = delivery.drifted(cs.clientConfFile, intended)
+		assert.NoError(t, err, name)
+		assert.False(t, drifted, name)
+	}
+
+	// the config piped to stdin cannot drift
+	cs, mountPoint = newClientConfTestServer(t, clientConfDeliveryStdin)
+	assert.NoError(t, cs.persistClientConf(mountPoint))
+	assert.NoError(t, cs.ensureClientConf())
+	_, err = os.Stat(cs.clientConfFile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestClientConfWithoutConsul(t *testing.T) {
+	cs, mountPoint := newClientConfTestServer(t, clientConfDeliveryFile)
+	assert.NoError(t, cs.persistClientConf(mountPoint))
+
+	content, err := ioutil.ReadFile(cs.clientConfFile)
+	assert.NoError(t, err)
+	written := map[string]string{}
+	assert.NoError(t, json.Unmarshal(content, &written))
+	assert.NotContains(t, written, KConsulAddr)
+}
+
+func TestStdinClientConfDelivery(t *testing.T) {
+	cs, mountPoint := newClientConfTestServer(t, clientConfDeliveryStdin)
+	assert.NoError(t, cs.persistClientConf(mountPoint))
+	assert.Equal(t, []string{"-c", "/dev/stdin"}, cs.clientArgs)
+	_, err := os.Stat(cs.clientConfFile)
+	assert.True(t, os.IsNotExist(err))
+
+	// the client reads the same configuration from its stdin
+	output, err := execCommandWithStdin(cs.clientStdin, "cat", cs.clientArgs[1])
+	assert.NoError(t, err)
+	written := map[string]string{}
+	assert.NoError(t, json.Unmarshal(output, &written))
+	assert.Equal(t, mountPoint, written[KMountPoint])
+}
+
+func TestPersistClientConfNoSpace(t *testing.T) {
+	cs, mountPoint := newClientConfTestServer(t, clientConfDeliveryFile)
+	logRoot := filepath.Dir(cs.clientConf[KLogDir])
+	oldLog := filepath.Join(logRoot, "pvc-old", "output.log.1")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(oldLog), 0755))
+	assert.NoError(t, ioutil.WriteFile(oldLog, []byte("old"), 0644))
+	old := time.Now().Add(-2 * clientLogGCAge)
+	assert.NoError(t, os.Chtimes(oldLog, old, old))
+
+	// the disk is full until the old logs are removed
+	writes := 0
+	cs.conf.clientConfDelivery = fileClientConfDelivery{writeFile: func(name string, data []byte, perm os.FileMode) error {
+		writes++
+		if _, err := os.Stat(oldLog); err == nil {
+			return &os.PathError{Op: "write", Path: name, Err: syscall.ENOSPC}
+		}
+		return ioutil.WriteFile(name, data, perm)
+	}}
+	assert.NoError(t, cs.persistClientConf(mountPoint))
+	// the failed config, the config and its checksum
+	assert.Equal(t, 3, writes)
+
+	// the disk stays full
+	cs, mountPoint = newClientConfTestServer(t, clientConfDeliveryFile)
+	cs.conf.clientConfDelivery = fileClientConfDelivery{writeFile: func(name string, data []byte, perm os.FileMode) error {
+		return &os.PathError{Op: "write", Path: name, Err: syscall.ENOSPC}
+	}}
+	err := cs.persistClientConf(mountPoint)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Contains(t, err.Error(), filepath.Dir(cs.clientConfFile))
+
+	cs, mountPoint = newClientConfTestServer(t, clientConfDeliveryFile)
+	cs.conf.clientConfDelivery = fileClientConfDelivery{writeFile: func(name string, data []byte, perm os.FileMode) error {
+		return &os.PathError{Op: "open", Path: name, Err: syscall.EACCES}
+	}}
+	assert.Equal(t, codes.Internal, status.Code(cs.persistClientConf(mountPoint)))
+}
+
+func TestGCClientLogs(t *testing.T) {
+	root := t.TempDir()
+	oldLog := filepath.Join(root, "pvc-a", "output.log.1")
+	newLog := filepath.Join(root, "pvc-a", "output.log")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(oldLog), 0755))
+	assert.NoError(t, ioutil.WriteFile(oldLog, []byte("rotated"), 0644))
+	assert.NoError(t, ioutil.WriteFile(newLog, []byte("current"), 0644))
+	old := time.Now().Add(-2 * clientLogGCAge)
+	assert.NoError(t, os.Chtimes(oldLog, old, old))
+
+	freed, err := gcClientLogs(root, clientLogGCAge)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len("rotated")), freed)
+	_, err = os.Stat(oldLog)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(newLog)
+	assert.NoError(t, err)
+
+	_, err = gcClientLogs(filepath.Join(root, "missing"), clientLogGCAge)
+	assert.NoError(t, err)
+}
+
+func TestNewClientConfDelivery(t *testing.T) {
+	delivery, err := newClientConfDelivery("")
+	assert.NoError(t, err)
+	assert.IsType(t, fileClientConfDelivery{}, delivery)
+
+	_, err = newClientConfDelivery("args")
+	assert.Error(t, err)
+}
+
+func TestPersistClientConfValidatesParameters(t *testing.T) {
+	// the node rejects the parameters CreateVolume rejects, not only those of the client
+	for k, v := range map[string]string{
+		KDataPartitionCount: "0",
+		KInitDirsMode:       "rwx",
+		KClientUID:          "nobody",
+	} {
+		cs, mountPoint := newClientConfTestServer(t, clientConfDeliveryFile)
+		cs.clientConf[KInitDirs] = "data"
+		cs.clientConf[k] = v
+		assert.Equal(t, codes.InvalidArgument, status.Code(cs.persistClientConf(mountPoint)), k)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// clientOptionMinVersions maps the client config options which older clients
+// do not support to the client version introducing them. The options missing
+// here are supported by every client the driver works with.
+var clientOptionMinVersions = map[string]string{
+	"nearRead":          "2.4.0",
+	"enableBcache":      "3.0.0",
+	"bcacheDir":         "3.0.0",
+	"bcacheCapacity":    "3.0.0",
+	"maxStreamerLimit":  "3.2.0",
+	"enableAudit":       "3.2.0",
+	"aheadReadEnable":   "3.4.0",
+	"aheadReadTotalMem": "3.4.0",
+}
+
+// clientVersionProbe queries the version of the client binary once, as it
+// only changes with the image of the driver.
+type clientVersionProbe struct {
+	clientBin string
+	once      sync.Once
+	version   string
+	err       error
+}
+
+func newClientVersionProbe(clientBin string) *clientVersionProbe {
+	return &clientVersionProbe{clientBin: clientBin}
+}
+
+func (p *clientVersionProbe) get() (string, error) {
+	p.once.Do(func() {
+		output, err := execCommand(p.clientBin, "-v")
+		if err != nil {
+			p.err = fmt.Errorf("run %s -v failed: %v, output: %s", p.clientBin, err, output)
+			return
+		}
+
+		p.version, p.err = parseClientVersion(string(output))
+	})
+
+	return p.version, p.err
+}
+
+// parseClientVersion returns the version in the output of "cfs-client -v",
+// which has a line like "Version: 3.2.0".
+func parseClientVersion(output string) (string, error) {
+	for _, line := range strings.Split(output, "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if ok && strings.TrimSpace(key) == "Version" {
+			if version := strings.TrimSpace(value); len(version) != 0 {
+				return version, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("no version found in the client output %q", output)
+}
+
+// checkClientOptions rejects the options set in param which the client of
+// version does not support, instead of letting the mount fail opaquely.
+func checkClientOptions(param map[string]string, version string) error {
+	options := make([]string, 0, len(param))
+	for option := range param {
+		options = append(options, option)
+	}
+	sort.Strings(options)
+
+	for _, option := range options {
+		minVersion, ok := clientOptionMinVersions[option]
+		if !ok || len(param[option]) == 0 {
+			continue
+		}
+
+		if compareVersions(version, minVersion) < 0 {
+			return fmt.Errorf("client option %q is not supported by the installed client %s, it needs client %s or later",
+				option, version, minVersion)
+		}
+	}
+
+	return nil
+}
+
+// compareVersions compares the dotted numeric versions a and b, ignoring any
+// suffix like "-rc1" or "+commit". A missing or malformed component counts as 0.
+func compareVersions(a, b string) int {
+	as, bs := versionComponents(a), versionComponents(b)
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func versionComponents(version string) []int {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if i := strings.IndexAny(version, "-+ "); i >= 0 {
+		version = version[:i]
+	}
+
+	var components []int
+	for _, part := range strings.Split(version, ".") {
+		n, _ := strconv.Atoi(part)
+		components = append(components, n)
+	}
+
+	return components
+}
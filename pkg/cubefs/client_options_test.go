@@ -0,0 +1,88 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseClientVersion(t *testing.T) {
+	version, err := parseClientVersion("CubeFS Client\nBranch: release-3.2.0\nVersion: 3.2.0\nCommit: 1a2b3c\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "3.2.0", version)
+
+	_, err = parseClientVersion("usage: cfs-client -c <config>")
+	assert.Error(t, err)
+}
+
+func TestCompareVersions(t *testing.T) {
+	assert.Equal(t, 0, compareVersions("3.2.0", "3.2"))
+	assert.Equal(t, -1, compareVersions("3.1.9", "3.2.0"))
+	assert.Equal(t, 1, compareVersions("3.10.0", "3.2.0"))
+	assert.Equal(t, 0, compareVersions("v3.2.0-rc1", "3.2.0"))
+}
+
+func TestCheckClientOptions(t *testing.T) {
+	supported := map[string]string{"nearRead": "true", "enableBcache": "true", "icacheTimeout": "60"}
+	assert.NoError(t, checkClientOptions(supported, "3.2.0"))
+
+	err := checkClientOptions(supported, "2.5.1")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), `"enableBcache"`)
+	assert.Contains(t, err.Error(), "2.5.1")
+
+	// an empty value does not set the option
+	assert.NoError(t, checkClientOptions(map[string]string{"enableAudit": ""}, "3.0.0"))
+}
+
+func TestClientVersionProbe(t *testing.T) {
+	clientBin := filepath.Join(t.TempDir(), "cfs-client")
+	assert.NoError(t, ioutil.WriteFile(clientBin, []byte("#!/bin/sh\necho 'Version: 3.1.0'\n"), 0755))
+
+	probe := newClientVersionProbe(clientBin)
+	version, err := probe.get()
+	assert.NoError(t, err)
+	assert.Equal(t, "3.1.0", version)
+
+	// the version is only queried once
+	assert.NoError(t, os.Remove(clientBin))
+	version, err = probe.get()
+	assert.NoError(t, err)
+	assert.Equal(t, "3.1.0", version)
+
+	_, err = newClientVersionProbe(clientBin).get()
+	assert.Error(t, err)
+}
+
+func TestPersistClientConfChecksClientOptions(t *testing.T) {
+	clientBin := filepath.Join(t.TempDir(), "cfs-client")
+	assert.NoError(t, ioutil.WriteFile(clientBin, []byte("#!/bin/sh\necho 'Version: 2.5.1'\n"), 0755))
+
+	conf := fakeConfig
+	conf.clientConfDelivery = stdinClientConfDelivery{}
+	conf.clientVersionProbe = newClientVersionProbe(clientBin)
+	cs, err := newCfsServer("pvc-options", map[string]string{KMasterAddr: "10.0.0.1:17010", "enableBcache": "true"}, &conf)
+	assert.NoError(t, err)
+	err = cs.persistClientConf(t.TempDir())
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "enableBcache")
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// the clock ticks per second of the cpu times in /proc/<pid>/stat, which is
+// 100 on all the architectures Kubernetes runs on
+const procClockTicks = 100
+
+// clientStats are the resources used by a fuse client.
+type clientStats struct {
+	rssBytes   int64
+	cpuSeconds float64
+}
+
+// clientStatsSampler samples the resources used by the fuse clients, which
+// are found in procDir by the client binary they run. As the clients detach
+// from the driver, a client is attributed to its volume by the config file
+// it is started with, so the clients reading their config from stdin are
+// not sampled.
+type clientStatsSampler struct {
+	procDir   string
+	clientBin string
+	pageSize  int64
+}
+
+func newClientStatsSampler() *clientStatsSampler {
+	return &clientStatsSampler{procDir: "/proc", clientBin: CfsClientBin, pageSize: int64(os.Getpagesize())}
+}
+
+// run samples the clients every interval into the client metrics.
+func (s *clientStatsSampler) run(interval time.Duration) {
+	for {
+		stats := s.sample()
+		memory := make(map[string]float64, len(stats))
+		cpu := make(map[string]float64, len(stats))
+		for volume, stat := range stats {
+			memory[volume] = float64(stat.rssBytes)
+			cpu[volume] = stat.cpuSeconds
+		}
+		clientMemoryBytes.replace(memory)
+		clientCPUSeconds.replace(cpu)
+
+		time.Sleep(interval + time.Duration(rand.Int63n(int64(interval)/10+1)))
+	}
+}
+
+// sample returns the resources used by the client of each volume. The
+// processes exiting while they are sampled are skipped.
+func (s *clientStatsSampler) sample() map[string]clientStats {
+	stats := make(map[string]clientStats)
+	entries, err := ioutil.ReadDir(s.procDir)
+	if err != nil {
+		glog.Warningf("sample client stats: read %s fail. err:%v", s.procDir, err)
+		return stats
+	}
+
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+
+		pidDir := filepath.Join(s.procDir, entry.Name())
+		volume, ok := s.clientVolume(pidDir)
+		if !ok {
+			continue
+		}
+
+		stat, err := s.processStats(pidDir)
+		if err != nil {
+			glog.V(4).Infof("sample client stats of volume[%v] fail. err:%v", volume, err)
+			continue
+		}
+
+		// a volume has a single client, unless it is mounted at several targets
+		sum := stats[volume]
+		sum.rssBytes += stat.rssBytes
+		sum.cpuSeconds += stat.cpuSeconds
+		stats[volume] = sum
+	}
+
+	return stats
+}
+
+// clientVolume returns the volume served by the process of pidDir, and false
+// if it is not a client started with a config file.
+func (s *clientStatsSampler) clientVolume(pidDir string) (string, bool) {
+	cmdline, err := ioutil.ReadFile(filepath.Join(pidDir, "cmdline"))
+	if err != nil {
+		return "", false
+	}
+
+	args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+	if len(args) == 0 || args[0] != s.clientBin {
+		return "", false
+	}
+
+	for i := 1; i+1 < len(args); i++ {
+		if args[i] == "-c" && strings.HasPrefix(args[i+1], defaultClientConfPath) {
+			return strings.TrimSuffix(filepath.Base(args[i+1]), jsonFileSuffix), true
+		}
+	}
+
+	return "", false
+}
+
+// processStats reads the resident memory from statm, and the user and
+// system cpu time from stat.
+func (s *clientStatsSampler) processStats(pidDir string) (clientStats, error) {
+	statm, err := ioutil.ReadFile(filepath.Join(pidDir, "statm"))
+	if err != nil {
+		return clientStats{}, err
+	}
+
+	fields := strings.Fields(string(statm))
+	if len(fields) < 2 {
+		return clientStats{}, fmt.Errorf("malformed statm %q", statm)
+	}
+	residentPages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return clientStats{}, fmt.Errorf("malformed statm %q", statm)
+	}
+
+	stat, err := ioutil.ReadFile(filepath.Join(pidDir, "stat"))
+	if err != nil {
+		return clientStats{}, err
+	}
+
+	// the command in parentheses may contain spaces, the fields after it
+	// start with the state, so utime and stime are the 12th and 13th
+	end := strings.LastIndexByte(string(stat), ')')
+	fields = strings.Fields(string(stat[end+1:]))
+	if end < 0 || len(fields) < 13 {
+		return clientStats{}, fmt.Errorf("malformed stat %q", stat)
+	}
+	utime, err := strconv.ParseInt(fields[11], 10, 64)
+	if err != nil {
+		return clientStats{}, fmt.Errorf("malformed stat %q", stat)
+	}
+	stime, err := strconv.ParseInt(fields[12], 10, 64)
+	if err != nil {
+		return clientStats{}, fmt.Errorf("malformed stat %q", stat)
+	}
+
+	return clientStats{
+		rssBytes:   residentPages * s.pageSize,
+		cpuSeconds: float64(utime+stime) / procClockTicks,
+	}, nil
+}
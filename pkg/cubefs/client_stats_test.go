@@ -0,0 +1,70 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeFakeProcess writes the /proc entries of a process into procDir.
+func writeFakeProcess(t *testing.T, procDir, pid string, cmdline []string, statm, stat string) {
+	dir := filepath.Join(procDir, pid)
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	var raw []byte
+	for _, arg := range cmdline {
+		raw = append(append(raw, arg...), 0)
+	}
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "cmdline"), raw, 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "statm"), []byte(statm), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0644))
+}
+
+func TestClientStatsSampler(t *testing.T) {
+	procDir := t.TempDir()
+	// utime 250 and stime 50 ticks, with a space in the command
+	writeFakeProcess(t, procDir, "101", []string{CfsClientBin, "-c", "/cfs/conf/pvc-a.json"},
+		"50000 2560 300 10 0 900 0\n",
+		"101 (cfs client) S 1 101 101 0 -1 4194560 1000 0 0 0 250 50 0 0 20 0 12 0 100 1000000 2560\n")
+	writeFakeProcess(t, procDir, "102", []string{CfsClientBin, "-c", "/cfs/conf/pvc-b.json"},
+		"50000 1024 300 10 0 900 0\n",
+		"102 (cfs-client) S 1 102 102 0 -1 4194560 1000 0 0 0 100 0 0 0 20 0 12 0 100 1000000 1024\n")
+	// the clients reading the config from stdin and other processes are skipped
+	writeFakeProcess(t, procDir, "103", []string{CfsClientBin, "-c", "/dev/stdin"}, "1 1\n", "103 (cfs-client) S\n")
+	writeFakeProcess(t, procDir, "104", []string{"/bin/sh"}, "1 1\n", "104 (sh) S\n")
+	assert.NoError(t, os.MkdirAll(filepath.Join(procDir, "self"), 0755))
+
+	sampler := &clientStatsSampler{procDir: procDir, clientBin: CfsClientBin, pageSize: 4096}
+	assert.Equal(t, map[string]clientStats{
+		"pvc-a": {rssBytes: 2560 * 4096, cpuSeconds: 3},
+		"pvc-b": {rssBytes: 1024 * 4096, cpuSeconds: 1},
+	}, sampler.sample())
+}
+
+func TestClientStatsMalformed(t *testing.T) {
+	procDir := t.TempDir()
+	writeFakeProcess(t, procDir, "101", []string{CfsClientBin, "-c", "/cfs/conf/pvc-a.json"}, "50000\n", "101 (cfs-client) S\n")
+
+	sampler := &clientStatsSampler{procDir: procDir, clientBin: CfsClientBin, pageSize: 4096}
+	assert.Empty(t, sampler.sample())
+	_, err := sampler.processStats(filepath.Join(procDir, "101"))
+	assert.Error(t, err)
+}
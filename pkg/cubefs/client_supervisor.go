@@ -0,0 +1,318 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"k8s.io/utils/mount"
+)
+
+// a client up for this long is considered recovered, and its restarts are reset
+const clientStablePeriod = 10 * time.Minute
+
+// supervisedClient is the client of a staged volume, with the targets its
+// staging path is bind mounted to.
+type supervisedClient struct {
+	volumeID    string
+	stagingPath string
+	// the config file, log dir and ports of the client, see clientLocations
+	locations map[string]string
+	// propagation of the targets by target
+	targets map[string]string
+	// runs the client again with the persisted config and ports
+	restart func() error
+	// regenerates the persisted config if it drifted, nil if it cannot drift
+	ensureConf  func() error
+	restarts    int
+	upSince     time.Time
+	nextRestart time.Time
+	gaveUp      bool
+	lastErr     error
+}
+
+// clientSupervisor restarts the clients which exited unexpectedly, e.g. as
+// they were OOM killed, with an exponential backoff. After restartLimit
+// consecutive restarts it gives up, and reports the volume abnormal.
+type clientSupervisor struct {
+	mutex   sync.Mutex
+	clients map[string]*supervisedClient
+	// staging paths being staged, which count against the max volumes, see reserve
+	reserved     map[string]bool
+	restartLimit int
+	backoff      time.Duration
+	// replaceable in tests
+	healthy func(stagingPath string) bool
+	rebind  func(stagingPath, target, propagation string) error
+	now     func() time.Time
+}
+
+func newClientSupervisor(restartLimit int, backoff time.Duration, mounter mount.Interface, dirMode os.FileMode) *clientSupervisor {
+	return &clientSupervisor{
+		clients:      make(map[string]*supervisedClient),
+		reserved:     make(map[string]bool),
+		restartLimit: restartLimit,
+		backoff:      backoff,
+		healthy:      clientMountHealthy,
+		rebind: func(stagingPath, target, propagation string) error {
+			if err := mount.CleanupMountPoint(target, mounter, false); err != nil {
+				return err
+			}
+			if err := createMountPoint(target, dirMode); err != nil {
+				return err
+			}
+			if err := bindMount(stagingPath, target); err != nil {
+				return err
+			}
+			if propagation == "" {
+				return nil
+			}
+			return makePropagation(target, propagation)
+		},
+		now: time.Now,
+	}
+}
+
+// clientMountHealthy reports whether the client of the staging path still
+// serves it, the mount point of a dead client is disconnected or gone.
+func clientMountHealthy(stagingPath string) bool {
+	notMnt, err := mount.New("").IsLikelyNotMountPoint(stagingPath)
+	return err == nil && !notMnt
+}
+
+func (s *clientSupervisor) watch(volumeID, stagingPath string, locations map[string]string, restart, ensureConf func() error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	targets := make(map[string]string)
+	if c, ok := s.clients[stagingPath]; ok {
+		targets = c.targets
+	}
+	s.clients[stagingPath] = &supervisedClient{
+		volumeID:    volumeID,
+		stagingPath: stagingPath,
+		locations:   locations,
+		targets:     targets,
+		restart:     restart,
+		ensureConf:  ensureConf,
+		upSince:     s.now(),
+	}
+}
+
+func (s *clientSupervisor) unwatch(stagingPath string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.clients, stagingPath)
+}
+
+// profPorts returns the prof ports of the clients by volume.
+func (s *clientSupervisor) profPorts() map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ports := make(map[string]string)
+	for _, c := range s.clients {
+		if port := c.locations[KProfPort]; len(port) != 0 {
+			ports[c.volumeID] = port
+		}
+	}
+
+	return ports
+}
+
+// reserve reserves the client of the staging path until it is released,
+// unless the clients watched or reserved already reach limit, and returns
+// their number. The client of a staged volume is always reserved.
+func (s *clientSupervisor) reserve(stagingPath string, limit int) (bool, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	clients := len(s.clients)
+	for reserved := range s.reserved {
+		if _, ok := s.clients[reserved]; !ok {
+			clients++
+		}
+	}
+
+	_, staged := s.clients[stagingPath]
+	if !staged && !s.reserved[stagingPath] && clients >= limit {
+		return false, clients
+	}
+	s.reserved[stagingPath] = true
+	return true, clients
+}
+
+// release drops the reservation of the staging path, its client keeps
+// counting if it was watched meanwhile.
+func (s *clientSupervisor) release(stagingPath string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.reserved, stagingPath)
+}
+
+// locations returns the locations of the client of the staging path, nil if
+// it is not watched.
+func (s *clientSupervisor) locations(stagingPath string) map[string]string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if c, ok := s.clients[stagingPath]; ok {
+		return c.locations
+	}
+
+	return nil
+}
+
+// publish records the target the staging path is bind mounted to, which is
+// bound again once the client is restarted.
+func (s *clientSupervisor) publish(stagingPath, target, propagation string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if c, ok := s.clients[stagingPath]; ok {
+		c.targets[target] = propagation
+	}
+}
+
+// ensureConf regenerates the persisted client config of the staging path if
+// it drifted from the one the client was mounted with.
+func (s *clientSupervisor) ensureConf(stagingPath string) error {
+	s.mutex.Lock()
+	c, ok := s.clients[stagingPath]
+	s.mutex.Unlock()
+	if !ok || c.ensureConf == nil {
+		return nil
+	}
+
+	return c.ensureConf()
+}
+
+func (s *clientSupervisor) unpublish(target string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, c := range s.clients {
+		delete(c.targets, target)
+	}
+}
+
+// check restarts the dead clients whose backoff elapsed. Each client is
+// checked holding only the lock of its volume, taken by lockVolume, so that
+// a hung mount or a slow restart does not block the other volumes.
+func (s *clientSupervisor) check(lockVolume func(volumeID string) func()) {
+	s.mutex.Lock()
+	clients := make([]*supervisedClient, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mutex.Unlock()
+
+	for _, c := range clients {
+		s.checkClient(c, lockVolume)
+	}
+}
+
+func (s *clientSupervisor) checkClient(c *supervisedClient, lockVolume func(volumeID string) func()) {
+	defer lockVolume(c.volumeID)()
+
+	// the volume may have been unstaged or staged again since the snapshot
+	s.mutex.Lock()
+	watched := s.clients[c.stagingPath] == c && !c.gaveUp
+	s.mutex.Unlock()
+	if !watched {
+		return
+	}
+
+	healthy := s.healthy(c.stagingPath)
+	now := s.now()
+
+	s.mutex.Lock()
+	if healthy {
+		if c.restarts > 0 && now.Sub(c.upSince) >= clientStablePeriod {
+			glog.Infof("client of volume[%v] recovered after %d restarts", c.volumeID, c.restarts)
+			c.restarts, c.lastErr = 0, nil
+		}
+		s.mutex.Unlock()
+		return
+	}
+
+	if c.restarts >= s.restartLimit {
+		c.gaveUp = true
+		glog.Errorf("client of volume[%v] at %v died, give up after %d restarts. last err: %v",
+			c.volumeID, c.stagingPath, c.restarts, c.lastErr)
+		s.mutex.Unlock()
+		return
+	}
+
+	if now.Before(c.nextRestart) {
+		s.mutex.Unlock()
+		return
+	}
+
+	c.restarts++
+	c.nextRestart = now.Add(backoffWithJitter(s.backoff, c.restarts-1))
+	s.mutex.Unlock()
+
+	glog.Warningf("client of volume[%v] at %v died, restart %d/%d", c.volumeID, c.stagingPath, c.restarts, s.restartLimit)
+	err := c.restart()
+
+	s.mutex.Lock()
+	if err != nil {
+		c.lastErr = err
+		s.mutex.Unlock()
+		glog.Errorf("restart client of volume[%v] fail. err:%v", c.volumeID, err)
+		return
+	}
+	c.upSince = now
+	targets := make(map[string]string, len(c.targets))
+	for target, propagation := range c.targets {
+		targets[target] = propagation
+	}
+	s.mutex.Unlock()
+
+	for target, propagation := range targets {
+		if err := s.rebind(c.stagingPath, target, propagation); err != nil {
+			glog.Warningf("rebind volume[%v] to %v fail. err:%v", c.volumeID, target, err)
+		}
+	}
+}
+
+// condition returns the condition of the volume, which is abnormal once the
+// supervisor gave up restarting its client, and nil if it is not supervised.
+func (s *clientSupervisor) condition(volumeID string) *csi.VolumeCondition {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var condition *csi.VolumeCondition
+	for _, c := range s.clients {
+		if c.volumeID != volumeID {
+			continue
+		}
+
+		if c.gaveUp {
+			return &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  fmt.Sprintf("client died and failed to restart %d times, last err: %v", c.restarts, c.lastErr),
+			}
+		}
+		condition = &csi.VolumeCondition{Message: "client is running"}
+	}
+
+	return condition
+}
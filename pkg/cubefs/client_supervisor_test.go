@@ -0,0 +1,183 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClientSupervisor supervises a single client at /staging, published to
+// /target, whose mount is healthy while alive is true.
+type fakeClientSupervisor struct {
+	*clientSupervisor
+	alive    bool
+	now      time.Time
+	restarts int
+	rebinds  []string
+	// volumes locked by the checks, and whether one is locked
+	locks  []string
+	locked bool
+	// error of the restarts, which revive the client if nil
+	restartErr error
+}
+
+func newFakeClientSupervisor(restartLimit int) *fakeClientSupervisor {
+	f := &fakeClientSupervisor{alive: true, now: time.Unix(1700000000, 0)}
+	f.clientSupervisor = newClientSupervisor(restartLimit, time.Second, nil, 0)
+	f.healthy = func(string) bool { return f.alive }
+	f.rebind = func(stagingPath, target, propagation string) error {
+		f.rebinds = append(f.rebinds, target)
+		return nil
+	}
+	f.clientSupervisor.now = func() time.Time { return f.now }
+	f.watch("pvc-1", "/staging", nil, func() error {
+		// the supervisor is not locked while the client restarts
+		f.locations("/staging")
+		f.restarts++
+		if f.restartErr != nil {
+			return f.restartErr
+		}
+		f.alive = true
+		return nil
+	}, nil)
+	f.publish("/staging", "/target", "")
+	return f
+}
+
+func (f *fakeClientSupervisor) lockVolume(volumeID string) func() {
+	f.locks = append(f.locks, volumeID)
+	f.locked = true
+	return func() { f.locked = false }
+}
+
+// tick advances the clock beyond any backoff and checks the client.
+func (f *fakeClientSupervisor) tick() {
+	f.now = f.now.Add(time.Hour)
+	f.check(f.lockVolume)
+}
+
+func TestClientSupervisorRestartsExitedClient(t *testing.T) {
+	f := newFakeClientSupervisor(3)
+
+	f.tick()
+	assert.Equal(t, 0, f.restarts)
+
+	f.alive = false
+	f.tick()
+	assert.Equal(t, 1, f.restarts)
+	assert.True(t, f.alive)
+	assert.Equal(t, []string{"/target"}, f.rebinds)
+	assert.False(t, f.condition("pvc-1").Abnormal)
+	// only the volume of the client is locked, and only while it is checked
+	assert.Equal(t, []string{"pvc-1", "pvc-1"}, f.locks)
+	assert.False(t, f.locked)
+
+	// the restarts are reset once the client stays up
+	f.tick()
+	f.alive = false
+	f.tick()
+	assert.Equal(t, 2, f.restarts)
+	assert.Equal(t, 1, f.clients["/staging"].restarts)
+}
+
+func TestClientSupervisorBacksOff(t *testing.T) {
+	f := newFakeClientSupervisor(5)
+	f.restartErr = errors.New("mount failed")
+	f.alive = false
+
+	f.check(f.lockVolume)
+	assert.Equal(t, 1, f.restarts)
+	// within the backoff of the failed restart
+	f.check(f.lockVolume)
+	assert.Equal(t, 1, f.restarts)
+
+	f.tick()
+	assert.Equal(t, 2, f.restarts)
+	assert.Empty(t, f.rebinds)
+}
+
+func TestClientSupervisorGivesUpAfterCap(t *testing.T) {
+	f := newFakeClientSupervisor(2)
+	f.restartErr = errors.New("mount failed")
+	f.alive = false
+
+	for i := 0; i < 5; i++ {
+		f.tick()
+	}
+	assert.Equal(t, 2, f.restarts)
+
+	condition := f.condition("pvc-1")
+	assert.True(t, condition.Abnormal)
+	assert.Contains(t, condition.Message, "mount failed")
+	assert.Nil(t, f.condition("pvc-2"))
+
+	// unstaging stops supervising the volume
+	f.unwatch("/staging")
+	assert.Nil(t, f.condition("pvc-1"))
+}
+
+func TestClientSupervisorUnpublish(t *testing.T) {
+	f := newFakeClientSupervisor(3)
+	f.unpublish("/target")
+	f.alive = false
+
+	f.tick()
+	assert.Equal(t, 1, f.restarts)
+	assert.Empty(t, f.rebinds)
+}
+
+func TestClientSupervisorEnsureConf(t *testing.T) {
+	f := newFakeClientSupervisor(3)
+	// the client of the fake cannot drift
+	assert.NoError(t, f.ensureConf("/staging"))
+
+	ensured := 0
+	f.watch("pvc-2", "/staging-2", nil, func() error { return nil }, func() error {
+		ensured++
+		return nil
+	})
+	assert.NoError(t, f.ensureConf("/staging-2"))
+	assert.Equal(t, 1, ensured)
+
+	// nothing to ensure for a volume not staged
+	assert.NoError(t, f.ensureConf("/unknown"))
+}
+
+func TestClientSupervisorLocations(t *testing.T) {
+	f := newFakeClientSupervisor(3)
+	locations := map[string]string{KClientConfFile: "/cfs/conf/pvc-2.json", KLogDir: "/cfs/logs/pvc-2", KProfPort: "10094"}
+	f.watch("pvc-2", "/staging-2", locations, func() error { return nil }, nil)
+	assert.Equal(t, locations, f.locations("/staging-2"))
+	assert.Equal(t, map[string]string{"pvc-2": "10094"}, f.profPorts())
+	assert.Nil(t, f.locations("/staging-3"))
+}
+
+func TestClientSupervisorSkipsUnstagedClient(t *testing.T) {
+	f := newFakeClientSupervisor(3)
+	f.alive = false
+
+	// the volume is unstaged while the supervisor waits for its lock
+	f.check(func(volumeID string) func() {
+		f.unwatch("/staging")
+		return func() {}
+	})
+	assert.Equal(t, 0, f.restarts)
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// KClusterID is the volume context key of the kubernetes cluster the volume
+// was provisioned by, set from --cluster-id.
+const KClusterID = "clusterID"
+
+var clusterIDPattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,62}$`)
+
+// validateClusterID checks the cluster id of --cluster-id.
+func validateClusterID(id string) error {
+	if !clusterIDPattern.MatchString(id) {
+		return fmt.Errorf("invalid cluster id %q, must be at most 63 letters, digits, '.', '_' or '-'", id)
+	}
+	return nil
+}
+
+// ownedByOtherCluster reports whether the volume was provisioned by another
+// cluster than the one of clusterID, according to the volume store. As the
+// master does not record the cluster, the volumes without a recorded cluster,
+// e.g. created before --cluster-id was set or missing from the store of this
+// controller, are unknown and not taken as owned by another cluster.
+func ownedByOtherCluster(store volumeStore, clusterID, volumeID string) (bool, error) {
+	meta, err := store.get(volumeID)
+	if err != nil || meta == nil {
+		return false, err
+	}
+	return len(meta.ClusterID) != 0 && meta.ClusterID != clusterID, nil
+}
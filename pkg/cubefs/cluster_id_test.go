@@ -0,0 +1,119 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/cubefs/cubefs-csi/pkg/mockmaster"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateClusterID(t *testing.T) {
+	for _, id := range []string{"prod", "eu-west-1.k8s", "c_1"} {
+		assert.NoError(t, validateClusterID(id), id)
+	}
+	for _, id := range []string{"", "-prod", "prod cluster", "prod/1", string(make([]byte, 64))} {
+		assert.Error(t, validateClusterID(id), id)
+	}
+}
+
+func TestCreateVolumeClusterID(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+
+	store, err := newFileVolumeStore(t.TempDir())
+	assert.NoError(t, err)
+	conf := fakeConfig
+	conf.ClusterID = "prod"
+	conf.volumeStore = store
+	cs := newFakeControllerServer(conf)
+
+	resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "pvc-stamped",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 5 << 30},
+		Parameters:    map[string]string{KMasterAddr: master.Addr(), KOwner: "csiuser", KClusterID: "spoofed"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "prod", resp.Volume.VolumeContext[KClusterID])
+
+	meta, err := store.get("pvc-stamped")
+	assert.NoError(t, err)
+	assert.Equal(t, "prod", meta.ClusterID)
+}
+
+func TestListVolumesClusterID(t *testing.T) {
+	store, err := newFileVolumeStore(t.TempDir())
+	assert.NoError(t, err)
+	assert.NoError(t, store.put("pvc-1", &volumeMetadata{Owner: "csiuser", ClusterID: "prod"}))
+	assert.NoError(t, store.put("pvc-2", &volumeMetadata{Owner: "csiuser", ClusterID: "staging"}))
+	assert.NoError(t, store.put("pvc-3", &volumeMetadata{Owner: "csiuser"}))
+	assert.NoError(t, store.put("pvc-5", &volumeMetadata{Owner: "csiuser", ClusterID: "prod"}))
+
+	conf := fakeConfig
+	conf.ClusterID = "prod"
+	conf.volumeStore = store
+	// the master paginates the unfiltered list, so its pagination is not used
+	conf.MasterListPagination = true
+	withFakeDefaultMaster(t, &conf, func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.URL.Query().Get("offset"))
+		fmt.Fprint(w, `{"code":0,"msg":"success","data":[`+
+			`{"Name":"pvc-1"},{"Name":"pvc-2"},{"Name":"pvc-3"},{"Name":"pvc-4"},{"Name":"pvc-5"}]}`)
+	})
+	cs := newFakeControllerServer(conf)
+
+	listed := func(resp *csi.ListVolumesResponse) []string {
+		var names []string
+		for _, entry := range resp.Entries {
+			names = append(names, entry.Volume.VolumeId)
+		}
+		return names
+	}
+
+	// the volumes without a recorded cluster are unknown, only those of other clusters are left out
+	resp, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"pvc-1", "pvc-3", "pvc-4", "pvc-5"}, listed(resp))
+
+	resp, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"pvc-1", "pvc-3", "pvc-4"}, listed(resp))
+	assert.Equal(t, "3", resp.NextToken)
+
+	resp, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 3, StartingToken: resp.NextToken})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"pvc-5"}, listed(resp))
+	assert.Empty(t, resp.NextToken)
+}
+
+func TestOwnedByOtherCluster(t *testing.T) {
+	store, err := newFileVolumeStore(t.TempDir())
+	assert.NoError(t, err)
+	assert.NoError(t, store.put("pvc-1", &volumeMetadata{ClusterID: "prod"}))
+	assert.NoError(t, store.put("pvc-2", &volumeMetadata{ClusterID: "staging"}))
+	assert.NoError(t, store.put("pvc-3", &volumeMetadata{}))
+
+	for volumeID, expected := range map[string]bool{"pvc-1": false, "pvc-2": true, "pvc-3": false, "pvc-missing": false} {
+		other, err := ownedByOtherCluster(store, "prod", volumeID)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, other, volumeID)
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const redacted = "<redacted>"
+
+// configRedactions rewrites the Config fields which may carry credentials
+// before they are reported.
+var configRedactions = map[string]func(value interface{}) interface{}{
+	// the headers usually authenticate the driver to a gateway
+	"MasterHeaders": func(value interface{}) interface{} {
+		headers := make(map[string]string)
+		for k := range value.(map[string]string) {
+			headers[k] = redacted
+		}
+		return headers
+	},
+	// the userinfo and the query of the url may hold a token
+	"WebhookURL": func(value interface{}) interface{} {
+		return redactURL(value.(string))
+	},
+	"PolicyWebhookURL": func(value interface{}) interface{} {
+		return redactURL(value.(string))
+	},
+	"TracingEndpoint": func(value interface{}) interface{} {
+		return redactURL(value.(string))
+	},
+}
+
+// redactURL masks the password and the query of rawURL, or the whole of it if
+// it does not parse.
+func redactURL(rawURL string) string {
+	if len(rawURL) == 0 {
+		return rawURL
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redacted
+	}
+	if len(u.RawQuery) != 0 {
+		u.RawQuery = redacted
+	}
+
+	return u.Redacted()
+}
+
+// effectiveConfig returns the exported fields of conf by name, with the
+// durations formatted and the credentials redacted.
+func effectiveConfig(conf *Config) map[string]interface{} {
+	report := make(map[string]interface{})
+	v := reflect.ValueOf(*conf)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		value := v.Field(i).Interface()
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		if redact, ok := configRedactions[field.Name]; ok {
+			value = redact(value)
+		}
+		report[field.Name] = value
+	}
+
+	return report
+}
+
+// configHandler serves the effective configuration of the driver as JSON.
+type configHandler struct {
+	conf *Config
+}
+
+func (h *configHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(effectiveConfig(h.conf)); err != nil {
+		glog.Warningf("write config report fail. err:%v", err)
+	}
+}
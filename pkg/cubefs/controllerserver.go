@@ -17,6 +17,9 @@ limitations under the License.
 package cubefs
 
 import (
+	"fmt"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -25,72 +28,284 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	v1 "k8s.io/api/core/v1"
 )
 
+// time the deletion of a volume whose create failed is given, independently of
+// the deadline of the create request which may have expired already
+const rollbackTimeout = time.Minute
+
 type controllerServer struct {
 	*csicommon.DefaultControllerServer
-	driver *driver
+	driver      *driver
+	attachments *attachmentTracker
 }
 
-func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+// checkWritable refuses the RPCs mutating the volumes of a read-only controller.
+func (cs *controllerServer) checkWritable(rpc string) error {
+	if cs.driver.ReadOnlyController {
+		return status.Errorf(codes.PermissionDenied, "%s is refused by the read-only controller", rpc)
+	}
+	return nil
+}
+
+func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (_ *csi.CreateVolumeResponse, err error) {
+	ctx, span := cs.driver.tracer.start(ctx, "CreateVolume", spanKindServer)
+	span.setAttribute("csi.volume", req.GetName())
+	defer func() { span.finish(err) }()
+
+	if err := cs.checkWritable("CreateVolume"); err != nil {
+		return nil, err
+	}
+
 	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
 		return nil, err
 	}
 
+	if err := cs.validateRequestSize(req.GetName(), req.GetParameters()); err != nil {
+		return nil, err
+	}
+
+	if err := checkFsTypes(req.GetVolumeCapabilities(), cs.driver.FsTypes); err != nil {
+		return nil, err
+	}
+
+	// there are no snapshots to restore from, creating an empty volume instead
+	// would silently lose the data the CO expects to find in it
+	if req.GetVolumeContentSource() != nil {
+		return nil, status.Error(codes.InvalidArgument, "creating a volume from a snapshot or another volume is not supported")
+	}
+	// neither are snapshot groups, the parameter would be ignored otherwise
+	if group := req.GetParameters()[KSnapshotGroup]; len(group) != 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "restoring from snapshot group %q is not supported by the master", group)
+	}
+
 	start := time.Now()
-	// Volume Size - Default is 1 GiB
 	capacity := req.GetCapacityRange().GetRequiredBytes()
-	capacityGB := capacity >> 30
-	if capacityGB == 0 {
-		return nil, status.Error(codes.InvalidArgument, "apply for at least 1GB of space")
+	capacityGB := (capacity + 1<<30 - 1) >> 30
+	if req.GetParameters()[KUnlimited] == "true" {
+		if cs.driver.UnlimitedCapacityGB <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "unlimited volumes are not allowed, the driver must be started with --unlimited-capacity-gb")
+		}
+
+		// the volume is bounded by the cluster only, so its capacity is reported unknown
+		capacityGB, capacity = cs.driver.UnlimitedCapacityGB, 0
+	} else if noCapacityRequested(req.GetCapacityRange()) && cs.driver.NoCapacityMode == noCapacityReject {
+		glog.Warningf("no capacity requested for volume[%v], reject it", req.GetName())
+		return nil, status.Errorf(codes.InvalidArgument,
+			"no capacity requested for volume %v, the driver is started with --no-capacity-mode=reject", req.GetName())
+	} else if noCapacityRequested(req.GetCapacityRange()) {
+		capacityGB = cs.driver.DefaultCapacityGB
+		if capacityGB <= 0 {
+			capacityGB = 1
+		}
+		glog.Infof("no capacity requested for volume[%v], create it with the default capacity of %dGiB",
+			req.GetName(), capacityGB)
+		capacity = capacityGB << 30
+	} else if capacity < 1<<30 && cs.driver.MinVolumeSizeMode == minVolumeSizeStrict {
+		return nil, status.Errorf(codes.OutOfRange,
+			"requested %d bytes is below the minimum volume size of 1GiB, check the unit of the requested storage", capacity)
+	} else if capacity < 1<<30 {
+		glog.Infof("requested %d bytes of volume[%v] is below the minimum volume size, create it with 1GiB",
+			capacity, req.GetName())
+		capacityGB, capacity = 1, 1<<30
+	} else if cs.driver.NoRoundUp {
+		if err := checkWholeGB(capacity); err != nil {
+			return nil, err
+		}
+	}
+	if limit := req.GetCapacityRange().GetLimitBytes(); capacity != 0 && limit > 0 && capacityGB<<30 > limit {
+		return nil, status.Errorf(codes.OutOfRange, "no capacity in whole GB within [%d, %d] bytes",
+			req.GetCapacityRange().GetRequiredBytes(), limit)
+	}
+	if capacity != 0 {
+		// the volume is created with the capacity rounded up to whole GiB
+		capacity = capacityGB << 30
 	}
 
 	volName := req.GetName()
-	cfsServer, err := newCfsServer(volName, req.GetParameters())
+	if cs.driver.VolumeNameFromPVC {
+		if name, ok := pvcVolumeName(volName, req.GetParameters()); ok {
+			volName = name
+		} else {
+			glog.Warningf("the PVC of volume[%v] is not passed, keep the name. the csi-provisioner needs --extra-create-metadata", volName)
+		}
+	}
+
+	cfsServer, err := newCfsServer(volName, req.GetParameters(), &cs.driver.Config)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	cfsServer.applySecrets(req.GetSecrets())
+	cfsServer.bindContext(ctx)
+
+	if _, err := cfsServer.validateParameters(); err != nil {
+		return nil, err
+	}
+
+	if id := cs.driver.ClusterID; len(id) != 0 {
+		cfsServer.clientConf[KClusterID] = id
+	}
+
+	topology, err := nodePoolTopology(cs.driver.nodePools, cfsServer.clientConf)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	if err := cfsServer.createVolume(capacityGB); err != nil {
+	if err := cfsServer.applyZoneList(); err != nil {
 		return nil, err
 	}
 
+	// the policy applies to the effective parameters, including the defaults
+	// of the driver and the ones implied by the zoneList
+	if err := cs.driver.parameterPolicy.check(cfsServer.clientConf); err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	if ratio := cs.driver.InodeHeadroomRatio; ratio > 0 {
+		if err := cfsServer.checkInodeHeadroom(ratio); err != nil {
+			if pvc, ok := pvcReference(req.GetParameters()); ok {
+				cs.driver.recordFailureEvent(ctx, pvc, eventCreateVolumeFailed, err)
+			}
+			return nil, err
+		}
+	}
+
+	if cs.driver.policyWebhook != nil {
+		if err := cs.driver.policyWebhook.review(ctx, policyReview{
+			Name:          req.GetName(),
+			Volume:        volName,
+			CapacityBytes: capacityGB << 30,
+			Parameters:    reviewParameters(req.GetParameters()),
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	err = cfsServer.createVolume(capacityGB)
+	cs.audit(auditEntry{
+		Operation:      auditCreate,
+		Volume:         volName,
+		Owner:          cfsServer.clientConf[KOwner],
+		RequestedBytes: req.GetCapacityRange().GetRequiredBytes(),
+		CapacityBytes:  capacityGB << 30,
+	}, err)
+	if err != nil {
+		if pvc, ok := pvcReference(req.GetParameters()); ok {
+			cs.driver.recordFailureEvent(ctx, pvc, eventCreateVolumeFailed, err)
+		}
+		return nil, err
+	}
+	cs.driver.recentCreates.add(cfsServer.clientConf[KVolumeName])
+
+	if requested := req.GetCapacityRange().GetRequiredBytes(); requested > 0 {
+		cfsServer.clientConf[KRequestedBytes] = strconv.FormatInt(requested, 10)
+	}
+	cfsServer.clientConf[KProvisionedBytes] = strconv.FormatInt(capacityGB<<30, 10)
+
+	if err := cfsServer.checkRootPath(); err != nil {
+		rollbackCreate(cfsServer, err)
+		return nil, err
+	}
+
+	if zone := cfsServer.clientConf[KZoneName]; len(cs.driver.nodePools) > 0 && len(zone) != 0 {
+		topology = cs.placedTopology(cfsServer, zone, topology)
+	}
+
+	if store := cs.driver.volumeStore; store != nil {
+		// the later requests rely on the store, so the volume is only created
+		// once its metadata is recorded
+		if err := store.put(volName, newVolumeMetadata(cfsServer.clientConf)); err != nil {
+			err = status.Errorf(codes.Internal, "record metadata of volume[%v] failed, err: %v", volName, err)
+			rollbackCreate(cfsServer, err)
+			return nil, err
+		}
+	}
+
 	duration := time.Since(start)
 	glog.V(0).Infof("create volume[%v] success. cost time:%v", volName, duration)
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      volName,
-			CapacityBytes: capacity,
-			VolumeContext: cfsServer.clientConf,
+			VolumeId:           volName,
+			CapacityBytes:      capacity,
+			VolumeContext:      cfsServer.clientConf,
+			AccessibleTopology: topology,
 		},
 	}, nil
 }
 
-func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (_ *csi.DeleteVolumeResponse, err error) {
+	ctx, span := cs.driver.tracer.start(ctx, "DeleteVolume", spanKindServer)
+	span.setAttribute("csi.volume", req.GetVolumeId())
+	defer func() { span.finish(err) }()
+
+	if err := cs.checkWritable("DeleteVolume"); err != nil {
+		return nil, err
+	}
+
 	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME); err != nil {
 		return nil, err
 	}
 
 	volumeName := req.VolumeId
+	if len(volumeName) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+
+	if err := cs.validateRequestSize(volumeName, nil); err != nil {
+		return nil, err
+	}
+
 	persistentVolume, err := cs.driver.queryPersistentVolumes(ctx, volumeName)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "not found PersistentVolume[%v], error:%v", volumeName, err)
 	}
 
+	if err := checkDeleteGuard(persistentVolume); err != nil {
+		return nil, err
+	}
+
 	param := persistentVolume.Spec.CSI.VolumeAttributes
-	cfsServer, err := newCfsServer(volumeName, param)
+	cfsServer, err := newCfsServer(volumeName, param, &cs.driver.Config)
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
+	cfsServer.applySecrets(req.GetSecrets())
+	cfsServer.bindContext(ctx)
 
-	err = cfsServer.deleteVolume()
+	if cs.driver.BlockDeleteInUse {
+		err = cfsServer.checkNotInUse()
+	}
+	if err == nil {
+		if cs.driver.AsyncDelete {
+			err = cfsServer.deleteVolumeAsync(ctx, cs.driver.AsyncDeletePollInterval)
+		} else {
+			err = cfsServer.deleteVolume()
+		}
+	}
+	pvCapacity := persistentVolume.Spec.Capacity[v1.ResourceStorage]
+	cs.audit(auditEntry{
+		Operation:     auditDelete,
+		Volume:        volumeName,
+		Owner:         cfsServer.clientConf[KOwner],
+		PreviousBytes: pvCapacity.Value(),
+	}, err)
 	if err != nil {
+		cs.driver.recordFailureEvent(ctx, pvReference(persistentVolume), eventDeleteVolumeFailed, err)
+		if code := status.Code(err); code == codes.FailedPrecondition || code == codes.DeadlineExceeded || code == codes.Canceled {
+			return nil, err
+		}
 		return nil, status.Error(codes.Unknown, err.Error())
 	} else {
 		glog.V(0).Infof("delete volume:%v success.", volumeName)
 	}
 
+	if store := cs.driver.volumeStore; store != nil {
+		if err := store.delete(volumeName); err != nil {
+			glog.Warningf("remove metadata of volume[%v] failed, err: %v", volumeName, err)
+		}
+	}
+
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
@@ -101,6 +316,10 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 		}
 	}
 
+	if err := checkFsTypes(req.VolumeCapabilities, cs.driver.FsTypes); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: status.Convert(err).Message()}, nil
+	}
+
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
 			VolumeCapabilities: req.VolumeCapabilities,
@@ -108,27 +327,532 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 	}, nil
 }
 
-func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	pvName := req.VolumeId
-	pv, err := cs.driver.ClientSet.CoreV1().PersistentVolumes().Get(ctx, pvName, metav1.GetOptions{})
+func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (_ *csi.ControllerExpandVolumeResponse, err error) {
+	ctx, span := cs.driver.tracer.start(ctx, "ControllerExpandVolume", spanKindServer)
+	span.setAttribute("csi.volume", req.GetVolumeId())
+	defer func() { span.finish(err) }()
+
+	if err := cs.checkWritable("ControllerExpandVolume"); err != nil {
+		return nil, err
+	}
+
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME); err != nil {
+		return nil, err
+	}
+
+	volumeID := req.VolumeId
+	if len(volumeID) == 0 || req.GetCapacityRange() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume id and capacity range are required")
+	}
+
+	if err := cs.validateRequestSize(volumeID, nil); err != nil {
+		return nil, err
+	}
+
+	pv, err := cs.driver.queryPersistentVolumes(ctx, volumeID)
 	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "Not found PersistentVolumes[%v], error:%v", pvName, err)
+		return nil, status.Errorf(codes.NotFound, "Not found PersistentVolume of volume[%v], error:%v", volumeID, err)
 	}
 
 	attr := pv.Spec.CSI.VolumeAttributes
-	cfsServer, err := newCfsServer(pvName, attr)
+	cfsServer, err := newCfsServer(volumeID, attr, &cs.driver.Config)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "newCfsServer[%v] error:%v", volumeID, err)
+	}
+	cfsServer.applySecrets(req.GetSecrets())
+	cfsServer.bindContext(ctx)
+
+	capacityGB, err := expandCapacityGB(req.GetCapacityRange(), !cs.driver.NoRoundUp)
 	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "newCfsServer[%v] error:%v", pvName, err)
+		return nil, err
 	}
 
-	capacityGB := req.CapacityRange.RequiredBytes >> 30
 	err = cfsServer.expandVolume(capacityGB)
+	pvCapacity := pv.Spec.Capacity[v1.ResourceStorage]
+	cs.audit(auditEntry{
+		Operation:      auditExpand,
+		Volume:         volumeID,
+		Owner:          cfsServer.clientConf[KOwner],
+		PreviousBytes:  pvCapacity.Value(),
+		RequestedBytes: req.GetCapacityRange().GetRequiredBytes(),
+		CapacityBytes:  capacityGB << 30,
+	}, err)
 	if err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "expandVolume[%v] error:%v", pvName, err)
+		cs.driver.recordFailureEvent(ctx, pvReference(pv), eventExpandVolumeFailed, err)
+		return nil, expandVolumeError(volumeID, err)
 	}
 
 	return &csi.ControllerExpandVolumeResponse{
-		CapacityBytes:         req.CapacityRange.RequiredBytes,
+		CapacityBytes:         capacityGB << 30,
 		NodeExpansionRequired: false,
 	}, nil
 }
+
+// expandVolumeError returns the error of expanding the volume to the CO. The
+// status errors, e.g. Unavailable while the masters are down, keep their code
+// so that the resizer retries, only the others are the request's fault.
+func expandVolumeError(volumeID string, err error) error {
+	if code := status.Code(err); code != codes.Unknown && code != codes.InvalidArgument {
+		return err
+	}
+	return status.Errorf(codes.InvalidArgument, "expandVolume[%v] error:%v", volumeID, err)
+}
+
+func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME); err != nil {
+		return nil, err
+	}
+
+	volumeID, nodeID := req.GetVolumeId(), req.GetNodeId()
+	if len(volumeID) == 0 || len(nodeID) == 0 || req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "volume id, node id and volume capability are required")
+	}
+
+	if err := cs.validateRequestSize(volumeID, req.GetVolumeContext()); err != nil {
+		return nil, err
+	}
+
+	// the volume context is copied, as newCfsServer fills the defaults into it
+	param := make(map[string]string, len(req.GetVolumeContext()))
+	for k, v := range req.GetVolumeContext() {
+		param[k] = v
+	}
+
+	cfsServer, err := newCfsServer(volumeID, param, &cs.driver.Config)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	cfsServer.applySecrets(req.GetSecrets())
+	cfsServer.bindContext(ctx)
+
+	if _, err := cfsServer.getVolume(); err != nil {
+		return nil, err
+	}
+
+	switch req.GetVolumeCapability().GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:
+		nodes := cs.attachments.nodesOf(volumeID)
+		if cs.driver.ClientSet != nil {
+			// the attachments recorded before a restart or by another replica
+			attached, err := attachedNodes(ctx, cs.driver.ClientSet, cs.driver.DriverName, volumeID)
+			if err != nil {
+				return nil, status.Errorf(codes.Unavailable, "list the attachments of volume[%v] fail: %v", volumeID, err)
+			}
+			nodes = append(nodes, attached...)
+		}
+
+		for _, node := range nodes {
+			if node != nodeID {
+				return nil, status.Errorf(codes.FailedPrecondition, "volume[%v] is already published to node %v", volumeID, node)
+			}
+		}
+	}
+
+	cs.attachments.attach(volumeID, nodeID)
+	glog.V(0).Infof("publish volume[%v] to node %v", volumeID, nodeID)
+	// the config file and the ports of the client depend on the node, which
+	// logs them and records them in its supervisor, only the log dir does not
+	publishContext := map[string]string{KLogDir: cfsServer.clientConf[KLogDir]}
+	return &csi.ControllerPublishVolumeResponse{PublishContext: publishContext}, nil
+}
+
+func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME); err != nil {
+		return nil, err
+	}
+
+	volumeID, nodeID := req.GetVolumeId(), req.GetNodeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+
+	if len(nodeID) == 0 {
+		// unpublish from all the nodes
+		for _, node := range cs.attachments.nodesOf(volumeID) {
+			cs.attachments.detach(volumeID, node)
+		}
+	} else {
+		cs.attachments.detach(volumeID, nodeID)
+	}
+
+	glog.V(0).Infof("unpublish volume[%v] from node %q", volumeID, nodeID)
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+// rollbackCreate deletes the volume created by cfsServer, as a later step of
+// CreateVolume failed with err and the CO may never retry it with the same
+// name. A volume which already existed before the request is kept.
+func rollbackCreate(cfsServer *cfsServer, err error) {
+	volName := cfsServer.clientConf[KVolumeName]
+	if !cfsServer.created {
+		glog.Warningf("create volume[%v] failed after it was found existing, keep it. err: %v", volName, err)
+		return
+	}
+
+	glog.Warningf("create volume[%v] failed after it was created, delete it. err: %v", volName, err)
+	// the create request may have failed as its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+	cfsServer.bindContext(ctx)
+	if deleteErr := cfsServer.deleteVolume(); deleteErr != nil {
+		glog.Errorf("delete volume[%v] after the failed create failed, it is orphaned on the master. err: %v", volName, deleteErr)
+	}
+}
+
+// audit records an operation in the audit log and posts it to the webhook,
+// if enabled. Failing to record or post it does not fail the operation, which
+// has already been sent to the master.
+func (cs *controllerServer) audit(entry auditEntry, err error) {
+	if cs.driver.webhook != nil {
+		cs.driver.webhook.notify(entry, err)
+	}
+
+	if cs.driver.auditLog == nil {
+		return
+	}
+
+	if err := cs.driver.auditLog.record(entry, err); err != nil {
+		glog.Errorf("record %v of volume[%v] in the audit log failed, err: %v", entry.Operation, entry.Volume, err)
+	}
+}
+
+// placedTopology returns the topology of the zones the master placed the
+// volume in, which may differ from the requested zone, e.g. when the master
+// falls back to another zone. The requested topology is kept if the volume
+// cannot be queried.
+func (cs *controllerServer) placedTopology(cfsServer *cfsServer, requestedZone string, requested []*csi.Topology) []*csi.Topology {
+	volName := cfsServer.clientConf[KVolumeName]
+	view, err := cfsServer.getVolume()
+	if err != nil || len(view.ZoneName) == 0 {
+		glog.Warningf("query the zone of volume[%v] failed, keep the topology of the requested zone %v. err: %v",
+			volName, requestedZone, err)
+		return requested
+	}
+
+	if view.ZoneName != requestedZone {
+		glog.Warningf("volume[%v] is placed in zone %v instead of the requested zone %v", volName, view.ZoneName, requestedZone)
+	}
+
+	topology, ok := placedTopology(cs.driver.nodePools, view.ZoneName)
+	if !ok {
+		// restricting the volume to the pools of other zones would be wrong
+		glog.Warningf("zone %v of volume[%v] is not served by a node pool, leave the volume accessible from all nodes",
+			view.ZoneName, volName)
+		return nil
+	}
+
+	return topology
+}
+
+// expandCapacityGB picks the capacity in GB to expand a volume to, which is
+// the required bytes rounded up to GB, clamped to the limit bytes if set.
+// Without roundUp, the required bytes must be a whole GB.
+func expandCapacityGB(capacityRange *csi.CapacityRange, roundUp bool) (int64, error) {
+	required, limit := capacityRange.GetRequiredBytes(), capacityRange.GetLimitBytes()
+	if required < 0 || limit < 0 {
+		return 0, status.Errorf(codes.InvalidArgument, "invalid capacity range [%d, %d]", required, limit)
+	}
+
+	if !roundUp {
+		if err := checkWholeGB(required); err != nil {
+			return 0, err
+		}
+	}
+
+	if limit > 0 && required > limit {
+		return 0, status.Errorf(codes.OutOfRange, "required bytes %d exceed limit bytes %d", required, limit)
+	}
+
+	capacityGB := (required + 1<<30 - 1) >> 30
+	if limit > 0 && capacityGB<<30 > limit {
+		capacityGB = limit >> 30
+		if capacityGB<<30 < required {
+			return 0, status.Errorf(codes.OutOfRange, "no capacity in whole GB within [%d, %d] bytes", required, limit)
+		}
+	}
+
+	if capacityGB == 0 {
+		return 0, status.Error(codes.InvalidArgument, "apply for at least 1GB of space")
+	}
+
+	return capacityGB, nil
+}
+
+// checkFsTypes rejects the mount capabilities whose fstype is not accepted,
+// an empty fstype stands for the primary one. Nil fsTypes accept any fstype.
+func checkFsTypes(caps []*csi.VolumeCapability, fsTypes []string) error {
+	if len(fsTypes) == 0 {
+		return nil
+	}
+
+	for _, cap := range caps {
+		fsType := cap.GetMount().GetFsType()
+		if len(fsType) != 0 && !containsString(fsTypes, fsType) {
+			return status.Errorf(codes.InvalidArgument, "fstype %q is not supported, must be one of %v", fsType, fsTypes)
+		}
+	}
+
+	return nil
+}
+
+// how the requests below the minimum volume size of 1GiB are handled
+const (
+	// create the volume with the minimum size
+	minVolumeSizeRoundUp = "round-up"
+	// reject the request, as it is likely a mistake of the unit
+	minVolumeSizeStrict = "strict"
+)
+
+// how the requests without a capacity are handled
+const (
+	// create the volume with the default capacity
+	noCapacityDefault = "default"
+	// reject the request, as a capacity is expected
+	noCapacityReject = "reject"
+)
+
+// noCapacityRequested reports whether the CO left the capacity of the volume
+// to the driver.
+func noCapacityRequested(capacityRange *csi.CapacityRange) bool {
+	return capacityRange.GetRequiredBytes() == 0 && capacityRange.GetLimitBytes() == 0
+}
+
+// checkWholeGB rejects the capacities which are not a whole GB, as they are
+// not rounded when the driver is started with --no-round-up.
+func checkWholeGB(bytes int64) error {
+	if bytes%(1<<30) != 0 {
+		return status.Errorf(codes.InvalidArgument,
+			"capacity %d bytes is not a whole GiB, request e.g. %dGi or %dGi, as --no-round-up is set",
+			bytes, bytes>>30, (bytes>>30)+1)
+	}
+
+	return nil
+}
+
+// validateRequestSize rejects oversize names and parameter maps, so that a buggy
+// or malicious CO cannot make the driver handle unbounded input.
+func (cs *controllerServer) validateRequestSize(name string, param map[string]string) error {
+	conf := cs.driver.Config
+	if conf.MaxNameLength > 0 && len(name) > conf.MaxNameLength {
+		return status.Errorf(codes.InvalidArgument, "name length %d exceeds the limit %d", len(name), conf.MaxNameLength)
+	}
+
+	if conf.MaxParameters > 0 && len(param) > conf.MaxParameters {
+		return status.Errorf(codes.InvalidArgument, "%d parameters exceed the limit %d", len(param), conf.MaxParameters)
+	}
+
+	if conf.MaxParametersSize > 0 {
+		size := 0
+		for k, v := range param {
+			size += len(k) + len(v)
+		}
+
+		if size > conf.MaxParametersSize {
+			return status.Errorf(codes.InvalidArgument, "parameters size %d exceeds the limit %d", size, conf.MaxParametersSize)
+		}
+	}
+
+	return nil
+}
+
+func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_VOLUMES); err != nil {
+		return nil, err
+	}
+
+	start := 0
+	if token := req.GetStartingToken(); token != "" {
+		var err error
+		if start, err = strconv.Atoi(token); err != nil || start < 0 {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q", token)
+		}
+	}
+
+	cfsServer, err := newClusterCfsServer(&cs.driver.Config)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	cfsServer.bindContext(ctx)
+
+	// a master paginating the list returns the volumes from start on, with one
+	// more than the page to tell whether there is a next page. Otherwise the
+	// whole list is skipped through, as it is when the volumes of other
+	// clusters are filtered out, which the master cannot do
+	clusterID := cs.driver.ClusterID
+	maxEntries := int(req.GetMaxEntries())
+
+	// only the entries of the page are kept, the other volumes are just counted
+	var resp *csi.ListVolumesResponse
+	var first string
+	total := 0
+	list := func(query string, skip int) error {
+		var filterErr error
+		err := cfsServer.streamVolumes(query, func() func(vol *cfsVolumeInfo) {
+			resp, first, total, filterErr = &csi.ListVolumesResponse{}, "", 0, nil
+			return func(vol *cfsVolumeInfo) {
+				if len(clusterID) != 0 && filterErr == nil {
+					other, err := ownedByOtherCluster(cs.driver.volumeStore, clusterID, vol.Name)
+					if err != nil {
+						filterErr = status.Errorf(codes.Internal, "read metadata of volume[%v] failed, err: %v", vol.Name, err)
+					}
+					if other || err != nil {
+						return
+					}
+				}
+
+				if total == 0 {
+					first = vol.Name
+				}
+				if total >= skip && (maxEntries <= 0 || total < skip+maxEntries) {
+					resp.Entries = append(resp.Entries, newListVolumesEntry(vol, cs.driver.InodeAbnormalRatio))
+				}
+				total++
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return filterErr
+	}
+
+	skip := start
+	if cs.driver.MasterListPagination && len(clusterID) == 0 {
+		limit := 0
+		if maxEntries > 0 {
+			limit = maxEntries + 1
+		}
+
+		// the first volume of the list tells a master ignoring the offset,
+		// which returns the first page for every token
+		var head string
+		if start > 0 {
+			if err := list(pageQuery(0, 1), 0); err != nil {
+				return nil, err
+			}
+			head = first
+		}
+
+		if err := list(pageQuery(start, limit), 0); err != nil {
+			return nil, err
+		}
+		skip = 0
+
+		if (limit > 0 && total > limit) || (start > 0 && total > 0 && first == head) {
+			glog.Warningf("the master ignores the offset or limit of the volume list, skip through the whole list")
+			skip = start
+			if err := list("", skip); err != nil {
+				return nil, err
+			}
+		}
+	} else if err := list("", skip); err != nil {
+		return nil, err
+	}
+
+	// the paginating master cannot tell a token beyond the end from the end
+	if skip > total || (skip == 0 && start > 0 && total == 0) {
+		return nil, status.Errorf(codes.Aborted, "starting token %q exceeds the volumes", req.GetStartingToken())
+	}
+
+	if len(resp.Entries) < total-skip {
+		resp.NextToken = strconv.Itoa(start + len(resp.Entries))
+	}
+
+	return resp, nil
+}
+
+// ControllerGetVolume returns the volume as listed by the master, with the
+// capacity requested by its PVC, if recorded in the volume store, and the one
+// provisioned by the master in its volume context.
+func (cs *controllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	if err := cs.Driver.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_GET_VOLUME); err != nil {
+		return nil, err
+	}
+
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume id is required")
+	}
+
+	if clusterID := cs.driver.ClusterID; len(clusterID) != 0 {
+		other, err := ownedByOtherCluster(cs.driver.volumeStore, clusterID, volumeID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "read metadata of volume[%v] failed, err: %v", volumeID, err)
+		}
+		if other {
+			return nil, status.Errorf(codes.NotFound, "volume[%v] not exists in cluster %v", volumeID, clusterID)
+		}
+	}
+
+	cfsServer, err := newClusterCfsServer(&cs.driver.Config)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	cfsServer.bindContext(ctx)
+
+	// the master lists the volumes whose name contains the keywords
+	var vol *cfsVolumeInfo
+	err = cfsServer.streamVolumes(url.QueryEscape(volumeID), func() func(v *cfsVolumeInfo) {
+		vol = nil
+		return func(v *cfsVolumeInfo) {
+			if v.Name == volumeID {
+				vol = v
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if vol == nil {
+		return nil, status.Errorf(codes.NotFound, "volume[%v] not exists", volumeID)
+	}
+
+	volumeContext := map[string]string{KProvisionedBytes: strconv.FormatInt(vol.TotalSize, 10)}
+	if store := cs.driver.volumeStore; store != nil {
+		meta, err := store.get(volumeID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "read metadata of volume[%v] failed, err: %v", volumeID, err)
+		}
+		if meta != nil && len(meta.RequestedBytes) != 0 {
+			volumeContext[KRequestedBytes] = meta.RequestedBytes
+		}
+		if meta != nil && len(meta.Description) != 0 {
+			volumeContext[KDescription] = meta.Description
+		}
+	}
+
+	entry := newListVolumesEntry(vol, cs.driver.InodeAbnormalRatio)
+	entry.Volume.VolumeContext = volumeContext
+	return &csi.ControllerGetVolumeResponse{
+		Volume: entry.Volume,
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			VolumeCondition: entry.Status.VolumeCondition,
+		},
+	}, nil
+}
+
+// newListVolumesEntry maps the volume listed by the master into a ListVolumes
+// entry, whose condition is abnormal if the volume is being deleted or is
+// running out of inodes.
+func newListVolumesEntry(vol *cfsVolumeInfo, inodeAbnormalRatio float64) *csi.ListVolumesResponse_Entry {
+	condition := &csi.VolumeCondition{Message: "volume is healthy"}
+	switch {
+	case vol.Status == volStatusMarkDelete:
+		condition.Abnormal = true
+		condition.Message = "volume is marked for deletion"
+	case vol.InodeLimit > 0 && float64(vol.InodeCount) >= float64(vol.InodeLimit)*inodeAbnormalRatio:
+		condition.Abnormal = true
+		condition.Message = fmt.Sprintf("volume is running out of inodes, inode usage %d/%d", vol.InodeCount, vol.InodeLimit)
+	case vol.InodeLimit > 0:
+		condition.Message = fmt.Sprintf("volume is healthy, inode usage %d/%d", vol.InodeCount, vol.InodeLimit)
+	}
+
+	return &csi.ListVolumesResponse_Entry{
+		Volume: &csi.Volume{
+			VolumeId:      vol.Name,
+			CapacityBytes: vol.TotalSize,
+		},
+		Status: &csi.ListVolumesResponse_VolumeStatus{
+			VolumeCondition: condition,
+		},
+	}
+}
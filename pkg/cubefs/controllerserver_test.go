@@ -0,0 +1,925 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/cubefs/cubefs-csi/pkg/csi-common"
+	"github.com/cubefs/cubefs-csi/pkg/mockmaster"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newFakeControllerServer(conf Config) *controllerServer {
+	csiDriver := csicommon.NewCSIDriver(DriverName, "1.0.0", "fakeNodeID", nil)
+	csiDriver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+	})
+
+	return NewControllerServer(&driver{CSIDriver: csiDriver, Config: conf})
+}
+
+func TestCreateVolumeRequestSizeLimits(t *testing.T) {
+	cs := newFakeControllerServer(Config{MaxNameLength: 16, MaxParameters: 2, MaxParametersSize: 32})
+
+	_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: strings.Repeat("x", 17),
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:       "pvc-limits",
+		Parameters: map[string]string{"a": "1", "b": "2", "c": "3"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:       "pvc-limits",
+		Parameters: map[string]string{KMasterAddr: strings.Repeat("m", 32)},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: strings.Repeat("x", 17)})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	assert.NoError(t, cs.validateRequestSize("pvc-limits", map[string]string{"a": "1", "b": "2"}))
+	assert.NoError(t, newFakeControllerServer(Config{}).validateRequestSize(strings.Repeat("x", 4096), nil))
+}
+
+// withFakeDefaultMaster points the default master addr of conf to a master served by handler.
+func withFakeDefaultMaster(t *testing.T, conf *Config, handler http.HandlerFunc) {
+	master := httptest.NewServer(handler)
+	t.Cleanup(master.Close)
+
+	path := filepath.Join(t.TempDir(), "masterAddr")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(master.Listener.Addr().String()), 0644))
+	source, err := newMasterAddrSource(path)
+	assert.NoError(t, err)
+	conf.masterAddrSource = source
+}
+
+func TestListVolumesCondition(t *testing.T) {
+	conf := fakeConfig
+	conf.InodeAbnormalRatio = 0.9
+	withFakeDefaultMaster(t, &conf, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/admin/listVols", r.URL.Path)
+		fmt.Fprint(w, `{"code":0,"msg":"success","data":[
+			{"Name":"pvc-healthy","TotalSize":10737418240,"InodeCount":100,"InodeLimit":1000},
+			{"Name":"pvc-inodes","TotalSize":21474836480,"InodeCount":950,"InodeLimit":1000},
+			{"Name":"pvc-deleting","Status":1,"TotalSize":1073741824},
+			{"Name":"pvc-legacy","TotalSize":1073741824,"InodeCount":5000}]}`)
+	})
+	cs := newFakeControllerServer(conf)
+
+	resp, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Entries, 4)
+	assert.Empty(t, resp.NextToken)
+
+	abnormal := make(map[string]bool)
+	for _, entry := range resp.Entries {
+		abnormal[entry.Volume.VolumeId] = entry.Status.VolumeCondition.Abnormal
+	}
+	assert.Equal(t, map[string]bool{
+		"pvc-healthy":  false,
+		"pvc-inodes":   true,
+		"pvc-deleting": true,
+		"pvc-legacy":   false,
+	}, abnormal)
+	assert.Equal(t, int64(21474836480), resp.Entries[1].Volume.CapacityBytes)
+	assert.Contains(t, resp.Entries[1].Status.VolumeCondition.Message, "950/1000")
+}
+
+func TestListVolumesPagination(t *testing.T) {
+	conf := fakeConfig
+	withFakeDefaultMaster(t, &conf, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"code":0,"msg":"success","data":[{"Name":"pvc-1"},{"Name":"pvc-2"},{"Name":"pvc-3"}]}`)
+	})
+	cs := newFakeControllerServer(conf)
+
+	resp, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 2})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Entries, 2)
+	assert.Equal(t, "2", resp.NextToken)
+
+	resp, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: resp.NextToken})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Entries, 1)
+	assert.Equal(t, "pvc-3", resp.Entries[0].Volume.VolumeId)
+	assert.Empty(t, resp.NextToken)
+
+	for _, token := range []string{"x", "-1", "4"} {
+		_, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: token})
+		assert.Equal(t, codes.Aborted, status.Code(err), "token %q", token)
+	}
+
+	_, err = newFakeControllerServer(fakeConfig).ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestListVolumesMasterPagination(t *testing.T) {
+	conf := fakeConfig
+	conf.MasterListPagination = true
+	var queries []url.Values
+	withFakeDefaultMaster(t, &conf, func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		queries = append(queries, query)
+		// the master has the volumes pvc-0 to pvc-4
+		offset, _ := strconv.Atoi(query.Get("offset"))
+		limit, _ := strconv.Atoi(query.Get("limit"))
+		var vols []string
+		for i := offset; i < 5 && (limit == 0 || i < offset+limit); i++ {
+			vols = append(vols, fmt.Sprintf(`{"Name":"pvc-%d"}`, i))
+		}
+		fmt.Fprintf(w, `{"code":0,"msg":"success","data":[%s]}`, strings.Join(vols, ","))
+	})
+	cs := newFakeControllerServer(conf)
+
+	resp, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: "2"})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Entries, 2)
+	assert.Equal(t, "pvc-2", resp.Entries[0].Volume.VolumeId)
+	assert.Equal(t, "4", resp.NextToken)
+	// the first volume is listed to tell whether the master honours the offset
+	assert.Equal(t, "0", queries[0].Get("offset"))
+	assert.Equal(t, "1", queries[0].Get("limit"))
+	assert.Equal(t, "2", queries[1].Get("offset"))
+	assert.Equal(t, "3", queries[1].Get("limit"))
+
+	resp, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: resp.NextToken})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Entries, 1)
+	assert.Empty(t, resp.NextToken)
+
+	resp, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Entries, 5)
+	assert.Empty(t, queries[4].Get("limit"))
+
+	_, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: "9"})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+}
+
+func TestListVolumesMasterIgnoresPagination(t *testing.T) {
+	for name, honoursLimit := range map[string]bool{"offset and limit": false, "offset": true} {
+		conf := fakeConfig
+		conf.MasterListPagination = true
+		withFakeDefaultMaster(t, &conf, func(w http.ResponseWriter, r *http.Request) {
+			// the master always lists from pvc-0, whatever the offset
+			limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+			var vols []string
+			for i := 0; i < 5 && (!honoursLimit || limit == 0 || i < limit); i++ {
+				vols = append(vols, fmt.Sprintf(`{"Name":"pvc-%d"}`, i))
+			}
+			fmt.Fprintf(w, `{"code":0,"msg":"success","data":[%s]}`, strings.Join(vols, ","))
+		})
+		cs := newFakeControllerServer(conf)
+
+		// the pages are skipped through by the driver instead of repeating the first one
+		var names []string
+		token := ""
+		for pages := 0; pages < 10; pages++ {
+			resp, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: token})
+			assert.NoError(t, err, name)
+			for _, entry := range resp.Entries {
+				names = append(names, entry.Volume.VolumeId)
+			}
+			if token = resp.NextToken; token == "" {
+				break
+			}
+		}
+		assert.Equal(t, []string{"pvc-0", "pvc-1", "pvc-2", "pvc-3", "pvc-4"}, names, name)
+	}
+}
+
+func TestListVolumesClientPagination(t *testing.T) {
+	conf := fakeConfig
+	withFakeDefaultMaster(t, &conf, func(w http.ResponseWriter, r *http.Request) {
+		// the master is not asked to paginate
+		assert.Empty(t, r.URL.Query().Get("offset"))
+		assert.Empty(t, r.URL.Query().Get("limit"))
+		fmt.Fprint(w, `{"code":0,"msg":"success","data":[{"Name":"pvc-0"},{"Name":"pvc-1"},{"Name":"pvc-2"}]}`)
+	})
+	cs := newFakeControllerServer(conf)
+
+	resp, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 1, StartingToken: "1"})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Entries, 1)
+	assert.Equal(t, "pvc-1", resp.Entries[0].Volume.VolumeId)
+	assert.Equal(t, "2", resp.NextToken)
+}
+
+func TestListVolumesStreamsLargeResponse(t *testing.T) {
+	const count = 50000
+	conf := fakeConfig
+	withFakeDefaultMaster(t, &conf, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, &volumeListReader{count: count})
+	})
+	cs := newFakeControllerServer(conf)
+
+	resp, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 10, StartingToken: "20000"})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Entries, 10)
+	assert.Equal(t, "pvc-20000", resp.Entries[0].Volume.VolumeId)
+	assert.Equal(t, "20010", resp.NextToken)
+
+	_, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: "50001"})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+}
+
+func TestControllerPublishVolume(t *testing.T) {
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("name") == "pvc-missing" {
+			writeMasterResponse(w, ErrCodeVolNotExists, "vol not exists")
+			return
+		}
+		fmt.Fprint(w, `{"code":0,"msg":"success","data":{"Name":"pvc-1","Capacity":10}}`)
+	}))
+	t.Cleanup(master.Close)
+
+	cs := newFakeControllerServer(fakeConfig)
+	publish := func(volumeID, nodeID string, mode csi.VolumeCapability_AccessMode_Mode) error {
+		_, err := cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+			VolumeId:         volumeID,
+			NodeId:           nodeID,
+			VolumeCapability: &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode}},
+			VolumeContext:    map[string]string{KMasterAddr: master.Listener.Addr().String(), KOwner: "csiuser"},
+		})
+		return err
+	}
+	unpublish := func(volumeID, nodeID string) {
+		_, err := cs.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+			VolumeId: volumeID,
+			NodeId:   nodeID,
+		})
+		assert.NoError(t, err)
+	}
+
+	multiWriter := csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
+	resp, err := cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+		VolumeId:         "pvc-1",
+		NodeId:           "node-a",
+		VolumeCapability: &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: multiWriter}},
+		VolumeContext:    map[string]string{KMasterAddr: master.Listener.Addr().String(), KOwner: "csiuser"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{KLogDir: "/cfs/logs/pvc-1"}, resp.PublishContext)
+	assert.NoError(t, publish("pvc-1", "node-a", multiWriter))
+	assert.NoError(t, publish("pvc-1", "node-b", multiWriter))
+	assert.NoError(t, publish("pvc-1", "node-b", multiWriter))
+	assert.Equal(t, []string{"node-a", "node-b"}, cs.attachments.nodesOf("pvc-1"))
+
+	unpublish("pvc-1", "node-a")
+	unpublish("pvc-1", "node-a")
+	assert.Equal(t, []string{"node-b"}, cs.attachments.nodesOf("pvc-1"))
+
+	// a single node volume cannot be published to another node
+	singleWriter := csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+	assert.Equal(t, codes.FailedPrecondition, status.Code(publish("pvc-1", "node-c", singleWriter)))
+	assert.NoError(t, publish("pvc-1", "node-b", singleWriter))
+
+	unpublish("pvc-1", "")
+	assert.Empty(t, cs.attachments.nodesOf("pvc-1"))
+	assert.NoError(t, publish("pvc-1", "node-c", singleWriter))
+
+	assert.Equal(t, codes.NotFound, status.Code(publish("pvc-missing", "node-a", multiWriter)))
+	assert.Empty(t, cs.attachments.nodesOf("pvc-missing"))
+	assert.Equal(t, codes.InvalidArgument, status.Code(publish("pvc-1", "", multiWriter)))
+}
+
+func TestReadOnlyController(t *testing.T) {
+	conf := fakeConfig
+	conf.ReadOnlyController = true
+	conf.masterAddrSource = &masterAddrSource{addrs: "127.0.0.1:1"}
+	caps, err := controllerCapabilities(&conf)
+	assert.NoError(t, err)
+	assert.NotContains(t, caps, csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME)
+	assert.NotContains(t, caps, csi.ControllerServiceCapability_RPC_EXPAND_VOLUME)
+	assert.Contains(t, caps, csi.ControllerServiceCapability_RPC_LIST_VOLUMES)
+
+	// refused even if the capabilities were advertised
+	cs := newFakeControllerServer(conf)
+	_, err = cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{Name: "pvc-ro", Parameters: map[string]string{KMasterAddr: "127.0.0.1:1"}})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "pvc-ro"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = cs.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+		VolumeId:      "pvc-ro",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30},
+	})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// the read RPCs are served
+	_, err = cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{VolumeId: "pvc-ro"})
+	assert.NotEqual(t, codes.PermissionDenied, status.Code(err))
+	_, err = cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	assert.NotEqual(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestExpandVolumeError(t *testing.T) {
+	for _, code := range []codes.Code{codes.Unavailable, codes.Internal, codes.NotFound, codes.FailedPrecondition, codes.DeadlineExceeded} {
+		assert.Equal(t, code, status.Code(expandVolumeError("pvc-1", status.Error(code, "failed"))), code.String())
+	}
+
+	err := expandVolumeError("pvc-1", status.Error(codes.InvalidArgument, "capacity too large"))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	err = expandVolumeError("pvc-1", fmt.Errorf("get owner failed"))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Contains(t, err.Error(), "pvc-1")
+}
+
+func TestExpandCapacityGB(t *testing.T) {
+	const gb = int64(1) << 30
+	for _, tc := range []struct {
+		required, limit int64
+		capacityGB      int64
+		code            codes.Code
+	}{
+		{required: 10 * gb, capacityGB: 10},
+		{required: 10*gb + 1, capacityGB: 11},
+		{required: 10 * gb, limit: 20 * gb, capacityGB: 10},
+		{required: 10*gb + 1, limit: 11 * gb, capacityGB: 11},
+		{required: 10 * gb, limit: 10 * gb, capacityGB: 10},
+		// rounding up exceeds the limit, clamp it to the largest GB within the limit
+		{required: 10*gb + 1, limit: 12*gb - 1, capacityGB: 11},
+		// no whole GB within the range
+		{required: 10*gb + 1, limit: 11*gb - 1, code: codes.OutOfRange},
+		{required: 20 * gb, limit: 10 * gb, code: codes.OutOfRange},
+		{limit: gb / 2, code: codes.InvalidArgument},
+		{required: -1, code: codes.InvalidArgument},
+	} {
+		capacityGB, err := expandCapacityGB(&csi.CapacityRange{RequiredBytes: tc.required, LimitBytes: tc.limit}, true)
+		assert.Equal(t, tc.code, status.Code(err), "%+v", tc)
+		assert.Equal(t, tc.capacityGB, capacityGB, "%+v", tc)
+	}
+}
+
+func TestNoRoundUp(t *testing.T) {
+	const gb = int64(1) << 30
+	capacityGB, err := expandCapacityGB(&csi.CapacityRange{RequiredBytes: 5*gb + gb/2}, false)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Contains(t, err.Error(), "5Gi or 6Gi")
+	assert.Equal(t, int64(0), capacityGB)
+	capacityGB, err = expandCapacityGB(&csi.CapacityRange{RequiredBytes: 6 * gb}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), capacityGB)
+
+	var capacities []string
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		capacities = append(capacities, r.URL.Query().Get("capacity"))
+		writeMasterResponse(w, 0, "success")
+	}))
+	t.Cleanup(master.Close)
+
+	createVolume := func(cs *controllerServer, required int64) (*csi.CreateVolumeResponse, error) {
+		return cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:          "pvc-exact",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: required},
+			Parameters:    map[string]string{KMasterAddr: master.Listener.Addr().String(), KOwner: "csiuser"},
+		})
+	}
+
+	conf := fakeConfig
+	resp, err := createVolume(newFakeControllerServer(conf), 2*gb+gb/2)
+	assert.NoError(t, err)
+	assert.Equal(t, 3*gb, resp.Volume.CapacityBytes)
+
+	conf.NoRoundUp = true
+	_, err = createVolume(newFakeControllerServer(conf), 2*gb+gb/2)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	resp, err = createVolume(newFakeControllerServer(conf), 3*gb)
+	assert.NoError(t, err)
+	assert.Equal(t, 3*gb, resp.Volume.CapacityBytes)
+	assert.Equal(t, []string{"3", "3"}, capacities)
+}
+
+func TestCreateVolumeUnlimited(t *testing.T) {
+	var capacities []string
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		capacities = append(capacities, r.URL.Query().Get("capacity"))
+		writeMasterResponse(w, 0, "success")
+	}))
+	t.Cleanup(master.Close)
+
+	createVolume := func(cs *controllerServer, unlimited string) (*csi.CreateVolumeResponse, error) {
+		return cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:          "pvc-unlimited",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 10 << 30},
+			Parameters: map[string]string{
+				KMasterAddr: master.Listener.Addr().String(),
+				KOwner:      "csiuser",
+				KUnlimited:  unlimited,
+			},
+		})
+	}
+
+	conf := fakeConfig
+	_, err := createVolume(newFakeControllerServer(conf), "true")
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Empty(t, capacities)
+
+	resp, err := createVolume(newFakeControllerServer(conf), "false")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10<<30), resp.Volume.CapacityBytes)
+
+	conf.UnlimitedCapacityGB = 1 << 20
+	resp, err = createVolume(newFakeControllerServer(conf), "true")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), resp.Volume.CapacityBytes)
+	assert.Equal(t, []string{"10", "1048576"}, capacities)
+}
+
+func TestCreateVolumeAudit(t *testing.T) {
+	code := 0
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeMasterResponse(w, code, "create vol failed")
+	}))
+	t.Cleanup(master.Close)
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	conf := fakeConfig
+	var err error
+	conf.auditLog, err = newAuditLog(path)
+	assert.NoError(t, err)
+	cs := newFakeControllerServer(conf)
+
+	req := &csi.CreateVolumeRequest{
+		Name:          "pvc-audit",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 10<<30 + 1},
+		Parameters:    map[string]string{KMasterAddr: master.Listener.Addr().String(), KOwner: "csiuser"},
+	}
+	_, err = cs.CreateVolume(context.Background(), req)
+	assert.NoError(t, err)
+	code = 1
+	_, err = cs.CreateVolume(context.Background(), req)
+	assert.Error(t, err)
+
+	entries := readAuditLog(t, path)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, auditCreate, entries[0].Operation)
+	assert.Equal(t, "pvc-audit", entries[0].Volume)
+	assert.Equal(t, "csiuser", entries[0].Owner)
+	assert.Equal(t, int64(10<<30+1), entries[0].RequestedBytes)
+	assert.Equal(t, int64(11<<30), entries[0].CapacityBytes)
+	assert.Equal(t, "success", entries[0].Result)
+	assert.Equal(t, "failure", entries[1].Result)
+	assert.NotEmpty(t, entries[1].Error)
+}
+
+func TestCreateVolumeContentSource(t *testing.T) {
+	cs := newFakeControllerServer(fakeConfig)
+	_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "pvc-restore",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 10 << 30},
+		Parameters:    map[string]string{KMasterAddr: "10.0.0.1:17010"},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "snap-1"},
+			},
+		},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	_, err = cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "pvc-restore",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 10 << 30},
+		Parameters:    map[string]string{KMasterAddr: "10.0.0.1:17010", KSnapshotGroup: "db-set"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Contains(t, err.Error(), "db-set")
+}
+
+func TestCheckFsTypes(t *testing.T) {
+	mountCap := func(fsType string) []*csi.VolumeCapability {
+		return []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType}},
+		}}
+	}
+
+	defaults := []string{"cubefs", "chubaofs"}
+	assert.NoError(t, checkFsTypes(mountCap("cubefs"), defaults))
+	assert.NoError(t, checkFsTypes(mountCap("chubaofs"), defaults))
+	assert.NoError(t, checkFsTypes(mountCap(""), defaults))
+	assert.Equal(t, codes.InvalidArgument, status.Code(checkFsTypes(mountCap("myfs"), defaults)))
+
+	custom := []string{"myfs", "cubefs"}
+	assert.NoError(t, checkFsTypes(mountCap("myfs"), custom))
+	assert.NoError(t, checkFsTypes(mountCap(""), custom))
+	assert.Equal(t, codes.InvalidArgument, status.Code(checkFsTypes(mountCap("chubaofs"), custom)))
+	assert.NoError(t, checkFsTypes(mountCap("anything"), nil))
+
+	conf := fakeConfig
+	conf.FsTypes = custom
+	cs := newFakeControllerServer(conf)
+	_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:               "pvc-fstype",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1 << 30},
+		VolumeCapabilities: mountCap("chubaofs"),
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	resp, err := cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "pvc-fstype",
+		VolumeCapabilities: mountCap("myfs"),
+	})
+	assert.NoError(t, err)
+	assert.NotNil(t, resp.Confirmed)
+	resp, err = cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "pvc-fstype",
+		VolumeCapabilities: mountCap("chubaofs"),
+	})
+	assert.NoError(t, err)
+	assert.Nil(t, resp.Confirmed)
+	assert.Contains(t, resp.Message, "chubaofs")
+}
+
+func TestCreateVolumeInodeHeadroom(t *testing.T) {
+	var usedGB int
+	var creates []string
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/admin/getCluster":
+			fmt.Fprintf(w, `{"code":0,"msg":"success","data":{"Name":"test","MetaNodeStatInfo":{"TotalGB":100,"UsedGB":%d,"UsedRatio":"0"}}}`, usedGB)
+		case "/admin/createVol":
+			creates = append(creates, r.URL.Query().Get("name"))
+			writeMasterResponse(w, 0, "success")
+		}
+	}))
+	t.Cleanup(master.Close)
+
+	conf := fakeConfig
+	conf.InodeHeadroomRatio = 0.9
+	cs := newFakeControllerServer(conf)
+	createVolume := func(name string) error {
+		_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:          name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30},
+			Parameters:    map[string]string{KMasterAddr: master.Listener.Addr().String(), KOwner: "csiuser"},
+		})
+		return err
+	}
+
+	usedGB = 89
+	assert.NoError(t, createVolume("pvc-below"))
+	usedGB = 90
+	assert.Equal(t, codes.ResourceExhausted, status.Code(createVolume("pvc-above")))
+	assert.Equal(t, []string{"pvc-below"}, creates)
+
+	// the check is disabled by default
+	cs = newFakeControllerServer(fakeConfig)
+	assert.NoError(t, createVolume("pvc-unchecked"))
+	assert.Equal(t, []string{"pvc-below", "pvc-unchecked"}, creates)
+}
+
+func TestCreateVolumeWithMockMaster(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+
+	cs := newFakeControllerServer(fakeConfig)
+	req := &csi.CreateVolumeRequest{
+		Name:          "pvc-mock",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 5 << 30},
+		Parameters:    map[string]string{KMasterAddr: master.Addr()},
+	}
+	resp, err := cs.CreateVolume(context.Background(), req)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5<<30), resp.Volume.CapacityBytes)
+
+	// the generated owner is returned in the volume context
+	vol, ok := master.Volume("pvc-mock")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(5), vol.CapacityGB)
+	assert.Equal(t, vol.Owner, resp.Volume.VolumeContext[KOwner])
+
+	// a retried request finds the volume created with its owner
+	req.Parameters = resp.Volume.VolumeContext
+	_, err = cs.CreateVolume(context.Background(), req)
+	assert.NoError(t, err)
+	retried, ok := master.Volume("pvc-mock")
+	assert.True(t, ok)
+	assert.Equal(t, vol.Owner, retried.Owner)
+}
+
+type failingVolumeStore struct{}
+
+func (failingVolumeStore) get(volumeID string) (*volumeMetadata, error) {
+	return nil, nil
+}
+
+func (failingVolumeStore) put(volumeID string, meta *volumeMetadata) error {
+	return fmt.Errorf("disk full")
+}
+
+func (failingVolumeStore) delete(volumeID string) error {
+	return nil
+}
+
+func TestCreateVolumeRollback(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+
+	cs := newFakeControllerServer(fakeConfig)
+	cs.driver.volumeStore = failingVolumeStore{}
+	createVolume := func(name string) error {
+		_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:          name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 5 << 30},
+			Parameters:    map[string]string{KMasterAddr: master.Addr(), KOwner: "csiuser"},
+		})
+		return err
+	}
+
+	// the volume created by the failed request is deleted
+	err := createVolume("pvc-new")
+	assert.Equal(t, codes.Internal, status.Code(err))
+	_, ok := master.Volume("pvc-new")
+	assert.False(t, ok)
+
+	// while a volume which already existed is kept
+	master.PutVolume(mockmaster.Volume{Name: "pvc-existing", Owner: "csiuser", CapacityGB: 5})
+	err = createVolume("pvc-existing")
+	assert.Equal(t, codes.Internal, status.Code(err))
+	_, ok = master.Volume("pvc-existing")
+	assert.True(t, ok)
+}
+
+func TestCreateVolumeRollbackAfterDeadline(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+	// the root path check times out after the volume is created
+	master.GetVolDelay = time.Second
+
+	cs := newFakeControllerServer(fakeConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:          "pvc-timeout",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 5 << 30},
+		Parameters:    map[string]string{KMasterAddr: master.Addr(), KOwner: "csiuser", KRootPath: "/team-a"},
+	})
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err))
+
+	// the volume is still deleted with a context of its own
+	_, ok := master.Volume("pvc-timeout")
+	assert.False(t, ok)
+}
+
+func TestCreateVolumeRootPathCheck(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+
+	cs := newFakeControllerServer(fakeConfig)
+	createVolume := func(name string) error {
+		_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:          name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 5 << 30},
+			Parameters:    map[string]string{KMasterAddr: master.Addr(), KOwner: "csiuser", KRootPath: "/team-a"},
+		})
+		return err
+	}
+
+	assert.NoError(t, createVolume("pvc-scoped"))
+	vol, ok := master.Volume("pvc-scoped")
+	assert.True(t, ok)
+	assert.Equal(t, "/team-a", vol.RootPath)
+
+	// a master without directory-scoped volumes ignores rootPath, so the
+	// volume it created is deleted rather than handed out whole
+	master.IgnoreRootPath = true
+	err := createVolume("pvc-unscoped")
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "the master does not support rootPath")
+	_, ok = master.Volume("pvc-unscoped")
+	assert.False(t, ok)
+}
+
+func TestCreateVolumeMinVolumeSize(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+
+	createVolume := func(cs *controllerServer, name string) (*csi.CreateVolumeResponse, error) {
+		return cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:          name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 100},
+			Parameters:    map[string]string{KMasterAddr: master.Addr(), KOwner: "csiuser"},
+		})
+	}
+
+	conf := fakeConfig
+	conf.MinVolumeSizeMode = minVolumeSizeRoundUp
+	resp, err := createVolume(newFakeControllerServer(conf), "pvc-round-up")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1<<30), resp.Volume.CapacityBytes)
+	vol, ok := master.Volume("pvc-round-up")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), vol.CapacityGB)
+
+	conf.MinVolumeSizeMode = minVolumeSizeStrict
+	_, err = createVolume(newFakeControllerServer(conf), "pvc-strict")
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+	assert.Contains(t, err.Error(), "100 bytes")
+	_, ok = master.Volume("pvc-strict")
+	assert.False(t, ok)
+
+	// rounding up must not exceed the limit
+	conf.MinVolumeSizeMode = minVolumeSizeRoundUp
+	for _, capacityRange := range []*csi.CapacityRange{
+		{RequiredBytes: 100, LimitBytes: 512 << 20},
+		{RequiredBytes: 2<<30 + 1, LimitBytes: 2<<30 + 512<<20},
+	} {
+		_, err = newFakeControllerServer(conf).CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:          "pvc-limited",
+			CapacityRange: capacityRange,
+			Parameters:    map[string]string{KMasterAddr: master.Addr(), KOwner: "csiuser"},
+		})
+		assert.Equal(t, codes.OutOfRange, status.Code(err), "%v", capacityRange)
+	}
+	_, ok = master.Volume("pvc-limited")
+	assert.False(t, ok)
+}
+
+func TestCreateVolumeNoCapacity(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+
+	createVolume := func(cs *controllerServer, name string) (*csi.CreateVolumeResponse, error) {
+		return cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:       name,
+			Parameters: map[string]string{KMasterAddr: master.Addr(), KOwner: "csiuser"},
+		})
+	}
+
+	// the default capacity is 1GB, even with the strict minimum volume size
+	conf := fakeConfig
+	conf.MinVolumeSizeMode = minVolumeSizeStrict
+	resp, err := createVolume(newFakeControllerServer(conf), "pvc-no-capacity")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1<<30), resp.Volume.CapacityBytes)
+
+	conf.NoCapacityMode = noCapacityDefault
+	conf.DefaultCapacityGB = 10
+	resp, err = createVolume(newFakeControllerServer(conf), "pvc-default-capacity")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10<<30), resp.Volume.CapacityBytes)
+	vol, ok := master.Volume("pvc-default-capacity")
+	assert.True(t, ok)
+	assert.Equal(t, uint64(10), vol.CapacityGB)
+
+	conf.NoCapacityMode = noCapacityReject
+	_, err = createVolume(newFakeControllerServer(conf), "pvc-rejected")
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Contains(t, err.Error(), "no capacity requested")
+	_, ok = master.Volume("pvc-rejected")
+	assert.False(t, ok)
+
+	// a capacity range with only a limit is a capacity requested, below the minimum volume size
+	_, err = newFakeControllerServer(conf).CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "pvc-limited",
+		CapacityRange: &csi.CapacityRange{LimitBytes: 5 << 30},
+		Parameters:    map[string]string{KMasterAddr: master.Addr(), KOwner: "csiuser"},
+	})
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+}
+
+func TestCreateVolumePlacedTopology(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+
+	pools, err := parseNodePools("ssd-zone:disktype=ssd,hdd-zone:disktype=hdd")
+	assert.NoError(t, err)
+	conf := fakeConfig
+	conf.nodePools = pools
+	cs := newFakeControllerServer(conf)
+
+	createVolume := func(name string, param map[string]string) *csi.CreateVolumeResponse {
+		param[KMasterAddr], param[KOwner] = master.Addr(), "csiuser"
+		resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:          name,
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30},
+			Parameters:    param,
+		})
+		assert.NoError(t, err)
+		return resp
+	}
+
+	// placed as requested
+	resp := createVolume("pvc-as-requested", map[string]string{KNodeSelector: "disktype=ssd"})
+	assert.Equal(t, []*csi.Topology{{Segments: map[string]string{"disktype": "ssd"}}}, resp.Volume.AccessibleTopology)
+
+	// the master falls back to another zone than the one of the node pool
+	master.PlaceZone = func(requested string) string { return "hdd-zone" }
+	resp = createVolume("pvc-fallback", map[string]string{KNodeSelector: "disktype=ssd"})
+	assert.Equal(t, []*csi.Topology{{Segments: map[string]string{"disktype": "hdd"}}}, resp.Volume.AccessibleTopology)
+	resp = createVolume("pvc-zone-fallback", map[string]string{KZoneName: "ssd-zone"})
+	assert.Equal(t, []*csi.Topology{{Segments: map[string]string{"disktype": "hdd"}}}, resp.Volume.AccessibleTopology)
+
+	// or to a zone of no node pool, which leaves the volume accessible from all nodes
+	master.PlaceZone = func(requested string) string { return "default" }
+	resp = createVolume("pvc-unpooled", map[string]string{KNodeSelector: "disktype=ssd"})
+	assert.Empty(t, resp.Volume.AccessibleTopology)
+
+	// the volumes without a zone are not restricted
+	master.PlaceZone = nil
+	resp = createVolume("pvc-anywhere", map[string]string{})
+	assert.Empty(t, resp.Volume.AccessibleTopology)
+}
+
+func TestControllerGetVolumeCapacities(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+
+	path := filepath.Join(t.TempDir(), "masterAddr")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(master.Addr()), 0644))
+	source, err := newMasterAddrSource(path)
+	assert.NoError(t, err)
+	store, err := newFileVolumeStore(t.TempDir())
+	assert.NoError(t, err)
+
+	conf := fakeConfig
+	conf.masterAddrSource = source
+	conf.volumeStore = store
+	cs := newFakeControllerServer(conf)
+
+	// the master is asked for whole GiB, rounded up
+	created, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "pvc-thin",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1536 << 20},
+		Parameters:    map[string]string{KOwner: "csiuser"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "1610612736", created.Volume.VolumeContext[KRequestedBytes])
+	assert.Equal(t, "2147483648", created.Volume.VolumeContext[KProvisionedBytes])
+
+	resp, err := cs.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "pvc-thin"})
+	assert.NoError(t, err)
+	assert.Equal(t, "pvc-thin", resp.Volume.VolumeId)
+	assert.Equal(t, int64(2<<30), resp.Volume.CapacityBytes)
+	assert.Equal(t, map[string]string{
+		KRequestedBytes:   "1610612736",
+		KProvisionedBytes: "2147483648",
+	}, resp.Volume.VolumeContext)
+	assert.False(t, resp.Status.VolumeCondition.Abnormal)
+
+	// the provisioned capacity is the one of the master, e.g. after an expand
+	vol, _ := master.Volume("pvc-thin")
+	vol.CapacityGB = 10
+	master.PutVolume(vol)
+	resp, err = cs.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "pvc-thin"})
+	assert.NoError(t, err)
+	assert.Equal(t, "10737418240", resp.Volume.VolumeContext[KProvisionedBytes])
+	assert.Equal(t, "1610612736", resp.Volume.VolumeContext[KRequestedBytes])
+
+	// only the exact name is returned, not the volumes containing it
+	master.PutVolume(mockmaster.Volume{Name: "pvc-thin-2", Owner: "csiuser", CapacityGB: 1})
+	_, err = cs.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "pvc-thi"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	// without the request of its PVC, a volume has its provisioned capacity only
+	resp, err = cs.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "pvc-thin-2"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{KProvisionedBytes: "1073741824"}, resp.Volume.VolumeContext)
+
+	// the description is kept in the volume store, as the master does not list it
+	_, err = cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "pvc-described",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30},
+		Parameters:    map[string]string{KOwner: "csiuser", KDescription: "team a\tlogs"},
+	})
+	assert.NoError(t, err)
+	resp, err = cs.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{VolumeId: "pvc-described"})
+	assert.NoError(t, err)
+	assert.Equal(t, "team alogs", resp.Volume.VolumeContext[KDescription])
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// how often a volume created moments ago is deleted again while the master
+// reports it missing, see deleteVolume
+const deleteGracePollInterval = 500 * time.Millisecond
+
+// errNotFoundInGrace is returned by the deletion of a volume created within
+// its grace period, which the master reports missing.
+var errNotFoundInGrace = errors.New("volume created moments ago not exists")
+
+// recentCreates remembers when the controller created the volumes, to tell a
+// volume not yet listed by a lagging master from a deleted one.
+type recentCreates struct {
+	mutex   sync.Mutex
+	grace   time.Duration
+	created map[string]time.Time
+	now     func() time.Time
+}
+
+func newRecentCreates(grace time.Duration) *recentCreates {
+	return &recentCreates{grace: grace, created: make(map[string]time.Time), now: time.Now}
+}
+
+// add records the creation of the volume, and forgets the volumes whose grace
+// period ended.
+func (r *recentCreates) add(volName string) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := r.now()
+	for name, created := range r.created {
+		if now.Sub(created) >= r.grace {
+			delete(r.created, name)
+		}
+	}
+	r.created[volName] = now
+}
+
+// remaining returns how long the grace period of the volume lasts, 0 if it
+// ended or the volume was not created by the controller.
+func (r *recentCreates) remaining(volName string) time.Duration {
+	if r == nil {
+		return 0
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	created, ok := r.created[volName]
+	if !ok {
+		return 0
+	}
+
+	if remaining := r.grace - r.now().Sub(created); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
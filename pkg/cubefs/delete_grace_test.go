@@ -0,0 +1,111 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRecentCreates(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	r := newRecentCreates(30 * time.Second)
+	r.now = func() time.Time { return now }
+
+	r.add("pvc-1")
+	assert.Equal(t, 30*time.Second, r.remaining("pvc-1"))
+	assert.Equal(t, time.Duration(0), r.remaining("pvc-2"))
+
+	now = now.Add(20 * time.Second)
+	r.add("pvc-2")
+	assert.Equal(t, 10*time.Second, r.remaining("pvc-1"))
+
+	// the volumes whose grace period ended are forgotten
+	now = now.Add(15 * time.Second)
+	assert.Equal(t, time.Duration(0), r.remaining("pvc-1"))
+	r.add("pvc-3")
+	assert.NotContains(t, r.created, "pvc-1")
+	assert.Equal(t, 15*time.Second, r.remaining("pvc-2"))
+
+	// disabled without a grace period
+	var disabled *recentCreates
+	disabled.add("pvc-1")
+	assert.Equal(t, time.Duration(0), disabled.remaining("pvc-1"))
+}
+
+// newLaggingMaster returns a cfsServer of a master which reports the volume
+// missing to the first lagging deletions, and counts the deletions.
+func newLaggingMaster(t *testing.T, lagging int32) (*cfsServer, *int32, *int32) {
+	var calls, deleted int32
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= lagging {
+			writeMasterResponse(w, ErrCodeVolNotExists, "vol not exists")
+			return
+		}
+		atomic.AddInt32(&deleted, 1)
+		writeMasterResponse(w, 0, "success")
+	})
+	return cs, &calls, &deleted
+}
+
+func TestDeleteVolumeNotFoundGrace(t *testing.T) {
+	// without a grace period, the volume not listed yet is left behind
+	cs, calls, deleted := newLaggingMaster(t, 1)
+	assert.NoError(t, cs.deleteVolume())
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+	assert.Equal(t, int32(0), atomic.LoadInt32(deleted))
+
+	// within the grace period it is deleted once the master lists it
+	cs, calls, deleted = newLaggingMaster(t, 1)
+	cs.conf.recentCreates = newRecentCreates(time.Minute)
+	cs.conf.recentCreates.add("pvc-fake")
+	assert.NoError(t, cs.deleteVolume())
+	assert.Equal(t, int32(2), atomic.LoadInt32(calls))
+	assert.Equal(t, int32(1), atomic.LoadInt32(deleted))
+
+	// the volumes created by others are taken as deleted
+	cs, calls, deleted = newLaggingMaster(t, 1)
+	cs.conf.recentCreates = newRecentCreates(time.Minute)
+	cs.conf.recentCreates.add("pvc-other")
+	assert.NoError(t, cs.deleteVolume())
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+	assert.Equal(t, int32(0), atomic.LoadInt32(deleted))
+
+	// a volume still missing at the end of its grace period is taken as deleted
+	cs, calls, deleted = newLaggingMaster(t, 100)
+	cs.conf.recentCreates = newRecentCreates(time.Second)
+	cs.conf.recentCreates.add("pvc-fake")
+	assert.NoError(t, cs.deleteVolume())
+	assert.Equal(t, int32(0), atomic.LoadInt32(deleted))
+	assert.True(t, atomic.LoadInt32(calls) >= 2)
+
+	// the deletion stops at the request deadline
+	cs, _, _ = newLaggingMaster(t, 100)
+	cs.conf.recentCreates = newRecentCreates(time.Minute)
+	cs.conf.recentCreates.add("pvc-fake")
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	cs.bindContext(ctx)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(cs.deleteVolume()))
+}
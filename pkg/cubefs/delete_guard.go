@@ -0,0 +1,72 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"fmt"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// KDeleteGuard makes DeleteVolume refuse to delete the volume unless its
+	// PersistentVolume is annotated with AnnConfirmDelete.
+	KDeleteGuard = "deleteGuard"
+	// AnnConfirmDelete confirms the deletion of a guarded volume.
+	AnnConfirmDelete = "csi.cubefs.com/confirm-delete"
+)
+
+// parseDeleteGuard returns whether the volume is guarded against deletion.
+func parseDeleteGuard(param map[string]string) (bool, error) {
+	value := param[KDeleteGuard]
+	if len(value) == 0 {
+		return false, nil
+	}
+
+	guarded, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q, must be true or false", KDeleteGuard, value)
+	}
+
+	return guarded, nil
+}
+
+// checkDeleteGuard fails with FailedPrecondition if the volume of pv is
+// guarded and its deletion is not confirmed. As DeleteVolume does not carry
+// the annotations of the PVC, the confirmation is put on the PersistentVolume,
+// and the provisioner retries the deletion until it is.
+func checkDeleteGuard(pv *v1.PersistentVolume) error {
+	if pv.Spec.CSI == nil {
+		return nil
+	}
+
+	guarded, err := parseDeleteGuard(pv.Spec.CSI.VolumeAttributes)
+	if err != nil {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	if !guarded || pv.Annotations[AnnConfirmDelete] == "true" {
+		return nil
+	}
+
+	return status.Errorf(codes.FailedPrecondition,
+		"volume[%v] is guarded against deletion, confirm it with \"kubectl annotate pv %s %s=true\"",
+		pv.Name, pv.Name, AnnConfirmDelete)
+}
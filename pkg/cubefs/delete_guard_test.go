@@ -0,0 +1,65 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newGuardedPV(guard string, annotations map[string]string) *v1.PersistentVolume {
+	return &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-guarded", Annotations: annotations},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				CSI: &v1.CSIPersistentVolumeSource{VolumeAttributes: map[string]string{KDeleteGuard: guard}},
+			},
+		},
+	}
+}
+
+func TestCheckDeleteGuard(t *testing.T) {
+	assert.NoError(t, checkDeleteGuard(newGuardedPV("", nil)))
+	assert.NoError(t, checkDeleteGuard(newGuardedPV("false", nil)))
+
+	err := checkDeleteGuard(newGuardedPV("true", nil))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "kubectl annotate pv pvc-guarded "+AnnConfirmDelete+"=true")
+
+	err = checkDeleteGuard(newGuardedPV("true", map[string]string{AnnConfirmDelete: "yes"}))
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// a confirmed delete goes ahead
+	assert.NoError(t, checkDeleteGuard(newGuardedPV("true", map[string]string{AnnConfirmDelete: "true"})))
+}
+
+func TestCreateVolumeDeleteGuard(t *testing.T) {
+	cs := newFakeControllerServer(fakeConfig)
+	_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "pvc-guarded",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30},
+		Parameters:    map[string]string{KMasterAddr: "10.0.0.1:17010", KDeleteGuard: "yes"},
+	})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
@@ -0,0 +1,152 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DiagnoseOptions controls the checks run by Diagnose.
+type DiagnoseOptions struct {
+	MasterAddr string
+	ClientBin  string
+	// skip mounting the throwaway volume, e.g. on a host without fuse
+	SkipMount bool
+}
+
+type diagnoser struct {
+	DiagnoseOptions
+	conf   *Config
+	out    io.Writer
+	failed int
+}
+
+// Diagnose checks whether the driver can work with the given CubeFS cluster:
+// it checks the master connectivity and the client binary, then creates,
+// mounts and deletes a throwaway volume. A report is written to out, and an
+// error is returned if any check failed.
+func Diagnose(conf Config, opts DiagnoseOptions, out io.Writer) error {
+	if opts.ClientBin == "" {
+		opts.ClientBin = CfsClientBin
+	}
+
+	d := &diagnoser{DiagnoseOptions: opts, conf: &conf, out: out}
+	d.run()
+	if d.failed > 0 {
+		return fmt.Errorf("%d diagnose check(s) failed", d.failed)
+	}
+
+	return nil
+}
+
+func (d *diagnoser) report(check string, err error) bool {
+	if err != nil {
+		d.failed++
+		fmt.Fprintf(d.out, "[FAIL] %s: %v\n", check, err)
+		return false
+	}
+
+	fmt.Fprintf(d.out, "[PASS] %s\n", check)
+	return true
+}
+
+func (d *diagnoser) skip(check string, reason string) {
+	fmt.Fprintf(d.out, "[SKIP] %s: %s\n", check, reason)
+}
+
+func (d *diagnoser) run() {
+	volName := fmt.Sprintf("csi-diagnose-%d", time.Now().Unix())
+	cs, err := newCfsServer(volName, map[string]string{
+		KMasterAddr: d.MasterAddr,
+		KOwner:      "csi_diagnose",
+	}, d.conf)
+	if !d.report("parse master addr", err) {
+		return
+	}
+
+	reachable := 0
+	for _, addr := range cs.masterAddrs {
+		if d.report(fmt.Sprintf("connect master %s", addr), cs.checkMaster(addr)) {
+			reachable++
+		}
+	}
+
+	clientOK := d.report(fmt.Sprintf("client binary %s", d.ClientBin), checkExecutable(d.ClientBin))
+	if reachable == 0 {
+		d.skip("create/mount/delete volume", "no master reachable")
+		return
+	}
+
+	if !d.report(fmt.Sprintf("create volume %s", volName), cs.createVolume(1)) {
+		return
+	}
+
+	switch {
+	case d.SkipMount:
+		d.skip("mount volume", "disabled")
+	case !clientOK:
+		d.skip("mount volume", "client binary not available")
+	default:
+		d.report("mount volume", d.mount(cs))
+	}
+
+	d.report(fmt.Sprintf("delete volume %s", volName), cs.deleteVolume())
+}
+
+// mount mounts the volume at a temporary directory and unmounts it again.
+func (d *diagnoser) mount(cs *cfsServer) error {
+	dir, err := ioutil.TempDir("", "csi-diagnose")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	mountPoint := filepath.Join(dir, "mnt")
+	if err := createMountPoint(mountPoint, d.conf.mountDirMode); err != nil {
+		return err
+	}
+
+	cs.clientConfFile = filepath.Join(dir, "client"+jsonFileSuffix)
+	cs.clientConf[KLogDir] = filepath.Join(dir, "logs")
+	if err := cs.persistClientConf(mountPoint); err != nil {
+		return err
+	}
+
+	if output, err := execCommandWithStdin(cs.clientStdin, d.ClientBin, cs.clientArgs...); err != nil {
+		return fmt.Errorf("%v, output: %s", err, output)
+	}
+
+	return umountVolume(mountPoint)
+}
+
+func checkExecutable(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if fi.IsDir() || fi.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%s is not an executable file", path)
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiagnose(t *testing.T) {
+	var paths []string
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		writeMasterResponse(w, 0, "success")
+	}))
+	defer master.Close()
+
+	out := &bytes.Buffer{}
+	err := Diagnose(fakeConfig, DiagnoseOptions{
+		MasterAddr: master.Listener.Addr().String(),
+		ClientBin:  filepath.Join(t.TempDir(), "cfs-client"),
+		SkipMount:  true,
+	}, out)
+
+	// the client binary is missing
+	assert.Error(t, err)
+	assert.Equal(t, []string{"/admin/getIp", "/admin/createVol", "/vol/delete"}, paths)
+	assert.Contains(t, out.String(), "[FAIL] client binary")
+	assert.Contains(t, out.String(), "[PASS] create volume")
+	assert.Contains(t, out.String(), "[SKIP] mount volume")
+	assert.Contains(t, out.String(), "[PASS] delete volume")
+}
+
+func TestDiagnoseMasterUnreachable(t *testing.T) {
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	addr := master.Listener.Addr().String()
+	master.Close()
+
+	out := &bytes.Buffer{}
+	conf := fakeConfig
+	conf.MasterRetryCount = 0
+	err := Diagnose(conf, DiagnoseOptions{MasterAddr: addr, SkipMount: true}, out)
+	assert.Error(t, err)
+	assert.True(t, strings.Contains(out.String(), "[FAIL] connect master"), out.String())
+	assert.Contains(t, out.String(), "[SKIP] create/mount/delete volume")
+}
@@ -15,8 +15,11 @@ package cubefs
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/cubefs/cubefs-csi/pkg/csi-common"
@@ -48,8 +51,210 @@ type Config struct {
 	Version        string
 	RemountDamaged bool
 	KubeletRootDir string
+
+	// retries of the master requests which failed with a transient error
+	MasterRetryCount    int
+	MasterRetryInterval time.Duration
+	// cap of the interval between two retries and deadline of all the retries
+	// of a master request, 0 leaves them unbounded
+	MasterRetryMaxInterval time.Duration
+	MasterRetryDeadline    time.Duration
+	// codes of the master responses retried like the unreachable masters
+	MasterRetryableCodes []int
+
+	// connection pool of the http client shared by the master requests
+	MasterMaxIdleConns        int
+	MasterMaxIdleConnsPerHost int
+	MasterIdleConnTimeout     time.Duration
+	// the master client shared by the controller and the node servers
+	masterClient *masterClient
+
+	// talk to the masters over https, verifying them against the CA file (the
+	// system roots if empty) and, if set, the expected certificate names
+	MasterTLS           bool
+	MasterTLSCAFile     string
+	MasterTLSIdentities []string
+	masterTLSConfig     *tls.Config
+
+	// path prefix of a gateway fronting the masters, prepended to the master api paths
+	MasterPathPrefix string
+
+	// minimum number of reachable masters to create, delete or expand a volume, 0 disables the check
+	MasterQuorum int
+
+	// file holding the master addr list used when a volume does not specify one
+	MasterAddrFile           string
+	MasterAddrReloadInterval time.Duration
+	masterAddrSource         *masterAddrSource
+
+	// limits of the controller requests, 0 means unlimited
+	MaxNameLength     int
+	MaxParameters     int
+	MaxParametersSize int
+
+	// static http headers attached to every master request
+	MasterHeaders map[string]string
+
+	// node pools the nodeSelector parameter can select, see parseNodePools
+	NodePools string
+	nodePools []nodePool
+
+	// volumes whose inode usage reaches this ratio of the limit are reported abnormal
+	InodeAbnormalRatio float64
+
+	// the master paginates the volume list with the offset and limit parameters
+	MasterListPagination bool
+
+	// refuse to create volumes once the meta nodes are used up to this ratio, 0 disables the check
+	InodeHeadroomRatio float64
+	// reject the expands exceeding the free data capacity of the cluster
+	ExpandCapacityCheck bool
+
+	// how the client configuration is handed to the client, see newClientConfDelivery
+	ClientConfDelivery string
+	clientConfDelivery clientConfDelivery
+	// the version of the client, to check the client options against
+	clientVersionProbe *clientVersionProbe
+
+	// interval of comparing the capacity of the volumes with the master, 0 disables it
+	CapacityReconcileInterval time.Duration
+	// expand the volumes shrunk on the master back to the capacity of their PersistentVolume
+	CapacityReconcileExpand bool
+
+	// file of the parameters allowed per namespace, see parameterPolicy
+	ParameterPolicyFile string
+	parameterPolicy     parameterPolicy
+
+	// how long a port handed to a client stays reserved, see portAllocator
+	PortReservationTTL time.Duration
+	portAllocator      *portAllocator
+	// ranges the exporter and prof ports of the clients are allocated in, any free port if empty
+	ExporterPortRange string
+	exporterPortRange *portRange
+	ProfPortRange     string
+	profPortRange     *portRange
+
+	// serve ControllerPublishVolume/ControllerUnpublishVolume for the external-attacher
+	EnableAttach bool
+
+	// address serving the metrics at /metrics, empty disables it
+	MetricsAddress string
+	// how often the resources used by the fuse clients are sampled into the metrics, 0 disables it
+	ClientStatsInterval time.Duration
+	// masters whose capacity is reported at /capacity, the default masters if empty
+	CapacityMasterAddr string
+	// how long the capacity report is cached
+	CapacityCacheTTL time.Duration
+	// what the total of the volume stats reflects, see reportsClusterCapacity
+	VolumeStatsTotal string
+	// how often the node plugin checks the fuse clients to restart the dead ones, 0 disables it
+	ClientSuperviseInterval time.Duration
+	// consecutive restarts of a client before giving up and reporting the volume abnormal
+	ClientRestartLimit int
+	// volumes mounted by a node at most, reported to the CO, 0 means unlimited
+	MaxVolumesPerNode int
+	// path of the prof port the clients are asked to flush at on shutdown, empty disables it
+	ShutdownFlushPath    string
+	ShutdownFlushTimeout time.Duration
+
+	// capacity of the volumes created with unlimited=true, 0 disallows them
+	UnlimitedCapacityGB int64
+
+	// reject the capacities which are not a whole GB instead of rounding them
+	NoRoundUp bool
+
+	// permission of the target and staging directories created by the node plugin
+	MountDirMode string
+	mountDirMode os.FileMode
+
+	// how the requests below 1GiB are handled, round-up or strict
+	MinVolumeSizeMode string
+
+	// how the requests without a capacity are handled, default or reject
+	NoCapacityMode string
+	// capacity of the volumes created without a capacity, 0 means 1GB
+	DefaultCapacityGB int64
+
+	// name the volumes after the namespace and name of their PVC
+	VolumeNameFromPVC bool
+
+	// wait for the master to remove a deleted volume, polling every interval
+	AsyncDelete             bool
+	AsyncDeletePollInterval time.Duration
+
+	// refuse to delete the volumes still mounted by clients
+	BlockDeleteInUse bool
+
+	// how long a volume the master reports missing right after its creation
+	// is deleted again, 0 takes it as deleted right away
+	DeleteNotFoundGrace time.Duration
+	recentCreates       *recentCreates
+
+	// try to load the fuse module if the fuse device is missing, needs a privileged node plugin
+	LoadFuseModule bool
+
+	// retries and timeout of every attempt of the client mount, independent of the master requests
+	MountRetryCount    int
+	MountRetryInterval time.Duration
+	MountTimeout       time.Duration
+
+	// controller features not advertised to the CO, see controllerCapabilities
+	DisabledFeatures []string
+	// refuse creating, deleting and expanding volumes, serving the read RPCs only
+	ReadOnlyController bool
+
+	// kubernetes cluster stamped onto the created volumes, ListVolumes only lists its volumes
+	ClusterID string
+
+	// fstypes accepted in the volume capabilities, the first one is the primary
+	FsTypes []string
+
+	// crossZone of the volumes without the parameter, empty leaves it to the master
+	DefaultCrossZone string
+
+	// zoneName of the volumes without the parameter, empty leaves it to the master
+	DefaultZone string
+
+	// consulAddr of the clients without the parameter, empty omits it for the deployments without consul
+	DefaultConsulAddr string
+	// the zones of the clusters validating the zoneList parameter
+	zoneCache *zoneCache
+
+	// directory persisting the volume metadata, empty disables the store
+	VolumeStoreDir string
+	volumeStore    volumeStore
+
+	// record events of the failed operations on the PVC or the PersistentVolume
+	EmitEvents bool
+	eventSink  eventSink
+
+	// file appending the volume lifecycle operations, empty disables the audit log
+	AuditLogFile string
+	auditLog     *auditLog
+
+	// endpoint the volume lifecycle operations are posted to, empty disables it
+	WebhookURL           string
+	WebhookRetries       int
+	WebhookRetryInterval time.Duration
+	webhook              *volumeWebhook
+
+	// endpoint every volume is validated by before it is created, empty disables it
+	PolicyWebhookURL      string
+	PolicyWebhookTimeout  time.Duration
+	PolicyWebhookFailOpen bool
+	policyWebhook         *policyWebhook
+
+	// OTLP/HTTP endpoint the spans of the volume operations are exported to, empty disables tracing
+	TracingEndpoint string
+	tracer          *tracer
 }
 
+// optional controller features, which can be disabled if the master does not support them
+const (
+	featureExpand = "expand"
+	featureList   = "list"
+)
+
 func NewDriver(conf Config) (*driver, error) {
 	glog.Infof("driverName:%v, version:%v, nodeID:%v", conf.DriverName, conf.Version, conf.NodeID)
 	clientSet, err := initClientSet(conf.KubeConfig)
@@ -58,16 +263,176 @@ func NewDriver(conf Config) (*driver, error) {
 		return nil, err
 	}
 
+	if conf.MasterAddrFile != "" {
+		source, err := newMasterAddrSource(conf.MasterAddrFile)
+		if err != nil {
+			glog.Errorf("load default master addr fail. err:%v", err)
+			return nil, err
+		}
+
+		go source.run(conf.MasterAddrReloadInterval)
+		conf.masterAddrSource = source
+	}
+
+	if conf.MasterPathPrefix, err = parseMasterPathPrefix(conf.MasterPathPrefix); err != nil {
+		glog.Errorf("parse master path prefix fail. err:%v", err)
+		return nil, err
+	}
+
+	if conf.MasterTLS {
+		if conf.masterTLSConfig, err = newMasterTLSConfig(conf.MasterTLSCAFile, conf.MasterTLSIdentities); err != nil {
+			glog.Errorf("init master tls config fail. err:%v", err)
+			return nil, err
+		}
+	}
+
+	if conf.EmitEvents {
+		conf.eventSink = newClientSetEventSink(clientSet)
+	}
+
+	conf.masterClient = newMasterClient(&conf, newMasterHTTPClient(&conf))
+
+	if conf.DeleteNotFoundGrace > 0 {
+		conf.recentCreates = newRecentCreates(conf.DeleteNotFoundGrace)
+	}
+	conf.portAllocator = newPortAllocator(conf.PortReservationTTL)
+	if conf.exporterPortRange, err = parsePortRange(conf.ExporterPortRange); err != nil {
+		glog.Errorf("parse exporter port range fail. err:%v", err)
+		return nil, err
+	}
+	if conf.profPortRange, err = parsePortRange(conf.ProfPortRange); err != nil {
+		glog.Errorf("parse prof port range fail. err:%v", err)
+		return nil, err
+	}
+
+	if conf.ParameterPolicyFile != "" {
+		if conf.parameterPolicy, err = loadParameterPolicy(conf.ParameterPolicyFile); err != nil {
+			glog.Errorf("load parameter policy fail. err:%v", err)
+			return nil, err
+		}
+	}
+
+	conf.clientVersionProbe = newClientVersionProbe(CfsClientBin)
+	if conf.clientConfDelivery, err = newClientConfDelivery(conf.ClientConfDelivery); err != nil {
+		glog.Errorf("init client config delivery fail. err:%v", err)
+		return nil, err
+	}
+
+	if conf.VolumeStoreDir != "" {
+		if conf.volumeStore, err = newFileVolumeStore(conf.VolumeStoreDir); err != nil {
+			glog.Errorf("init volume store fail. err:%v", err)
+			return nil, err
+		}
+	}
+
+	if conf.AuditLogFile != "" {
+		if conf.auditLog, err = newAuditLog(conf.AuditLogFile); err != nil {
+			glog.Errorf("open audit log fail. err:%v", err)
+			return nil, err
+		}
+	}
+
+	if conf.WebhookURL != "" {
+		if conf.webhook, err = newVolumeWebhook(conf.WebhookURL, conf.WebhookRetries, conf.WebhookRetryInterval); err != nil {
+			glog.Errorf("init webhook fail. err:%v", err)
+			return nil, err
+		}
+	}
+
+	if conf.PolicyWebhookURL != "" {
+		if conf.policyWebhook, err = newPolicyWebhook(conf.PolicyWebhookURL, conf.PolicyWebhookTimeout, conf.PolicyWebhookFailOpen); err != nil {
+			glog.Errorf("init policy webhook fail. err:%v", err)
+			return nil, err
+		}
+	}
+
+	if conf.TracingEndpoint != "" {
+		if conf.tracer, err = newTracer(conf.TracingEndpoint, conf.DriverName); err != nil {
+			glog.Errorf("init tracer fail. err:%v", err)
+			return nil, err
+		}
+	}
+
+	if conf.MountDirMode != "" {
+		if conf.mountDirMode, err = parseDirMode(conf.MountDirMode); err != nil {
+			glog.Errorf("invalid mount dir mode. err:%v", err)
+			return nil, err
+		}
+	}
+
+	if err := validateVolumeStatsTotal(conf.VolumeStatsTotal); err != nil {
+		glog.Errorf("invalid volume stats total. err:%v", err)
+		return nil, err
+	}
+
+	switch conf.MinVolumeSizeMode {
+	case "", minVolumeSizeRoundUp, minVolumeSizeStrict:
+	default:
+		glog.Errorf("invalid min volume size mode %q, must be %s or %s", conf.MinVolumeSizeMode, minVolumeSizeRoundUp, minVolumeSizeStrict)
+		return nil, fmt.Errorf("invalid min volume size mode %q", conf.MinVolumeSizeMode)
+	}
+
+	switch conf.NoCapacityMode {
+	case "", noCapacityDefault, noCapacityReject:
+	default:
+		glog.Errorf("invalid no capacity mode %q, must be %s or %s", conf.NoCapacityMode, noCapacityDefault, noCapacityReject)
+		return nil, fmt.Errorf("invalid no capacity mode %q", conf.NoCapacityMode)
+	}
+
+	if conf.DefaultCapacityGB < 0 {
+		glog.Errorf("invalid default capacity %dGB, must not be negative", conf.DefaultCapacityGB)
+		return nil, fmt.Errorf("invalid default capacity %dGB", conf.DefaultCapacityGB)
+	}
+
+	if conf.DefaultCrossZone != "" {
+		crossZone, err := strconv.ParseBool(conf.DefaultCrossZone)
+		if err != nil {
+			glog.Errorf("invalid default crossZone %q, must be a boolean", conf.DefaultCrossZone)
+			return nil, err
+		}
+		conf.DefaultCrossZone = strconv.FormatBool(crossZone)
+	}
+
+	conf.zoneCache = newZoneCache()
+	if conf.DefaultZone != "" {
+		if conf.DefaultZone, err = parseDefaultZone(conf.DefaultZone); err != nil {
+			glog.Errorf("invalid default zone. err:%v", err)
+			return nil, err
+		}
+	}
+
+	if conf.nodePools, err = parseNodePools(conf.NodePools); err != nil {
+		glog.Errorf("parse node pools fail. err:%v", err)
+		return nil, err
+	}
+
 	csiDriver := csicommon.NewCSIDriver(conf.DriverName, conf.Version, conf.NodeID, clientSet)
 	if csiDriver == nil {
 		return nil, status.Error(codes.InvalidArgument, "csiDriver init fail")
 	}
 
-	csiDriver.AddControllerServiceCapabilities(
-		[]csi.ControllerServiceCapability_RPC_Type{
-			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-			csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
-		})
+	if conf.ReadOnlyController && conf.CapacityReconcileExpand {
+		glog.Errorf("the read-only controller cannot expand the volumes shrunk on the master")
+		return nil, fmt.Errorf("--read-only-controller conflicts with --capacity-reconcile-expand")
+	}
+
+	if len(conf.ClusterID) != 0 {
+		if err := validateClusterID(conf.ClusterID); err != nil {
+			glog.Errorf("validate cluster id fail. err:%v", err)
+			return nil, err
+		}
+		if len(conf.VolumeStoreDir) == 0 {
+			glog.Errorf("the cluster of the volumes can only be told from the volume store")
+			return nil, fmt.Errorf("--cluster-id needs --volume-store-dir")
+		}
+	}
+
+	controllerCaps, err := controllerCapabilities(&conf)
+	if err != nil {
+		glog.Errorf("resolve controller capabilities fail. err:%v", err)
+		return nil, err
+	}
+	csiDriver.AddControllerServiceCapabilities(controllerCaps)
 	csiDriver.AddVolumeCapabilityAccessModes(
 		[]csi.VolumeCapability_AccessMode_Mode{
 			csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
@@ -76,10 +441,46 @@ func NewDriver(conf Config) (*driver, error) {
 			csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
 		})
 
-	return &driver{
+	d := &driver{
 		CSIDriver: csiDriver,
 		Config:    conf,
-	}, nil
+	}
+	d.ns = NewNodeServer(d)
+	return d, nil
+}
+
+// controllerCapabilities returns the capabilities of the controller features
+// which are enabled, so that the CO never calls an RPC the driver cannot serve.
+func controllerCapabilities(conf *Config) ([]csi.ControllerServiceCapability_RPC_Type, error) {
+	disabled := make(map[string]bool)
+	for _, feature := range conf.DisabledFeatures {
+		switch feature {
+		case featureExpand, featureList:
+			disabled[feature] = true
+		default:
+			return nil, fmt.Errorf("unknown feature %q, must be %s or %s", feature, featureExpand, featureList)
+		}
+	}
+
+	var caps []csi.ControllerServiceCapability_RPC_Type
+	if !conf.ReadOnlyController {
+		caps = append(caps, csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME)
+	}
+	if !disabled[featureExpand] && !conf.ReadOnlyController {
+		caps = append(caps, csi.ControllerServiceCapability_RPC_EXPAND_VOLUME)
+	}
+	if conf.EnableAttach {
+		caps = append(caps, csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME)
+	}
+	// listing is not bound to a volume, so it needs the default master addr
+	if !disabled[featureList] && conf.masterAddrSource != nil {
+		caps = append(caps,
+			csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+			csi.ControllerServiceCapability_RPC_GET_VOLUME,
+			csi.ControllerServiceCapability_RPC_VOLUME_CONDITION)
+	}
+
+	return caps, nil
 }
 
 func initClientSet(kubeconfig string) (*kubernetes.Clientset, error) {
@@ -101,16 +502,21 @@ func initClientSet(kubeconfig string) (*kubernetes.Clientset, error) {
 }
 
 func NewNodeServer(d *driver) *nodeServer {
+	mounter := mount.New("")
 	return &nodeServer{
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d.CSIDriver),
-		mounter:           mount.New(""),
+		mounter:           mounter,
 		Config:            d.Config,
+		volumes:           newVolumeLocks(),
+		supervisor:        newClientSupervisor(d.ClientRestartLimit, d.ClientSuperviseInterval, mounter, d.mountDirMode),
+		clusterStats:      newClusterCapacityStats(),
 	}
 }
 
 func NewIdentityServer(d *driver) *identityServer {
 	return &identityServer{
 		DefaultIdentityServer: csicommon.NewDefaultIdentityServer(d.CSIDriver),
+		topology:              len(d.nodePools) > 0,
 	}
 }
 
@@ -118,27 +524,67 @@ func NewControllerServer(d *driver) *controllerServer {
 	return &controllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d.CSIDriver),
 		driver:                  d,
+		attachments:             newAttachmentTracker(),
 	}
 }
 
+// Shutdown prepares the node plugin for the termination of its pod, see
+// nodeServer.shutdown.
+func (d *driver) Shutdown() {
+	d.ns.shutdown()
+}
+
 func (d *driver) Run(endpoint string) {
-	nodeServer := NewNodeServer(d)
+	nodeServer := d.ns
 	if nodeName := os.Getenv("KUBE_NODE_NAME"); d.RemountDamaged && nodeName != "" {
 		nodeServer.remountDamagedVolumes(nodeName)
 	}
 
-	csicommon.RunControllerandNodePublishServer(endpoint, NewIdentityServer(d), NewControllerServer(d), NewNodeServer(d))
+	if d.MetricsAddress != "" {
+		go serveMetrics(d.MetricsAddress, newDriverCapacityCache(&d.Config), &configHandler{conf: &d.Config})
+	}
+
+	if d.CapacityReconcileInterval > 0 {
+		go d.runCapacityReconciler(d.CapacityReconcileInterval)
+	}
+
+	if d.ClientStatsInterval > 0 {
+		go newClientStatsSampler().run(d.ClientStatsInterval)
+	}
+
+	if d.ClientSuperviseInterval > 0 {
+		go nodeServer.runClientSupervisor(d.ClientSuperviseInterval)
+	}
+
+	csicommon.RunControllerandNodePublishServer(endpoint, NewIdentityServer(d), NewControllerServer(d), nodeServer)
 }
 
-func (d *driver) queryPersistentVolumes(ctx context.Context, pvName string) (*v1.PersistentVolume, error) {
-	persistentVolume, err := d.CSIDriver.ClientSet.CoreV1().PersistentVolumes().Get(ctx, pvName, metav1.GetOptions{})
+// queryPersistentVolumes returns the PersistentVolume of the driver whose
+// volume handle is volumeID. The PersistentVolume is usually named after the
+// volume, except for the volumes named after their PVC, which are looked up
+// in the list of the PersistentVolumes.
+func (d *driver) queryPersistentVolumes(ctx context.Context, volumeID string) (*v1.PersistentVolume, error) {
+	persistentVolume, err := d.CSIDriver.ClientSet.CoreV1().PersistentVolumes().Get(ctx, volumeID, metav1.GetOptions{})
+	if err == nil && persistentVolume != nil && isVolumeOf(persistentVolume, d.DriverName, volumeID) {
+		return persistentVolume, nil
+	}
+
+	pvList, err := d.CSIDriver.ClientSet.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
 	if err != nil {
 		return nil, err
 	}
 
-	if persistentVolume == nil {
-		return nil, status.Error(codes.Unknown, fmt.Sprintf("not found PersistentVolume[%v]", pvName))
+	for i := range pvList.Items {
+		if isVolumeOf(&pvList.Items[i], d.DriverName, volumeID) {
+			return &pvList.Items[i], nil
+		}
 	}
 
-	return persistentVolume, nil
+	return nil, status.Error(codes.NotFound, fmt.Sprintf("not found PersistentVolume of volume[%v]", volumeID))
+}
+
+// isVolumeOf reports whether pv is the PersistentVolume of the volume of the
+// driver with the handle volumeID.
+func isVolumeOf(pv *v1.PersistentVolume, driverName, volumeID string) bool {
+	return pv.Spec.CSI != nil && pv.Spec.CSI.Driver == driverName && pv.Spec.CSI.VolumeHandle == volumeID
 }
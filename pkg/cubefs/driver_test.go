@@ -0,0 +1,132 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/cubefs/cubefs-csi/pkg/csi-common"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+)
+
+// controllerRPCs calls the RPCs of every controller capability with empty
+// requests, which must fail with anything but Unimplemented.
+var controllerRPCs = map[csi.ControllerServiceCapability_RPC_Type][]func(cs *controllerServer) error{
+	csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME: {
+		func(cs *controllerServer) error {
+			_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{})
+			return err
+		},
+		func(cs *controllerServer) error {
+			_, err := cs.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{})
+			return err
+		},
+	},
+	csi.ControllerServiceCapability_RPC_EXPAND_VOLUME: {
+		func(cs *controllerServer) error {
+			_, err := cs.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{})
+			return err
+		},
+	},
+	csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME: {
+		func(cs *controllerServer) error {
+			_, err := cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{})
+			return err
+		},
+		func(cs *controllerServer) error {
+			_, err := cs.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{})
+			return err
+		},
+	},
+	csi.ControllerServiceCapability_RPC_LIST_VOLUMES: {
+		func(cs *controllerServer) error {
+			_, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+			return err
+		},
+	},
+	csi.ControllerServiceCapability_RPC_GET_VOLUME: {
+		func(cs *controllerServer) error {
+			_, err := cs.ControllerGetVolume(context.Background(), &csi.ControllerGetVolumeRequest{})
+			return err
+		},
+	},
+	csi.ControllerServiceCapability_RPC_VOLUME_CONDITION: {
+		func(cs *controllerServer) error {
+			_, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+			return err
+		},
+	},
+}
+
+func TestAdvertisedCapabilitiesImplemented(t *testing.T) {
+	source := &masterAddrSource{addrs: "127.0.0.1:1"}
+	for _, conf := range []Config{
+		{},
+		{masterAddrSource: source},
+		{masterAddrSource: source, DisabledFeatures: []string{featureExpand}, EnableAttach: true},
+		{masterAddrSource: source, DisabledFeatures: []string{featureExpand, featureList}},
+		{masterAddrSource: source, ReadOnlyController: true},
+	} {
+		caps, err := controllerCapabilities(&conf)
+		assert.NoError(t, err)
+
+		csiDriver := csicommon.NewCSIDriver(DriverName, "1.0.0", "fakeNodeID", nil)
+		csiDriver.AddControllerServiceCapabilities(caps)
+		cs := NewControllerServer(&driver{CSIDriver: csiDriver, Config: conf})
+
+		resp, err := cs.ControllerGetCapabilities(context.Background(), &csi.ControllerGetCapabilitiesRequest{})
+		assert.NoError(t, err)
+		advertised := make(map[csi.ControllerServiceCapability_RPC_Type]bool)
+		for _, c := range resp.Capabilities {
+			capType := c.GetRpc().GetType()
+			advertised[capType] = true
+
+			rpcs, ok := controllerRPCs[capType]
+			assert.True(t, ok, "no handler known for the advertised capability %v", capType)
+			for _, rpc := range rpcs {
+				assert.NotEqual(t, codes.Unimplemented, status.Code(rpc(cs)), "capability %v", capType)
+			}
+		}
+
+		// the RPCs of the capabilities not advertised are refused
+		for capType, rpcs := range controllerRPCs {
+			if !advertised[capType] && capType != csi.ControllerServiceCapability_RPC_VOLUME_CONDITION {
+				for _, rpc := range rpcs {
+					assert.Error(t, rpc(cs), "capability %v", capType)
+				}
+			}
+		}
+	}
+
+	_, err := controllerCapabilities(&Config{DisabledFeatures: []string{"snapshot"}})
+	assert.Error(t, err)
+}
+
+func TestIsVolumeOf(t *testing.T) {
+	// named after its PVC, the volume is not named after its PersistentVolume
+	pv := &v1.PersistentVolume{}
+	pv.Name = "pvc-6f1c"
+	pv.Spec.CSI = &v1.CSIPersistentVolumeSource{Driver: DriverName, VolumeHandle: "team-a-data-1a2b3c4d"}
+	assert.True(t, isVolumeOf(pv, DriverName, "team-a-data-1a2b3c4d"))
+	assert.False(t, isVolumeOf(pv, DriverName, "pvc-6f1c"))
+	assert.False(t, isVolumeOf(pv, "other.csi.driver", "team-a-data-1a2b3c4d"))
+
+	pv.Spec.CSI = nil
+	assert.False(t, isVolumeOf(pv, DriverName, "pvc-6f1c"))
+}
@@ -0,0 +1,103 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// set by the csi-provisioner started with --extra-create-metadata
+const KPVCName = "csi.storage.k8s.io/pvc/name"
+
+// reasons of the events recorded for the failed operations
+const (
+	eventCreateVolumeFailed = "CreateVolumeFailed"
+	eventDeleteVolumeFailed = "DeleteVolumeFailed"
+	eventExpandVolumeFailed = "ExpandVolumeFailed"
+)
+
+// eventSink creates events, so that the tests do not need a clientset.
+type eventSink func(ctx context.Context, event *v1.Event) error
+
+func newClientSetEventSink(clientSet *kubernetes.Clientset) eventSink {
+	return func(ctx context.Context, event *v1.Event) error {
+		_, err := clientSet.CoreV1().Events(event.Namespace).Create(ctx, event, metav1.CreateOptions{})
+		return err
+	}
+}
+
+// newEvent returns an event of the object in namespace, which is the default
+// one for the cluster scoped objects like PersistentVolumes.
+func newEvent(object v1.ObjectReference, namespace, eventType, reason, message, component string) *v1.Event {
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+
+	now := metav1.Now()
+	return &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: object.Name + ".",
+			Namespace:    namespace,
+		},
+		InvolvedObject: object,
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source:         v1.EventSource{Component: component},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+}
+
+// pvcReference returns the PVC of a CreateVolume request, which is only known
+// if the csi-provisioner passes it in the parameters.
+func pvcReference(param map[string]string) (v1.ObjectReference, bool) {
+	name, namespace := param[KPVCName], param[KPVCNamespace]
+	if name == "" || namespace == "" {
+		return v1.ObjectReference{}, false
+	}
+
+	return v1.ObjectReference{Kind: "PersistentVolumeClaim", APIVersion: "v1", Name: name, Namespace: namespace}, true
+}
+
+// pvReference returns the PersistentVolume of a volume.
+func pvReference(pv *v1.PersistentVolume) v1.ObjectReference {
+	return v1.ObjectReference{Kind: "PersistentVolume", APIVersion: "v1", Name: pv.Name, UID: pv.UID}
+}
+
+// recordFailureEvent records a warning event of the failed operation on
+// object, if the events are enabled. Failing to record it, e.g. as the RBAC
+// rules do not allow it, is only logged.
+func (d *driver) recordFailureEvent(ctx context.Context, object v1.ObjectReference, reason string, err error) {
+	if d.eventSink == nil {
+		return
+	}
+
+	// the errors may carry master urls, which must not leave the driver
+	message := redactAuthKey(fmt.Sprintf("%v", err))
+	event := newEvent(object, object.Namespace, v1.EventTypeWarning, reason, message, d.DriverName)
+	if err := d.eventSink(ctx, event); err != nil {
+		glog.Warningf("record %v event of %v[%v] fail. err:%v", reason, object.Kind, object.Name, err)
+	}
+}
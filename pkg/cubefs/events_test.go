@@ -0,0 +1,102 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestCreateVolumeFailureEvent(t *testing.T) {
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeMasterResponse(w, 1, "no enough data nodes")
+	}))
+	t.Cleanup(master.Close)
+
+	var events []*v1.Event
+	var sinkErr error
+	conf := fakeConfig
+	conf.DriverName = DriverName
+	conf.eventSink = func(ctx context.Context, event *v1.Event) error {
+		events = append(events, event)
+		return sinkErr
+	}
+	cs := newFakeControllerServer(conf)
+	createVolume := func(param map[string]string) error {
+		param[KMasterAddr] = master.Listener.Addr().String()
+		param[KOwner] = "csiuser"
+		_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+			Name:          "pvc-event",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30},
+			Parameters:    param,
+		})
+		return err
+	}
+
+	assert.Error(t, createVolume(map[string]string{KPVCName: "data", KPVCNamespace: "team-a"}))
+	assert.Len(t, events, 1)
+	event := events[0]
+	assert.Equal(t, "team-a", event.Namespace)
+	assert.Equal(t, v1.ObjectReference{Kind: "PersistentVolumeClaim", APIVersion: "v1", Name: "data", Namespace: "team-a"},
+		event.InvolvedObject)
+	assert.Equal(t, eventCreateVolumeFailed, event.Reason)
+	assert.Equal(t, v1.EventTypeWarning, event.Type)
+	assert.Contains(t, event.Message, "no enough data nodes")
+	// the owner is the md5 preimage of the authKey
+	assert.NotContains(t, event.Message, "csiuser")
+	assert.Equal(t, DriverName, event.Source.Component)
+
+	// without the PVC in the parameters there is nothing to attach the event to
+	assert.Error(t, createVolume(map[string]string{}))
+	assert.Len(t, events, 1)
+
+	// a denied event does not change the result of the request
+	sinkErr = status.Error(codes.PermissionDenied, `events is forbidden: cannot create resource "events"`)
+	err := createVolume(map[string]string{KPVCName: "data", KPVCNamespace: "team-a"})
+	assert.Contains(t, err.Error(), "no enough data nodes")
+	assert.Len(t, events, 2)
+}
+
+func TestRecordFailureEvent(t *testing.T) {
+	// events are disabled without a sink
+	d := &driver{}
+	d.recordFailureEvent(context.Background(), v1.ObjectReference{Name: "pv"}, eventDeleteVolumeFailed, errors.New("boom"))
+
+	var events []*v1.Event
+	d.eventSink = func(ctx context.Context, event *v1.Event) error {
+		events = append(events, event)
+		return nil
+	}
+	pv := &v1.PersistentVolume{}
+	pv.Name, pv.UID = "pvc-1", "uid-1"
+	d.recordFailureEvent(context.Background(), pvReference(pv), eventExpandVolumeFailed, errors.New("auth key not match"))
+	assert.Len(t, events, 1)
+	// PersistentVolumes are cluster scoped, their events are in the default namespace
+	assert.Equal(t, "default", events[0].Namespace)
+	assert.Equal(t, "pvc-1.", events[0].GenerateName)
+	assert.Equal(t, "PersistentVolume", events[0].InvolvedObject.Kind)
+	assert.Equal(t, "auth key not match", events[0].Message)
+}
@@ -17,9 +17,29 @@ limitations under the License.
 package cubefs
 
 import (
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	csicommon "github.com/cubefs/cubefs-csi/pkg/csi-common"
+	"golang.org/x/net/context"
 )
 
 type identityServer struct {
 	*csicommon.DefaultIdentityServer
+	// whether volumes may be restricted to node pools
+	topology bool
+}
+
+func (ids *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	resp, err := ids.DefaultIdentityServer.GetPluginCapabilities(ctx, req)
+	if err != nil || !ids.topology {
+		return resp, err
+	}
+
+	resp.Capabilities = append(resp.Capabilities, &csi.PluginCapability{
+		Type: &csi.PluginCapability_Service_{
+			Service: &csi.PluginCapability_Service{
+				Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+			},
+		},
+	})
+	return resp, nil
 }
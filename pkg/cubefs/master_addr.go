@@ -0,0 +1,128 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// masterAddrSource provides the default master address list, which is read from
+// a file (usually a mounted ConfigMap) and re-read periodically, so that the
+// master endpoints can be changed without restarting the driver.
+type masterAddrSource struct {
+	path  string
+	mutex sync.RWMutex
+	addrs string
+}
+
+func newMasterAddrSource(path string) (*masterAddrSource, error) {
+	s := &masterAddrSource{path: path}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// get returns the last successfully loaded master address list, comma separated.
+func (s *masterAddrSource) get() string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.addrs
+}
+
+// reload re-reads the file. Malformed contents are rejected and the last good
+// value is retained.
+func (s *masterAddrSource) reload() error {
+	content, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("read master addr file %s fail: %v", s.path, err)
+	}
+
+	addrs, err := parseMasterAddrs(string(content))
+	if err != nil {
+		return fmt.Errorf("parse master addr file %s fail: %v", s.path, err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if addrs != s.addrs {
+		glog.Infof("default master addr changed from %q to %q", s.addrs, addrs)
+		s.addrs = addrs
+	}
+
+	return nil
+}
+
+func (s *masterAddrSource) run(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.reload(); err != nil {
+			glog.Warningf("reload default master addr fail, keep using %q: %v", s.get(), err)
+		}
+	}
+}
+
+// parseMasterAddrs accepts a list of host:port separated by commas or whitespace
+// and returns it comma separated, as used by the masterAddr parameter.
+func parseMasterAddrs(content string) (string, error) {
+	fields := strings.FieldsFunc(content, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	})
+	if len(fields) == 0 {
+		return "", fmt.Errorf("no master addr found")
+	}
+
+	for _, addr := range fields {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", fmt.Errorf("invalid master addr %q: %v", addr, err)
+		}
+
+		if host == "" {
+			return "", fmt.Errorf("invalid master addr %q: missing host", addr)
+		}
+
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return "", fmt.Errorf("invalid master addr %q: invalid port", addr)
+		}
+	}
+
+	return strings.Join(fields, ","), nil
+}
+
+// parseMasterPathPrefix normalizes the path prefix of a gateway fronting the
+// masters into "/<prefix>" without a trailing slash, empty if none.
+func parseMasterPathPrefix(prefix string) (string, error) {
+	prefix = strings.Trim(strings.TrimSpace(prefix), "/")
+	if len(prefix) == 0 {
+		return "", nil
+	}
+
+	if strings.ContainsAny(prefix, "?#% ") {
+		return "", fmt.Errorf("invalid master path prefix %q, must be a plain url path", prefix)
+	}
+
+	return "/" + prefix, nil
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMasterAddrs(t *testing.T) {
+	addrs, err := parseMasterAddrs("10.0.0.1:17010,10.0.0.2:17010\n master-3.cubefs.svc:17010\n")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:17010,10.0.0.2:17010,master-3.cubefs.svc:17010", addrs)
+
+	for _, content := range []string{"", " \n", "10.0.0.1", ":17010", "10.0.0.1:port", "10.0.0.1:70000"} {
+		_, err = parseMasterAddrs(content)
+		assert.Error(t, err, "content %q", content)
+	}
+}
+
+func TestParseMasterPathPrefix(t *testing.T) {
+	for prefix, want := range map[string]string{
+		"":                "",
+		"/":               "",
+		"cubefs/master":   "/cubefs/master",
+		"/cubefs/master/": "/cubefs/master",
+	} {
+		got, err := parseMasterPathPrefix(prefix)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+
+	for _, prefix := range []string{"/master?x=1", "/master#a", "/cube fs"} {
+		_, err := parseMasterPathPrefix(prefix)
+		assert.Error(t, err, prefix)
+	}
+}
+
+func TestMasterAddrSourceReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "masterAddr")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("10.0.0.1:17010"), 0644))
+
+	source, err := newMasterAddrSource(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1:17010", source.get())
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte("10.0.0.2:17010,10.0.0.3:17010"), 0644))
+	assert.NoError(t, source.reload())
+	assert.Equal(t, "10.0.0.2:17010,10.0.0.3:17010", source.get())
+
+	// malformed contents keep the last good value
+	assert.NoError(t, ioutil.WriteFile(path, []byte("<html>bad gateway</html>"), 0644))
+	assert.Error(t, source.reload())
+	assert.Equal(t, "10.0.0.2:17010,10.0.0.3:17010", source.get())
+
+	_, err = newMasterAddrSource(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
+
+func TestNewCfsServerDefaultMasterAddr(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "masterAddr")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("10.0.0.1:17010,10.0.0.2:17010"), 0644))
+	source, err := newMasterAddrSource(path)
+	assert.NoError(t, err)
+	conf := &Config{masterAddrSource: source}
+
+	param := map[string]string{}
+	cs, err := newCfsServer("pvc-default", param, conf)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1:17010", "10.0.0.2:17010"}, cs.masterAddrs)
+	_, pinned := param[KMasterAddr]
+	assert.False(t, pinned)
+
+	cs, err = newCfsServer("pvc-explicit", map[string]string{KMasterAddr: "10.0.0.9:17010"}, conf)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.9:17010"}, cs.masterAddrs)
+
+	_, err = newCfsServer("pvc-none", map[string]string{}, &Config{})
+	assert.Error(t, err)
+}
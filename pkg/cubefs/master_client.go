@@ -0,0 +1,123 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// masterClient sends the master requests of the controller and the node
+// servers alike. The driver sets up one, which they share, so that they reuse
+// the connections of its tuned transport and cannot drift apart in the
+// scheme, the static headers or the retry policy of their master requests.
+type masterClient struct {
+	httpClient    *http.Client
+	scheme        string
+	pathPrefix    string
+	headers       map[string]string
+	retryCount    int
+	retryInterval time.Duration
+	// caps of a single backoff and of the whole retries, 0 leaves them unbounded
+	retryMaxInterval time.Duration
+	retryDeadline    time.Duration
+	retryableCodes   []int
+}
+
+func newMasterClient(conf *Config, httpClient *http.Client) *masterClient {
+	scheme := "http"
+	if conf.MasterTLS {
+		scheme = "https"
+	}
+
+	return &masterClient{
+		httpClient:       httpClient,
+		scheme:           scheme,
+		pathPrefix:       conf.MasterPathPrefix,
+		headers:          conf.MasterHeaders,
+		retryCount:       conf.MasterRetryCount,
+		retryInterval:    conf.MasterRetryInterval,
+		retryMaxInterval: conf.MasterRetryMaxInterval,
+		retryDeadline:    conf.MasterRetryDeadline,
+		retryableCodes:   conf.MasterRetryableCodes,
+	}
+}
+
+// the master http client used if the driver did not set up a shared one
+var defaultMasterHTTPClient = &http.Client{CheckRedirect: keepHeadersOnRedirect}
+
+// newMasterHTTPClient returns the http client shared by all the master
+// requests, whose connections are kept alive and reused.
+func newMasterHTTPClient(conf *Config) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = conf.MasterMaxIdleConns
+	transport.MaxIdleConnsPerHost = conf.MasterMaxIdleConnsPerHost
+	transport.IdleConnTimeout = conf.MasterIdleConnTimeout
+	transport.TLSClientConfig = conf.masterTLSConfig
+	return &http.Client{Transport: transport, CheckRedirect: keepHeadersOnRedirect}
+}
+
+// url returns the url of the master api path at addr, behind the path prefix
+// of a gateway fronting the master.
+func (c *masterClient) url(addr, path string) string {
+	return fmt.Sprintf("%s://%s%s%s", c.scheme, addr, c.pathPrefix, path)
+}
+
+// backoff returns the delay before the retry after attempt, growing
+// exponentially with jitter up to retryMaxInterval.
+func (c *masterClient) backoff(attempt int) time.Duration {
+	delay := backoffWithJitter(c.retryInterval, attempt)
+	if c.retryMaxInterval > 0 && delay > c.retryMaxInterval {
+		// keep the jitter of the capped delays, so that they do not synchronize
+		delay = backoffWithJitter(c.retryMaxInterval, 0)
+	}
+
+	return delay
+}
+
+// isRetryableCode reports whether the master code is one of
+// MasterRetryableCodes, which the master returns for transient conditions.
+func (c *masterClient) isRetryableCode(code int) bool {
+	for _, retryable := range c.retryableCodes {
+		if retryable == code && code != 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newRequest returns a master request of rawURL with the static headers of
+// the driver, which the headers of the volume can override.
+func (c *masterClient) newRequest(ctx context.Context, rawURL string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+
+	return req, nil
+}
+
+func (c *masterClient) do(req *http.Request) (*http.Response, error) {
+	return c.httpClient.Do(req)
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newTestDriver returns a driver of conf, with a kubeconfig which is never
+// connected to.
+func newTestDriver(t *testing.T, conf Config) *driver {
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	assert.NoError(t, ioutil.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: fake
+  cluster:
+    server: https://127.0.0.1:1
+contexts:
+- name: fake
+  context:
+    cluster: fake
+current-context: fake
+`), 0600))
+
+	conf.DriverName, conf.Version, conf.NodeID, conf.KubeConfig = DriverName, "1.0.0", "fakeNodeID", kubeconfig
+	d, err := NewDriver(conf)
+	assert.NoError(t, err)
+	return d
+}
+
+func TestSharedMasterClient(t *testing.T) {
+	var conns, requests int32
+	master := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		assert.Equal(t, "csi", r.Header.Get("X-Route"))
+		assert.Equal(t, "/cubefs/master/admin/getIp", r.URL.Path)
+		writeMasterResponse(w, 0, "success")
+	}))
+	master.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	master.Start()
+	t.Cleanup(master.Close)
+
+	d := newTestDriver(t, Config{
+		MasterHeaders:         map[string]string{"X-Route": "csi"},
+		MasterPathPrefix:      "/cubefs/master",
+		MasterRetryCount:      3,
+		MasterRetryInterval:   time.Millisecond,
+		MasterIdleConnTimeout: time.Minute,
+	})
+	assert.NotNil(t, d.masterClient)
+	assert.Equal(t, 3, d.masterClient.retryCount)
+
+	// the controller and the node servers share the client of the driver
+	cs, ns := NewControllerServer(d), d.ns
+	for i, conf := range []*Config{&cs.driver.Config, &ns.Config} {
+		cfsServer, err := newCfsServer(fmt.Sprintf("pvc-%d", i), map[string]string{
+			KMasterAddr: master.Listener.Addr().String(),
+		}, conf)
+		assert.NoError(t, err)
+		assert.Same(t, d.masterClient, cfsServer.masterClient())
+		assert.NoError(t, cfsServer.checkMaster(cfsServer.masterAddrs[0]))
+	}
+
+	// and its connections
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&conns))
+}
+
+func TestMasterClientWithoutDriver(t *testing.T) {
+	conf := fakeConfig
+	conf.MasterTLS = true
+	conf.MasterPathPrefix = "/gateway"
+	cs, err := newCfsServer("pvc-standalone", map[string]string{KMasterAddr: "master:17010"}, &conf)
+	assert.NoError(t, err)
+
+	// the config is honored without a shared client, e.g. by the CLI tools
+	client := cs.masterClient()
+	assert.Same(t, defaultMasterHTTPClient, client.httpClient)
+	assert.Equal(t, "https://master:17010/gateway/admin/getIp", client.url("master:17010", "/admin/getIp"))
+	assert.Equal(t, fakeConfig.MasterRetryCount, client.retryCount)
+}
+
+func TestMasterClientBackoffCap(t *testing.T) {
+	conf := fakeConfig
+	conf.MasterRetryInterval = time.Second
+	conf.MasterRetryMaxInterval = 5 * time.Second
+	client := newMasterClient(&conf, defaultMasterHTTPClient)
+	for attempt := 0; attempt < 10; attempt++ {
+		delay := client.backoff(attempt)
+		assert.True(t, delay <= 5*time.Second, "attempt %d delay %v", attempt, delay)
+		if attempt >= 3 {
+			// the capped delays keep their jitter
+			assert.True(t, delay >= 5*time.Second/2, "attempt %d delay %v", attempt, delay)
+		}
+	}
+
+	// uncapped
+	conf.MasterRetryMaxInterval = 0
+	client = newMasterClient(&conf, defaultMasterHTTPClient)
+	assert.True(t, client.backoff(5) >= 16*time.Second)
+}
+
+func TestMasterRetryDeadline(t *testing.T) {
+	var calls int32
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	cs.conf.MasterRetryCount = 1000
+	cs.conf.MasterRetryInterval = 10 * time.Millisecond
+	cs.conf.MasterRetryMaxInterval = 20 * time.Millisecond
+	cs.conf.MasterRetryDeadline = 200 * time.Millisecond
+
+	start := time.Now()
+	err := cs.deleteVolume()
+	elapsed := time.Since(start)
+
+	// the last error is returned once the next retry would pass the deadline,
+	// and an attempt still running at the deadline is interrupted
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Contains(t, err.Error(), "http status 503")
+	assert.True(t, elapsed < 200*time.Millisecond+5*time.Millisecond, "elapsed %v", elapsed)
+	// with the delays capped at 20ms, there is room for at least 10 retries
+	assert.True(t, atomic.LoadInt32(&calls) > 10, "calls %d", atomic.LoadInt32(&calls))
+}
+
+func TestMasterRetryDeadlineInterruptsAttempt(t *testing.T) {
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	cs.conf.MasterRetryCount = 3
+	cs.conf.MasterRetryDeadline = 100 * time.Millisecond
+
+	start := time.Now()
+	err := cs.deleteVolume()
+	elapsed := time.Since(start)
+
+	assert.NotNil(t, err)
+	assert.True(t, elapsed < 100*time.Millisecond+50*time.Millisecond, "elapsed %v", elapsed)
+}
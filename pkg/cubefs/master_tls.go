@@ -0,0 +1,70 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// newMasterTLSConfig returns the tls config verifying the masters against the
+// CA certificates in caFile, or the system roots if caFile is empty. If
+// identities is not empty, the master certificate must also carry one of them
+// as a SAN or the CN, so that a certificate issued by a trusted CA to another
+// host is not accepted.
+func newMasterTLSConfig(caFile string, identities []string) (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %v", caFile)
+		}
+	}
+
+	if len(identities) != 0 {
+		conf.VerifyConnection = func(state tls.ConnectionState) error {
+			return verifyMasterIdentity(state, identities)
+		}
+	}
+
+	return conf, nil
+}
+
+// verifyMasterIdentity checks that the certificate presented by the master,
+// already verified against the CA, carries one of the identities.
+func verifyMasterIdentity(state tls.ConnectionState, identities []string) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("master presented no certificate")
+	}
+
+	cert := state.PeerCertificates[0]
+	for _, identity := range identities {
+		if cert.VerifyHostname(identity) == nil || cert.Subject.CommonName == identity {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("master certificate (CN %q, SANs %v %v) carries none of the expected identities %v",
+		cert.Subject.CommonName, cert.DNSNames, cert.IPAddresses, identities)
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTLSMasterServer returns a cfsServer talking over https to a master whose
+// certificate (SANs example.com, 127.0.0.1 and ::1) is verified as configured.
+func newTLSMasterServer(t *testing.T, identities []string) *cfsServer {
+	master := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeMasterResponse(w, 0, "success")
+	}))
+	t.Cleanup(master.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: master.Certificate().Raw})
+	assert.NoError(t, ioutil.WriteFile(caFile, caPEM, 0600))
+
+	conf := fakeConfig
+	conf.MasterTLS = true
+	tlsConfig, err := newMasterTLSConfig(caFile, identities)
+	assert.NoError(t, err)
+	conf.masterTLSConfig = tlsConfig
+	conf.masterClient = newMasterClient(&conf, newMasterHTTPClient(&conf))
+
+	cs, err := newCfsServer("pvc-tls", map[string]string{
+		KMasterAddr: master.Listener.Addr().String(),
+		KOwner:      "csiuser",
+	}, &conf)
+	assert.NoError(t, err)
+	return cs
+}
+
+func TestMasterTLSIdentities(t *testing.T) {
+	cs := newTLSMasterServer(t, nil)
+	assert.NoError(t, cs.checkMaster(cs.masterAddrs[0]))
+
+	cs = newTLSMasterServer(t, []string{"master.cubefs.io", "example.com"})
+	assert.NoError(t, cs.checkMaster(cs.masterAddrs[0]))
+
+	// the certificate chains to the trusted CA, but is issued to another host
+	cs = newTLSMasterServer(t, []string{"master.cubefs.io"})
+	err := cs.checkMaster(cs.masterAddrs[0])
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "none of the expected identities")
+}
+
+func TestNewMasterTLSConfig(t *testing.T) {
+	_, err := newMasterTLSConfig(filepath.Join(t.TempDir(), "missing.pem"), nil)
+	assert.Error(t, err)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(caFile, []byte("not a certificate"), 0600))
+	_, err = newMasterTLSConfig(caFile, nil)
+	assert.Error(t, err)
+
+	conf, err := newMasterTLSConfig("", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, conf.RootCAs)
+	assert.Nil(t, conf.VerifyConnection)
+}
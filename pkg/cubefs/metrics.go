@@ -0,0 +1,161 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// metric is exposed in the prometheus text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+// counterVec is a counter partitioned by the value of a single label.
+type counterVec struct {
+	name   string
+	help   string
+	label  string
+	mutex  sync.Mutex
+	values map[string]int64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{name: name, help: help, label: label, values: make(map[string]int64)}
+}
+
+func (c *counterVec) inc(labelValue string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.values[labelValue]++
+}
+
+func (c *counterVec) get(labelValue string) int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.values[labelValue]
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	labelValues := make([]string, 0, len(c.values))
+	for labelValue := range c.values {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, labelValue := range labelValues {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, c.label, labelValue, c.values[labelValue])
+	}
+}
+
+// gaugeVec is a gauge partitioned by the value of a single label, whose
+// values are replaced as a whole by each sample.
+type gaugeVec struct {
+	name   string
+	help   string
+	label  string
+	kind   string
+	mutex  sync.Mutex
+	values map[string]float64
+}
+
+func newGaugeVec(name, help, label string) *gaugeVec {
+	return &gaugeVec{name: name, help: help, label: label, kind: "gauge", values: make(map[string]float64)}
+}
+
+// newSampledCounterVec returns a counter sampled like a gauge, for the totals
+// counted elsewhere, e.g. the CPU time of a process. A counter restarting
+// from zero, e.g. with its process, is seen as a reset by prometheus.
+func newSampledCounterVec(name, help, label string) *gaugeVec {
+	return &gaugeVec{name: name, help: help, label: label, kind: "counter", values: make(map[string]float64)}
+}
+
+// replace sets the values of the gauge, dropping the label values missing
+// from values, e.g. of the volumes unmounted since the last sample.
+func (g *gaugeVec) replace(values map[string]float64) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.values = values
+}
+
+func (g *gaugeVec) get(labelValue string) (float64, bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	value, ok := g.values[labelValue]
+	return value, ok
+}
+
+func (g *gaugeVec) write(w io.Writer) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	labelValues := make([]string, 0, len(g.values))
+	for labelValue := range g.values {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", g.name, g.help, g.name, g.kind)
+	for _, labelValue := range labelValues {
+		fmt.Fprintf(w, "%s{%s=%q} %g\n", g.name, g.label, labelValue, g.values[labelValue])
+	}
+}
+
+var (
+	// hits of the idempotency shortcuts, i.e. creating an existing volume or
+	// deleting a missing one, a high rate hints at a misbehaving provisioner
+	idempotencyShortcuts = newCounterVec("cubefs_csi_idempotency_shortcuts_total",
+		"Requests finished by an idempotency shortcut, by operation.", "operation")
+
+	// resources used by the client of each volume mounted on the node
+	clientMemoryBytes = newGaugeVec("cubefs_csi_client_resident_memory_bytes",
+		"Resident memory of the fuse client, by volume.", "volume")
+	clientCPUSeconds = newSampledCounterVec("cubefs_csi_client_cpu_seconds_total",
+		"User and system CPU time of the fuse client, by volume.", "volume")
+
+	metrics = []metric{idempotencyShortcuts, clientMemoryBytes, clientCPUSeconds}
+)
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// serveMetrics serves the metrics at /metrics of addr, the capacity report at
+// /capacity and the effective configuration at /config.
+func serveMetrics(addr string, capacity, config http.Handler) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.Handle("/capacity", capacity)
+	mux.Handle("/config", config)
+	glog.Infof("serve metrics at %v", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		glog.Errorf("serve metrics at %v fail. err:%v", addr, err)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotencyShortcutCounters(t *testing.T) {
+	created := idempotencyShortcuts.get("CreateVolume")
+	deleted := idempotencyShortcuts.get("DeleteVolume")
+
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/admin/createVol":
+			writeMasterResponse(w, 1, ErrDuplicateVolMsg)
+		case "/vol/delete":
+			writeMasterResponse(w, ErrCodeVolNotExists, "vol not exists")
+		}
+	})
+
+	assert.NoError(t, cs.createVolume(10))
+	assert.NoError(t, cs.createVolume(10))
+	assert.NoError(t, cs.deleteVolume())
+	assert.Equal(t, created+2, idempotencyShortcuts.get("CreateVolume"))
+	assert.Equal(t, deleted+1, idempotencyShortcuts.get("DeleteVolume"))
+
+	// the successful paths are not counted
+	cs = newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		writeMasterResponse(w, 0, "success")
+	})
+	assert.NoError(t, cs.createVolume(10))
+	assert.NoError(t, cs.deleteVolume())
+	assert.Equal(t, created+2, idempotencyShortcuts.get("CreateVolume"))
+	assert.Equal(t, deleted+1, idempotencyShortcuts.get("DeleteVolume"))
+}
+
+func TestMetricsHandler(t *testing.T) {
+	counter := newCounterVec("test_total", "Test counter.", "operation")
+	counter.inc("b")
+	counter.inc("a")
+	counter.inc("b")
+
+	saved := metrics
+	metrics = []metric{counter}
+	defer func() { metrics = saved }()
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, "# HELP test_total Test counter.\n# TYPE test_total counter\n"+
+		"test_total{operation=\"a\"} 1\ntest_total{operation=\"b\"} 2\n", w.Body.String())
+}
+
+func TestGaugeVec(t *testing.T) {
+	gauge := newGaugeVec("test_bytes", "Test gauge.", "volume")
+	gauge.replace(map[string]float64{"pvc-b": 1.5, "pvc-a": 1048576})
+
+	w := httptest.NewRecorder()
+	gauge.write(w)
+	assert.Equal(t, "# HELP test_bytes Test gauge.\n# TYPE test_bytes gauge\n"+
+		"test_bytes{volume=\"pvc-a\"} 1.048576e+06\ntest_bytes{volume=\"pvc-b\"} 1.5\n", w.Body.String())
+
+	// the volumes missing from a sample are dropped
+	gauge.replace(map[string]float64{"pvc-a": 1})
+	_, ok := gauge.get("pvc-b")
+	assert.False(t, ok)
+}
+
+func TestSampledCounterVec(t *testing.T) {
+	counter := newSampledCounterVec("test_seconds_total", "Test counter.", "volume")
+	counter.replace(map[string]float64{"pvc-a": 3})
+
+	w := httptest.NewRecorder()
+	counter.write(w)
+	assert.Equal(t, "# HELP test_seconds_total Test counter.\n# TYPE test_seconds_total counter\n"+
+		"test_seconds_total{volume=\"pvc-a\"} 3\n", w.Body.String())
+}
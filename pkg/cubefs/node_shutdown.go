@@ -0,0 +1,90 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// clientProfHost is the host the prof ports of the clients listen on.
+var clientProfHost = "127.0.0.1"
+
+// shutdown prepares the node plugin for the termination of its pod: it stops
+// staging volumes and restarting clients, and asks the running clients to
+// flush their caches at ShutdownFlushPath of their prof port if set. The
+// volumes are left mounted, so that the pods keep their data through the
+// clients surviving the plugin.
+func (ns *nodeServer) shutdown() {
+	ns.mutex.Lock()
+	ns.draining = true
+	profPorts := ns.supervisor.profPorts()
+	ns.mutex.Unlock()
+
+	if len(ns.ShutdownFlushPath) == 0 {
+		return
+	}
+
+	glog.Infof("shutting down, flush the clients of %d volumes", len(profPorts))
+	for volumeID, err := range flushClients(profPorts, ns.ShutdownFlushPath, ns.ShutdownFlushTimeout) {
+		glog.Warningf("flush the client of volume[%v] failed. err: %v", volumeID, err)
+	}
+}
+
+// flushClients requests path of the prof ports of the clients by volume in
+// parallel, waiting for them up to timeout, and returns the errors by volume.
+func flushClients(profPorts map[string]string, path string, timeout time.Duration) map[string]error {
+	client := &http.Client{Timeout: timeout}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(map[string]error)
+	for volumeID, port := range profPorts {
+		wg.Add(1)
+		go func(volumeID, port string) {
+			defer wg.Done()
+			if err := flushClient(client, fmt.Sprintf("http://%s:%s%s", clientProfHost, port, path)); err != nil {
+				mutex.Lock()
+				errs[volumeID] = err
+				mutex.Unlock()
+			}
+		}(volumeID, port)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+func flushClient(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("%s responded with http status %v: %s", url, resp.StatusCode, body)
+	}
+
+	return nil
+}
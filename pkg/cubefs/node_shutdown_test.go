@@ -0,0 +1,105 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newFlushServer returns the prof port of a fake client recording its
+// flushes, responding with code.
+func newFlushServer(t *testing.T, code int, flushes *[]string, mutex *sync.Mutex) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		*flushes = append(*flushes, r.URL.Path)
+		mutex.Unlock()
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(server.Close)
+
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	assert.NoError(t, err)
+	return port
+}
+
+func TestFlushClients(t *testing.T) {
+	var mutex sync.Mutex
+	var flushes []string
+	ok := newFlushServer(t, http.StatusOK, &flushes, &mutex)
+	failing := newFlushServer(t, http.StatusNotFound, &flushes, &mutex)
+
+	errs := flushClients(map[string]string{"pvc-ok": ok, "pvc-failing": failing}, "/flush", time.Second)
+	assert.Equal(t, []string{"/flush", "/flush"}, flushes)
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs["pvc-failing"].Error(), "404")
+
+	// a client which is gone does not block the others
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	_, gone, _ := net.SplitHostPort(listener.Addr().String())
+	assert.NoError(t, listener.Close())
+	errs = flushClients(map[string]string{"pvc-ok": ok, "pvc-gone": gone}, "/flush", time.Second)
+	assert.Len(t, errs, 1)
+	assert.Error(t, errs["pvc-gone"])
+}
+
+func TestNodeShutdown(t *testing.T) {
+	var mutex sync.Mutex
+	var flushes []string
+	port := newFlushServer(t, http.StatusOK, &flushes, &mutex)
+
+	conf := fakeConfig
+	conf.ShutdownFlushPath = "/flush"
+	conf.ShutdownFlushTimeout = time.Second
+	ns := newFakeNodeServer(conf)
+	ns.supervisor.watch("pvc-1", "/staging-1", map[string]string{KProfPort: port}, nil, nil)
+	ns.supervisor.watch("pvc-2", "/staging-2", map[string]string{KProfPort: port}, nil, nil)
+	ns.supervisor.watch("pvc-3", "/staging-3", map[string]string{}, nil, nil)
+
+	ns.shutdown()
+	sort.Strings(flushes)
+	assert.Equal(t, []string{"/flush", "/flush"}, flushes)
+
+	// no client is launched once draining, and the staged ones are kept
+	_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "pvc-4",
+		StagingTargetPath: t.TempDir(),
+		VolumeContext:     map[string]string{KMasterAddr: "10.0.0.1:17010", KOwner: "csiuser"},
+	})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Len(t, ns.supervisor.profPorts(), 2)
+
+	// the flush is disabled without a path
+	flushes = nil
+	ns = newFakeNodeServer(fakeConfig)
+	ns.supervisor.watch("pvc-1", "/staging-1", map[string]string{KProfPort: port}, nil, nil)
+	ns.shutdown()
+	assert.Empty(t, flushes)
+	assert.True(t, ns.draining)
+}
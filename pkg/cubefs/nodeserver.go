@@ -40,23 +40,41 @@ type nodeServer struct {
 	Config
 	*csicommon.DefaultNodeServer
 	mounter mount.Interface
-	mutex   sync.RWMutex
+	// the RPCs and the client supervisor hold the lock of their volume, so
+	// that only the operations on the same volume are serialized
+	volumes *volumeLocks
+	// restarts the clients which died, see clientSupervisor
+	supervisor *clientSupervisor
+	// the volumes reporting the capacity of the cluster, see reportsClusterCapacity
+	clusterStats *clusterCapacityStats
+	// set once the plugin is shutting down, guarded by mutex, see shutdown
+	mutex    sync.Mutex
+	draining bool
 }
 
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	ns.mutex.Lock()
-	defer ns.mutex.Unlock()
+	defer ns.volumes.lock(req.GetVolumeId())()
 
 	start := time.Now()
 	stagingTargetPath := req.GetStagingTargetPath()
 	targetPath := req.GetTargetPath()
 
-	err := mount.CleanupMountPoint(targetPath, ns.mounter, false)
+	propagation, err := parseMountPropagation(req.GetVolumeCapability().GetMount().GetMountFlags())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	// the running client is not affected, only its restarts read the config again
+	if err := ns.supervisor.ensureConf(stagingTargetPath); err != nil {
+		glog.Warningf("ensure the client config of %v fail. err:%v", stagingTargetPath, err)
+	}
+
+	err = mount.CleanupMountPoint(targetPath, ns.mounter, false)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "CleanupMountPoint fail, targetPath:%v error: %v", targetPath, err)
 	}
 
-	err = createMountPoint(targetPath)
+	err = createMountPoint(targetPath, ns.mountDirMode)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "createMountPoint fail, targetPath:%s error: %v", targetPath, err)
 	}
@@ -67,26 +85,46 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			stagingTargetPath, targetPath, err)
 	}
 
+	if propagation != "" {
+		if err := makePropagation(targetPath, propagation); err != nil {
+			if cleanupErr := mount.CleanupMountPoint(targetPath, ns.mounter, false); cleanupErr != nil {
+				glog.Errorf("cleanup targetPath:%v after propagation failure fail: %v", targetPath, cleanupErr)
+			}
+			return nil, status.Errorf(codes.Internal, "%v", err)
+		}
+	}
+
+	ns.supervisor.publish(stagingTargetPath, targetPath, propagation)
 	duration := time.Since(start)
-	glog.Infof("NodePublishVolume mount success, targetPath:%v cost:%v", targetPath, duration)
+	// the response has no room for the locations of the client, so they are logged
+	glog.Infof("NodePublishVolume mount success, targetPath:%v cost:%v client:%v",
+		targetPath, duration, ns.supervisor.locations(stagingTargetPath))
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
 func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	ns.mutex.Lock()
-	defer ns.mutex.Unlock()
+	defer ns.volumes.lock(req.GetVolumeId())()
 	targetPath := req.GetTargetPath()
 	err := mount.CleanupMountPoint(targetPath, ns.mounter, false)
 	if err != nil {
 		return nil, err
 	}
 
+	ns.supervisor.unpublish(targetPath)
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
 func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	ns.mutex.Lock()
-	defer ns.mutex.Unlock()
+	defer ns.volumes.lock(req.GetVolumeId())()
+	if ns.isDraining() {
+		return nil, status.Error(codes.Unavailable, "the node plugin is shutting down, no clients are launched")
+	}
+
+	release, err := ns.reserveVolume(req.GetStagingTargetPath())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
 
 	start := time.Now()
 	stagingTargetPath := req.GetStagingTargetPath()
@@ -102,6 +140,10 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 }
 
 func (ns *nodeServer) mount(targetPath, volumeName string, param map[string]string) (retErr error) {
+	if err := checkFuseDevice(fuseDevicePath, ns.LoadFuseModule); err != nil {
+		return err
+	}
+
 	defer func(){
 		if retErr != nil {
 			glog.Errorf("volume mount failed, remove the targetPath: %v, error: %v", targetPath, retErr.Error())
@@ -122,34 +164,95 @@ func (ns *nodeServer) mount(targetPath, volumeName string, param map[string]stri
 		return 
 	}
 
-	if err := createMountPoint(targetPath); err != nil {
+	if err := createMountPoint(targetPath, ns.mountDirMode); err != nil {
 		retErr = status.Errorf(codes.Internal, "createMountPoint fail, stagingTargetPath: %v error: %v", targetPath, err)
 		return 
 	}
 
-	cfsServer, err := newCfsServer(volumeName, param)
+	ns.restoreOwner(volumeName, param)
+
+	cfsServer, err := newCfsServer(volumeName, param, &ns.Config)
 	if err != nil {
 		retErr = status.Errorf(codes.InvalidArgument, "new cfs server failed: %v", err)
 		return 
 	}
 
 	if err := cfsServer.persistClientConf(targetPath); err != nil {
-		retErr = status.Errorf(codes.Internal, "persist client config file failed: %v", err)
+		// keep the code, e.g. ResourceExhausted of a full disk
+		retErr = status.Errorf(status.Code(err), "persist client config file failed: %v", status.Convert(err).Message())
 		return 
 	}
 
+	// validated along with the other parameters by persistClientConf
+	initDirs, initDirsMode, err := cfsServer.initDirs()
+	if err != nil {
+		retErr = status.Errorf(codes.InvalidArgument, "%v", err)
+		return
+	}
+
 	if err := cfsServer.runClient(); err != nil {
 		retErr = status.Errorf(codes.Internal, "mount failed: %v", err)
 		return 
 	}
 
+	// the bind mounts of the targets only reach the pods if the staging mount is shared
+	if err := makePropagation(targetPath, stagingPropagation); err != nil {
+		if umountErr := umountVolume(targetPath); umountErr != nil {
+			glog.Errorf("umount after propagation failure fail: %v", umountErr)
+		}
+		retErr = status.Errorf(codes.Internal, "%v", err)
+		return
+	}
+
+	if err := createInitDirs(targetPath, initDirs, initDirsMode); err != nil {
+		if umountErr := umountVolume(targetPath); umountErr != nil {
+			glog.Errorf("umount after init dirs failure fail: %v", umountErr)
+		}
+		retErr = status.Errorf(codes.Internal, "create init dirs failed: %v", err)
+		return
+	}
+
+	ns.supervisor.watch(volumeName, targetPath, cfsServer.clientLocations(), func() error {
+		cleanupStuckMount(targetPath)
+		if err := cfsServer.ensureClientConf(); err != nil {
+			return err
+		}
+		if err := cfsServer.runClient(); err != nil {
+			return err
+		}
+		return makePropagation(targetPath, stagingPropagation)
+	}, cfsServer.ensureClientConf)
+
+	if reportsClusterCapacity(ns.VolumeStatsTotal, param) {
+		ns.clusterStats.set(volumeName, newCapacityCache(ns.CapacityCacheTTL, cfsServer.clusterStat), param[KZoneName])
+	}
 	return
 }
 
+// restoreOwner makes sure param carries the owner the volume was created with,
+// so that the client of a republished volume authenticates the same as before.
+// An owner missing from the volume context, which is the volume attributes of
+// the PersistentVolume, is taken from the volume store. Without one, e.g. for
+// a static PersistentVolume, the owner is generated as before.
+func (ns *nodeServer) restoreOwner(volumeName string, param map[string]string) {
+	if len(param[KOwner]) != 0 {
+		return
+	}
+
+	if err := restoreVolumeMetadata(ns.volumeStore, volumeName, param); err != nil {
+		glog.Warningf("restore metadata of volume[%v] failed, err: %v", volumeName, err)
+	}
+
+	if len(param[KOwner]) == 0 {
+		glog.Warningf("no owner of volume[%v] in the volume context or the volume store, generate one", volumeName)
+	}
+}
+
 func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
-	ns.mutex.Lock()
-	defer ns.mutex.Unlock()
+	defer ns.volumes.lock(req.GetVolumeId())()
 	stagingTargetPath := req.GetStagingTargetPath()
+	ns.supervisor.unwatch(stagingTargetPath)
+	ns.clusterStats.remove(req.GetVolumeId())
 	err := mount.CleanupMountPoint(stagingTargetPath, ns.mounter, false)
 	if err != nil {
 		return nil, err
@@ -159,30 +262,54 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 }
 
 func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	return &csi.NodeGetInfoResponse{
-		NodeId: ns.Driver.NodeID,
-	}, nil
+	resp := &csi.NodeGetInfoResponse{
+		NodeId:            ns.Driver.NodeID,
+		MaxVolumesPerNode: int64(ns.MaxVolumesPerNode),
+	}
+
+	if len(ns.nodePools) > 0 {
+		node, err := ns.Driver.ClientSet.CoreV1().Nodes().Get(ctx, ns.Driver.NodeID, metav1.GetOptions{})
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "get node[%v] for topology fail: %v", ns.Driver.NodeID, err)
+		}
+
+		resp.AccessibleTopology = &csi.Topology{
+			Segments: nodeTopologySegments(ns.nodePools, node.Labels),
+		}
+	}
+
+	return resp, nil
 }
 
 func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	return &csi.NodeGetCapabilitiesResponse{
-		Capabilities: []*csi.NodeServiceCapability{
-			{
-				Type: &csi.NodeServiceCapability_Rpc{
-					Rpc: &csi.NodeServiceCapability_RPC{
-						Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
-					},
+	capabilities := []*csi.NodeServiceCapability{
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
 				},
 			},
-			{
-				Type: &csi.NodeServiceCapability_Rpc{
-					Rpc: &csi.NodeServiceCapability_RPC{
-						Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
-					},
+		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
 				},
 			},
 		},
-	}, nil
+	}
+
+	if ns.ClientSuperviseInterval > 0 {
+		capabilities = append(capabilities, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+				},
+			},
+		})
+	}
+
+	return &csi.NodeGetCapabilitiesResponse{Capabilities: capabilities}, nil
 }
 
 // NodeGetVolumeStats provides volume space and inodes usage statistics.
@@ -195,6 +322,11 @@ func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 		return nil, status.Errorf(codes.InvalidArgument, "argument volume path is required")
 	}
 
+	// the mount of a client given up on is disconnected, no stats to report
+	if condition := ns.supervisor.condition(req.GetVolumeId()); condition != nil && condition.Abnormal {
+		return &csi.NodeGetVolumeStatsResponse{VolumeCondition: condition}, nil
+	}
+
 	isMnt, err := IsMountPoint(volumePath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -208,7 +340,54 @@ func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 		return nil, status.Error(codes.InvalidArgument, "volume path is not a valid filesystem mount point")
 	}
 
-	return nodeGetVolumeStats(ctx, volumePath)
+	resp, err := nodeGetVolumeStats(ctx, volumePath)
+	if err != nil {
+		return nil, err
+	}
+
+	ns.clusterStats.apply(req.GetVolumeId(), resp)
+	if ns.ClientSuperviseInterval > 0 {
+		resp.VolumeCondition = ns.supervisor.condition(req.GetVolumeId())
+	}
+
+	return resp, err
+}
+
+// reserveVolume reserves a client for the staging path while it is mounted,
+// failing with ResourceExhausted if it would run more clients than
+// MaxVolumesPerNode, and returns the func releasing it. The clients being
+// staged count, so that concurrent stages of different volumes cannot exceed
+// the limit. The clients are counted by the supervisor, so those started
+// before the node plugin restarted are not.
+func (ns *nodeServer) reserveVolume(stagingPath string) (func(), error) {
+	if ns.MaxVolumesPerNode <= 0 {
+		return func() {}, nil
+	}
+
+	if ok, clients := ns.supervisor.reserve(stagingPath, ns.MaxVolumesPerNode); !ok {
+		return nil, status.Errorf(codes.ResourceExhausted, "node %v already mounts %d volumes, the maximum of --max-volumes-per-node",
+			ns.Driver.NodeID, clients)
+	}
+
+	return func() { ns.supervisor.release(stagingPath) }, nil
+}
+
+// isDraining reports whether the plugin is shutting down, see shutdown.
+func (ns *nodeServer) isDraining() bool {
+	ns.mutex.Lock()
+	defer ns.mutex.Unlock()
+	return ns.draining
+}
+
+// runClientSupervisor checks the clients every interval, serialized with the
+// node RPCs on the same volume so that a client is not restarted while its
+// volume is unstaged.
+func (ns *nodeServer) runClientSupervisor(interval time.Duration) {
+	for range time.Tick(interval) {
+		if !ns.isDraining() {
+			ns.supervisor.check(ns.volumes.lock)
+		}
+	}
 }
 
 // IsMountPoint judges whether the given path is a mount point or not
@@ -381,10 +560,13 @@ func (ns *nodeServer) remountDamagedVolumes(nodeName string) {
 		go func(p *persistentVolumeWithPods) {
 			defer wg.Done()
 
-			// remount globalmount
+			// remount globalmount. The kubelet paths are named after the
+			// PersistentVolume, while the volume is identified by its handle
+			// like in the node RPCs, which differs with --volume-name-from-pvc
+			volumeID := p.Spec.CSI.VolumeHandle
 			globalMountPath := filepath.Join(ns.KubeletRootDir, fmt.Sprintf("/plugins/kubernetes.io/csi/pv/%s/globalmount", p.Name))
-			if err := ns.mount(globalMountPath, p.Name, p.Spec.CSI.VolumeAttributes); err != nil {
-				glog.Warningf("remount damaged volume %q to path %q failed: %v\n", p.Name, globalMountPath, err)
+			if err := ns.mount(globalMountPath, volumeID, p.Spec.CSI.VolumeAttributes); err != nil {
+				glog.Warningf("remount damaged volume %q to path %q failed: %v\n", volumeID, globalMountPath, err)
 				return
 			}
 			glog.Infof("remount damaged volume %q to global mount path %q succeed.", p.Name, globalMountPath)
@@ -0,0 +1,196 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/cubefs/cubefs-csi/pkg/csi-common"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/utils/mount"
+)
+
+func newFakeNodeServer(conf Config) *nodeServer {
+	csiDriver := csicommon.NewCSIDriver(DriverName, "1.0.0", "fakeNodeID", nil)
+	return &nodeServer{
+		DefaultNodeServer: csicommon.NewDefaultNodeServer(csiDriver),
+		Config:            conf,
+		volumes:           newVolumeLocks(),
+		supervisor:        newClientSupervisor(conf.ClientRestartLimit, conf.ClientSuperviseInterval, nil, conf.mountDirMode),
+		clusterStats:      newClusterCapacityStats(),
+	}
+}
+
+func TestRestoreOwnerOnRepublish(t *testing.T) {
+	store, err := newFileVolumeStore(t.TempDir())
+	assert.NoError(t, err)
+	assert.NoError(t, store.put("pvc-stored", &volumeMetadata{Owner: "csi_1700000000"}))
+	conf := fakeConfig
+	conf.volumeStore = store
+	ns := newFakeNodeServer(conf)
+
+	// the owner persisted in the volume context at creation is kept as is
+	param := map[string]string{KMasterAddr: "10.0.0.1:17010", KOwner: "csi_1600000000", KEnableToken: "true"}
+	ns.restoreOwner("pvc-context", param)
+	cs, err := newCfsServer("pvc-context", param, &ns.Config)
+	assert.NoError(t, err)
+	assert.Equal(t, "csi_1600000000", cs.clientConf[KOwner])
+	assert.Equal(t, "true", cs.clientConf[KEnableToken])
+
+	// republishing twice gives the same owner instead of a generated one
+	for i := 0; i < 2; i++ {
+		param = map[string]string{KMasterAddr: "10.0.0.1:17010"}
+		ns.restoreOwner("pvc-stored", param)
+		cs, err = newCfsServer("pvc-stored", param, &ns.Config)
+		assert.NoError(t, err)
+		assert.Equal(t, "csi_1700000000", cs.clientConf[KOwner])
+	}
+
+	// static volumes without an owner are still mounted, with a generated one
+	param = map[string]string{KMasterAddr: "10.0.0.1:17010"}
+	ns.restoreOwner("pvc-static", param)
+	assert.Empty(t, param[KOwner])
+	cs, err = newCfsServer("pvc-static", param, &ns.Config)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, cs.clientConf[KOwner])
+}
+
+// blockingMounter blocks the mount point checks until released, reporting
+// the path of every check entered.
+type blockingMounter struct {
+	mount.Interface
+	entered chan string
+	release chan struct{}
+}
+
+func (m *blockingMounter) IsLikelyNotMountPoint(file string) (bool, error) {
+	m.entered <- file
+	<-m.release
+	return true, nil
+}
+
+func TestNodeVolumeLocks(t *testing.T) {
+	mounter := &blockingMounter{
+		Interface: mount.NewFakeMounter(nil),
+		entered:   make(chan string),
+		release:   make(chan struct{}),
+	}
+	ns := newFakeNodeServer(fakeConfig)
+	ns.mounter = mounter
+
+	root := t.TempDir()
+	unpublish := func(volumeID, target string) <-chan error {
+		path := filepath.Join(root, target)
+		assert.NoError(t, os.Mkdir(path, 0750))
+		done := make(chan error, 1)
+		go func() {
+			_, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: volumeID, TargetPath: path})
+			done <- err
+		}()
+		return done
+	}
+	entered := func() string {
+		select {
+		case path := <-mounter.entered:
+			return filepath.Base(path)
+		case <-time.After(5 * time.Second):
+			return "timeout"
+		}
+	}
+
+	// different volumes are unpublished in parallel
+	doneA, doneB := unpublish("pvc-a", "a"), unpublish("pvc-b", "b")
+	assert.ElementsMatch(t, []string{"a", "b"}, []string{entered(), entered()})
+	mounter.release <- struct{}{}
+	mounter.release <- struct{}{}
+	assert.NoError(t, <-doneA)
+	assert.NoError(t, <-doneB)
+
+	// while the operations on the same volume are serialized
+	done1 := unpublish("pvc-c", "c1")
+	assert.Equal(t, "c1", entered())
+	done2 := unpublish("pvc-c", "c2")
+	select {
+	case path := <-mounter.entered:
+		t.Fatalf("%v entered while the volume is locked", path)
+	case <-time.After(100 * time.Millisecond):
+	}
+	mounter.release <- struct{}{}
+	assert.NoError(t, <-done1)
+	assert.Equal(t, "c2", entered())
+	mounter.release <- struct{}{}
+	assert.NoError(t, <-done2)
+
+	// the locks of the volumes are dropped
+	assert.Empty(t, ns.volumes.locks)
+}
+
+func TestNodeMaxVolumesPerNode(t *testing.T) {
+	conf := fakeConfig
+	conf.MaxVolumesPerNode = 2
+	ns := newFakeNodeServer(conf)
+
+	info, err := ns.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), info.MaxVolumesPerNode)
+
+	ns.supervisor.watch("pvc-1", "/staging-1", nil, nil, nil)
+	// a volume being staged counts until it is released
+	release, err := ns.reserveVolume("/staging-2")
+	assert.NoError(t, err)
+	_, err = ns.reserveVolume("/staging-3")
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	ns.supervisor.watch("pvc-2", "/staging-2", nil, nil, nil)
+	release()
+
+	// the mounts at the limit are rejected, the staged volumes are not
+	_, err = ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "pvc-3",
+		StagingTargetPath: filepath.Join(t.TempDir(), "staging-3"),
+		VolumeContext:     map[string]string{KMasterAddr: "10.0.0.1:17010", KOwner: "csiuser"},
+	})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	assert.Contains(t, err.Error(), "already mounts 2 volumes")
+
+	release, err = ns.reserveVolume("/staging-1")
+	assert.NoError(t, err)
+	release()
+
+	// the reservation of a failed mount is released
+	ns.supervisor.unwatch("/staging-2")
+	_, err = ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "pvc-3",
+		StagingTargetPath: filepath.Join(t.TempDir(), "staging-3"),
+		VolumeContext:     map[string]string{KMasterAddr: "10.0.0.1:17010", KOwner: "csiuser"},
+	})
+	assert.Error(t, err)
+	assert.NotEqual(t, codes.ResourceExhausted, status.Code(err))
+	assert.Empty(t, ns.supervisor.reserved)
+
+	// unlimited by default
+	ns = newFakeNodeServer(fakeConfig)
+	ns.supervisor.watch("pvc-1", "/staging-1", nil, nil, nil)
+	_, err = ns.reserveVolume("/staging-2")
+	assert.NoError(t, err)
+}
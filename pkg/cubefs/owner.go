@@ -0,0 +1,76 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cubefs/cubefs-csi/pkg/csi-common"
+)
+
+// KStorageClassName names the StorageClass of a volume, which the generated
+// owner is derived from. The csi-provisioner does not pass it, so it has to be
+// set in the parameters of the StorageClass.
+const KStorageClassName = "storageClassName"
+
+const (
+	// length of the owner generated for a volume without a StorageClass
+	defaultOwnerLength = 20
+	// the longest prefix taken from the StorageClass name in an owner
+	maxOwnerClassLength = 24
+)
+
+// generateOwner returns the owner of a volume created without the owner
+// parameter. The volumes of a StorageClass are owned by <class>_<timestamp>,
+// e.g. gold_ssd_cwyvpeni7w9h for the class gold-ssd, so that the master
+// attributes them to their class while the timestamp keeps every owner
+// unique.
+func generateOwner(param map[string]string, now time.Time) string {
+	class := sanitizeOwner(param[KStorageClassName])
+	if len(class) == 0 {
+		return csicommon.ShortenString(fmt.Sprintf("csi_%d", now.UnixNano()), defaultOwnerLength)
+	}
+
+	if len(class) > maxOwnerClassLength {
+		class = strings.TrimRight(class[:maxOwnerClassLength], "_")
+	}
+
+	return class + "_" + strconv.FormatInt(now.UnixNano(), 36)
+}
+
+// sanitizeOwner maps name to the letters, digits and underscores the master
+// allows in an owner, which has to start with a letter.
+func sanitizeOwner(name string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+
+	sanitized = strings.Trim(sanitized, "_")
+	if len(sanitized) != 0 && !(sanitized[0] >= 'a' && sanitized[0] <= 'z' || sanitized[0] >= 'A' && sanitized[0] <= 'Z') {
+		sanitized = "sc_" + sanitized
+	}
+
+	return sanitized
+}
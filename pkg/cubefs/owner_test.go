@@ -0,0 +1,86 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/cubefs/cubefs-csi/pkg/mockmaster"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerateOwner(t *testing.T) {
+	now := time.Unix(1700000000, 123456789)
+	assert.Equal(t, "csi_1700000000123456", generateOwner(map[string]string{}, now))
+	assert.Equal(t, "gold_ssd_cwyvpeni7w9h", generateOwner(map[string]string{KStorageClassName: "gold-ssd"}, now))
+
+	for class, prefix := range map[string]string{
+		"gold.ssd":                       "gold_ssd_",
+		"-gold-":                         "gold_",
+		"1tier":                          "sc_1tier_",
+		"a-very-long-storage-class-name": "a_very_long_storage_clas_",
+		"---":                            "csi_",
+	} {
+		owner := generateOwner(map[string]string{KStorageClassName: class}, now)
+		assert.True(t, strings.HasPrefix(owner, prefix), "%s: %s", class, owner)
+	}
+
+	// the volumes of a class get distinct owners
+	param := map[string]string{KStorageClassName: "gold"}
+	assert.NotEqual(t, generateOwner(param, now), generateOwner(param, now.Add(time.Microsecond)))
+}
+
+func TestCreateVolumeStorageClassOwner(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+
+	store, err := newFileVolumeStore(t.TempDir())
+	assert.NoError(t, err)
+	conf := fakeConfig
+	conf.volumeStore = store
+	cs := newFakeControllerServer(conf)
+	resp, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "pvc-gold",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30},
+		Parameters:    map[string]string{KMasterAddr: master.Addr(), KStorageClassName: "gold"},
+	})
+	assert.NoError(t, err)
+
+	owner := resp.Volume.VolumeContext[KOwner]
+	assert.True(t, strings.HasPrefix(owner, "gold_"), owner)
+	vol, ok := master.Volume("pvc-gold")
+	assert.True(t, ok)
+	assert.Equal(t, owner, vol.Owner)
+
+	// the later requests of the volume find the owner in the volume store
+	restored, err := newCfsServer("pvc-gold", map[string]string{KMasterAddr: master.Addr()}, &conf)
+	assert.NoError(t, err)
+	assert.Equal(t, owner, restored.clientConf[KOwner])
+
+	// an explicit owner wins over the class
+	resp, err = cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "pvc-explicit",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30},
+		Parameters:    map[string]string{KMasterAddr: master.Addr(), KStorageClassName: "gold", KOwner: "csiuser"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "csiuser", resp.Volume.VolumeContext[KOwner])
+}
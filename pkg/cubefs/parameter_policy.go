@@ -0,0 +1,80 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	// set by the csi-provisioner started with --extra-create-metadata
+	KPVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+
+	// the policy of the namespaces without their own
+	defaultPolicyNamespace = "*"
+)
+
+// parameterPolicy maps a namespace to the values its StorageClass parameters
+// may take. Parameters missing from the policy of a namespace are not
+// restricted, and a parameter allowing no values must not be set.
+type parameterPolicy map[string]map[string][]string
+
+func loadParameterPolicy(path string) (parameterPolicy, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := parameterPolicy{}
+	if err := json.Unmarshal(content, &policy); err != nil {
+		return nil, fmt.Errorf("parse parameter policy %v fail: %v", path, err)
+	}
+
+	return policy, nil
+}
+
+// check returns an error if param violates the policy of its PVC namespace.
+func (p parameterPolicy) check(param map[string]string) error {
+	if len(p) == 0 {
+		return nil
+	}
+
+	namespace, ok := param[KPVCNamespace]
+	if !ok {
+		return fmt.Errorf("parameter policy requires %s, start the csi-provisioner with --extra-create-metadata", KPVCNamespace)
+	}
+
+	rules, ok := p[namespace]
+	if !ok {
+		rules = p[defaultPolicyNamespace]
+	}
+
+	for key, allowed := range rules {
+		value, ok := param[key]
+		if !ok {
+			continue
+		}
+
+		if !containsString(allowed, value) {
+			return fmt.Errorf("namespace %q is not allowed to set %s to %q", namespace, key, value)
+		}
+	}
+
+	return nil
+}
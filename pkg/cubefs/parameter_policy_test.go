@@ -0,0 +1,84 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testParameterPolicy = `{
+	"tenant-a": {"crossZone": ["false"], "zoneName": ["zone-a", "zone-b"]},
+	"*": {"crossZone": ["false"], "zoneName": []}
+}`
+
+func TestParameterPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	assert.NoError(t, ioutil.WriteFile(path, []byte(testParameterPolicy), 0644))
+	policy, err := loadParameterPolicy(path)
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		param map[string]string
+		ok    bool
+	}{
+		{param: map[string]string{KPVCNamespace: "tenant-a", KZoneName: "zone-a", KCrossZone: "false"}, ok: true},
+		{param: map[string]string{KPVCNamespace: "tenant-a", KOwner: "anyone"}, ok: true},
+		{param: map[string]string{KPVCNamespace: "tenant-a", KZoneName: "zone-c"}, ok: false},
+		{param: map[string]string{KPVCNamespace: "tenant-a", KCrossZone: "true"}, ok: false},
+		{param: map[string]string{KPVCNamespace: "tenant-b", KCrossZone: "false"}, ok: true},
+		{param: map[string]string{KPVCNamespace: "tenant-b", KZoneName: "zone-a"}, ok: false},
+		{param: map[string]string{KZoneName: "zone-a"}, ok: false},
+	} {
+		err := policy.check(tc.param)
+		if tc.ok {
+			assert.NoError(t, err, "%v", tc.param)
+		} else {
+			assert.Error(t, err, "%v", tc.param)
+		}
+	}
+
+	assert.NoError(t, parameterPolicy(nil).check(map[string]string{KCrossZone: "true"}))
+
+	assert.NoError(t, ioutil.WriteFile(path, []byte(`{"tenant-a": ["zone-a"]}`), 0644))
+	_, err = loadParameterPolicy(path)
+	assert.Error(t, err)
+}
+
+func TestCreateVolumeParameterPolicyDenied(t *testing.T) {
+	conf := Config{parameterPolicy: parameterPolicy{"tenant-a": {KCrossZone: {"false"}}}}
+	_, err := newFakeControllerServer(conf).CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:       "pvc-denied",
+		Parameters: map[string]string{KMasterAddr: "127.0.0.1:1", KPVCNamespace: "tenant-a", KCrossZone: "true"},
+	})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// the defaults of the driver do not bypass the policy
+	conf.DefaultCrossZone = "true"
+	_, err = newFakeControllerServer(conf).CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:       "pvc-defaulted",
+		Parameters: map[string]string{KMasterAddr: "127.0.0.1:1", KPVCNamespace: "tenant-a"},
+	})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
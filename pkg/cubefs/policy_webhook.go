@@ -0,0 +1,142 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// size of the policy decisions read at most
+const maxPolicyDecisionLength = 64 << 10
+
+// policyReview is the volume proposed to the policy webhook.
+type policyReview struct {
+	Name          string            `json:"name"`
+	Volume        string            `json:"volume"`
+	CapacityBytes int64             `json:"capacityBytes"`
+	Parameters    map[string]string `json:"parameters"`
+}
+
+// reviewParameters returns the parameters of the volume proposed to the policy
+// webhook, without the owner which the authKey of the volume derives from.
+func reviewParameters(parameters map[string]string) map[string]string {
+	review := make(map[string]string, len(parameters))
+	for k, v := range parameters {
+		if k != KOwner {
+			review[k] = v
+		}
+	}
+	return review
+}
+
+// policyDecision is the response of the policy webhook.
+type policyDecision struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason"`
+}
+
+// policyWebhook has every volume validated by an external policy server,
+// e.g. OPA, before it is created. A failing policy server denies the volumes,
+// unless failOpen.
+type policyWebhook struct {
+	url      string
+	client   *http.Client
+	failOpen bool
+}
+
+func newPolicyWebhook(rawURL string, timeout time.Duration, failOpen bool) (*policyWebhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid policy webhook url %q, must be an http or https url", rawURL)
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("invalid policy webhook timeout %v, must be positive", timeout)
+	}
+
+	return &policyWebhook{
+		url:      rawURL,
+		client:   &http.Client{Timeout: timeout},
+		failOpen: failOpen,
+	}, nil
+}
+
+// review returns PermissionDenied with the reason of the policy server if it
+// denies the volume, and Unavailable if it fails, unless failOpen.
+func (w *policyWebhook) review(ctx context.Context, review policyReview) error {
+	decision, err := w.decide(ctx, review)
+	if err != nil && w.failOpen {
+		glog.Warningf("policy webhook failed for volume[%v], allow it as fail open. err: %v", review.Name, err)
+		return nil
+	}
+	if err != nil {
+		glog.Errorf("policy webhook failed for volume[%v], deny it. err: %v", review.Name, err)
+		return status.Errorf(codes.Unavailable, "policy webhook failed: %v", err)
+	}
+
+	if !decision.Allowed {
+		glog.Infof("policy webhook denied volume[%v]: %v", review.Name, decision.Reason)
+		return status.Errorf(codes.PermissionDenied, "volume %v denied by policy: %v", review.Name, decision.Reason)
+	}
+
+	return nil
+}
+
+func (w *policyWebhook) decide(ctx context.Context, review policyReview) (*policyDecision, error) {
+	body, err := json.Marshal(review)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	content, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPolicyDecisionLength))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("policy webhook responded with http status %v, body(%v)", resp.StatusCode, bodySnippet(content))
+	}
+
+	decision := &policyDecision{}
+	if err := json.Unmarshal(content, decision); err != nil {
+		return nil, fmt.Errorf("parse policy decision %v fail: %v", bodySnippet(content), err)
+	}
+
+	return decision, nil
+}
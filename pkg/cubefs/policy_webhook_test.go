@@ -0,0 +1,134 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/cubefs/cubefs-csi/pkg/mockmaster"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newPolicyControllerServer(t *testing.T, handler http.HandlerFunc, failOpen bool) *controllerServer {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	webhook, err := newPolicyWebhook(server.URL+"/v1/data/csi/allow", 100*time.Millisecond, failOpen)
+	assert.NoError(t, err)
+
+	conf := fakeConfig
+	conf.policyWebhook = webhook
+	return newFakeControllerServer(conf)
+}
+
+func createPolicyVolume(cs *controllerServer, master *mockmaster.Master, name string) error {
+	_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          name,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 5 << 30},
+		Parameters:    map[string]string{KMasterAddr: master.Addr(), KOwner: "csiuser"},
+	})
+	return err
+}
+
+func TestPolicyWebhookAllow(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+
+	var review policyReview
+	cs := newPolicyControllerServer(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&review))
+		_, _ = w.Write([]byte(`{"allowed": true}`))
+	}, false)
+
+	assert.NoError(t, createPolicyVolume(cs, master, "pvc-allowed"))
+	_, ok := master.Volume("pvc-allowed")
+	assert.True(t, ok)
+
+	assert.Equal(t, "pvc-allowed", review.Name)
+	assert.Equal(t, "pvc-allowed", review.Volume)
+	assert.Equal(t, int64(5<<30), review.CapacityBytes)
+	assert.Equal(t, master.Addr(), review.Parameters[KMasterAddr])
+	// the owner is a secret of the volume, it is not proposed
+	assert.NotContains(t, review.Parameters, KOwner)
+}
+
+func TestPolicyWebhookDeny(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+
+	cs := newPolicyControllerServer(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"allowed": false, "reason": "volumes above 1GiB need approval"}`))
+	}, true)
+
+	err := createPolicyVolume(cs, master, "pvc-denied")
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.Contains(t, err.Error(), "volumes above 1GiB need approval")
+	_, ok := master.Volume("pvc-denied")
+	assert.False(t, ok)
+}
+
+func TestPolicyWebhookFailure(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+
+	for _, handler := range []http.HandlerFunc{
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		},
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`<html>not a decision</html>`))
+		},
+		func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(time.Second)
+		},
+	} {
+		// fail closed
+		err := createPolicyVolume(newPolicyControllerServer(t, handler, false), master, "pvc-closed")
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+		assert.Contains(t, err.Error(), "policy webhook failed")
+		_, ok := master.Volume("pvc-closed")
+		assert.False(t, ok)
+
+		// fail open
+		assert.NoError(t, createPolicyVolume(newPolicyControllerServer(t, handler, true), master, "pvc-open"))
+		_, ok = master.Volume("pvc-open")
+		assert.True(t, ok)
+	}
+}
+
+func TestNewPolicyWebhook(t *testing.T) {
+	_, err := newPolicyWebhook("http://opa.example.com:8181/v1/data/csi/allow", time.Second, false)
+	assert.NoError(t, err)
+
+	for _, u := range []string{"opa.example.com", "ftp://opa.example.com", "http://", "://"} {
+		_, err = newPolicyWebhook(u, time.Second, false)
+		assert.Error(t, err, u)
+	}
+
+	_, err = newPolicyWebhook("http://opa.example.com", 0, false)
+	assert.Error(t, err)
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// attempts to find a free port which is not reserved
+const maxPortAllocateAttempts = 16
+
+// portAllocator hands out free ports to the clients. A port is kept reserved
+// for ttl, so that it is not handed out twice before the client binds it,
+// and is reclaimed afterwards even if the mount failed and no client binds it.
+type portAllocator struct {
+	mutex    sync.Mutex
+	ttl      time.Duration
+	reserved map[int]time.Time // port -> expiry
+
+	// for tests
+	now      func() time.Time
+	freePort func(defaultPort int) (int, error)
+	portFree func(port int) bool
+}
+
+func newPortAllocator(ttl time.Duration) *portAllocator {
+	return &portAllocator{
+		ttl:      ttl,
+		reserved: make(map[int]time.Time),
+		now:      time.Now,
+		freePort: getFreePort,
+		portFree: isPortFree,
+	}
+}
+
+// expire drops the reservations expired at now.
+func (a *portAllocator) expire(now time.Time) {
+	for port, expiry := range a.reserved {
+		if !now.Before(expiry) {
+			delete(a.reserved, port)
+		}
+	}
+}
+
+// allocate returns a free port which is not reserved, and reserves it.
+func (a *portAllocator) allocate(defaultPort int) (int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := a.now()
+	a.expire(now)
+
+	for i := 0; i < maxPortAllocateAttempts; i++ {
+		port, err := a.freePort(defaultPort)
+		if err != nil {
+			return port, err
+		}
+
+		if _, ok := a.reserved[port]; !ok {
+			a.reserved[port] = now.Add(a.ttl)
+			return port, nil
+		}
+	}
+
+	return defaultPort, fmt.Errorf("no free port after %d attempts, %d ports reserved", maxPortAllocateAttempts, len(a.reserved))
+}
+
+// allocateInRange returns the first free port of r which is not reserved,
+// and reserves it.
+func (a *portAllocator) allocateInRange(r portRange) (int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := a.now()
+	a.expire(now)
+
+	reserved := 0
+	for port := r.min; port <= r.max; port++ {
+		if _, ok := a.reserved[port]; ok {
+			reserved++
+			continue
+		}
+
+		if a.portFree(port) {
+			a.reserved[port] = now.Add(a.ttl)
+			return port, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no free port in range %v, %d of its ports reserved and the others in use", r, reserved)
+}
+
+// portRange is an inclusive range of ports.
+type portRange struct {
+	min int
+	max int
+}
+
+func (r portRange) String() string {
+	return fmt.Sprintf("%d-%d", r.min, r.max)
+}
+
+// parsePortRange parses a port range like 9500-9600, nil if value is empty.
+func parsePortRange(value string) (*portRange, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+
+	minStr, maxStr, ok := strings.Cut(value, "-")
+	min, minErr := strconv.Atoi(strings.TrimSpace(minStr))
+	max, maxErr := strconv.Atoi(strings.TrimSpace(maxStr))
+	if !ok || minErr != nil || maxErr != nil || min < 1 || max > 65535 || min > max {
+		return nil, fmt.Errorf("invalid port range %q, must be <min>-<max> within 1-65535", value)
+	}
+
+	return &portRange{min: min, max: max}, nil
+}
+
+// isPortFree reports whether port can be listened on.
+func isPortFree(port int) bool {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return false
+	}
+
+	l.Close()
+	return true
+}
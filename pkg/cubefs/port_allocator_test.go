@@ -0,0 +1,127 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPortAllocatorReservationExpiry(t *testing.T) {
+	now := time.Now()
+	a := newPortAllocator(time.Minute)
+	a.now = func() time.Time { return now }
+	// the system keeps offering the same two ports, as no client binds them
+	var mutex sync.Mutex
+	offered := 0
+	a.freePort = func(defaultPort int) (int, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		offered++
+		return 20000 + offered%2, nil
+	}
+
+	allocateConcurrently := func(n int) (ports []int, failures int) {
+		var wg sync.WaitGroup
+		var resultMutex sync.Mutex
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				port, err := a.allocate(defaultExporterPort)
+				resultMutex.Lock()
+				defer resultMutex.Unlock()
+				if err != nil {
+					failures++
+					return
+				}
+				ports = append(ports, port)
+			}()
+		}
+		wg.Wait()
+		return ports, failures
+	}
+
+	ports, failures := allocateConcurrently(8)
+	assert.ElementsMatch(t, []int{20000, 20001}, ports)
+	assert.Equal(t, 6, failures)
+
+	// still reserved within the ttl
+	now = now.Add(30 * time.Second)
+	ports, _ = allocateConcurrently(4)
+	assert.Empty(t, ports)
+
+	// the reservations expire and the ports are reused
+	now = now.Add(31 * time.Second)
+	ports, failures = allocateConcurrently(4)
+	assert.ElementsMatch(t, []int{20000, 20001}, ports)
+	assert.Equal(t, 2, failures)
+}
+
+func TestPortAllocatorFreePort(t *testing.T) {
+	a := newPortAllocator(time.Minute)
+	first, err := a.allocate(defaultExporterPort)
+	assert.NoError(t, err)
+	second, err := a.allocate(defaultExporterPort)
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, second)
+}
+
+func TestPortAllocatorRange(t *testing.T) {
+	now := time.Now()
+	busy := map[int]bool{9501: true}
+	a := newPortAllocator(time.Minute)
+	a.now = func() time.Time { return now }
+	a.portFree = func(port int) bool { return !busy[port] }
+
+	r := portRange{min: 9500, max: 9502}
+	var ports []int
+	for i := 0; i < 2; i++ {
+		port, err := a.allocateInRange(r)
+		assert.NoError(t, err)
+		ports = append(ports, port)
+	}
+	assert.Equal(t, []int{9500, 9502}, ports)
+
+	// all ports of the range are reserved or in use
+	_, err := a.allocateInRange(r)
+	assert.EqualError(t, err, "no free port in range 9500-9502, 2 of its ports reserved and the others in use")
+
+	// the reservations expire and the ports are reused
+	now = now.Add(time.Minute)
+	port, err := a.allocateInRange(r)
+	assert.NoError(t, err)
+	assert.Equal(t, 9500, port)
+}
+
+func TestParsePortRange(t *testing.T) {
+	r, err := parsePortRange("")
+	assert.NoError(t, err)
+	assert.Nil(t, r)
+
+	r, err = parsePortRange("9500-9600")
+	assert.NoError(t, err)
+	assert.Equal(t, &portRange{min: 9500, max: 9600}, r)
+
+	for _, value := range []string{"9500", "9600-9500", "0-10", "9500-70000", "a-b"} {
+		_, err = parsePortRange(value)
+		assert.Error(t, err, value)
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// KProfile selects a bundle of client tuning values, see clientProfiles.
+const KProfile = "profile"
+
+// clientProfiles are the client config values each profile expands into.
+// Clients reaching the cluster over a WAN link cache the metadata longer and
+// read from the nearest replicas, trading freshness for fewer round trips.
+var clientProfiles = map[string]map[string]string{
+	"lan": {
+		"icacheTimeout": "5",
+		"lookupValid":   "5",
+		"attrValid":     "5",
+		"followerRead":  "false",
+		"nearRead":      "false",
+	},
+	"wan": {
+		"icacheTimeout": "60",
+		"lookupValid":   "60",
+		"attrValid":     "60",
+		"keepcache":     "true",
+		"followerRead":  "true",
+		"nearRead":      "true",
+	},
+}
+
+// applyClientProfile expands the profile selected in param into the client
+// config values it bundles, the values set explicitly in param win.
+func applyClientProfile(param map[string]string) error {
+	name := param[KProfile]
+	if len(name) == 0 {
+		return nil
+	}
+
+	profile, ok := clientProfiles[name]
+	if !ok {
+		names := make([]string, 0, len(clientProfiles))
+		for n := range clientProfiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown %s %q, must be one of %s", KProfile, name, strings.Join(names, ", "))
+	}
+
+	for k, v := range profile {
+		if len(param[k]) == 0 {
+			param[k] = v
+		}
+	}
+
+	return nil
+}
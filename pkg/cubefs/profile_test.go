@@ -0,0 +1,66 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestApplyClientProfile(t *testing.T) {
+	param := map[string]string{KProfile: "wan", "lookupValid": "120"}
+	assert.NoError(t, applyClientProfile(param))
+	for k, v := range clientProfiles["wan"] {
+		if k == "lookupValid" {
+			continue
+		}
+		assert.Equal(t, v, param[k], k)
+	}
+	// explicit parameters win over the profile
+	assert.Equal(t, "120", param["lookupValid"])
+
+	param = map[string]string{}
+	assert.NoError(t, applyClientProfile(param))
+	assert.Empty(t, param)
+
+	err := applyClientProfile(map[string]string{KProfile: "satellite"})
+	assert.EqualError(t, err, `unknown profile "satellite", must be one of lan, wan`)
+}
+
+func TestPersistClientConfProfile(t *testing.T) {
+	cs, mountPoint := newClientConfTestServer(t, clientConfDeliveryFile)
+	cs.clientConf[KProfile] = "wan"
+	cs.clientConf["followerRead"] = "false"
+	assert.NoError(t, cs.persistClientConf(mountPoint))
+
+	content, err := ioutil.ReadFile(cs.clientConfFile)
+	assert.NoError(t, err)
+	written := map[string]string{}
+	assert.NoError(t, json.Unmarshal(content, &written))
+	assert.Equal(t, "60", written["icacheTimeout"])
+	assert.Equal(t, "true", written["nearRead"])
+	assert.Equal(t, "false", written["followerRead"])
+
+	cs, mountPoint = newClientConfTestServer(t, clientConfDeliveryFile)
+	cs.clientConf[KProfile] = "satellite"
+	assert.Equal(t, codes.InvalidArgument, status.Code(cs.persistClientConf(mountPoint)))
+}
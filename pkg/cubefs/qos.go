@@ -0,0 +1,146 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// volume type which does not support QoS, i.e. the erasure coded cold volume
+const volTypeCold = "1"
+
+// qosQuery validates the QoS parameters, and returns the query string setting
+// them on the master, which is empty if none of them is set. The limits apply
+// to reads and writes each, maxBandwidth is in MB/s.
+func (cs *cfsServer) qosQuery() (string, error) {
+	iops, err := parseQosLimit(cs.clientConf, KMaxIOPS)
+	if err != nil {
+		return "", err
+	}
+
+	bandwidth, err := parseQosLimit(cs.clientConf, KMaxBandwidth)
+	if err != nil {
+		return "", err
+	}
+
+	if iops == 0 && bandwidth == 0 {
+		return "", nil
+	}
+
+	if cs.clientConf[KVolType] == volTypeCold {
+		return "", fmt.Errorf("%s and %s are not supported by %s %s", KMaxIOPS, KMaxBandwidth, KVolType, volTypeCold)
+	}
+
+	query := "&qosEnable=true"
+	if iops > 0 {
+		query += fmt.Sprintf("&iopsRLimit=%d&iopsWLimit=%d", iops, iops)
+	}
+	if bandwidth > 0 {
+		query += fmt.Sprintf("&flowRLimit=%d&flowWLimit=%d", bandwidth, bandwidth)
+	}
+
+	return query, nil
+}
+
+func parseQosLimit(param map[string]string, key string) (int64, error) {
+	value, ok := param[key]
+	if !ok || len(value) == 0 {
+		return 0, nil
+	}
+
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit <= 0 || limit > math.MaxInt32 {
+		return 0, fmt.Errorf("invalid %s %q, must be an integer in [1, %d]", key, value, math.MaxInt32)
+	}
+
+	return limit, nil
+}
+
+// updateQos sets the QoS limits of an existing volume.
+func (cs *cfsServer) updateQos() error {
+	qos, err := cs.qosQuery()
+	if err != nil {
+		return err
+	}
+
+	if len(qos) == 0 {
+		return fmt.Errorf("neither %s nor %s is set", KMaxIOPS, KMaxBandwidth)
+	}
+
+	authKey, err := cs.getAuthKey()
+	if err != nil {
+		return err
+	}
+
+	volName := cs.clientConf[KVolumeName]
+	return cs.retryOnTransient("UpdateQos", func() error {
+		return cs.forEachMasterAddr("UpdateQos", func(addr string) error {
+			url := cs.masterURL(addr, fmt.Sprintf("/qos/update?name=%s&authKey=%v%s", volName, authKey, qos))
+			glog.Infof("updateQos url: %v", redactAuthKey(url))
+			resp, err := cs.executeRequest(url)
+			if err != nil {
+				return err
+			}
+
+			if resp.Code != 0 {
+				return fmt.Errorf("update qos of volume[%v] failed, code:%v, msg:%v", volName, resp.Code, resp.Msg)
+			}
+
+			return nil
+		})
+	})
+}
+
+// QosOptions selects the volume whose QoS limits UpdateVolumeQos sets.
+type QosOptions struct {
+	MasterAddr   string
+	VolumeName   string
+	Owner        string
+	AuthKey      string
+	MaxIOPS      string
+	MaxBandwidth string
+}
+
+// UpdateVolumeQos adjusts the QoS limits of an existing volume, as the CSI
+// version the driver implements cannot modify a volume after creation.
+func UpdateVolumeQos(conf Config, opts QosOptions) error {
+	if len(opts.Owner) == 0 && len(opts.AuthKey) == 0 {
+		return fmt.Errorf("either the owner or the authKey of the volume is required")
+	}
+
+	param := map[string]string{
+		KMasterAddr:   opts.MasterAddr,
+		KOwner:        opts.Owner,
+		KMaxIOPS:      opts.MaxIOPS,
+		KMaxBandwidth: opts.MaxBandwidth,
+	}
+
+	cs, err := newCfsServer(opts.VolumeName, param, &conf)
+	if err != nil {
+		return err
+	}
+
+	if len(opts.AuthKey) != 0 {
+		cs.applySecrets(map[string]string{secretAuthKey: opts.AuthKey})
+	}
+
+	return cs.updateQos()
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCreateVolumeForwardsQos(t *testing.T) {
+	var query url.Values
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		writeMasterResponse(w, 0, "success")
+	})
+
+	assert.NoError(t, cs.createVolume(10))
+	assert.Empty(t, query.Get("qosEnable"))
+
+	cs.clientConf[KMaxIOPS] = "2000"
+	cs.clientConf[KMaxBandwidth] = "100"
+	assert.NoError(t, cs.createVolume(10))
+	assert.Equal(t, "true", query.Get("qosEnable"))
+	assert.Equal(t, "2000", query.Get("iopsRLimit"))
+	assert.Equal(t, "2000", query.Get("iopsWLimit"))
+	assert.Equal(t, "100", query.Get("flowRLimit"))
+	assert.Equal(t, "100", query.Get("flowWLimit"))
+}
+
+func TestQosValidation(t *testing.T) {
+	cs := &cfsServer{clientConf: map[string]string{KVolType: defaultVolType}}
+	for _, value := range []string{"0", "-1", "fast", "1.5", "4294967296"} {
+		cs.clientConf[KMaxIOPS] = value
+		_, err := cs.qosQuery()
+		assert.Error(t, err, "maxIOPS %q", value)
+	}
+
+	cs.clientConf[KMaxIOPS] = "100"
+	query, err := cs.qosQuery()
+	assert.NoError(t, err)
+	assert.Equal(t, "&qosEnable=true&iopsRLimit=100&iopsWLimit=100", query)
+
+	// the cold volume does not support QoS
+	cs.clientConf[KVolType] = volTypeCold
+	_, err = cs.qosQuery()
+	assert.Error(t, err)
+
+	delete(cs.clientConf, KMaxIOPS)
+	query, err = cs.qosQuery()
+	assert.NoError(t, err)
+	assert.Empty(t, query)
+}
+
+func TestCreateVolumeRejectsColdVolumeQos(t *testing.T) {
+	var calls int
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		writeMasterResponse(w, 0, "success")
+	})
+	cs.clientConf[KVolType] = volTypeCold
+	cs.clientConf[KMaxBandwidth] = "100"
+
+	assert.Equal(t, codes.InvalidArgument, status.Code(cs.createVolume(10)))
+	assert.Equal(t, 0, calls)
+}
+
+func TestUpdateQos(t *testing.T) {
+	var path string
+	var query url.Values
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		path, query = r.URL.Path, r.URL.Query()
+		writeMasterResponse(w, 0, "success")
+	})
+
+	assert.Error(t, cs.updateQos())
+
+	cs.clientConf[KMaxIOPS] = "500"
+	assert.NoError(t, cs.updateQos())
+	assert.Equal(t, "/qos/update", path)
+	assert.Equal(t, "pvc-fake", query.Get("name"))
+	assert.Equal(t, "500", query.Get("iopsWLimit"))
+	assert.NotEmpty(t, query.Get("authKey"))
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// nodePool is a set of nodes selected by a node label, served by a CubeFS zone.
+type nodePool struct {
+	labelKey   string
+	labelValue string
+	zone       string
+}
+
+// parseNodePools parses the node pool definitions in the form of
+// "<zone>:<label key>=<label value>", separated by comma.
+func parseNodePools(value string) ([]nodePool, error) {
+	var pools []nodePool
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		zone, selector, ok := strings.Cut(item, ":")
+		if !ok || len(zone) == 0 {
+			return nil, fmt.Errorf("invalid node pool %q, must be <zone>:<label key>=<label value>", item)
+		}
+
+		key, value, err := parseNodeSelector(selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node pool %q: %v", item, err)
+		}
+
+		pools = append(pools, nodePool{labelKey: key, labelValue: value, zone: zone})
+	}
+
+	return pools, nil
+}
+
+// parseDefaultZone validates the zoneName applied to the volumes without the
+// parameter, which may list several zones separated by comma like the
+// parameter, and returns it without the spaces.
+func parseDefaultZone(value string) (string, error) {
+	zones := strings.Split(value, ",")
+	for i, zone := range zones {
+		zones[i] = strings.TrimSpace(zone)
+		if len(zones[i]) == 0 {
+			return "", fmt.Errorf("invalid default zone %q, the zone names must not be empty", value)
+		}
+	}
+
+	return strings.Join(zones, ","), nil
+}
+
+func parseNodeSelector(selector string) (string, string, error) {
+	key, value, ok := strings.Cut(strings.TrimSpace(selector), "=")
+	if !ok || len(key) == 0 || len(value) == 0 {
+		return "", "", fmt.Errorf("invalid node selector %q, must be <label key>=<label value>", selector)
+	}
+
+	return key, value, nil
+}
+
+// nodePoolTopology resolves the nodeSelector parameter into the zone serving
+// the selected node pool, which is written back to param, and returns the
+// topology restricting the volume to the nodes of the pool.
+func nodePoolTopology(pools []nodePool, param map[string]string) ([]*csi.Topology, error) {
+	selector := param[KNodeSelector]
+	if len(selector) == 0 {
+		return nil, nil
+	}
+
+	key, value, err := parseNodeSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pool := range pools {
+		if pool.labelKey != key || pool.labelValue != value {
+			continue
+		}
+
+		if zone := param[KZoneName]; len(zone) != 0 && zone != pool.zone {
+			return nil, fmt.Errorf("%s %q conflicts with zone %q of %s %q", KZoneName, zone, pool.zone, KNodeSelector, selector)
+		}
+
+		param[KZoneName] = pool.zone
+		return []*csi.Topology{{Segments: map[string]string{key: value}}}, nil
+	}
+
+	return nil, fmt.Errorf("%s %q does not match any node pool of a known zone", KNodeSelector, selector)
+}
+
+// placedTopology returns the topology of the nodes of the pools serving the
+// zones the master placed a volume in, separated by comma. It returns false if
+// one of the zones is not served by a node pool, in which case the volume
+// cannot be restricted to the nodes of the pools.
+func placedTopology(pools []nodePool, zoneName string) ([]*csi.Topology, bool) {
+	var topology []*csi.Topology
+	seen := make(map[nodePool]bool)
+	for _, zone := range strings.Split(zoneName, ",") {
+		zone = strings.TrimSpace(zone)
+		served := false
+		for _, pool := range pools {
+			if pool.zone != zone {
+				continue
+			}
+
+			served = true
+			if !seen[pool] {
+				seen[pool] = true
+				topology = append(topology, &csi.Topology{Segments: map[string]string{pool.labelKey: pool.labelValue}})
+			}
+		}
+
+		if !served {
+			return nil, false
+		}
+	}
+
+	return topology, true
+}
+
+// nodeTopologySegments returns the topology segments of a node with the given labels.
+func nodeTopologySegments(pools []nodePool, labels map[string]string) map[string]string {
+	segments := make(map[string]string)
+	for _, pool := range pools {
+		if value, ok := labels[pool.labelKey]; ok {
+			segments[pool.labelKey] = value
+		}
+	}
+
+	return segments
+}
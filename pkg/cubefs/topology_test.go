@@ -0,0 +1,107 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseNodePools(t *testing.T) {
+	pools, err := parseNodePools("ssd-zone:disktype=ssd, hdd-zone:disktype=hdd")
+	assert.NoError(t, err)
+	assert.Equal(t, []nodePool{
+		{labelKey: "disktype", labelValue: "ssd", zone: "ssd-zone"},
+		{labelKey: "disktype", labelValue: "hdd", zone: "hdd-zone"},
+	}, pools)
+
+	pools, err = parseNodePools("")
+	assert.NoError(t, err)
+	assert.Empty(t, pools)
+
+	for _, value := range []string{"ssd-zone", ":disktype=ssd", "ssd-zone:disktype", "ssd-zone:=ssd"} {
+		_, err = parseNodePools(value)
+		assert.Error(t, err, "value %q", value)
+	}
+}
+
+func TestNodePoolTopology(t *testing.T) {
+	pools, err := parseNodePools("ssd-zone:disktype=ssd,hdd-zone:disktype=hdd")
+	assert.NoError(t, err)
+
+	// no selector, no restriction
+	topology, err := nodePoolTopology(pools, map[string]string{})
+	assert.NoError(t, err)
+	assert.Nil(t, topology)
+
+	param := map[string]string{KNodeSelector: "disktype=ssd"}
+	topology, err = nodePoolTopology(pools, param)
+	assert.NoError(t, err)
+	assert.Equal(t, "ssd-zone", param[KZoneName])
+	assert.Len(t, topology, 1)
+	assert.Equal(t, map[string]string{"disktype": "ssd"}, topology[0].GetSegments())
+
+	_, err = nodePoolTopology(pools, map[string]string{KNodeSelector: "disktype=nvme"})
+	assert.Error(t, err)
+
+	_, err = nodePoolTopology(pools, map[string]string{KNodeSelector: "disktype=ssd", KZoneName: "hdd-zone"})
+	assert.Error(t, err)
+}
+
+func TestNodeTopologySegments(t *testing.T) {
+	pools, err := parseNodePools("ssd-zone:disktype=ssd,rack-zone:rack=r1")
+	assert.NoError(t, err)
+
+	segments := nodeTopologySegments(pools, map[string]string{"disktype": "hdd", "kubernetes.io/os": "linux"})
+	assert.Equal(t, map[string]string{"disktype": "hdd"}, segments)
+}
+
+func TestParseDefaultZone(t *testing.T) {
+	zone, err := parseDefaultZone(" zone-a ")
+	assert.NoError(t, err)
+	assert.Equal(t, "zone-a", zone)
+	zone, err = parseDefaultZone("zone-a, zone-b")
+	assert.NoError(t, err)
+	assert.Equal(t, "zone-a,zone-b", zone)
+
+	for _, value := range []string{" ", "zone-a,", ",zone-b"} {
+		_, err = parseDefaultZone(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestPlacedTopology(t *testing.T) {
+	pools, err := parseNodePools("ssd-zone:disktype=ssd,ssd-zone:rack=r1,hdd-zone:disktype=hdd")
+	assert.NoError(t, err)
+
+	topology, ok := placedTopology(pools, "hdd-zone")
+	assert.True(t, ok)
+	assert.Equal(t, []*csi.Topology{{Segments: map[string]string{"disktype": "hdd"}}}, topology)
+
+	topology, ok = placedTopology(pools, "ssd-zone,hdd-zone")
+	assert.True(t, ok)
+	assert.Equal(t, []*csi.Topology{
+		{Segments: map[string]string{"disktype": "ssd"}},
+		{Segments: map[string]string{"rack": "r1"}},
+		{Segments: map[string]string{"disktype": "hdd"}},
+	}, topology)
+
+	_, ok = placedTopology(pools, "hdd-zone,nvme-zone")
+	assert.False(t, ok)
+}
@@ -0,0 +1,287 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// the W3C trace context header, propagated to the masters
+	traceparentHeader = "traceparent"
+	// spans buffered for the exporter, the spans beyond are dropped
+	maxPendingSpans = 1024
+	// spans exported by one request at most
+	maxSpansPerExport = 256
+	// timeout of every export to the collector
+	traceExportTimeout = 10 * time.Second
+)
+
+// kinds and status codes of the spans in OTLP
+const (
+	spanKindServer  = 2
+	spanKindClient  = 3
+	spanStatusOK    = 1
+	spanStatusError = 2
+)
+
+// tracer records the spans of the CSI operations and of their master
+// requests, and exports them to an OpenTelemetry collector with OTLP/HTTP in
+// JSON. A nil tracer, i.e. tracing disabled, records nothing.
+type tracer struct {
+	endpoint string
+	service  string
+	client   *http.Client
+	spans    chan *span
+}
+
+func newTracer(endpoint, service string) (*tracer, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid tracing endpoint %q, must be the http or https url of the OTLP traces", endpoint)
+	}
+
+	t := &tracer{
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: traceExportTimeout},
+		spans:    make(chan *span, maxPendingSpans),
+	}
+	go t.run()
+	return t, nil
+}
+
+// span is an operation traced, see tracer.
+type span struct {
+	tracer     *tracer
+	name       string
+	kind       int
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	err        error
+}
+
+type spanContextKey struct{}
+
+// start starts a span of ctx, the child of the span of ctx if any, or of the
+// trace context the CO passed in the grpc metadata. The returned context
+// carries the span.
+func (t *tracer) start(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &span{tracer: t, name: name, kind: kind, start: time.Now(), attributes: make(map[string]string)}
+	if parent, ok := ctx.Value(spanContextKey{}).(*span); ok {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else if traceID, parentID, ok := incomingTraceparent(ctx); ok {
+		s.traceID, s.parentID = traceID, parentID
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+	_, _ = rand.Read(s.spanID[:])
+
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+// incomingTraceparent parses the trace context of the grpc metadata.
+func incomingTraceparent(ctx context.Context) (traceID [16]byte, spanID [8]byte, ok bool) {
+	md, found := metadata.FromIncomingContext(ctx)
+	if !found || len(md.Get(traceparentHeader)) == 0 {
+		return traceID, spanID, false
+	}
+
+	parts := strings.Split(md.Get(traceparentHeader)[0], "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil {
+		return traceID, spanID, false
+	}
+
+	return traceID, spanID, traceID != [16]byte{}
+}
+
+// traceparent returns the W3C trace context of the span, sampled.
+func (s *span) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:]))
+}
+
+func (s *span) setAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.attributes[key] = value
+}
+
+// finish ends the span with the result of err, and queues it for export.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+
+	s.end, s.err = time.Now(), err
+	select {
+	case s.tracer.spans <- s:
+	default:
+		glog.V(2).Infof("too many spans pending for export, drop span %v", s.name)
+	}
+}
+
+// run exports the finished spans in batches.
+func (t *tracer) run() {
+	for s := range t.spans {
+		batch := []*span{s}
+		for len(batch) < maxSpansPerExport {
+			select {
+			case s := <-t.spans:
+				batch = append(batch, s)
+				continue
+			default:
+			}
+			break
+		}
+
+		if err := t.export(batch); err != nil {
+			glog.Warningf("export %d spans to %v failed. err: %v", len(batch), t.endpoint, err)
+		}
+	}
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func newOTLPAttribute(key, value string) otlpAttribute {
+	attribute := otlpAttribute{Key: key}
+	attribute.Value.StringValue = value
+	return attribute
+}
+
+// newOTLPTraces maps the spans into the OTLP traces of the service.
+func newOTLPTraces(service string, spans []*span) *otlpTraces {
+	traces := &otlpTraces{ResourceSpans: make([]otlpResourceSpans, 1)}
+	resource := &traces.ResourceSpans[0]
+	resource.Resource.Attributes = []otlpAttribute{newOTLPAttribute("service.name", service)}
+	resource.ScopeSpans = make([]otlpScopeSpans, 1)
+	scope := &resource.ScopeSpans[0]
+	scope.Scope.Name = DriverName
+
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for k, v := range s.attributes {
+			o.Attributes = append(o.Attributes, newOTLPAttribute(k, v))
+		}
+		o.Status.Code = spanStatusOK
+		if s.err != nil {
+			// the errors of the master requests may carry the authKey
+			o.Status.Code, o.Status.Message = spanStatusError, redactAuthKey(s.err.Error())
+		}
+		scope.Spans = append(scope.Spans, o)
+	}
+
+	return traces
+}
+
+// export posts the spans to the collector.
+func (t *tracer) export(spans []*span) error {
+	body, err := json.Marshal(newOTLPTraces(t.service, spans))
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded with http status %v", resp.StatusCode)
+	}
+
+	return nil
+}
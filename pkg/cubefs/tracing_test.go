@@ -0,0 +1,185 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/cubefs/cubefs-csi/pkg/mockmaster"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/metadata"
+)
+
+// newTraceCollector returns a tracer exporting to a collector, and the spans
+// the collector received.
+func newTraceCollector(t *testing.T) (*tracer, func() []otlpSpan) {
+	var lock sync.Mutex
+	var spans []otlpSpan
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		traces := otlpTraces{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&traces))
+		assert.Len(t, traces.ResourceSpans, 1)
+		assert.Equal(t, "csi.cubefs.com", traces.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+
+		lock.Lock()
+		defer lock.Unlock()
+		for _, scope := range traces.ResourceSpans[0].ScopeSpans {
+			spans = append(spans, scope.Spans...)
+		}
+	}))
+	t.Cleanup(collector.Close)
+
+	tracer, err := newTracer(collector.URL+"/v1/traces", "csi.cubefs.com")
+	assert.NoError(t, err)
+
+	return tracer, func() []otlpSpan {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]otlpSpan(nil), spans...)
+	}
+}
+
+func findSpan(spans []otlpSpan, name string) (otlpSpan, bool) {
+	for _, s := range spans {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return otlpSpan{}, false
+}
+
+func TestTracingCreateVolume(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+
+	// proxy the master to see the trace context of its requests
+	var lock sync.Mutex
+	traceparents := make(map[string]string)
+	target, _ := url.Parse("http://" + master.Addr())
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		traceparents[r.URL.Path] = r.Header.Get(traceparentHeader)
+		lock.Unlock()
+		proxy.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	tracer, received := newTraceCollector(t)
+	conf := fakeConfig
+	conf.tracer = tracer
+	cs := newFakeControllerServer(conf)
+
+	_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "pvc-traced",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 5 << 30},
+		Parameters:    map[string]string{KMasterAddr: server.Listener.Addr().String(), KOwner: "csiuser"},
+	})
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		_, ok := findSpan(received(), "CreateVolume")
+		return ok
+	}, 5*time.Second, 10*time.Millisecond)
+
+	spans := received()
+	create, _ := findSpan(spans, "CreateVolume")
+	assert.Equal(t, spanKindServer, create.Kind)
+	assert.Empty(t, create.ParentSpanID)
+	assert.Equal(t, spanStatusOK, create.Status.Code)
+
+	createVol, ok := findSpan(spans, "master /admin/createVol")
+	assert.True(t, ok)
+	assert.Equal(t, spanKindClient, createVol.Kind)
+	assert.Equal(t, create.TraceID, createVol.TraceID)
+	assert.Equal(t, create.SpanID, createVol.ParentSpanID)
+	assert.Contains(t, createVol.Attributes, newOTLPAttribute("http.status_code", "200"))
+
+	// the master is passed the trace context of the span of its request
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, "00-"+createVol.TraceID+"-"+createVol.SpanID+"-01", traceparents["/admin/createVol"])
+}
+
+func TestTracingFailedOperation(t *testing.T) {
+	tracer, received := newTraceCollector(t)
+	conf := fakeConfig
+	conf.tracer = tracer
+	cs := newFakeControllerServer(conf)
+
+	// the trace context of the CO is continued
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(traceparentHeader,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"))
+	_, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{})
+	assert.Error(t, err)
+
+	assert.Eventually(t, func() bool {
+		return len(received()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	span := received()[0]
+	assert.Equal(t, "DeleteVolume", span.Name)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.TraceID)
+	assert.Equal(t, "00f067aa0ba902b7", span.ParentSpanID)
+	assert.Equal(t, spanStatusError, span.Status.Code)
+	assert.Contains(t, span.Status.Message, "volume id is required")
+}
+
+func TestTracingDisabled(t *testing.T) {
+	var tracer *tracer
+	ctx := context.Background()
+	spanCtx, span := tracer.start(ctx, "CreateVolume", spanKindServer)
+	assert.Nil(t, span)
+	assert.Equal(t, ctx, spanCtx)
+
+	// the spans of the disabled tracer are no-ops
+	span.setAttribute("csi.volume", "pvc-untraced")
+	span.finish(nil)
+}
+
+func TestNewTracer(t *testing.T) {
+	for _, u := range []string{"collector:4318", "grpc://collector:4317", "http://", "://"} {
+		_, err := newTracer(u, DriverName)
+		assert.Error(t, err, u)
+	}
+}
+
+func TestIncomingTraceparent(t *testing.T) {
+	for _, traceparent := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+		"00-" + strings.Repeat("0", 32) + "-00f067aa0ba902b7-01",
+	} {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(traceparentHeader, traceparent))
+		_, _, ok := incomingTraceparent(ctx)
+		assert.False(t, ok, traceparent)
+	}
+}
@@ -17,18 +17,33 @@ limitations under the License.
 package cubefs
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"net"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/utils/mount"
 )
 
 const (
-	CfsClientBin = "/cfs/bin/cfs-client"
+	CfsClientBin   = "/cfs/bin/cfs-client"
+	fuseDevicePath = "/dev/fuse"
+	// mode of the target and staging directories, unless --mount-dir-mode is set
+	defaultMountDirMode os.FileMode = 0750
+	// propagation of the staging mounts
+	stagingPropagation = "shared"
 )
 
 func parseEndpoint(ep string) (string, string, error) {
@@ -56,8 +71,35 @@ func getFreePort(defaultPort int) (int, error) {
 	return l.Addr().(*net.TCPAddr).Port, nil
 }
 
-func createMountPoint(root string) error {
-	return os.MkdirAll(root, 0750)
+// createMountPoint creates the directory root with mode, regardless of the
+// umask. defaultMountDirMode is used if mode is 0.
+func createMountPoint(root string, mode os.FileMode) error {
+	if mode == 0 {
+		mode = defaultMountDirMode
+	}
+
+	_, err := os.Stat(root)
+	created := os.IsNotExist(err)
+	if err := os.MkdirAll(root, mode); err != nil {
+		return err
+	}
+
+	if !created {
+		return nil
+	}
+
+	// MkdirAll is subject to the umask
+	return os.Chmod(root, mode)
+}
+
+// parseDirMode parses an octal permission like 0755.
+func parseDirMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid mode %q, must be an octal permission like 0755", s)
+	}
+
+	return os.FileMode(mode), nil
 }
 
 // return true if mount
@@ -74,15 +116,134 @@ func bindMount(stagingTargetPath string, targetPath string) error {
 	return nil
 }
 
+// mount propagations by the mount flags requesting them, which also take the
+// mount propagation names of kubernetes
+var mountPropagations = map[string]string{
+	"shared":          "shared",
+	"rshared":         "rshared",
+	"slave":           "slave",
+	"rslave":          "rslave",
+	"private":         "private",
+	"rprivate":        "rprivate",
+	"bidirectional":   "rshared",
+	"hosttocontainer": "rslave",
+	"none":            "rprivate",
+}
+
+// parseMountPropagation returns the propagation requested by the mount flags,
+// empty if none. Other flags are ignored.
+func parseMountPropagation(flags []string) (string, error) {
+	var propagation string
+	for _, flag := range flags {
+		p, ok := mountPropagations[strings.ToLower(strings.TrimSpace(flag))]
+		if !ok {
+			continue
+		}
+
+		if propagation != "" && p != propagation {
+			return "", fmt.Errorf("conflicting mount propagations %q and %q", propagation, p)
+		}
+		propagation = p
+	}
+
+	return propagation, nil
+}
+
+func propagationArgs(path, propagation string) []string {
+	return []string{"--make-" + propagation, path}
+}
+
+// makePropagation changes the propagation of the mount at path.
+func makePropagation(path, propagation string) error {
+	if output, err := execCommand("mount", propagationArgs(path, propagation)...); err != nil {
+		return fmt.Errorf("make %s %s fail: %v, output: %s", propagation, path, err, output)
+	}
+	return nil
+}
+
 func listMount() ([]mount.MountPoint, error) {
 	return mount.New("").List()
 }
 
-func mountVolume(configFilePath string) error {
-	_, err := execCommand(CfsClientBin, "-c", configFilePath)
+// checkFuseDevice returns a FailedPrecondition error if the fuse device is
+// missing, after trying to load the fuse module if loadModule is set.
+func checkFuseDevice(device string, loadModule bool) error {
+	_, err := os.Stat(device)
+	if err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return status.Errorf(codes.FailedPrecondition, "check fuse device %s fail: %v", device, err)
+	}
+
+	if loadModule {
+		if output, err := execCommand("modprobe", "fuse"); err != nil {
+			glog.Warningf("load fuse module fail: %v, output: %s", err, output)
+		} else if _, err := os.Stat(device); err == nil {
+			return nil
+		}
+	}
+
+	return status.Errorf(codes.FailedPrecondition,
+		"fuse device %s not found on the node, load the fuse kernel module with \"modprobe fuse\"", device)
+}
+
+func mountVolume(ctx context.Context, args []string, stdin []byte, cred *syscall.Credential) error {
+	_, err := newClientCommand(ctx, CfsClientBin, args, stdin, cred).CombinedOutput()
 	return err
 }
 
+// retryMount runs mountFn up to retryCount+1 times, waiting interval between
+// the attempts. Each attempt is killed once it exceeds timeout if positive, and
+// cleanup is called then, as the client may have left a stuck mount behind.
+func retryMount(retryCount int, interval, timeout time.Duration, mountFn func(ctx context.Context) error, cleanup func()) error {
+	var err error
+	for i := 0; i <= retryCount; i++ {
+		if i > 0 {
+			glog.Warningf("mount attempt %d failed, retry in %v. err:%v", i, interval, err)
+			time.Sleep(interval)
+		}
+
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if timeout > 0 {
+			ctx, cancel = context.WithTimeout(context.Background(), timeout)
+		}
+		err = mountFn(ctx)
+		timedOut := ctx.Err() == context.DeadlineExceeded
+		cancel()
+
+		if err == nil {
+			return nil
+		}
+		if timedOut {
+			err = fmt.Errorf("mount timed out after %v: %v", timeout, err)
+			cleanup()
+		}
+	}
+
+	return err
+}
+
+// cleanupStuckMount lazily unmounts path, which may be a fuse mount whose
+// client is gone. It is not an error if path is not mounted.
+func cleanupStuckMount(path string) {
+	if output, err := execCommand("umount", "-l", path); err != nil {
+		glog.Warningf("lazy umount %v: %v, output: %s", path, err, output)
+	}
+}
+
+// newClientCommand returns the command running the client, as the user of
+// cred if not nil. The client is killed when ctx is done.
+func newClientCommand(ctx context.Context, clientBin string, args []string, stdin []byte, cred *syscall.Credential) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, clientBin, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	if cred != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
+	return cmd
+}
+
 func umountVolume(path string) error {
 	if _, err := execCommand("umount", path); err != nil {
 		return fmt.Errorf("umount %s fail: %v", path, err)
@@ -95,11 +256,90 @@ func execCommand(command string, args ...string) ([]byte, error) {
 	return cmd.CombinedOutput()
 }
 
+func execCommandWithStdin(stdin []byte, command string, args ...string) ([]byte, error) {
+	cmd := exec.Command(command, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	return cmd.CombinedOutput()
+}
+
 // remove the parent path of targetPath
 func CleanPath(targetPath string) error {
 	return os.RemoveAll(path.Dir(targetPath))
 }
 
+// validateRelativePath makes sure p stays inside the directory it is relative to.
+func validateRelativePath(p string) error {
+	if filepath.IsAbs(p) {
+		return fmt.Errorf("path %q must be relative", p)
+	}
+
+	for _, elem := range strings.Split(filepath.ToSlash(p), "/") {
+		if elem == ".." {
+			return fmt.Errorf("path %q must not contain \"..\"", p)
+		}
+	}
+
+	return nil
+}
+
+// createInitDirs creates dirs under root. Directories which already exist are
+// left untouched, so that permission changes made by the application survive a remount.
+func createInitDirs(root string, dirs []string, mode os.FileMode) error {
+	for _, dir := range dirs {
+		if err := createInitDir(root, dir, mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// createInitDir creates dir under root element by element, relative to the
+// directory created or opened last. As the volume is writable by its pods, an
+// element which is a symlink is refused instead of followed, so that the node
+// plugin cannot be made to create or chmod directories outside the volume.
+func createInitDir(root, dir string, mode os.FileMode) error {
+	p := filepath.Join(root, dir)
+	fd, err := unix.Open(root, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("open %s fail: %v", root, err)
+	}
+	defer func() { unix.Close(fd) }()
+
+	created := false
+	for _, elem := range strings.Split(filepath.ToSlash(filepath.Clean(dir)), "/") {
+		if len(elem) == 0 || elem == "." {
+			continue
+		}
+
+		err := unix.Mkdirat(fd, elem, uint32(mode.Perm()))
+		if err != nil && err != unix.EEXIST {
+			return fmt.Errorf("create init dir %s fail: %v", p, err)
+		}
+		created = err == nil
+
+		next, err := unix.Openat(fd, elem, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("open init dir %s at %q fail, it must not be a symlink: %v", p, elem, err)
+		}
+		unix.Close(fd)
+		fd = next
+	}
+
+	if !created {
+		return nil
+	}
+
+	// mkdir is subject to the umask
+	if err := unix.Fchmod(fd, uint32(mode.Perm())); err != nil {
+		return fmt.Errorf("chmod init dir %s fail: %v", p, err)
+	}
+
+	return nil
+}
+
 func pathExists(path string) (bool, error) {
 	_, err := os.Stat(path)
 	if err == nil {
@@ -110,3 +350,13 @@ func pathExists(path string) (bool, error) {
 	}
 	return false, err
 }
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
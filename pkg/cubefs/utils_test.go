@@ -0,0 +1,206 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidateRelativePath(t *testing.T) {
+	assert.NoError(t, validateRelativePath("data"))
+	assert.NoError(t, validateRelativePath("logs/app"))
+	assert.NoError(t, validateRelativePath("a..b"))
+
+	assert.Error(t, validateRelativePath("/data"))
+	assert.Error(t, validateRelativePath(".."))
+	assert.Error(t, validateRelativePath("data/../../etc"))
+}
+
+func TestCreateInitDirs(t *testing.T) {
+	root := t.TempDir()
+	assert.NoError(t, os.Mkdir(filepath.Join(root, "existing"), 0700))
+
+	assert.NoError(t, createInitDirs(root, []string{"data", "logs/app", "existing"}, 0750))
+
+	for _, dir := range []string{"data", "logs/app"} {
+		fi, err := os.Stat(filepath.Join(root, dir))
+		assert.NoError(t, err)
+		assert.True(t, fi.IsDir())
+		assert.Equal(t, os.FileMode(0750), fi.Mode().Perm())
+	}
+
+	// existing directories keep their permission
+	fi, err := os.Stat(filepath.Join(root, "existing"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+}
+
+func TestCreateInitDirsSymlink(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	assert.NoError(t, os.Chmod(outside, 0700))
+	// a pod of the volume replaced a directory with a symlink out of the volume
+	assert.NoError(t, os.Symlink(outside, filepath.Join(root, "a")))
+
+	for _, dir := range []string{"a/b", "a"} {
+		assert.Error(t, createInitDirs(root, []string{dir}, 0777))
+	}
+
+	_, err := os.Stat(filepath.Join(outside, "b"))
+	assert.True(t, os.IsNotExist(err))
+	fi, err := os.Stat(outside)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), fi.Mode().Perm())
+}
+
+func TestCreateMountPoint(t *testing.T) {
+	root := t.TempDir()
+
+	for _, mode := range []os.FileMode{0700, 0777} {
+		p := filepath.Join(root, mode.String(), "mount")
+		assert.NoError(t, createMountPoint(p, mode))
+		fi, err := os.Stat(p)
+		assert.NoError(t, err)
+		assert.Equal(t, mode, fi.Mode().Perm())
+	}
+
+	p := filepath.Join(root, "default")
+	assert.NoError(t, createMountPoint(p, 0))
+	fi, err := os.Stat(p)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultMountDirMode, fi.Mode().Perm())
+
+	// existing directories keep their permission
+	assert.NoError(t, createMountPoint(p, 0700))
+	fi, err = os.Stat(p)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultMountDirMode, fi.Mode().Perm())
+}
+
+func TestParseDirMode(t *testing.T) {
+	mode, err := parseDirMode("0755")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), mode)
+
+	for _, s := range []string{"", "755x", "0888", "01777", "rwxr-xr-x"} {
+		_, err := parseDirMode(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestParseMountPropagation(t *testing.T) {
+	propagation, err := parseMountPropagation([]string{"noatime", "Bidirectional"})
+	assert.NoError(t, err)
+	assert.Equal(t, "rshared", propagation)
+	assert.Equal(t, []string{"--make-rshared", "/target"}, propagationArgs("/target", propagation))
+
+	propagation, err = parseMountPropagation([]string{"rshared", "bidirectional"})
+	assert.NoError(t, err)
+	assert.Equal(t, "rshared", propagation)
+
+	propagation, err = parseMountPropagation([]string{"HostToContainer"})
+	assert.NoError(t, err)
+	assert.Equal(t, "rslave", propagation)
+
+	propagation, err = parseMountPropagation(nil)
+	assert.NoError(t, err)
+	assert.Empty(t, propagation)
+
+	_, err = parseMountPropagation([]string{"rshared", "private"})
+	assert.Error(t, err)
+}
+
+func TestNewClientCommandCredential(t *testing.T) {
+	cmd := newClientCommand(context.Background(), CfsClientBin, []string{"-c", "/cfs/conf/pvc.json"}, nil, nil)
+	assert.Equal(t, []string{CfsClientBin, "-c", "/cfs/conf/pvc.json"}, cmd.Args)
+	assert.Nil(t, cmd.SysProcAttr)
+	assert.Nil(t, cmd.Stdin)
+
+	cred := &syscall.Credential{Uid: 1000, Gid: 2000}
+	cmd = newClientCommand(context.Background(), CfsClientBin, []string{"-c", "/dev/stdin"}, []byte("{}"), cred)
+	assert.Equal(t, cred, cmd.SysProcAttr.Credential)
+	assert.NotNil(t, cmd.Stdin)
+}
+
+func TestCheckFuseDevice(t *testing.T) {
+	device := filepath.Join(t.TempDir(), "fuse")
+	err := checkFuseDevice(device, false)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "modprobe fuse")
+
+	assert.NoError(t, ioutil.WriteFile(device, nil, 0600))
+	assert.NoError(t, checkFuseDevice(device, false))
+}
+
+func TestRetryMount(t *testing.T) {
+	var attempts, cleanups int
+	cleanup := func() { cleanups++ }
+
+	// failures are retried up to the retry count
+	err := retryMount(2, time.Millisecond, 0, func(ctx context.Context) error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("exit status 1")
+		}
+		return nil
+	}, cleanup)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, 0, cleanups)
+
+	attempts = 0
+	err = retryMount(1, time.Millisecond, 0, func(ctx context.Context) error {
+		attempts++
+		return errors.New("exit status 1")
+	}, cleanup)
+	assert.EqualError(t, err, "exit status 1")
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, 0, cleanups)
+
+	// a stuck attempt is killed at the timeout and cleaned up before the retry
+	attempts = 0
+	err = retryMount(1, time.Millisecond, 20*time.Millisecond, func(ctx context.Context) error {
+		attempts++
+		if attempts == 1 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}, cleanup)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, 1, cleanups)
+
+	err = retryMount(0, time.Millisecond, 20*time.Millisecond, func(ctx context.Context) error {
+		return exec.CommandContext(ctx, "sleep", "10").Run()
+	}, cleanup)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "mount timed out after 20ms")
+	assert.Equal(t, 2, cleanups)
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// a client mounting a volume, as reported by the master
+type cfsVolumeClient struct {
+	Addr    string `json:"Addr"`
+	Version string `json:"Version"`
+	// unix time of the last heartbeat of the client
+	ReportTime int64 `json:"ReportTime"`
+}
+
+// getVolumeClients queries the master for the clients which currently mount
+// the volume, e.g. to locate a misbehaving one.
+func (cs *cfsServer) getVolumeClients() (clients []*cfsVolumeClient, err error) {
+	authKey, err := cs.getAuthKey()
+	if err != nil {
+		return nil, err
+	}
+
+	volName := cs.clientConf[KVolumeName]
+	err = cs.retryOnTransient("GetVolumeClients", func() error {
+		return cs.forEachReadMasterAddr("GetVolumeClients", func(addr string) error {
+			url := cs.masterURL(addr, fmt.Sprintf("/vol/clients?name=%s&authKey=%v", volName, authKey))
+			resp, err := cs.executeRequest(url)
+			if err != nil {
+				return err
+			}
+
+			if resp.Code == ErrCodeVolNotExists {
+				return status.Errorf(codes.NotFound, "volume[%v] not exists", volName)
+			}
+
+			if resp.Code != 0 {
+				return status.Errorf(codes.Internal, "get clients of volume[%v] failed, code:%v, msg:%v", volName, resp.Code, resp.Msg)
+			}
+
+			clients = nil
+			if err := json.Unmarshal(resp.Data, &clients); err != nil {
+				return status.Errorf(codes.Internal, "unmarshal clients of volume[%v] failed: %v", volName, err)
+			}
+
+			return nil
+		})
+	})
+
+	return clients, err
+}
+
+// maxInUseClientsReported bounds the clients named by checkNotInUse.
+const maxInUseClientsReported = 3
+
+// checkNotInUse fails with codes.FailedPrecondition if clients still mount
+// the volume, as deleting it would fail their pods hard. A volume which no
+// longer exists is not in use.
+func (cs *cfsServer) checkNotInUse() error {
+	clients, err := cs.getVolumeClients()
+	if status.Code(err) == codes.NotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(clients) == 0 {
+		return nil
+	}
+
+	addrs := make([]string, 0, maxInUseClientsReported)
+	for _, client := range clients {
+		if len(addrs) == maxInUseClientsReported {
+			addrs = append(addrs, "...")
+			break
+		}
+		addrs = append(addrs, client.Addr)
+	}
+	return status.Errorf(codes.FailedPrecondition, "volume[%v] is still mounted by %d clients (%s), delete the pods using it first",
+		cs.clientConf[KVolumeName], len(clients), strings.Join(addrs, ", "))
+}
+
+// VolumeClientsOptions selects the volume whose clients ListVolumeClients lists.
+type VolumeClientsOptions struct {
+	MasterAddr string
+	VolumeName string
+	Owner      string
+	AuthKey    string
+}
+
+// ListVolumeClients writes the address, client version and last heartbeat of
+// the clients mounting a volume to out.
+func ListVolumeClients(conf Config, opts VolumeClientsOptions, out io.Writer) error {
+	if len(opts.Owner) == 0 && len(opts.AuthKey) == 0 {
+		return fmt.Errorf("either the owner or the authKey of the volume is required")
+	}
+
+	cs, err := newCfsServer(opts.VolumeName, map[string]string{
+		KMasterAddr: opts.MasterAddr,
+		KOwner:      opts.Owner,
+	}, &conf)
+	if err != nil {
+		return err
+	}
+
+	if len(opts.AuthKey) != 0 {
+		cs.applySecrets(map[string]string{secretAuthKey: opts.AuthKey})
+	}
+
+	clients, err := cs.getVolumeClients()
+	if err != nil {
+		return err
+	}
+
+	return writeVolumeClients(out, clients)
+}
+
+func writeVolumeClients(out io.Writer, clients []*cfsVolumeClient) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tVERSION\tLAST REPORT")
+	for _, client := range clients {
+		report := "-"
+		if client.ReportTime > 0 {
+			report = time.Unix(client.ReportTime, 0).UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", client.Addr, client.Version, report)
+	}
+
+	return w.Flush()
+}
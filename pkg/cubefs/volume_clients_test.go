@@ -0,0 +1,96 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cubefs/cubefs-csi/pkg/mockmaster"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGetVolumeClients(t *testing.T) {
+	var path string
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		fmt.Fprint(w, `{"code":0,"msg":"success","data":[`+
+			`{"Addr":"10.0.0.1:17410","Version":"3.2.0","ReportTime":1700000000,"HostName":"node-1"},`+
+			`{"Addr":"10.0.0.2:17410","Version":"3.1.0"}]}`)
+	})
+
+	clients, err := cs.getVolumeClients()
+	assert.NoError(t, err)
+	assert.Equal(t, "/vol/clients", path)
+	assert.Equal(t, []*cfsVolumeClient{
+		{Addr: "10.0.0.1:17410", Version: "3.2.0", ReportTime: 1700000000},
+		{Addr: "10.0.0.2:17410", Version: "3.1.0"},
+	}, clients)
+
+	var out bytes.Buffer
+	assert.NoError(t, writeVolumeClients(&out, clients))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 3)
+	assert.Equal(t, []string{"10.0.0.1:17410", "3.2.0", "2023-11-14T22:13:20Z"}, strings.Fields(lines[1]))
+	assert.Equal(t, []string{"10.0.0.2:17410", "3.1.0", "-"}, strings.Fields(lines[2]))
+}
+
+func TestGetVolumeClientsNotFound(t *testing.T) {
+	cs := newFakeCfsServer(t, func(w http.ResponseWriter, r *http.Request) {
+		writeMasterResponse(w, ErrCodeVolNotExists, "vol not exists")
+	})
+
+	_, err := cs.getVolumeClients()
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestCheckNotInUse(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+	master.PutVolume(mockmaster.Volume{Name: "pvc-used", Owner: "csiuser", CapacityGB: 10,
+		Clients: []string{"10.0.0.1:17410", "10.0.0.2:17410", "10.0.0.3:17410", "10.0.0.4:17410"}})
+	master.PutVolume(mockmaster.Volume{Name: "pvc-unused", Owner: "csiuser", CapacityGB: 10})
+
+	newServer := func(volName string) *cfsServer {
+		conf := fakeConfig
+		cs, err := newCfsServer(volName, map[string]string{KMasterAddr: master.Addr(), KOwner: "csiuser"}, &conf)
+		assert.NoError(t, err)
+		return cs
+	}
+
+	// the mounted volume is blocked
+	err := newServer("pvc-used").checkNotInUse()
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	assert.Contains(t, err.Error(), "mounted by 4 clients (10.0.0.1:17410, 10.0.0.2:17410, 10.0.0.3:17410, ...)")
+	_, ok := master.Volume("pvc-used")
+	assert.True(t, ok)
+
+	// the unused volume is deleted
+	cs := newServer("pvc-unused")
+	assert.NoError(t, cs.checkNotInUse())
+	assert.NoError(t, cs.deleteVolume())
+	_, ok = master.Volume("pvc-unused")
+	assert.False(t, ok)
+
+	// as is a volume which is gone already
+	assert.NoError(t, newServer("pvc-unused").checkNotInUse())
+}
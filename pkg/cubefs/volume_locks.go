@@ -0,0 +1,61 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import "sync"
+
+// volumeLocks serializes the operations on the same volume, while the
+// operations on different volumes run concurrently. The lock of a volume is
+// dropped once nobody holds or waits for it.
+type volumeLocks struct {
+	mutex sync.Mutex
+	locks map[string]*volumeLock
+}
+
+type volumeLock struct {
+	sync.Mutex
+	// holders and waiters of the lock
+	refs int
+}
+
+func newVolumeLocks() *volumeLocks {
+	return &volumeLocks{locks: make(map[string]*volumeLock)}
+}
+
+// lock locks the volume, and returns the func unlocking it.
+func (l *volumeLocks) lock(volumeID string) func() {
+	l.mutex.Lock()
+	vl, ok := l.locks[volumeID]
+	if !ok {
+		vl = &volumeLock{}
+		l.locks[volumeID] = vl
+	}
+	vl.refs++
+	l.mutex.Unlock()
+
+	vl.Lock()
+	return func() {
+		vl.Unlock()
+
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		vl.refs--
+		if vl.refs == 0 {
+			delete(l.locks, volumeID)
+		}
+	}
+}
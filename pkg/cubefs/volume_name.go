@@ -0,0 +1,68 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+const (
+	// the longest volume name accepted by the master
+	maxVolumeNameLength = 63
+	// length of the hash suffix of a volume name derived from its PVC
+	volumeNameHashLength = 8
+)
+
+// pvcVolumeName derives a volume name identifiable in the master from the
+// namespace and name of the PVC, e.g. default-data-3f2a9c1e for the CSI name
+// pvc-<uuid>. The suffix hashes the CSI name, which is unique and stable
+// across the retries of a request, so that the PVCs whose sanitized names
+// coincide, e.g. a-b/c and a/b-c, never share a volume. False is returned if
+// the PVC is not passed, i.e. the csi-provisioner is started without
+// --extra-create-metadata.
+func pvcVolumeName(csiName string, param map[string]string) (string, bool) {
+	name, namespace := param[KPVCName], param[KPVCNamespace]
+	if name == "" || namespace == "" {
+		return "", false
+	}
+
+	sum := sha256.Sum256([]byte(csiName))
+	suffix := hex.EncodeToString(sum[:])[:volumeNameHashLength]
+	prefix := sanitizeVolumeName(namespace + "-" + name)
+	if maxPrefix := maxVolumeNameLength - volumeNameHashLength - 1; len(prefix) > maxPrefix {
+		prefix = strings.TrimRight(prefix[:maxPrefix], "-_.")
+	}
+
+	return prefix + "-" + suffix, true
+}
+
+// sanitizeVolumeName replaces the characters not allowed in a volume name by
+// the master with '-', and trims the leading and trailing separators.
+func sanitizeVolumeName(name string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '.':
+			return r
+		default:
+			return '-'
+		}
+	}, name)
+
+	return strings.Trim(sanitized, "-_.")
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/cubefs/cubefs-csi/pkg/mockmaster"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPVCVolumeName(t *testing.T) {
+	pvc := func(namespace, name string) map[string]string {
+		return map[string]string{KPVCNamespace: namespace, KPVCName: name}
+	}
+
+	name, ok := pvcVolumeName("pvc-1", pvc("default", "data"))
+	assert.True(t, ok)
+	assert.Regexp(t, `^default-data-[0-9a-f]{8}$`, name)
+
+	// the name is stable across the retries of the request
+	again, _ := pvcVolumeName("pvc-1", pvc("default", "data"))
+	assert.Equal(t, name, again)
+
+	_, ok = pvcVolumeName("pvc-1", map[string]string{KPVCName: "data"})
+	assert.False(t, ok)
+}
+
+func TestPVCVolumeNameSanitize(t *testing.T) {
+	assert.Equal(t, "web-cache_v1.2", sanitizeVolumeName("web/cache_v1.2"))
+	assert.Equal(t, "a-b", sanitizeVolumeName("-a:b."))
+
+	name, _ := pvcVolumeName("pvc-1", map[string]string{
+		KPVCNamespace: "tenant",
+		KPVCName:      strings.Repeat("x", 100),
+	})
+	assert.Len(t, name, maxVolumeNameLength)
+	assert.True(t, strings.HasPrefix(name, "tenant-xxx"))
+}
+
+func TestPVCVolumeNameCollision(t *testing.T) {
+	// a-b/c and a/b-c sanitize to the same prefix, but their volumes differ
+	first, _ := pvcVolumeName("pvc-1", map[string]string{KPVCNamespace: "a-b", KPVCName: "c"})
+	second, _ := pvcVolumeName("pvc-2", map[string]string{KPVCNamespace: "a", KPVCName: "b-c"})
+	assert.Equal(t, first[:len(first)-volumeNameHashLength], second[:len(second)-volumeNameHashLength])
+	assert.NotEqual(t, first, second)
+}
+
+func TestCreateVolumeNameFromPVC(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+
+	conf := fakeConfig
+	conf.VolumeNameFromPVC = true
+	resp, err := newFakeControllerServer(conf).CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "pvc-0f8b",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1 << 30},
+		Parameters: map[string]string{
+			KMasterAddr:   master.Addr(),
+			KOwner:        "csiuser",
+			KPVCNamespace: "default",
+			KPVCName:      "data",
+		},
+	})
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(resp.Volume.VolumeId, "default-data-"))
+	_, ok := master.Volume(resp.Volume.VolumeId)
+	assert.True(t, ok)
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+)
+
+// what the total of NodeGetVolumeStats reflects, see reportsClusterCapacity
+const (
+	volumeStatsTotalAuto        = "auto"
+	volumeStatsTotalProvisioned = "provisioned"
+	volumeStatsTotalCluster     = "cluster"
+)
+
+func validateVolumeStatsTotal(mode string) error {
+	switch mode {
+	case "", volumeStatsTotalAuto, volumeStatsTotalProvisioned, volumeStatsTotalCluster:
+		return nil
+	default:
+		return fmt.Errorf("invalid volume stats total %q, must be %s, %s or %s", mode,
+			volumeStatsTotalAuto, volumeStatsTotalProvisioned, volumeStatsTotalCluster)
+	}
+}
+
+// reportsClusterCapacity tells whether the stats of the volume with param
+// report the free capacity of the cluster instead of the provisioned one. By
+// default only the volumes without a quota do, whose provisioned capacity is
+// the made up one of --unlimited-capacity-gb.
+func reportsClusterCapacity(mode string, param map[string]string) bool {
+	switch mode {
+	case volumeStatsTotalCluster:
+		return true
+	case volumeStatsTotalProvisioned:
+		return false
+	default:
+		return param[KUnlimited] == "true"
+	}
+}
+
+// clusterCapacitySource is the cluster capacity of a volume, of its zones if
+// the master reports them.
+type clusterCapacitySource struct {
+	cache     *capacityCache
+	zoneNames string
+}
+
+// clusterCapacityStats tracks the staged volumes which report the free
+// capacity of their cluster.
+type clusterCapacityStats struct {
+	mutex   sync.Mutex
+	sources map[string]clusterCapacitySource
+}
+
+func newClusterCapacityStats() *clusterCapacityStats {
+	return &clusterCapacityStats{sources: make(map[string]clusterCapacitySource)}
+}
+
+func (s *clusterCapacityStats) set(volumeID string, cache *capacityCache, zoneNames string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sources[volumeID] = clusterCapacitySource{cache: cache, zoneNames: zoneNames}
+}
+
+func (s *clusterCapacityStats) remove(volumeID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sources, volumeID)
+}
+
+// apply replaces the byte usage of resp with the free capacity of the
+// cluster of the volume, keeping the used bytes reported by the client. The
+// provisioned capacity is kept if the master cannot be queried.
+func (s *clusterCapacityStats) apply(volumeID string, resp *csi.NodeGetVolumeStatsResponse) {
+	s.mutex.Lock()
+	source, ok := s.sources[volumeID]
+	s.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	report, err := source.cache.get()
+	if err != nil {
+		glog.Warningf("get the cluster capacity of volume[%v] failed, report the provisioned capacity. err: %v", volumeID, err)
+		return
+	}
+
+	free, _ := report.freeIn(source.zoneNames)
+	for _, usage := range resp.GetUsage() {
+		if usage.GetUnit() == csi.VolumeUsage_BYTES {
+			usage.Available = int64(free)
+			usage.Total = usage.Used + int64(free)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReportsClusterCapacity(t *testing.T) {
+	unlimited := map[string]string{KUnlimited: "true"}
+	limited := map[string]string{}
+
+	for _, mode := range []string{"", volumeStatsTotalAuto} {
+		assert.True(t, reportsClusterCapacity(mode, unlimited), mode)
+		assert.False(t, reportsClusterCapacity(mode, limited), mode)
+	}
+	assert.False(t, reportsClusterCapacity(volumeStatsTotalProvisioned, unlimited))
+	assert.True(t, reportsClusterCapacity(volumeStatsTotalCluster, limited))
+
+	assert.NoError(t, validateVolumeStatsTotal(volumeStatsTotalCluster))
+	assert.Error(t, validateVolumeStatsTotal("used"))
+}
+
+func TestClusterCapacityStats(t *testing.T) {
+	stat := &cfsClusterStat{}
+	assert.NoError(t, json.Unmarshal([]byte(multiZoneClusterStat), stat))
+	fetchErr := error(nil)
+	cache := newCapacityCache(0, func() (*cfsClusterStat, error) { return stat, fetchErr })
+
+	newResp := func() *csi.NodeGetVolumeStatsResponse {
+		return &csi.NodeGetVolumeStatsResponse{Usage: []*csi.VolumeUsage{
+			{Unit: csi.VolumeUsage_BYTES, Total: 10 << 30, Used: 4 << 30, Available: 6 << 30},
+			{Unit: csi.VolumeUsage_INODES, Total: 1000, Used: 10, Available: 990},
+		}}
+	}
+
+	stats := newClusterCapacityStats()
+	stats.set("pvc-cluster", cache, "")
+	stats.set("pvc-zone", cache, "zone-b")
+
+	// the provisioned capacity of the volumes not tracked
+	resp := newResp()
+	stats.apply("pvc-provisioned", resp)
+	assert.Equal(t, newResp(), resp)
+
+	resp = newResp()
+	stats.apply("pvc-cluster", resp)
+	assert.Equal(t, int64(180<<30), resp.Usage[0].Available)
+	assert.Equal(t, int64(184<<30), resp.Usage[0].Total)
+	assert.Equal(t, int64(4<<30), resp.Usage[0].Used)
+	assert.Equal(t, int64(1000), resp.Usage[1].Total)
+
+	resp = newResp()
+	stats.apply("pvc-zone", resp)
+	assert.Equal(t, int64(20<<30), resp.Usage[0].Available)
+	assert.Equal(t, int64(24<<30), resp.Usage[0].Total)
+
+	// the provisioned capacity is kept while the master is unavailable
+	fetchErr = errors.New("master unavailable")
+	resp = newResp()
+	stats.apply("pvc-cluster", resp)
+	assert.Equal(t, newResp(), resp)
+
+	stats.remove("pvc-cluster")
+	fetchErr = nil
+	resp = newResp()
+	stats.apply("pvc-cluster", resp)
+	assert.Equal(t, newResp(), resp)
+}
@@ -0,0 +1,178 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// volumeMetadata is the context of a volume decided at creation, which is
+// needed again by the later requests of the volume.
+type volumeMetadata struct {
+	Owner        string `json:"owner,omitempty"`
+	ZoneName     string `json:"zoneName,omitempty"`
+	ExporterPort string `json:"exporterPort,omitempty"`
+	ProfPort     string `json:"profPort,omitempty"`
+	ClusterID    string `json:"clusterID,omitempty"`
+	// the capacity of the PVC, which the master does not know
+	RequestedBytes string `json:"requestedBytes,omitempty"`
+	// the description, which the master does not list
+	Description string `json:"description,omitempty"`
+}
+
+// volumeStore persists the volume metadata, so that it survives controller
+// restarts and is shared between controller replicas.
+type volumeStore interface {
+	// get returns nil if there is no metadata of the volume.
+	get(volumeID string) (*volumeMetadata, error)
+	put(volumeID string, meta *volumeMetadata) error
+	// delete succeeds if there is no metadata of the volume.
+	delete(volumeID string) error
+}
+
+// fileVolumeStore keeps the metadata of every volume in a json file under dir,
+// which is expected to be a shared or persistent directory.
+type fileVolumeStore struct {
+	dir string
+}
+
+func newFileVolumeStore(dir string) (*fileVolumeStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &fileVolumeStore{dir: dir}, nil
+}
+
+func (s *fileVolumeStore) path(volumeID string) (string, error) {
+	if len(volumeID) == 0 || volumeID == "." || volumeID == ".." || strings.ContainsAny(volumeID, `/\`) {
+		return "", fmt.Errorf("invalid volume id %q for the volume store", volumeID)
+	}
+
+	return filepath.Join(s.dir, volumeID+jsonFileSuffix), nil
+}
+
+func (s *fileVolumeStore) get(volumeID string) (*volumeMetadata, error) {
+	path, err := s.path(volumeID)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	meta := &volumeMetadata{}
+	if err := json.Unmarshal(content, meta); err != nil {
+		return nil, fmt.Errorf("unmarshal metadata of volume[%v] failed: %v", volumeID, err)
+	}
+
+	return meta, nil
+}
+
+func (s *fileVolumeStore) put(volumeID string, meta *volumeMetadata) error {
+	path, err := s.path(volumeID)
+	if err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file and rename it, so that readers never see a partial file
+	tmp, err := ioutil.TempFile(s.dir, "."+volumeID)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *fileVolumeStore) delete(volumeID string) error {
+	path, err := s.path(volumeID)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// newVolumeMetadata takes the metadata to persist from the volume parameters.
+func newVolumeMetadata(param map[string]string) *volumeMetadata {
+	return &volumeMetadata{
+		Owner:          param[KOwner],
+		ZoneName:       param[KZoneName],
+		ExporterPort:   param[KExporterPort],
+		ProfPort:       param[KProfPort],
+		ClusterID:      param[KClusterID],
+		RequestedBytes: param[KRequestedBytes],
+		Description:    param[KDescription],
+	}
+}
+
+// restoreVolumeMetadata fills the parameters missing from param with the
+// stored metadata of the volume. The parameters carried by the request take
+// precedence, and param is left untouched if nothing is stored.
+func restoreVolumeMetadata(store volumeStore, volumeID string, param map[string]string) error {
+	if store == nil {
+		return nil
+	}
+
+	meta, err := store.get(volumeID)
+	if err != nil || meta == nil {
+		return err
+	}
+
+	for k, v := range map[string]string{
+		KOwner:          meta.Owner,
+		KZoneName:       meta.ZoneName,
+		KExporterPort:   meta.ExporterPort,
+		KProfPort:       meta.ProfPort,
+		KClusterID:      meta.ClusterID,
+		KRequestedBytes: meta.RequestedBytes,
+	} {
+		if len(param[k]) == 0 && len(v) != 0 {
+			param[k] = v
+		}
+	}
+
+	return nil
+}
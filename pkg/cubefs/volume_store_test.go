@@ -0,0 +1,79 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileVolumeStore(t *testing.T) {
+	store, err := newFileVolumeStore(filepath.Join(t.TempDir(), "store"))
+	assert.NoError(t, err)
+
+	meta, err := store.get("pvc-1")
+	assert.NoError(t, err)
+	assert.Nil(t, meta)
+
+	want := &volumeMetadata{Owner: "csi_123", ZoneName: "zone-a", ExporterPort: "9513"}
+	assert.NoError(t, store.put("pvc-1", want))
+	meta, err = store.get("pvc-1")
+	assert.NoError(t, err)
+	assert.Equal(t, want, meta)
+
+	// a restarted driver sees the same metadata
+	reopened, err := newFileVolumeStore(store.dir)
+	assert.NoError(t, err)
+	meta, err = reopened.get("pvc-1")
+	assert.NoError(t, err)
+	assert.Equal(t, want, meta)
+
+	assert.NoError(t, store.delete("pvc-1"))
+	assert.NoError(t, store.delete("pvc-1"))
+	meta, err = store.get("pvc-1")
+	assert.NoError(t, err)
+	assert.Nil(t, meta)
+
+	for _, id := range []string{"", "..", "../pvc", "a/b"} {
+		assert.Error(t, store.put(id, want), "id %q", id)
+	}
+}
+
+func TestNewCfsServerRestoreMetadata(t *testing.T) {
+	store, err := newFileVolumeStore(t.TempDir())
+	assert.NoError(t, err)
+	assert.NoError(t, store.put("pvc-stored", &volumeMetadata{Owner: "csi_stored", ZoneName: "zone-a"}))
+	conf := &Config{volumeStore: store}
+
+	cs, err := newCfsServer("pvc-stored", map[string]string{KMasterAddr: "10.0.0.1:17010"}, conf)
+	assert.NoError(t, err)
+	assert.Equal(t, "csi_stored", cs.clientConf[KOwner])
+	assert.Equal(t, "zone-a", cs.clientConf[KZoneName])
+
+	// the parameters of the request take precedence
+	cs, err = newCfsServer("pvc-stored", map[string]string{KMasterAddr: "10.0.0.1:17010", KOwner: "explicit"}, conf)
+	assert.NoError(t, err)
+	assert.Equal(t, "explicit", cs.clientConf[KOwner])
+
+	// a missing entry falls back to the generated owner
+	cs, err = newCfsServer("pvc-missing", map[string]string{KMasterAddr: "10.0.0.1:17010"}, conf)
+	assert.NoError(t, err)
+	assert.Contains(t, cs.clientConf[KOwner], "csi_")
+	assert.Empty(t, cs.clientConf[KZoneName])
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// timeout of every POST to the webhook
+const webhookRequestTimeout = 10 * time.Second
+
+// volumeWebhook posts the volume lifecycle operations, as the entries of the
+// audit log, to an external endpoint, e.g. to update a CMDB. The operations
+// are posted in the background, so that a failing webhook is only retried a
+// bounded number of times and never fails the CSI operation.
+type volumeWebhook struct {
+	url           string
+	client        *http.Client
+	retries       int
+	retryInterval time.Duration
+	// called once an event is delivered or given up, for tests
+	done func(entry auditEntry, err error)
+}
+
+func newVolumeWebhook(rawURL string, retries int, retryInterval time.Duration) (*volumeWebhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid webhook url %q, must be an http or https url", rawURL)
+	}
+	if retries < 0 {
+		return nil, fmt.Errorf("invalid webhook retries %d, must not be negative", retries)
+	}
+
+	return &volumeWebhook{
+		url:           rawURL,
+		client:        &http.Client{Timeout: webhookRequestTimeout},
+		retries:       retries,
+		retryInterval: retryInterval,
+	}, nil
+}
+
+// notify posts the entry with the result of err in the background. The owner,
+// which the authKey of the volume derives from, is not posted to the endpoint
+// and the error is redacted.
+func (w *volumeWebhook) notify(entry auditEntry, err error) {
+	entry = entry.withResult(err)
+	entry.Owner, entry.Error = "", redactAuthKey(entry.Error)
+	go func() {
+		err := w.deliver(entry)
+		if err != nil {
+			glog.Errorf("post %v of volume[%v] to the webhook failed, give up. err: %v", entry.Operation, entry.Volume, err)
+		}
+		if w.done != nil {
+			w.done(entry, err)
+		}
+	}()
+}
+
+// deliver posts the entry, retrying with backoff.
+func (w *volumeWebhook) deliver(entry auditEntry) error {
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = w.post(body)
+		if err == nil || attempt >= w.retries {
+			return err
+		}
+
+		glog.Warningf("post %v of volume[%v] to the webhook failed, retry %d/%d. err: %v",
+			entry.Operation, entry.Volume, attempt+1, w.retries, err)
+		time.Sleep(backoffWithJitter(w.retryInterval, attempt))
+	}
+}
+
+func (w *volumeWebhook) post(body []byte) error {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxBodySnippetLength))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with http status %v", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/cubefs/cubefs-csi/pkg/mockmaster"
+	"github.com/stretchr/testify/assert"
+)
+
+type webhookResult struct {
+	entry auditEntry
+	err   error
+}
+
+func newWebhookControllerServer(t *testing.T, handler http.HandlerFunc, retries int) (*controllerServer, <-chan webhookResult) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	webhook, err := newVolumeWebhook(server.URL+"/events", retries, time.Millisecond)
+	assert.NoError(t, err)
+	results := make(chan webhookResult, 1)
+	webhook.done = func(entry auditEntry, err error) {
+		results <- webhookResult{entry: entry, err: err}
+	}
+
+	conf := fakeConfig
+	conf.webhook = webhook
+	return newFakeControllerServer(conf), results
+}
+
+func waitWebhook(t *testing.T, results <-chan webhookResult) webhookResult {
+	select {
+	case result := <-results:
+		return result
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook was not called")
+		return webhookResult{}
+	}
+}
+
+func TestVolumeWebhookPayload(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+
+	var posted auditEntry
+	cs, results := newWebhookControllerServer(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "/events", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&posted))
+	}, 0)
+
+	_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "pvc-hooked",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 5 << 30},
+		Parameters:    map[string]string{KMasterAddr: master.Addr(), KOwner: "csiuser"},
+	})
+	assert.NoError(t, err)
+
+	result := waitWebhook(t, results)
+	assert.NoError(t, result.err)
+	assert.Equal(t, auditCreate, posted.Operation)
+	assert.Equal(t, "pvc-hooked", posted.Volume)
+	assert.Empty(t, posted.Owner)
+	assert.Equal(t, int64(5<<30), posted.CapacityBytes)
+	assert.Equal(t, "success", posted.Result)
+	assert.False(t, posted.Time.IsZero())
+}
+
+func TestVolumeWebhookFailure(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+
+	var posts int32
+	cs, results := newWebhookControllerServer(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}, 2)
+
+	// the operation succeeds regardless of the webhook
+	_, err := cs.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name:          "pvc-unhooked",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 5 << 30},
+		Parameters:    map[string]string{KMasterAddr: master.Addr(), KOwner: "csiuser"},
+	})
+	assert.NoError(t, err)
+	_, ok := master.Volume("pvc-unhooked")
+	assert.True(t, ok)
+
+	// which is given up after the retries
+	result := waitWebhook(t, results)
+	assert.Error(t, result.err)
+	assert.Contains(t, result.err.Error(), "http status 503")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&posts))
+}
+
+func TestVolumeWebhookRedacts(t *testing.T) {
+	var posted auditEntry
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&posted))
+	}))
+	t.Cleanup(server.Close)
+
+	webhook, err := newVolumeWebhook(server.URL, 0, time.Millisecond)
+	assert.NoError(t, err)
+	results := make(chan webhookResult, 1)
+	webhook.done = func(entry auditEntry, err error) {
+		results <- webhookResult{entry: entry, err: err}
+	}
+
+	webhook.notify(auditEntry{Operation: auditDelete, Volume: "pvc-1", Owner: "csiuser"},
+		errors.New("delete failed, url(http://10.0.0.1/vol/delete?name=pvc-1&authKey=0123abcd)"))
+	assert.NoError(t, waitWebhook(t, results).err)
+	assert.Empty(t, posted.Owner)
+	assert.Equal(t, "failure", posted.Result)
+	assert.Contains(t, posted.Error, "authKey=***")
+	assert.NotContains(t, posted.Error, "0123abcd")
+}
+
+func TestNewVolumeWebhook(t *testing.T) {
+	_, err := newVolumeWebhook("https://cmdb.example.com/hooks/volumes", 3, time.Second)
+	assert.NoError(t, err)
+
+	for _, u := range []string{"cmdb.example.com", "ftp://cmdb.example.com", "http://", "://"} {
+		_, err = newVolumeWebhook(u, 3, time.Second)
+		assert.Error(t, err, u)
+	}
+
+	_, err = newVolumeWebhook("http://cmdb.example.com", -1, time.Second)
+	assert.Error(t, err)
+}
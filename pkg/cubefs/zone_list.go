@@ -0,0 +1,187 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// KZoneList selects the zones a crossZone volume is placed across.
+const KZoneList = "zoneList"
+
+// how long the zones of a cluster are cached
+const zoneCacheTTL = 5 * time.Minute
+
+// listZones queries the master for the names of the zones of the cluster.
+func (cs *cfsServer) listZones() (zones []string, err error) {
+	err = cs.retryOnTransient("ListZones", func() error {
+		return cs.forEachReadMasterAddr("ListZones", func(addr string) error {
+			resp, err := cs.executeRequest(cs.masterURL(addr, "/zone/list"))
+			if err != nil {
+				return err
+			}
+
+			if resp.Code != 0 {
+				return status.Errorf(codes.Internal, "list zones failed, code:%v, msg:%v", resp.Code, resp.Msg)
+			}
+
+			var views []struct {
+				Name string `json:"Name"`
+			}
+			if err := json.Unmarshal(resp.Data, &views); err != nil {
+				return status.Errorf(codes.Internal, "unmarshal zones failed: %v", err)
+			}
+
+			zones = zones[:0]
+			for _, view := range views {
+				zones = append(zones, view.Name)
+			}
+			return nil
+		})
+	})
+
+	return zones, err
+}
+
+type cachedZones struct {
+	zones      map[string]struct{}
+	updateTime time.Time
+}
+
+// zoneCache caches the zones of the clusters by their master addresses, so
+// that validating the zoneList of each volume does not query the master.
+type zoneCache struct {
+	mutex    sync.Mutex
+	clusters map[string]*cachedZones
+}
+
+func newZoneCache() *zoneCache {
+	return &zoneCache{clusters: make(map[string]*cachedZones)}
+}
+
+// knownZones returns the zones of the cluster of cs, queried through the
+// cache of the driver if any.
+func (cs *cfsServer) knownZones() (map[string]struct{}, error) {
+	c := cs.conf.zoneCache
+	key := strings.Join(cs.readMasterAddrs(), ",")
+	if c != nil {
+		c.mutex.Lock()
+		cached, ok := c.clusters[key]
+		c.mutex.Unlock()
+		if ok && time.Since(cached.updateTime) < zoneCacheTTL {
+			return cached.zones, nil
+		}
+	}
+
+	names, err := cs.listZones()
+	if err != nil {
+		return nil, err
+	}
+
+	zones := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		zones[name] = struct{}{}
+	}
+
+	if c != nil {
+		c.mutex.Lock()
+		c.clusters[key] = &cachedZones{zones: zones, updateTime: time.Now()}
+		c.mutex.Unlock()
+	}
+
+	return zones, nil
+}
+
+// parseZoneList splits the zoneList parameter into its zones.
+func parseZoneList(value string) ([]string, error) {
+	var zones []string
+	seen := make(map[string]struct{})
+	for _, zone := range strings.Split(value, ",") {
+		zone = strings.TrimSpace(zone)
+		if len(zone) == 0 {
+			return nil, fmt.Errorf("invalid %s %q, the zone names must not be empty", KZoneList, value)
+		}
+
+		if _, ok := seen[zone]; ok {
+			continue
+		}
+		seen[zone] = struct{}{}
+		zones = append(zones, zone)
+	}
+
+	return zones, nil
+}
+
+// applyZoneList validates the zoneList parameter against the zones of the
+// cluster, and places the volume across them by passing them as the zoneName
+// of the master. A volume spanning several zones is made crossZone.
+func (cs *cfsServer) applyZoneList() error {
+	value := cs.clientConf[KZoneList]
+	if len(value) == 0 {
+		return nil
+	}
+
+	zones, err := parseZoneList(value)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	zoneName := strings.Join(zones, ",")
+	if zone := cs.clientConf[KZoneName]; len(zone) != 0 && zone != zoneName {
+		return status.Errorf(codes.InvalidArgument, "%s %q conflicts with %s %q", KZoneList, value, KZoneName, zone)
+	}
+
+	if len(zones) > 1 {
+		if cs.clientConf[KCrossZone] == "false" {
+			return status.Errorf(codes.InvalidArgument, "%s %q spans several zones, which needs %s", KZoneList, value, KCrossZone)
+		}
+		cs.clientConf[KCrossZone] = "true"
+	}
+
+	known, err := cs.knownZones()
+	if err != nil {
+		return err
+	}
+
+	var unknown []string
+	for _, zone := range zones {
+		if _, ok := known[zone]; !ok {
+			unknown = append(unknown, zone)
+		}
+	}
+
+	if len(unknown) != 0 {
+		names := make([]string, 0, len(known))
+		for name := range known {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return status.Errorf(codes.InvalidArgument, "zones %s of %s are not in the cluster, which has the zones %s",
+			strings.Join(unknown, ","), KZoneList, strings.Join(names, ","))
+	}
+
+	cs.clientConf[KZoneName] = zoneName
+	return nil
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cubefs
+
+import (
+	"testing"
+
+	"github.com/cubefs/cubefs-csi/pkg/mockmaster"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseZoneList(t *testing.T) {
+	zones, err := parseZoneList(" zone-a, zone-b ,zone-a")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"zone-a", "zone-b"}, zones)
+
+	_, err = parseZoneList("zone-a,,zone-b")
+	assert.Error(t, err)
+}
+
+func TestApplyZoneList(t *testing.T) {
+	master := mockmaster.New()
+	t.Cleanup(master.Close)
+	master.Zones = []string{"zone-a", "zone-b", "zone-c"}
+
+	conf := fakeConfig
+	conf.zoneCache = newZoneCache()
+	newServer := func(param map[string]string) *cfsServer {
+		param[KMasterAddr] = master.Addr()
+		param[KOwner] = "csiuser"
+		cs, err := newCfsServer("pvc-zones", param, &conf)
+		assert.NoError(t, err)
+		return cs
+	}
+
+	cs := newServer(map[string]string{KZoneList: "zone-a, zone-c"})
+	assert.NoError(t, cs.applyZoneList())
+	assert.NoError(t, cs.createVolume(10))
+	vol, ok := master.Volume("pvc-zones")
+	assert.True(t, ok)
+	assert.Equal(t, "zone-a,zone-c", vol.ZoneName)
+	assert.True(t, vol.CrossZone)
+
+	// a single zone does not need crossZone
+	cs = newServer(map[string]string{KZoneList: "zone-b", KCrossZone: "false"})
+	assert.NoError(t, cs.applyZoneList())
+	assert.Equal(t, "zone-b", cs.clientConf[KZoneName])
+	assert.Equal(t, "false", cs.clientConf[KCrossZone])
+
+	err := newServer(map[string]string{KZoneList: "zone-a,zone-x"}).applyZoneList()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	assert.Contains(t, err.Error(), "zones zone-x of zoneList are not in the cluster, which has the zones zone-a,zone-b,zone-c")
+
+	err = newServer(map[string]string{KZoneList: "zone-a,zone-b", KCrossZone: "false"}).applyZoneList()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	err = newServer(map[string]string{KZoneList: "zone-a,zone-b", KZoneName: "zone-c"}).applyZoneList()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// the zones are cached, a zone added to the cluster shows up after the ttl
+	master.Zones = append(master.Zones, "zone-d")
+	err = newServer(map[string]string{KZoneList: "zone-d"}).applyZoneList()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// without a cache the zones are queried every time
+	conf.zoneCache = nil
+	assert.NoError(t, newServer(map[string]string{KZoneList: "zone-d"}).applyZoneList())
+}
+
+func TestZoneListOverridesDefaultZone(t *testing.T) {
+	conf := fakeConfig
+	conf.DefaultZone = "zone-a"
+	cs, err := newCfsServer("pvc-zones", map[string]string{KMasterAddr: "10.0.0.1:17010", KZoneList: "zone-b"}, &conf)
+	assert.NoError(t, err)
+	assert.Empty(t, cs.clientConf[KZoneName])
+}
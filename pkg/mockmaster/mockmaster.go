@@ -0,0 +1,360 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package mockmaster serves the subset of the CubeFS master API used by the
+// driver from an in-memory volume map, so that the controller and the node
+// can be tested without a cluster.
+package mockmaster
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// error codes and messages of the master the driver depends on
+const (
+	CodeSuccess      = 0
+	CodeParamError   = 1
+	CodeVolNotExists = 7
+	CodeAuthFailed   = 33
+
+	MsgDuplicateVol = "duplicate vol"
+)
+
+// volume status of the master
+const (
+	VolStatusNormal     = 0
+	VolStatusMarkDelete = 1
+)
+
+// Volume is a volume of the mock master.
+type Volume struct {
+	Name        string
+	Owner       string
+	ZoneName    string
+	VolType     string
+	CrossZone   bool
+	EnableToken bool
+	Status      int
+	CapacityGB  uint64
+	UsedSize    int64
+	InodeCount  uint64
+	InodeLimit  uint64
+	RootPath    string
+	// addresses of the clients mounting the volume, reported by /vol/clients
+	Clients []string
+	// the query of the create request, e.g. the QoS and partition settings
+	CreateQuery map[string]string
+}
+
+// Master is an in-memory master served over http.
+type Master struct {
+	server *httptest.Server
+	mutex  sync.Mutex
+	vols   map[string]*Volume
+	// MetaNodeTotalGB and MetaNodeUsedGB are reported by /admin/getCluster
+	MetaNodeTotalGB uint64
+	MetaNodeUsedGB  uint64
+	// Zones are the zones of the cluster reported by /zone/list
+	Zones []string
+	// IgnoreRootPath makes the master ignore rootPath like the masters
+	// without directory-scoped volumes
+	IgnoreRootPath bool
+	// PlaceZone returns the zone the created volumes are placed in, given
+	// the requested one, nil places them in the requested zone
+	PlaceZone func(requested string) string
+	// GetVolDelay delays the responses of /admin/getVol, e.g. to have the
+	// requests time out
+	GetVolDelay time.Duration
+}
+
+// New starts a master, which must be closed after use.
+func New() *Master {
+	m := &Master{vols: make(map[string]*Volume)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/getIp", m.getIP)
+	mux.HandleFunc("/admin/getCluster", m.getCluster)
+	mux.HandleFunc("/zone/list", m.listZones)
+	mux.HandleFunc("/admin/createVol", m.createVol)
+	mux.HandleFunc("/admin/getVol", m.getVol)
+	mux.HandleFunc("/admin/listVols", m.listVols)
+	mux.HandleFunc("/vol/clients", m.volClients)
+	mux.HandleFunc("/vol/delete", m.deleteVol)
+	mux.HandleFunc("/vol/expand", m.expandVol)
+	mux.HandleFunc("/qos/update", m.updateQos)
+	m.server = httptest.NewServer(mux)
+	return m
+}
+
+// Addr returns the host:port of the master, as used in masterAddr.
+func (m *Master) Addr() string {
+	return m.server.Listener.Addr().String()
+}
+
+// Close shuts the master down.
+func (m *Master) Close() {
+	m.server.Close()
+}
+
+// Volume returns a copy of the volume, and false if it does not exist.
+func (m *Master) Volume(name string) (Volume, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	vol, ok := m.vols[name]
+	if !ok {
+		return Volume{}, false
+	}
+	return *vol, true
+}
+
+// PutVolume adds or replaces a volume, e.g. to set up a test.
+func (m *Master) PutVolume(vol Volume) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.vols[vol.Name] = &vol
+}
+
+// AuthKey returns the authKey of a volume of owner.
+func AuthKey(owner string) string {
+	sum := md5.Sum([]byte(owner))
+	return hex.EncodeToString(sum[:])
+}
+
+func reply(w http.ResponseWriter, code int, msg string, data interface{}) {
+	resp := struct {
+		Code int         `json:"code"`
+		Msg  string      `json:"msg"`
+		Data interface{} `json:"data"`
+	}{Code: code, Msg: msg, Data: data}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// authorizedVolume returns the volume of the request, replying the error if
+// it does not exist or the authKey does not match.
+func (m *Master) authorizedVolume(w http.ResponseWriter, r *http.Request) *Volume {
+	name := r.URL.Query().Get("name")
+	vol, ok := m.vols[name]
+	if !ok {
+		reply(w, CodeVolNotExists, fmt.Sprintf("vol[%v] not exists", name), nil)
+		return nil
+	}
+
+	if r.URL.Query().Get("authKey") != AuthKey(vol.Owner) {
+		reply(w, CodeAuthFailed, fmt.Sprintf("client and server auth key do not match for vol[%v]", name), nil)
+		return nil
+	}
+
+	return vol
+}
+
+func (m *Master) getIP(w http.ResponseWriter, r *http.Request) {
+	reply(w, CodeSuccess, "success", map[string]string{"Cluster": "mock", "Ip": "127.0.0.1"})
+}
+
+func (m *Master) getCluster(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	reply(w, CodeSuccess, "success", map[string]interface{}{
+		"Name": "mock",
+		"MetaNodeStatInfo": map[string]uint64{
+			"TotalGB": m.MetaNodeTotalGB,
+			"UsedGB":  m.MetaNodeUsedGB,
+		},
+	})
+}
+
+func (m *Master) listZones(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	zones := make([]map[string]string, 0, len(m.Zones))
+	for _, zone := range m.Zones {
+		zones = append(zones, map[string]string{"Name": zone, "Status": "available"})
+	}
+	reply(w, CodeSuccess, "success", zones)
+}
+
+func (m *Master) createVol(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name, owner := query.Get("name"), query.Get("owner")
+	capacity, err := strconv.ParseUint(query.Get("capacity"), 10, 64)
+	if len(name) == 0 || len(owner) == 0 || err != nil || capacity == 0 {
+		reply(w, CodeParamError, "parameter name, owner or capacity is invalid", nil)
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.vols[name]; ok {
+		reply(w, CodeParamError, fmt.Sprintf("action[createVol] %s, name[%v]", MsgDuplicateVol, name), nil)
+		return
+	}
+
+	rootPath := query.Get("rootPath")
+	if m.IgnoreRootPath {
+		rootPath = ""
+	}
+
+	zoneName := query.Get("zoneName")
+	if m.PlaceZone != nil {
+		zoneName = m.PlaceZone(zoneName)
+	}
+
+	createQuery := make(map[string]string)
+	for k := range query {
+		createQuery[k] = query.Get(k)
+	}
+	m.vols[name] = &Volume{
+		Name:        name,
+		Owner:       owner,
+		ZoneName:    zoneName,
+		VolType:     query.Get("volType"),
+		CrossZone:   query.Get("crossZone") == "true",
+		EnableToken: query.Get("enableToken") == "true",
+		CapacityGB:  capacity,
+		RootPath:    rootPath,
+		CreateQuery: createQuery,
+	}
+	reply(w, CodeSuccess, "success", nil)
+}
+
+func (m *Master) getVol(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-time.After(m.GetVolDelay):
+	case <-r.Context().Done():
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	vol := m.authorizedVolume(w, r)
+	if vol == nil {
+		return
+	}
+
+	reply(w, CodeSuccess, "success", map[string]interface{}{
+		"Name":     vol.Name,
+		"Owner":    vol.Owner,
+		"ZoneName": vol.ZoneName,
+		"Status":   vol.Status,
+		"Capacity": vol.CapacityGB,
+		"RootPath": vol.RootPath,
+	})
+}
+
+func (m *Master) listVols(w http.ResponseWriter, r *http.Request) {
+	keywords := r.URL.Query().Get("keywords")
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	names := make([]string, 0, len(m.vols))
+	for name := range m.vols {
+		if strings.Contains(name, keywords) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	vols := make([]map[string]interface{}, 0, len(names))
+	for _, name := range names {
+		vol := m.vols[name]
+		vols = append(vols, map[string]interface{}{
+			"Name":       vol.Name,
+			"Owner":      vol.Owner,
+			"Status":     vol.Status,
+			"TotalSize":  vol.CapacityGB << 30,
+			"UsedSize":   vol.UsedSize,
+			"InodeCount": vol.InodeCount,
+			"InodeLimit": vol.InodeLimit,
+		})
+	}
+	reply(w, CodeSuccess, "success", vols)
+}
+
+func (m *Master) volClients(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	vol := m.authorizedVolume(w, r)
+	if vol == nil {
+		return
+	}
+
+	clients := make([]map[string]interface{}, 0, len(vol.Clients))
+	for _, addr := range vol.Clients {
+		clients = append(clients, map[string]interface{}{"Addr": addr})
+	}
+	reply(w, CodeSuccess, "success", clients)
+}
+
+// deleteVol removes the volume at once, while the real master marks it
+// deleted first and removes it in the background.
+func (m *Master) deleteVol(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	vol := m.authorizedVolume(w, r)
+	if vol == nil {
+		return
+	}
+
+	delete(m.vols, vol.Name)
+	reply(w, CodeSuccess, "success", nil)
+}
+
+func (m *Master) expandVol(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	vol := m.authorizedVolume(w, r)
+	if vol == nil {
+		return
+	}
+
+	capacity, err := strconv.ParseUint(r.URL.Query().Get("capacity"), 10, 64)
+	if err != nil || capacity <= vol.CapacityGB {
+		reply(w, CodeParamError, fmt.Sprintf("capacity must be larger than the current %vGB", vol.CapacityGB), nil)
+		return
+	}
+
+	vol.CapacityGB = capacity
+	reply(w, CodeSuccess, "success", nil)
+}
+
+func (m *Master) updateQos(w http.ResponseWriter, r *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	vol := m.authorizedVolume(w, r)
+	if vol == nil {
+		return
+	}
+
+	if vol.CreateQuery == nil {
+		vol.CreateQuery = make(map[string]string)
+	}
+	for k := range r.URL.Query() {
+		if k != "name" && k != "authKey" {
+			vol.CreateQuery[k] = r.URL.Query().Get(k)
+		}
+	}
+	reply(w, CodeSuccess, "success", nil)
+}